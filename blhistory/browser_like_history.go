@@ -9,32 +9,89 @@ import (
 // a new item is added at this place in the history and all the previously existing
 // newer items are dropped; there is no persistence.
 //
-// A cache can be added to every history item too, but that's a TODO.
+// Every item can also have some arbitrary cached data attached to it (see
+// SetCache). The total size of all cached data is limited by
+// BLHistoryParams.CacheMaxSize, and once it's exceeded, caches of the least
+// recently used items are dropped.
 type BLHistory struct {
+	params BLHistoryParams
+
 	items []Item
 
 	curIdx int
+
+	// nextID is the ID which will be assigned to the next added item.
+	nextID int
+
+	// cacheSize is the total size of all the caches attached to items.
+	cacheSize int
+	// cacheUseCounter is incremented every time some cache is set or used, and
+	// the resulting value is stored in Item.cacheLastUsed, to implement LRU
+	// eviction.
+	cacheUseCounter int
+}
+
+type BLHistoryParams struct {
+	// CacheMaxSize is the maximum total size of all the cached data attached to
+	// the history items (the sizes are whatever SetCache callers report, but
+	// normally it should be bytes). If zero, caching is disabled.
+	CacheMaxSize int
 }
 
 type Item struct {
+	// ID identifies the item within the history; it's never reused, so it can
+	// be used to refer to the item later, even if the history has changed.
+	ID int
+
 	Time time.Time
 
 	Str string
+
+	// Cache is the data attached to the item by SetCache; nil if there is
+	// no cached data (or it was evicted).
+	Cache *ItemCache
+
+	// cacheLastUsed is the value of BLHistory.cacheUseCounter when the cache
+	// was last set or used.
+	cacheLastUsed int
+}
+
+type ItemCache struct {
+	// Data is the arbitrary cached data.
+	Data interface{}
+
+	// Size is the size of the Data, as reported by the SetCache caller.
+	Size int
+
+	// Time is when the cache was set.
+	Time time.Time
 }
 
-func New() *BLHistory {
-	h := &BLHistory{}
+func New(params BLHistoryParams) *BLHistory {
+	h := &BLHistory{
+		params: params,
+		nextID: 1,
+	}
 
 	return h
 }
 
 func (h *BLHistory) Add(s string) {
 	item := Item{
+		ID:   h.nextID,
 		Time: time.Now(),
 		Str:  s,
 	}
 
+	h.nextID++
+
 	if len(h.items) > 0 && h.curIdx < len(h.items)-1 {
+		for _, dropped := range h.items[h.curIdx+1:] {
+			if dropped.Cache != nil {
+				h.cacheSize -= dropped.Cache.Size
+			}
+		}
+
 		h.items = h.items[:h.curIdx+1]
 	}
 
@@ -42,6 +99,16 @@ func (h *BLHistory) Add(s string) {
 	h.curIdx = len(h.items) - 1
 }
 
+// Cur returns the current item, or nil if the history is empty.
+func (h *BLHistory) Cur() *Item {
+	if len(h.items) == 0 {
+		return nil
+	}
+
+	item := h.items[h.curIdx]
+	return &item
+}
+
 func (h *BLHistory) Prev() *Item {
 	if h.curIdx == 0 {
 		return nil
@@ -49,6 +116,8 @@ func (h *BLHistory) Prev() *Item {
 
 	h.curIdx--
 
+	h.markCacheUsed(h.curIdx)
+
 	item := h.items[h.curIdx]
 	return &item
 }
@@ -60,6 +129,91 @@ func (h *BLHistory) Next() *Item {
 
 	h.curIdx++
 
+	h.markCacheUsed(h.curIdx)
+
 	item := h.items[h.curIdx]
 	return &item
 }
+
+// SetCache attaches the given data to the item with the given ID, replacing
+// whatever cache it had before. If there is no such item (e.g. it was already
+// dropped from the history), or if the data alone exceeds the
+// CacheMaxSize, SetCache is a no-op.
+//
+// If the total size of all caches exceeds CacheMaxSize after that, caches of
+// the least recently used items are dropped until it fits.
+func (h *BLHistory) SetCache(id int, data interface{}, size int) {
+	idx := h.itemIdxByID(id)
+	if idx < 0 {
+		return
+	}
+
+	h.dropCache(idx)
+
+	if size > h.params.CacheMaxSize {
+		return
+	}
+
+	h.items[idx].Cache = &ItemCache{
+		Data: data,
+		Size: size,
+		Time: time.Now(),
+	}
+	h.cacheSize += size
+	h.markCacheUsed(idx)
+
+	h.evictCaches(idx)
+}
+
+func (h *BLHistory) itemIdxByID(id int) int {
+	for i, item := range h.items {
+		if item.ID == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (h *BLHistory) dropCache(idx int) {
+	if h.items[idx].Cache == nil {
+		return
+	}
+
+	h.cacheSize -= h.items[idx].Cache.Size
+	h.items[idx].Cache = nil
+}
+
+func (h *BLHistory) markCacheUsed(idx int) {
+	if h.items[idx].Cache == nil {
+		return
+	}
+
+	h.cacheUseCounter++
+	h.items[idx].cacheLastUsed = h.cacheUseCounter
+}
+
+// evictCaches drops caches of the least recently used items until the total
+// size fits in CacheMaxSize. The cache of the item at keepIdx is never
+// dropped.
+func (h *BLHistory) evictCaches(keepIdx int) {
+	for h.cacheSize > h.params.CacheMaxSize {
+		lruIdx := -1
+		for i, item := range h.items {
+			if i == keepIdx || item.Cache == nil {
+				continue
+			}
+
+			if lruIdx < 0 || item.cacheLastUsed < h.items[lruIdx].cacheLastUsed {
+				lruIdx = i
+			}
+		}
+
+		if lruIdx < 0 {
+			// Nothing else to evict.
+			return
+		}
+
+		h.dropCache(lruIdx)
+	}
+}
@@ -49,7 +49,7 @@ func TestBLHistory(t *testing.T) {
 		testCase{next: true, want: ""},
 	}
 
-	h := New()
+	h := New(BLHistoryParams{})
 
 	for i, tc := range testCases {
 		if tc.add != "" {
@@ -73,3 +73,63 @@ func TestBLHistory(t *testing.T) {
 		}
 	}
 }
+
+func TestBLHistoryCache(t *testing.T) {
+	h := New(BLHistoryParams{CacheMaxSize: 100})
+
+	h.Add("item 1")
+	id1 := h.Cur().ID
+	h.SetCache(id1, "data 1", 40)
+
+	h.Add("item 2")
+	id2 := h.Cur().ID
+	h.SetCache(id2, "data 2", 40)
+
+	assert.NotEqual(t, id1, id2)
+
+	// Both caches fit.
+	item := h.Prev()
+	assert.Equal(t, "item 1", item.Str)
+	if assert.NotNil(t, item.Cache) {
+		assert.Equal(t, "data 1", item.Cache.Data)
+	}
+
+	h.Add("item 3")
+	id3 := h.Cur().ID
+
+	// "item 2" was dropped from the history, together with its cache, so
+	// setting the cache for it is a no-op.
+	h.SetCache(id2, "data 2 again", 40)
+
+	h.SetCache(id3, "data 3", 40)
+
+	item = h.Prev()
+	assert.Equal(t, "item 1", item.Str)
+	if assert.NotNil(t, item.Cache) {
+		assert.Equal(t, "data 1", item.Cache.Data)
+	}
+
+	// Setting the cache which doesn't fit together with the other ones evicts
+	// the least recently used cache: "item 3" in this case.
+	h.SetCache(id1, "data 1 bigger", 61)
+
+	item = h.Next()
+	assert.Equal(t, "item 3", item.Str)
+	assert.Nil(t, item.Cache)
+
+	item = h.Prev()
+	if assert.NotNil(t, item.Cache) {
+		assert.Equal(t, "data 1 bigger", item.Cache.Data)
+	}
+
+	// Data which doesn't fit at all is not cached, and the old cache is dropped
+	// too.
+	h.SetCache(id1, "data 1 huge", 101)
+	assert.Nil(t, h.Cur().Cache)
+
+	// With zero CacheMaxSize, nothing is cached.
+	h = New(BLHistoryParams{})
+	h.Add("item 1")
+	h.SetCache(h.Cur().ID, "data 1", 1)
+	assert.Nil(t, h.Cur().Cache)
+}
@@ -0,0 +1,497 @@
+// Package client provides a blocking, context-aware API on top of
+// core.LStreamsManager, to make it easy to use nerdlog as a library from Go
+// programs.
+package client
+
+import (
+	"context"
+	"os/user"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dimonomid/clock"
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/dimonomid/ssh_config"
+	"github.com/juju/errors"
+)
+
+// DefaultMaxNumLines is used by Query when QueryLogsParams.MaxNumLines is
+// zero.
+const DefaultMaxNumLines = 250
+
+// ErrClosed is returned from the methods called after Close.
+var ErrClosed = errors.Errorf("client is closed")
+
+// Client wraps core.LStreamsManager; unlike the LStreamsManager itself, which
+// is driven by fire-and-forget requests and a single channel of mixed updates,
+// Client provides blocking methods which take a context.
+//
+// All methods are safe for concurrent use.
+type Client struct {
+	params ClientParams
+
+	lsman     lstreamsManager
+	updatesCh chan core.LStreamsManagerUpdate
+
+	mtx sync.Mutex
+
+	// state is the last state received from the LStreamsManager.
+	state core.LStreamsManagerState
+
+	// lstreamNames are the names of the logstreams resolved from the last spec
+	// given to SetLStreams. It's used to tell whether the state received from
+	// the LStreamsManager is up to date, since there might be some older states
+	// still in flight when SetLStreams returns.
+	lstreamNames map[string]struct{}
+
+	// stateSubs are the channels created by SubscribeState.
+	stateSubs map[int]chan core.LStreamsManagerState
+	nextSubID int
+
+	// queryMtx makes sure there's only one query in progress: the
+	// LStreamsManager can only run one query at a time, and a new one would
+	// supersede the old one, which is not what we want for concurrent Query
+	// calls.
+	queryMtx sync.Mutex
+
+	closeOnce sync.Once
+	closedCh  chan struct{}
+}
+
+// lstreamsManager is the subset of *core.LStreamsManager methods used by the
+// Client; it's an interface so that tests can substitute a fake.
+type lstreamsManager interface {
+	SetLStreamsGetNames(logStreamsSpec string) (map[string]struct{}, error)
+	QueryLogs(params core.QueryLogsParams)
+	CancelQuery()
+	Close()
+	Wait()
+}
+
+type ClientParams struct {
+	// LStreams is the initial logstreams spec, like "myhost-*, tag:db"; see
+	// core.LStreamsResolver.Resolve for the full syntax. Can be changed later
+	// with SetLStreams.
+	LStreams string
+
+	// ConfigLogStreams and ConfigGroups contain nerdlog-specific config,
+	// typically coming from ~/.config/nerdlog/logstreams.yaml. Optional.
+	ConfigLogStreams core.ConfigLogStreams
+	ConfigGroups     core.ConfigGroups
+
+	// SSHConfig contains the general ssh config, typically coming from
+	// ~/.ssh/config. Optional.
+	SSHConfig *ssh_config.Config
+
+	// SSHKeys specifies paths to ssh keys to try, in the given order, until
+	// an existing key is found.
+	SSHKeys []string
+
+	// TransportMode is the default transport mode; if nil, ssh-lib is used.
+	TransportMode *core.TransportMode
+
+	// ReconnectPolicy is the default reconnect policy; if nil,
+	// core.DefaultReconnectPolicy is used.
+	ReconnectPolicy *core.ReconnectPolicy
+
+	// LuaScript is the path to the global Lua script which is invoked for every
+	// log line, see core.LStreamsManagerParams.LuaScript. Optional.
+	LuaScript string
+
+	// ClientID is appended to the nerdlog_agent.sh and its index filenames on
+	// the hosts, see core.LStreamsManagerParams.ClientID. If empty, the current
+	// OS username is used.
+	ClientID string
+
+	// OnDataRequest is called when some connection needs data from the user,
+	// like a passphrase for an ssh key. The response must be sent to
+	// req.ResponseCh. If OnDataRequest is nil, an empty response is sent.
+	//
+	// It's called from an internal goroutine, so it shouldn't block for long.
+	OnDataRequest func(req *core.ShellConnDataRequest)
+
+	// OnBootstrapIssue, if set, is called when there is an issue with
+	// bootstrapping some logstream. Same as OnDataRequest, it shouldn't block
+	// for long.
+	OnBootstrapIssue func(issue core.BootstrapIssue)
+
+	Logger *log.Logger
+
+	Clock clock.Clock
+}
+
+// New creates a new Client and starts connecting to the logstreams from
+// params.LStreams. Use WaitConnected to wait for the connection, and Close
+// to release the resources once done.
+func New(params ClientParams) (*Client, error) {
+	if params.Clock == nil {
+		// For details on why not default to the real clock:
+		// https://dmitryfrank.com/articles/mocking_time_in_go#caveat_with_defaulting_to_real_clock
+		panic("Clock is nil")
+	}
+
+	if params.TransportMode == nil {
+		params.TransportMode = core.NewTransportModeSSHLib()
+	}
+
+	if params.ClientID == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, errors.Annotatef(err, "getting current OS user")
+		}
+
+		params.ClientID = u.Username
+	}
+
+	params.Logger = params.Logger.WithNamespaceAppended("Client")
+
+	c := &Client{
+		params: params,
+
+		updatesCh: make(chan core.LStreamsManagerUpdate, 128),
+
+		lstreamNames: map[string]struct{}{},
+		stateSubs:    map[int]chan core.LStreamsManagerState{},
+
+		closedCh: make(chan struct{}),
+	}
+
+	c.lsman = core.NewLStreamsManager(core.LStreamsManagerParams{
+		ConfigLogStreams: params.ConfigLogStreams,
+		ConfigGroups:     params.ConfigGroups,
+		SSHConfig:        params.SSHConfig,
+		SSHKeys:          params.SSHKeys,
+
+		Logger: params.Logger,
+
+		InitialDefaultTransportMode: params.TransportMode,
+		InitialReconnectPolicy:      params.ReconnectPolicy,
+
+		LuaScript: params.LuaScript,
+
+		ClientID: params.ClientID,
+
+		UpdatesCh: c.updatesCh,
+
+		Clock: params.Clock,
+	})
+
+	go c.run()
+
+	if err := c.SetLStreams(params.LStreams); err != nil {
+		c.Close()
+		return nil, errors.Trace(err)
+	}
+
+	return c, nil
+}
+
+func (c *Client) run() {
+	for {
+		select {
+		case upd := <-c.updatesCh:
+			c.handleUpdate(upd)
+
+		case <-c.closedCh:
+			return
+		}
+	}
+}
+
+func (c *Client) handleUpdate(upd core.LStreamsManagerUpdate) {
+	switch {
+	case upd.State != nil:
+		c.mtx.Lock()
+		c.state = *upd.State
+		for _, ch := range c.stateSubs {
+			sendLatestState(ch, *upd.State)
+		}
+		c.mtx.Unlock()
+
+	case upd.DataRequest != nil:
+		if c.params.OnDataRequest != nil {
+			c.params.OnDataRequest(upd.DataRequest)
+		} else {
+			c.params.Logger.Warnf("Got data request %q, responding with an empty string", upd.DataRequest.Title)
+			upd.DataRequest.ResponseCh <- ""
+		}
+
+	case upd.BootstrapIssue != nil:
+		if c.params.OnBootstrapIssue != nil {
+			c.params.OnBootstrapIssue(*upd.BootstrapIssue)
+		}
+
+	case upd.LogResp != nil:
+		// All our queries use RespCh, so it shouldn't happen.
+		c.params.Logger.Warnf("Got an unexpected log response, ignoring")
+	}
+}
+
+// SetLStreams changes the logstreams spec; see ClientParams.LStreams.
+func (c *Client) SetLStreams(lstreamsSpec string) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+
+	names, err := c.lsman.SetLStreamsGetNames(lstreamsSpec)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	c.mtx.Lock()
+	c.lstreamNames = names
+	c.mtx.Unlock()
+
+	return nil
+}
+
+// State returns the last known state of the LStreamsManager.
+func (c *Client) State() core.LStreamsManagerState {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.state
+}
+
+// SubscribeState returns a channel which receives the LStreamsManager state
+// every time it changes, and a function to unsubscribe. The channel only
+// keeps the latest state, so a slow reader skips intermediate states instead
+// of blocking the Client.
+func (c *Client) SubscribeState() (<-chan core.LStreamsManagerState, func()) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	ch := make(chan core.LStreamsManagerState, 1)
+	sendLatestState(ch, c.state)
+
+	id := c.nextSubID
+	c.nextSubID++
+	c.stateSubs[id] = ch
+
+	unsubscribe := func() {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+
+		delete(c.stateSubs, id)
+	}
+
+	return ch, unsubscribe
+}
+
+// WaitConnected waits until all the logstreams are connected. It returns an
+// error if the context is done first, or if there are no logstreams, or if
+// some of them have given up reconnecting (as per the reconnect policy).
+func (c *Client) WaitConnected(ctx context.Context) error {
+	stateCh, unsubscribe := c.SubscribeState()
+	defer unsubscribe()
+
+	for {
+		select {
+		case state := <-stateCh:
+			done, err := c.checkConnected(state)
+			if done {
+				return errors.Trace(err)
+			}
+
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+
+		case <-c.closedCh:
+			return ErrClosed
+		}
+	}
+}
+
+// checkConnected checks whether WaitConnected is done with the given state,
+// and if so, what it should return.
+func (c *Client) checkConnected(state core.LStreamsManagerState) (done bool, err error) {
+	c.mtx.Lock()
+	lstreamNames := c.lstreamNames
+	c.mtx.Unlock()
+
+	if len(lstreamNames) == 0 {
+		return true, errors.Errorf("no logstreams to connect to")
+	}
+
+	// Make sure the state is for the current logstreams, not some older ones.
+	numLStreams := 0
+	for _, names := range state.LStreamsByState {
+		for name := range names {
+			if _, ok := lstreamNames[name]; !ok {
+				return false, nil
+			}
+
+			numLStreams++
+		}
+	}
+
+	if numLStreams != len(lstreamNames) {
+		return false, nil
+	}
+
+	if state.Connected {
+		return true, nil
+	}
+
+	if givenUp := state.LStreamsByState[core.LStreamClientStateGivenUp]; len(givenUp) > 0 {
+		msgs := make([]string, 0, len(givenUp))
+		for name := range givenUp {
+			msgs = append(msgs, name+": "+state.ConnDetailsByLStream[name].Err)
+		}
+		sort.Strings(msgs)
+
+		return true, errors.Errorf("failed to connect: %s", strings.Join(msgs, "; "))
+	}
+
+	return false, nil
+}
+
+// Query runs the query and waits for the results. If MaxNumLines is zero,
+// DefaultMaxNumLines is used. All logstreams must be connected, see
+// WaitConnected.
+//
+// If the context is done before the query completes, the query is cancelled
+// on the logstreams as well, and the context error is returned.
+//
+// Concurrent queries are executed one by one.
+//
+// If the query fails on some logstreams, a *QueryError is returned.
+func (c *Client) Query(ctx context.Context, params core.QueryLogsParams) (*core.LogRespTotal, error) {
+	c.queryMtx.Lock()
+	defer c.queryMtx.Unlock()
+
+	return c.query(ctx, params)
+}
+
+// QueryAll is like Query, but it keeps loading earlier logs page by page
+// (params.MaxNumLines being the page size), until either all the logs
+// matching the query are loaded, or there are at least maxNumLines of them;
+// in the latter case, only the latest maxNumLines are returned. If
+// maxNumLines is zero, there is no limit.
+func (c *Client) QueryAll(
+	ctx context.Context, params core.QueryLogsParams, maxNumLines int,
+) (*core.LogRespTotal, error) {
+	c.queryMtx.Lock()
+	defer c.queryMtx.Unlock()
+
+	params.LoadEarlier = false
+
+	// NOTE: errors from query are returned as is, so that the caller can
+	// type-assert them to *QueryError.
+	resp, err := c.query(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	for len(resp.Logs) < resp.NumMsgsTotal && (maxNumLines == 0 || len(resp.Logs) < maxNumLines) {
+		params.LoadEarlier = true
+
+		earlierResp, err := c.query(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+
+		// If we didn't get anything new, there's no point to keep going.
+		gotMore := len(earlierResp.Logs) > len(resp.Logs)
+		resp = earlierResp
+		if !gotMore {
+			break
+		}
+	}
+
+	if maxNumLines != 0 && len(resp.Logs) > maxNumLines {
+		resp.Logs = resp.Logs[len(resp.Logs)-maxNumLines:]
+	}
+
+	return resp, nil
+}
+
+// query is the implementation of Query; queryMtx must be locked by the caller.
+func (c *Client) query(ctx context.Context, params core.QueryLogsParams) (*core.LogRespTotal, error) {
+	if params.MaxNumLines == 0 {
+		params.MaxNumLines = DefaultMaxNumLines
+	}
+
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+
+	respCh := make(chan *core.LogRespTotal, 1)
+	params.RespCh = respCh
+
+	c.lsman.QueryLogs(params)
+
+	select {
+	case resp := <-respCh:
+		if len(resp.Errs) > 0 {
+			return nil, &QueryError{Errs: resp.Errs}
+		}
+
+		return resp, nil
+
+	case <-ctx.Done():
+		c.lsman.CancelQuery()
+
+		// Wait for the cancellation to be acknowledged, so that the next query
+		// doesn't get cancelled instead.
+		select {
+		case <-respCh:
+		case <-c.closedCh:
+		}
+
+		return nil, errors.Trace(ctx.Err())
+
+	case <-c.closedCh:
+		return nil, ErrClosed
+	}
+}
+
+// Close disconnects from all the logstreams, and waits for it to complete.
+// The Client can't be used after that.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		// NOTE: the run goroutine keeps handling updates while the LStreamsManager
+		// is tearing down, so it won't block on sending them.
+		c.lsman.Close()
+		c.lsman.Wait()
+
+		close(c.closedCh)
+	})
+}
+
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.closedCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// QueryError is returned by Query when the query has failed on some of the
+// logstreams.
+type QueryError struct {
+	Errs []error
+}
+
+func (e *QueryError) Error() string {
+	msgs := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// sendLatestState sends the state to the channel with buffer size 1,
+// replacing whatever older state it might have.
+func sendLatestState(ch chan core.LStreamsManagerState, state core.LStreamsManagerState) {
+	select {
+	case <-ch:
+	default:
+	}
+
+	ch <- state
+}
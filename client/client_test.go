@@ -0,0 +1,362 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type checkConnectedTestCase struct {
+	name         string
+	lstreamNames []string
+	state        core.LStreamsManagerState
+
+	wantDone bool
+	wantErr  string
+}
+
+func TestCheckConnected(t *testing.T) {
+	testCases := []checkConnectedTestCase{
+		{
+			name:         "connected",
+			lstreamNames: []string{"host-01", "host-02"},
+			state: core.LStreamsManagerState{
+				LStreamsByState: map[core.LStreamClientState]map[string]struct{}{
+					core.LStreamClientStateConnectedIdle: {"host-01": {}, "host-02": {}},
+				},
+				Connected: true,
+			},
+			wantDone: true,
+		},
+		{
+			name:         "still connecting",
+			lstreamNames: []string{"host-01", "host-02"},
+			state: core.LStreamsManagerState{
+				LStreamsByState: map[core.LStreamClientState]map[string]struct{}{
+					core.LStreamClientStateConnectedIdle: {"host-01": {}},
+					core.LStreamClientStateConnecting:    {"host-02": {}},
+				},
+			},
+			wantDone: false,
+		},
+		{
+			name:         "outdated state for other logstreams",
+			lstreamNames: []string{"host-01", "host-02"},
+			state: core.LStreamsManagerState{
+				LStreamsByState: map[core.LStreamClientState]map[string]struct{}{
+					core.LStreamClientStateConnectedIdle: {"host-01": {}, "host-03": {}},
+				},
+				Connected: true,
+			},
+			wantDone: false,
+		},
+		{
+			name:         "outdated state for a subset of logstreams",
+			lstreamNames: []string{"host-01", "host-02"},
+			state: core.LStreamsManagerState{
+				LStreamsByState: map[core.LStreamClientState]map[string]struct{}{
+					core.LStreamClientStateConnectedIdle: {"host-01": {}},
+				},
+				Connected: true,
+			},
+			wantDone: false,
+		},
+		{
+			name:         "given up",
+			lstreamNames: []string{"host-01", "host-02"},
+			state: core.LStreamsManagerState{
+				LStreamsByState: map[core.LStreamClientState]map[string]struct{}{
+					core.LStreamClientStateConnectedIdle: {"host-01": {}},
+					core.LStreamClientStateGivenUp:       {"host-02": {}},
+				},
+				ConnDetailsByLStream: map[string]core.ConnDetails{
+					"host-02": {Err: "attempt 3: connection refused (giving up)"},
+				},
+			},
+			wantDone: true,
+			wantErr:  "failed to connect: host-02: attempt 3: connection refused (giving up)",
+		},
+		{
+			name:     "no logstreams",
+			state:    core.LStreamsManagerState{NoMatchingLStreams: true},
+			wantDone: true,
+			wantErr:  "no logstreams to connect to",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Client{
+				lstreamNames: map[string]struct{}{},
+			}
+			for _, name := range tc.lstreamNames {
+				c.lstreamNames[name] = struct{}{}
+			}
+
+			done, err := c.checkConnected(tc.state)
+			assert.Equal(t, tc.wantDone, done)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestQueryError(t *testing.T) {
+	err := &QueryError{
+		Errs: []error{
+			errors.Errorf("host-01: foo"),
+			errors.Errorf("host-02: bar"),
+		},
+	}
+
+	assert.EqualError(t, err, "host-01: foo; host-02: bar")
+}
+
+// fakeLStreamsManager implements lstreamsManager. Queries are answered by
+// queryFunc, or not answered at all if it's nil (until cancelled).
+type fakeLStreamsManager struct {
+	queryFunc func(params core.QueryLogsParams) *core.LogRespTotal
+
+	mtx        sync.Mutex
+	queries    []core.QueryLogsParams
+	numCancels int
+}
+
+func (m *fakeLStreamsManager) SetLStreamsGetNames(spec string) (map[string]struct{}, error) {
+	return map[string]struct{}{spec: {}}, nil
+}
+
+func (m *fakeLStreamsManager) QueryLogs(params core.QueryLogsParams) {
+	m.mtx.Lock()
+	m.queries = append(m.queries, params)
+	m.mtx.Unlock()
+
+	if m.queryFunc != nil {
+		params.RespCh <- m.queryFunc(params)
+	}
+}
+
+// CancelQuery responds to the last query with ErrQueryCancelled, just like
+// the real LStreamsManager does.
+func (m *fakeLStreamsManager) CancelQuery() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.numCancels++
+	if len(m.queries) > 0 {
+		m.queries[len(m.queries)-1].RespCh <- &core.LogRespTotal{
+			Errs: []error{core.ErrQueryCancelled},
+		}
+	}
+}
+
+func (m *fakeLStreamsManager) Close() {}
+func (m *fakeLStreamsManager) Wait()  {}
+
+func newTestClient(lsman lstreamsManager) *Client {
+	return &Client{
+		lsman:        lsman,
+		lstreamNames: map[string]struct{}{"host-01": {}},
+		stateSubs:    map[int]chan core.LStreamsManagerState{},
+		closedCh:     make(chan struct{}),
+	}
+}
+
+// makeTestLogs returns n logs, one per minute, with the last one being at
+// 10:00 UTC.
+func makeTestLogs(n int) []core.LogMsg {
+	ret := make([]core.LogMsg, 0, n)
+	last := time.Date(2025, 3, 12, 10, 0, 0, 0, time.UTC)
+	for i := n - 1; i >= 0; i-- {
+		ret = append(ret, core.LogMsg{Time: last.Add(-time.Duration(i) * time.Minute)})
+	}
+
+	return ret
+}
+
+// pagingQueryFunc returns a queryFunc which pretends that there are numTotal
+// logs matching the query, and returns (and keeps) one more page of them
+// every time the query is made with LoadEarlier.
+func pagingQueryFunc(numTotal int) func(params core.QueryLogsParams) *core.LogRespTotal {
+	numLoaded := 0
+	return func(params core.QueryLogsParams) *core.LogRespTotal {
+		if !params.LoadEarlier {
+			numLoaded = 0
+		}
+
+		numLoaded += params.MaxNumLines
+		if numLoaded > numTotal {
+			numLoaded = numTotal
+		}
+
+		return &core.LogRespTotal{
+			Logs:          makeTestLogs(numLoaded),
+			NumMsgsTotal:  numTotal,
+			LoadedEarlier: params.LoadEarlier,
+		}
+	}
+}
+
+func TestQueryContextCancelled(t *testing.T) {
+	lsman := &fakeLStreamsManager{}
+	c := newTestClient(lsman)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	resp, err := c.Query(ctx, core.QueryLogsParams{})
+	assert.Nil(t, resp)
+	assert.True(t, errors.Cause(err) == context.DeadlineExceeded, "unexpected error: %v", err)
+	assert.Equal(t, 1, lsman.numCancels)
+
+	// The default page size is used.
+	if assert.Len(t, lsman.queries, 1) {
+		assert.Equal(t, DefaultMaxNumLines, lsman.queries[0].MaxNumLines)
+	}
+}
+
+type queryAllTestCase struct {
+	name        string
+	numTotal    int
+	pageSize    int
+	maxNumLines int
+
+	wantNumLogs          int
+	wantLoadEarlierFlags []bool
+}
+
+func TestQueryAll(t *testing.T) {
+	testCases := []queryAllTestCase{
+		{
+			name:                 "everything fits in one page",
+			numTotal:             2,
+			pageSize:             3,
+			wantNumLogs:          2,
+			wantLoadEarlierFlags: []bool{false},
+		},
+		{
+			name:                 "no limit",
+			numTotal:             10,
+			pageSize:             3,
+			wantNumLogs:          10,
+			wantLoadEarlierFlags: []bool{false, true, true, true},
+		},
+		{
+			name:                 "stops at the limit",
+			numTotal:             10,
+			pageSize:             3,
+			maxNumLines:          5,
+			wantNumLogs:          5,
+			wantLoadEarlierFlags: []bool{false, true},
+		},
+		{
+			name:                 "limit at the page boundary",
+			numTotal:             10,
+			pageSize:             3,
+			maxNumLines:          6,
+			wantNumLogs:          6,
+			wantLoadEarlierFlags: []bool{false, true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lsman := &fakeLStreamsManager{queryFunc: pagingQueryFunc(tc.numTotal)}
+			c := newTestClient(lsman)
+
+			resp, err := c.QueryAll(
+				context.Background(), core.QueryLogsParams{MaxNumLines: tc.pageSize}, tc.maxNumLines,
+			)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			// The latest logs are returned.
+			assert.Equal(t, makeTestLogs(tc.wantNumLogs), resp.Logs)
+
+			var loadEarlierFlags []bool
+			for _, q := range lsman.queries {
+				loadEarlierFlags = append(loadEarlierFlags, q.LoadEarlier)
+			}
+			assert.Equal(t, tc.wantLoadEarlierFlags, loadEarlierFlags)
+		})
+	}
+}
+
+func TestQueryAllNoProgress(t *testing.T) {
+	// The logstream reports more logs than it's able to return, e.g. because
+	// the logs were rotated in the meantime.
+	lsman := &fakeLStreamsManager{
+		queryFunc: func(params core.QueryLogsParams) *core.LogRespTotal {
+			return &core.LogRespTotal{Logs: makeTestLogs(3), NumMsgsTotal: 10}
+		},
+	}
+	c := newTestClient(lsman)
+
+	resp, err := c.QueryAll(context.Background(), core.QueryLogsParams{MaxNumLines: 3}, 0)
+	assert.NoError(t, err)
+	assert.Len(t, resp.Logs, 3)
+	assert.Len(t, lsman.queries, 2)
+}
+
+func TestWaitConnectedTimeout(t *testing.T) {
+	c := newTestClient(&fakeLStreamsManager{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Some logstream is still connecting.
+	c.handleUpdate(core.LStreamsManagerUpdate{
+		State: &core.LStreamsManagerState{
+			LStreamsByState: map[core.LStreamClientState]map[string]struct{}{
+				core.LStreamClientStateConnecting: {"host-01": {}},
+			},
+		},
+	})
+
+	err := c.WaitConnected(ctx)
+	assert.True(t, errors.Cause(err) == context.DeadlineExceeded, "unexpected error: %v", err)
+
+	// The subscription is cleaned up.
+	assert.Empty(t, c.stateSubs)
+}
+
+func TestWaitConnected(t *testing.T) {
+	c := newTestClient(&fakeLStreamsManager{})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.WaitConnected(context.Background())
+	}()
+
+	// Wait until WaitConnected subscribes, and send the state.
+	assert.Eventually(t, func() bool {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		return len(c.stateSubs) == 1
+	}, time.Second, time.Millisecond)
+
+	c.handleUpdate(core.LStreamsManagerUpdate{
+		State: &core.LStreamsManagerState{
+			LStreamsByState: map[core.LStreamClientState]map[string]struct{}{
+				core.LStreamClientStateConnectedIdle: {"host-01": {}},
+			},
+			Connected: true,
+		},
+	})
+
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("WaitConnected didn't return")
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimonomid/nerdlog/client"
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+)
+
+// apiClient is the subset of *client.Client used by apiServer.
+type apiClient interface {
+	SetLStreams(lstreamsSpec string) error
+	State() core.LStreamsManagerState
+	WaitConnected(ctx context.Context) error
+	Query(ctx context.Context, params core.QueryLogsParams) (*core.LogRespTotal, error)
+}
+
+type apiServerParams struct {
+	Client  apiClient
+	Options *OptionsShared
+
+	// LStreams is the initial logstreams spec which the Client was created with.
+	LStreams string
+
+	// Token, if not empty, must be given in every request as
+	// "Authorization: Bearer <token>".
+	Token string
+
+	// LoopbackOnly should be true if the server listens at a loopback address;
+	// then only the requests with a loopback Host header are accepted, so that
+	// a web page can't get access to the API via DNS rebinding.
+	LoopbackOnly bool
+
+	// ConnectTimeout is how long a query waits for the logstreams to connect.
+	ConnectTimeout time.Duration
+
+	Logger *log.Logger
+}
+
+// apiServer implements the HTTP/JSON API served by "nerdlog serve"; see
+// docs/http_api.md for the details.
+type apiServer struct {
+	params apiServerParams
+
+	mux *http.ServeMux
+
+	// queryMtx makes sure that queries are executed one by one: pagination
+	// relies on the LStreamsManager state left after the last query, so
+	// checking the page token and running the query must be done atomically.
+	queryMtx sync.Mutex
+
+	// mtx guards the fields below.
+	mtx sync.Mutex
+
+	lstreams string
+
+	// lastQuery is the last successful query, used for pagination. It's nil if
+	// there was no query yet, or if there's nothing more to load, or if the
+	// logstreams have changed since then.
+	lastQuery *apiLastQuery
+
+	// nextPageTokenID is used to generate unique page tokens.
+	nextPageTokenID int
+
+	// lstreamsGen is incremented every time the logstreams change, so that a
+	// query which was in progress during the change doesn't set lastQuery.
+	lstreamsGen int
+}
+
+type apiLastQuery struct {
+	pageToken string
+	params    core.QueryLogsParams
+
+	// numLogs is the number of logs we've returned so far for this query,
+	// across all pages.
+	numLogs int
+}
+
+func newAPIServer(params apiServerParams) *apiServer {
+	params.Logger = params.Logger.WithNamespaceAppended("APIServer")
+
+	s := &apiServer{
+		params:   params,
+		mux:      http.NewServeMux(),
+		lstreams: params.LStreams,
+	}
+
+	s.mux.HandleFunc("/api/v1/state", s.handleState)
+	s.mux.HandleFunc("/api/v1/lstreams", s.handleLStreams)
+	s.mux.HandleFunc("/api/v1/query", s.handleQuery)
+
+	return s
+}
+
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.params.LoopbackOnly && !isLoopbackHost(r.Host) {
+		writeAPIError(w, http.StatusForbidden, errors.Errorf("invalid Host %q, expected a loopback one", r.Host))
+		return
+	}
+
+	if s.params.Token != "" {
+		// NOTE: not using strings.CutPrefix since it needs Go 1.20.
+		authHeader := r.Header.Get("Authorization")
+		hasBearer := strings.HasPrefix(authHeader, "Bearer ")
+		token := strings.TrimPrefix(authHeader, "Bearer ")
+		if !hasBearer || subtle.ConstantTimeCompare([]byte(token), []byte(s.params.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nerdlog"`)
+			writeAPIError(w, http.StatusUnauthorized, errors.New("invalid or missing bearer token"))
+			return
+		}
+	}
+
+	// Requiring the JSON content type makes sure that a web page can't send
+	// a request cross-origin without a CORS preflight (which we don't allow);
+	// for the GET requests, the browser won't let the page read the response.
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			writeAPIError(w, http.StatusUnsupportedMediaType, errors.New("Content-Type must be application/json"))
+			return
+		}
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// isLoopbackHost returns whether the given Host header value (optionally with
+// a port) refers to the loopback interface.
+func isLoopbackHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+type apiStateResp struct {
+	LStreams string                    `json:"lstreams"`
+	State    core.LStreamsManagerState `json:"state"`
+}
+
+func (s *apiServer) handleState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	s.mtx.Lock()
+	lstreams := s.lstreams
+	s.mtx.Unlock()
+
+	writeAPIResp(w, http.StatusOK, apiStateResp{
+		LStreams: lstreams,
+		State:    s.params.Client.State(),
+	})
+}
+
+type apiLStreamsReq struct {
+	LStreams string `json:"lstreams"`
+}
+
+func (s *apiServer) handleLStreams(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mtx.Lock()
+		lstreams := s.lstreams
+		s.mtx.Unlock()
+
+		writeAPIResp(w, http.StatusOK, apiLStreamsReq{LStreams: lstreams})
+
+	case http.MethodPut, http.MethodPost:
+		var req apiLStreamsReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errors.Annotatef(err, "parsing request"))
+			return
+		}
+
+		// Hold the lock while setting the logstreams, so that concurrent requests
+		// don't end up with s.lstreams not matching the actual logstreams.
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+
+		if err := s.params.Client.SetLStreams(req.LStreams); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errors.Annotatef(err, "lstreams"))
+			return
+		}
+
+		s.lstreams = req.LStreams
+		s.lastQuery = nil
+		s.lstreamsGen++
+
+		writeAPIResp(w, http.StatusOK, req)
+
+	default:
+		writeAPIMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodPost)
+	}
+}
+
+// apiQueryReq is the query request, either given as JSON body of a POST
+// request, or as URL params of a GET request.
+type apiQueryReq struct {
+	// Time is the time range in the same format as accepted by the UI, like
+	// "-15m" or "Mar27 12:00 to 13:00". Mutually exclusive with From and To.
+	Time string `json:"time"`
+
+	// From and To are in RFC 3339 format. If To is empty, the range is
+	// open-ended.
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	Pattern string `json:"pattern"`
+
+	// MaxNumLines is the page size; if zero, the numlines option is used.
+	MaxNumLines int `json:"max_num_lines"`
+
+	// PageToken, if not empty, is the NextPageToken from the previous
+	// response, and the next page of that query is returned; all the other
+	// fields are ignored then.
+	PageToken string `json:"page_token"`
+}
+
+type apiQueryResp struct {
+	Logs         []apiLogMsg      `json:"logs"`
+	MinuteStats  []apiMinuteStats `json:"minute_stats"`
+	NumMsgsTotal int              `json:"num_msgs_total"`
+
+	// NextPageToken, if not empty, can be used to get older logs.
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+type apiLogMsg struct {
+	Time     time.Time         `json:"time"`
+	LStream  string            `json:"lstream"`
+	Level    core.LogLevel     `json:"level,omitempty"`
+	Message  string            `json:"message"`
+	Context  map[string]string `json:"context"`
+	OrigLine string            `json:"orig_line"`
+}
+
+type apiMinuteStats struct {
+	Minute  time.Time `json:"minute"`
+	NumMsgs int       `json:"num_msgs"`
+}
+
+func (s *apiServer) handleQuery(w http.ResponseWriter, r *http.Request) {
+	var req apiQueryReq
+
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		req, err = parseAPIQueryURLParams(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errors.Annotatef(err, "parsing request"))
+			return
+		}
+
+	default:
+		writeAPIMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return
+	}
+
+	opts := s.params.Options.GetAll()
+
+	s.queryMtx.Lock()
+	defer s.queryMtx.Unlock()
+
+	s.mtx.Lock()
+	lastQuery := s.lastQuery
+	lstreamsGen := s.lstreamsGen
+	s.mtx.Unlock()
+
+	var params core.QueryLogsParams
+	numLogsBefore := 0
+
+	if req.PageToken != "" {
+		if lastQuery == nil || lastQuery.pageToken != req.PageToken {
+			writeAPIError(w, http.StatusConflict, errors.New("page token is expired, since there were other queries after it; rerun the query"))
+			return
+		}
+
+		params = lastQuery.params
+		params.LoadEarlier = true
+		numLogsBefore = lastQuery.numLogs
+	} else {
+		var err error
+		params, err = req.queryLogsParams(opts, time.Now())
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	connectCtx, cancel := context.WithTimeout(r.Context(), s.params.ConnectTimeout)
+	defer cancel()
+
+	if err := s.params.Client.WaitConnected(connectCtx); err != nil {
+		if errors.Cause(err) == context.DeadlineExceeded {
+			err = errors.Errorf("timed out connecting: %s", formatConnErrs(s.params.Client.State()))
+		}
+
+		writeAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	resp, err := s.params.Client.Query(r.Context(), params)
+	if err != nil {
+		if qErr, ok := errors.Cause(err).(*client.QueryError); ok {
+			writeAPIResp(w, http.StatusBadGateway, newAPIErrorResp(qErr, qErr.Errs))
+			return
+		}
+
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// When loading earlier logs, the response contains all the logs loaded so
+	// far (the older ones go first), so only return the new ones.
+	logs := resp.Logs
+	if numLogsBefore > 0 {
+		if numLogsBefore < len(logs) {
+			logs = logs[:len(logs)-numLogsBefore]
+		} else {
+			logs = nil
+		}
+	}
+
+	ret := apiQueryResp{
+		Logs:         make([]apiLogMsg, 0, len(logs)),
+		MinuteStats:  newAPIMinuteStats(resp.MinuteStats, opts.Timezone),
+		NumMsgsTotal: resp.NumMsgsTotal,
+	}
+
+	for _, msg := range logs {
+		ret.Logs = append(ret.Logs, newAPILogMsg(msg, opts.Timezone))
+	}
+
+	s.mtx.Lock()
+	if s.lstreamsGen == lstreamsGen {
+		s.lastQuery = nil
+
+		// Only allow loading more if we did get something new this time, to
+		// avoid the clients looping forever.
+		if len(resp.Logs) < resp.NumMsgsTotal && len(logs) > 0 {
+			s.nextPageTokenID++
+			s.lastQuery = &apiLastQuery{
+				pageToken: strconv.Itoa(s.nextPageTokenID),
+				params:    params,
+				numLogs:   len(resp.Logs),
+			}
+
+			ret.NextPageToken = s.lastQuery.pageToken
+		}
+	}
+	s.mtx.Unlock()
+
+	writeAPIResp(w, http.StatusOK, ret)
+}
+
+func parseAPIQueryURLParams(r *http.Request) (apiQueryReq, error) {
+	q := r.URL.Query()
+
+	req := apiQueryReq{
+		Time:      q.Get("time"),
+		From:      q.Get("from"),
+		To:        q.Get("to"),
+		Pattern:   q.Get("pattern"),
+		PageToken: q.Get("page_token"),
+	}
+
+	if v := q.Get("max_num_lines"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return apiQueryReq{}, errors.Errorf("invalid max_num_lines %q", v)
+		}
+
+		req.MaxNumLines = n
+	}
+
+	return req, nil
+}
+
+// queryLogsParams converts the request to the params for the LStreamsManager.
+func (req *apiQueryReq) queryLogsParams(opts Options, now time.Time) (core.QueryLogsParams, error) {
+	ret := core.QueryLogsParams{
+		MaxNumLines: req.MaxNumLines,
+		Query:       req.Pattern,
+	}
+
+	if ret.MaxNumLines == 0 {
+		ret.MaxNumLines = opts.MaxNumLines
+	}
+
+	if ret.MaxNumLines < 0 {
+		return core.QueryLogsParams{}, errors.Errorf("max_num_lines can't be negative")
+	}
+
+	switch {
+	case req.Time != "" && (req.From != "" || req.To != ""):
+		return core.QueryLogsParams{}, errors.Errorf("time can't be used together with from and to")
+
+	case req.Time != "":
+		ftr, err := ParseFromToRange(opts.Timezone, req.Time)
+		if err != nil {
+			return core.QueryLogsParams{}, errors.Annotatef(err, "time")
+		}
+
+		ret.From, ret.To = ftr.QueryRange(now)
+
+	case req.From != "":
+		from, err := time.Parse(time.RFC3339, req.From)
+		if err != nil {
+			return core.QueryLogsParams{}, errors.Annotatef(err, "from")
+		}
+		ret.From = from
+
+		if req.To != "" {
+			to, err := time.Parse(time.RFC3339, req.To)
+			if err != nil {
+				return core.QueryLogsParams{}, errors.Annotatef(err, "to")
+			}
+			ret.To = to
+
+			if ret.From.After(ret.To) {
+				return core.QueryLogsParams{}, errors.Errorf("from is after to")
+			}
+		}
+
+	default:
+		return core.QueryLogsParams{}, errors.Errorf("either time or from is required")
+	}
+
+	return ret, nil
+}
+
+func newAPILogMsg(msg core.LogMsg, tz *time.Location) apiLogMsg {
+	return apiLogMsg{
+		Time:     msg.Time.In(tz),
+		LStream:  msg.Context["lstream"],
+		Level:    msg.Level,
+		Message:  msg.Msg,
+		Context:  msg.Context,
+		OrigLine: msg.OrigLine,
+	}
+}
+
+func newAPIMinuteStats(stats map[int64]core.MinuteStatsItem, tz *time.Location) []apiMinuteStats {
+	ret := make([]apiMinuteStats, 0, len(stats))
+	for minute, item := range stats {
+		ret = append(ret, apiMinuteStats{
+			Minute:  time.Unix(minute, 0).In(tz),
+			NumMsgs: item.NumMsgs,
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Minute.Before(ret[j].Minute)
+	})
+
+	return ret
+}
+
+type apiErrorResp struct {
+	Error string `json:"error"`
+
+	// Errors contains per-logstream errors, if any.
+	Errors []string `json:"errors,omitempty"`
+}
+
+func newAPIErrorResp(err error, errs []error) apiErrorResp {
+	ret := apiErrorResp{Error: err.Error()}
+	for _, e := range errs {
+		ret.Errors = append(ret.Errors, e.Error())
+	}
+
+	return ret
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIResp(w, status, newAPIErrorResp(err, nil))
+}
+
+func writeAPIMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
+
+func writeAPIResp(w http.ResponseWriter, status int, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	// Nothing useful we can do about the error at this point.
+	_ = json.NewEncoder(w).Encode(resp)
+}
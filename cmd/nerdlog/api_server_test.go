@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/client"
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAPIClient implements apiClient; it has 5 log messages in total, and
+// every query returns at most 2 more of them, the same way LStreamsManager
+// does.
+type fakeAPIClient struct {
+	lstreams string
+
+	logs []core.LogMsg
+
+	// numLoaded is how many logs were loaded by the last query, including the
+	// earlier pages.
+	numLoaded int
+
+	queries []core.QueryLogsParams
+}
+
+func newFakeAPIClient() *fakeAPIClient {
+	c := &fakeAPIClient{lstreams: "localhost"}
+	for i := 0; i < 5; i++ {
+		c.logs = append(c.logs, core.LogMsg{
+			Time:     time.Date(2025, 4, 18, 18, 10+i, 0, 0, time.UTC),
+			Msg:      "msg " + string(rune('a'+i)),
+			Context:  map[string]string{"lstream": "localhost"},
+			OrigLine: "line " + string(rune('a'+i)),
+		})
+	}
+
+	return c
+}
+
+func (c *fakeAPIClient) SetLStreams(lstreamsSpec string) error {
+	if lstreamsSpec == "" {
+		return errors.New("no logstreams")
+	}
+
+	c.lstreams = lstreamsSpec
+	return nil
+}
+
+func (c *fakeAPIClient) State() core.LStreamsManagerState {
+	return core.LStreamsManagerState{NumLStreams: 1, Connected: true}
+}
+
+func (c *fakeAPIClient) WaitConnected(ctx context.Context) error {
+	return nil
+}
+
+func (c *fakeAPIClient) Query(ctx context.Context, params core.QueryLogsParams) (*core.LogRespTotal, error) {
+	c.queries = append(c.queries, params)
+
+	if params.Query == "fail" {
+		return nil, &client.QueryError{
+			Errs: []error{errors.New("host-01: foo"), errors.New("host-02: bar")},
+		}
+	}
+
+	if !params.LoadEarlier {
+		c.numLoaded = 0
+	}
+
+	c.numLoaded += params.MaxNumLines
+	if c.numLoaded > len(c.logs) {
+		c.numLoaded = len(c.logs)
+	}
+
+	return &core.LogRespTotal{
+		Logs:         c.logs[len(c.logs)-c.numLoaded:],
+		NumMsgsTotal: len(c.logs),
+		MinuteStats: map[int64]core.MinuteStatsItem{
+			c.logs[0].Time.Unix(): {NumMsgs: 5},
+		},
+	}, nil
+}
+
+func doAPIRequest(
+	t *testing.T, s *apiServer, method, url, token, body string, resp interface{},
+) int {
+	t.Helper()
+
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if resp != nil {
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), resp))
+	}
+
+	return rec.Code
+}
+
+func newTestAPIServer(c apiClient, token string) *apiServer {
+	opts := defaultOptions()
+	opts.Timezone = time.UTC
+	opts.MaxNumLines = 2
+
+	return newAPIServer(apiServerParams{
+		Client:         c,
+		Options:        NewOptionsShared(opts),
+		LStreams:       "localhost",
+		Token:          token,
+		ConnectTimeout: time.Second,
+	})
+}
+
+func TestAPIServerAuth(t *testing.T) {
+	s := newTestAPIServer(newFakeAPIClient(), "secret")
+
+	var errResp apiErrorResp
+	assert.Equal(t, http.StatusUnauthorized, doAPIRequest(t, s, "GET", "/api/v1/state", "", "", &errResp))
+	assert.Equal(t, "invalid or missing bearer token", errResp.Error)
+
+	assert.Equal(t, http.StatusUnauthorized, doAPIRequest(t, s, "GET", "/api/v1/state", "wrong", "", nil))
+
+	// The token without the "Bearer " prefix is not accepted.
+	req := httptest.NewRequest("GET", "/api/v1/state", nil)
+	req.Header.Set("Authorization", "secret")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	var stateResp apiStateResp
+	assert.Equal(t, http.StatusOK, doAPIRequest(t, s, "GET", "/api/v1/state", "secret", "", &stateResp))
+	assert.Equal(t, "localhost", stateResp.LStreams)
+	assert.True(t, stateResp.State.Connected)
+}
+
+func TestAPIServerContentType(t *testing.T) {
+	s := newTestAPIServer(newFakeAPIClient(), "")
+
+	for _, contentType := range []string{"", "text/plain", "application/x-www-form-urlencoded"} {
+		req := httptest.NewRequest("PUT", "/api/v1/lstreams", strings.NewReader(`{"lstreams": "evil-host"}`))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code, "content type %q", contentType)
+	}
+
+	// The lstreams weren't changed.
+	var resp apiLStreamsReq
+	assert.Equal(t, http.StatusOK, doAPIRequest(t, s, "GET", "/api/v1/lstreams", "", "", &resp))
+	assert.Equal(t, "localhost", resp.LStreams)
+
+	// Media type params, like charset, are allowed.
+	req := httptest.NewRequest("PUT", "/api/v1/lstreams", strings.NewReader(`{"lstreams": "other"}`))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestAPIServerLoopbackOnly(t *testing.T) {
+	s := newTestAPIServer(newFakeAPIClient(), "")
+	s.params.LoopbackOnly = true
+
+	for _, host := range []string{"127.0.0.1:8080", "localhost:8080", "LOCALHOST", "[::1]:8080", "[::1]", "127.0.0.2"} {
+		req := httptest.NewRequest("GET", "/api/v1/state", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, "host %q", host)
+	}
+
+	for _, host := range []string{"evil.example.com:8080", "evil.example.com", "10.0.0.1:8080", ""} {
+		req := httptest.NewRequest("GET", "/api/v1/state", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code, "host %q", host)
+	}
+}
+
+func TestAPIServerLStreams(t *testing.T) {
+	c := newFakeAPIClient()
+	s := newTestAPIServer(c, "")
+
+	var lsResp apiLStreamsReq
+	assert.Equal(t, http.StatusOK, doAPIRequest(t, s, "PUT", "/api/v1/lstreams", "", `{"lstreams": "web-*"}`, &lsResp))
+	assert.Equal(t, "web-*", lsResp.LStreams)
+	assert.Equal(t, "web-*", c.lstreams)
+
+	assert.Equal(t, http.StatusOK, doAPIRequest(t, s, "GET", "/api/v1/lstreams", "", "", &lsResp))
+	assert.Equal(t, "web-*", lsResp.LStreams)
+
+	var errResp apiErrorResp
+	assert.Equal(t, http.StatusBadRequest, doAPIRequest(t, s, "PUT", "/api/v1/lstreams", "", `{"lstreams": ""}`, &errResp))
+	assert.Equal(t, "lstreams: no logstreams", errResp.Error)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, doAPIRequest(t, s, "DELETE", "/api/v1/lstreams", "", "", nil))
+}
+
+func TestAPIServerQueryPagination(t *testing.T) {
+	c := newFakeAPIClient()
+	s := newTestAPIServer(c, "")
+
+	var resp apiQueryResp
+	assert.Equal(t, http.StatusOK, doAPIRequest(t, s, "POST", "/api/v1/query", "", `{"from": "2025-04-18T18:00:00Z", "pattern": "/foo/"}`, &resp))
+	assert.Equal(t, 5, resp.NumMsgsTotal)
+	assert.Equal(t, []string{"msg d", "msg e"}, apiLogMsgTexts(resp.Logs))
+	assert.Equal(t, "localhost", resp.Logs[0].LStream)
+	assert.Equal(t, 1, len(resp.MinuteStats))
+	assert.NotEmpty(t, resp.NextPageToken)
+
+	assert.Equal(t, core.QueryLogsParams{
+		MaxNumLines: 2,
+		From:        time.Date(2025, 4, 18, 18, 0, 0, 0, time.UTC),
+		Query:       "/foo/",
+	}, c.queries[0])
+
+	// Next page, via GET.
+	token := resp.NextPageToken
+	resp = apiQueryResp{}
+	assert.Equal(t, http.StatusOK, doAPIRequest(t, s, "GET", "/api/v1/query?page_token="+token, "", "", &resp))
+	assert.Equal(t, []string{"msg b", "msg c"}, apiLogMsgTexts(resp.Logs))
+	assert.True(t, c.queries[1].LoadEarlier)
+	assert.Equal(t, "/foo/", c.queries[1].Query)
+
+	// The old token can't be used anymore.
+	assert.Equal(t, http.StatusConflict, doAPIRequest(t, s, "GET", "/api/v1/query?page_token="+token, "", "", nil))
+
+	// The last page.
+	token = resp.NextPageToken
+	resp = apiQueryResp{}
+	assert.Equal(t, http.StatusOK, doAPIRequest(t, s, "GET", "/api/v1/query?page_token="+token, "", "", &resp))
+	assert.Equal(t, []string{"msg a"}, apiLogMsgTexts(resp.Logs))
+	assert.Empty(t, resp.NextPageToken)
+
+	// Changing logstreams invalidates the page token.
+	resp = apiQueryResp{}
+	assert.Equal(t, http.StatusOK, doAPIRequest(t, s, "GET", "/api/v1/query?time=-1h", "", "", &resp))
+	assert.NotEmpty(t, resp.NextPageToken)
+	assert.Equal(t, http.StatusOK, doAPIRequest(t, s, "PUT", "/api/v1/lstreams", "", `{"lstreams": "web-*"}`, nil))
+	assert.Equal(t, http.StatusConflict, doAPIRequest(t, s, "GET", "/api/v1/query?page_token="+resp.NextPageToken, "", "", nil))
+}
+
+func TestAPIServerQueryErrors(t *testing.T) {
+	s := newTestAPIServer(newFakeAPIClient(), "")
+
+	var errResp apiErrorResp
+	assert.Equal(t, http.StatusBadRequest, doAPIRequest(t, s, "GET", "/api/v1/query", "", "", &errResp))
+	assert.Equal(t, "either time or from is required", errResp.Error)
+
+	assert.Equal(t, http.StatusBadRequest, doAPIRequest(t, s, "GET", "/api/v1/query?time=-1h&from=2025-04-18T18:00:00Z", "", "", &errResp))
+	assert.Equal(t, "time can't be used together with from and to", errResp.Error)
+
+	assert.Equal(t, http.StatusBadRequest, doAPIRequest(t, s, "GET", "/api/v1/query?from=2025-04-18T18:00:00Z&to=2025-04-18T17:00:00Z", "", "", &errResp))
+	assert.Equal(t, "from is after to", errResp.Error)
+
+	assert.Equal(t, http.StatusBadRequest, doAPIRequest(t, s, "GET", "/api/v1/query?time=-1h&max_num_lines=foo", "", "", &errResp))
+	assert.Equal(t, `invalid max_num_lines "foo"`, errResp.Error)
+
+	errResp = apiErrorResp{}
+	assert.Equal(t, http.StatusBadGateway, doAPIRequest(t, s, "GET", "/api/v1/query?time=-1h&pattern=fail", "", "", &errResp))
+	assert.Equal(t, "host-01: foo; host-02: bar", errResp.Error)
+	assert.Equal(t, []string{"host-01: foo", "host-02: bar"}, errResp.Errors)
+}
+
+func apiLogMsgTexts(logs []apiLogMsg) []string {
+	ret := make([]string, 0, len(logs))
+	for _, msg := range logs {
+		ret = append(ret, msg.Message)
+	}
+
+	return ret
+}
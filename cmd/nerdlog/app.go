@@ -5,18 +5,21 @@ import (
 	"fmt"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/dimonomid/clock"
 	"github.com/dimonomid/nerdlog/blhistory"
 	"github.com/dimonomid/nerdlog/clhistory"
 	"github.com/dimonomid/nerdlog/core"
 	"github.com/dimonomid/nerdlog/log"
-	"github.com/dimonomid/ssh_config"
 	"github.com/juju/errors"
 	"github.com/rivo/tview"
 )
 
+// queryHistoryCacheMaxSize is the max total size (in bytes, roughly) of the
+// query results cached in the browser-like history, so that navigating back
+// and forth doesn't have to query the same logs again.
+const queryHistoryCacheMaxSize = 64 * 1024 * 1024
+
 type nerdlogApp struct {
 	params nerdlogAppParams
 
@@ -36,6 +39,10 @@ type nerdlogApp struct {
 	// - nerdlog --lstreams 'localhost' --time -10h --pattern '/something/'
 	// - nerdlog --lstreams 'localhost' --time -2h --pattern '/something/'
 	queryBLHistory *blhistory.BLHistory
+	// queryHistoryItemID is the ID of the queryBLHistory item which corresponds
+	// to the last query; once the response arrives, it'll be cached in this
+	// item.
+	queryHistoryItemID int
 	// queryCLHistory is tracking the same data as queryBLHistory (queries like
 	// nerdlog --lstreams .....), but it's command-line-like, and it can be
 	// navigated on the query edit form.
@@ -45,6 +52,10 @@ type nerdlogApp struct {
 
 	// lastLogResp contains the last response from LStreamsManager.
 	lastLogResp *core.LogRespTotal
+
+	// pendingWrite is non-nil if the :write command is waiting for more logs
+	// to be loaded.
+	pendingWrite *pendingWrite
 }
 
 type nerdlogAppParams struct {
@@ -61,6 +72,7 @@ type nerdlogAppParams struct {
 
 	logstreamsConfigPath string
 	cmdHistoryFile       string
+	luaScriptPath        string
 
 	noJournalctlAccessWarn bool
 }
@@ -90,16 +102,14 @@ func newNerdlogApp(
 	app := &nerdlogApp{
 		params: params,
 
-		options: NewOptionsShared(Options{
-			Timezone:             time.Local,
-			MaxNumLines:          250,
-			DefaultTransportMode: core.NewTransportModeSSHLib(),
-		}),
+		options: NewOptionsShared(defaultOptions()),
 
 		tviewApp: tview.NewApplication(),
 
 		cmdLineHistory: cmdLineHistory,
-		queryBLHistory: blhistory.New(),
+		queryBLHistory: blhistory.New(blhistory.BLHistoryParams{
+			CacheMaxSize: queryHistoryCacheMaxSize,
+		}),
 		queryCLHistory: queryCLHistory,
 	}
 
@@ -126,6 +136,12 @@ func newNerdlogApp(
 				}
 			}
 
+			// Remember which history item we're querying logs for, so that we can
+			// cache the response there.
+			if item := app.queryBLHistory.Cur(); item != nil {
+				app.queryHistoryItemID = item.ID
+			}
+
 			app.lsman.QueryLogs(params)
 		},
 		OnLStreamsChange: func(lstreamsSpec string) error {
@@ -142,6 +158,9 @@ func newNerdlogApp(
 		OnReconnectRequest: func() {
 			app.lsman.Reconnect()
 		},
+		OnRetryRequest: func() {
+			app.lsman.Retry()
+		},
 		OnCmd: func(cmd string, opts CmdOpts) {
 			cmdCh <- cmdWithOpts{
 				cmd:  cmd,
@@ -248,6 +267,13 @@ func (app *nerdlogApp) initLStreamsManager(
 					)
 				}
 
+				if upd.BootstrapIssue.WarnClockSkew != 0 {
+					bootstrapWarnings = append(
+						bootstrapWarnings,
+						errors.Errorf("%s: the host clock is %s, so the order of messages across logstreams might be misleading.\n\nUse the clock_correction logstream option to correct the timestamps and suppress this message.", upd.BootstrapIssue.LStreamName, formatClockSkew(upd.BootstrapIssue.WarnClockSkew)),
+					)
+				}
+
 			case upd.DataRequest != nil:
 				dataRequests = append(dataRequests, upd.DataRequest)
 
@@ -281,12 +307,21 @@ func (app *nerdlogApp) initLStreamsManager(
 
 						for _, logResp := range logResps {
 							if len(logResp.Errs) > 0 {
+								// If we were loading more logs for :write, don't keep waiting.
+								app.pendingWrite = nil
+
 								app.mainView.handleQueryError(combineErrors(logResp.Errs))
 								return
 							}
 
 							app.mainView.applyLogs(logResp)
 							app.lastLogResp = logResp
+
+							app.queryBLHistory.SetCache(
+								app.queryHistoryItemID, logResp, estimateLogRespSize(logResp),
+							)
+
+							app.handlePendingWrite(logResp)
 						}
 
 						if len(bootstrapErrors) > 0 {
@@ -320,73 +355,41 @@ func (app *nerdlogApp) initLStreamsManager(
 
 	envUser := os.Getenv("USER")
 
-	var logstreamsCfg core.ConfigLogStreams
-	if params.logstreamsConfigPath != "" {
-		appLogstreamsCfg, err := LoadLogstreamsConfigFromFile(params.logstreamsConfigPath)
-		if err != nil {
-			if !os.IsNotExist(errors.Cause(err)) {
-				return errors.Annotatef(
-					err,
-					"reading logstreams config from %s (path is configurable via --lstreams-config)",
-					params.logstreamsConfigPath,
-				)
-			}
-		} else {
-			logstreamsCfg = appLogstreamsCfg.LogStreams
-		}
+	logstreamsCfg, groupsCfg, err := loadLogstreamsConfig(params.logstreamsConfigPath)
+	if err != nil {
+		return errors.Trace(err)
 	}
 
-	var sshConfig *ssh_config.Config
-	if params.sshConfigPath != "" {
-		sshConfigFile, err := os.Open(params.sshConfigPath)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				return errors.Annotatef(
-					err,
-					"reading ssh config from %s (path is configurable via --ssh-config)",
-					params.sshConfigPath,
-				)
-			}
-		} else {
-			defer sshConfigFile.Close()
-			var err error
-			sshConfig, err = ssh_config.Decode(sshConfigFile, false)
-			if err != nil {
-				// Try again but ignoring Match
-				sshConfigFile, _ := os.Open(params.sshConfigPath)
-				defer sshConfigFile.Close()
-				var err error
-				sshConfig, err = ssh_config.Decode(sshConfigFile, true)
-				if err != nil {
-					return errors.Annotatef(
-						err,
-						"parsing ssh config from %s (path is configurable via --ssh-config)",
-						params.sshConfigPath,
-					)
-				}
+	sshConfig, matchIgnored, err := loadSSHConfig(params.sshConfigPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
 
-				if os.Getenv("NERDLOG_NO_WARN_SSH_MATCH") == "" {
-					// Apparently there is a Match directive. Let's warn the user about it,
-					// but still continue.
-					fmt.Printf("Your SSH config %s has a Match directive, fyi it'll be ignored, since Nerdlog can't parse this directive yet (see https://github.com/kevinburke/ssh_config/issues/6).\n", params.sshConfigPath)
-					fmt.Printf("Fyi you can provide a different ssh config with the --ssh-config flag.\n")
-					fmt.Printf("To disable this warning, set NERDLOG_NO_WARN_SSH_MATCH environment variable to 1.\n")
-					fmt.Printf("Press Enter to continue.\n")
-					bufio.NewReader(os.Stdin).ReadBytes('\n')
-				}
-			}
-		}
+	if matchIgnored && os.Getenv("NERDLOG_NO_WARN_SSH_MATCH") == "" {
+		// Apparently there is a Match directive. Let's warn the user about it,
+		// but still continue.
+		fmt.Printf("Your SSH config %s has a Match directive, fyi it'll be ignored, since Nerdlog can't parse this directive yet (see https://github.com/kevinburke/ssh_config/issues/6).\n", params.sshConfigPath)
+		fmt.Printf("Fyi you can provide a different ssh config with the --ssh-config flag.\n")
+		fmt.Printf("To disable this warning, set NERDLOG_NO_WARN_SSH_MATCH environment variable to 1.\n")
+		fmt.Printf("Press Enter to continue.\n")
+		bufio.NewReader(os.Stdin).ReadBytes('\n')
 	}
 
+	reconnectPolicy := app.options.GetReconnectPolicy()
+
 	app.lsman = core.NewLStreamsManager(core.LStreamsManagerParams{
 		Logger: logger,
 
 		ConfigLogStreams: logstreamsCfg,
+		ConfigGroups:     groupsCfg,
 		SSHConfig:        sshConfig,
 		SSHKeys:          params.sshKeys,
 
 		InitialLStreams:             initialLStreams,
 		InitialDefaultTransportMode: defaultTransportMode,
+		InitialReconnectPolicy:      &reconnectPolicy,
+
+		LuaScript: params.luaScriptPath,
 
 		ClientID: envUser,
 
@@ -419,6 +422,7 @@ func (app *nerdlogApp) afterUserCmdOrOptionChange() {
 	app.mainView.formatTimeRange()
 	app.mainView.formatLogs()
 	app.lsman.SetDefaultTransportMode(app.options.GetTransportMode())
+	app.lsman.SetReconnectPolicy(app.options.GetReconnectPolicy())
 }
 
 // printError lets user know that there is an error by printing a simple error
@@ -459,6 +463,12 @@ type getOptionResult struct {
 // result to app options, and if the command was actually to get the current
 // value, then return that.
 func (app *nerdlogApp) setOption(expr string) (*setOptionResult, error) {
+	return setOption(app.options, expr)
+}
+
+// setOption is the implementation of nerdlogApp.setOption which works with
+// any OptionsShared, so that it can be used without the TUI app as well.
+func setOption(options *OptionsShared, expr string) (*setOptionResult, error) {
 	setParts := strings.SplitN(expr, "=", 2)
 	if len(setParts) == 2 {
 		optName := setParts[0]
@@ -470,7 +480,7 @@ func (app *nerdlogApp) setOption(expr string) (*setOptionResult, error) {
 		}
 
 		var setErr error
-		app.options.Call(func(o *Options) {
+		options.Call(func(o *Options) {
 			setErr = opt.Set(o, optValue)
 		})
 
@@ -490,7 +500,7 @@ func (app *nerdlogApp) setOption(expr string) (*setOptionResult, error) {
 		}
 
 		var optValue string
-		app.options.Call(func(o *Options) {
+		options.Call(func(o *Options) {
 			optValue = opt.Get(o)
 		})
 
@@ -505,6 +515,63 @@ func (app *nerdlogApp) setOption(expr string) (*setOptionResult, error) {
 	return nil, errors.Errorf("invalid set command")
 }
 
+// applyHistoryItem applies the query from the given browser-like history item.
+// If the item has cached results, they are shown right away without querying
+// the logstreams; otherwise the query is performed as usual.
+func (app *nerdlogApp) applyHistoryItem(item *blhistory.Item) error {
+	dqp := doQueryParams{
+		dontAddHistoryItem: true,
+	}
+
+	if item.Cache == nil {
+		return errors.Trace(app.unmarshalAndApplyQuery(item.Str, dqp))
+	}
+
+	var qf QueryFull
+	if err := qf.UnmarshalShellCmd(item.Str); err != nil {
+		return errors.Annotatef(err, "parsing")
+	}
+
+	logResp := item.Cache.Data.(*core.LogRespTotal)
+	if err := app.mainView.applyCachedLogs(qf, logResp, item.Cache.Time); err != nil {
+		return errors.Annotatef(err, "applying")
+	}
+
+	app.lastQueryFull = qf
+	app.lastLogResp = logResp
+	app.queryHistoryItemID = item.ID
+
+	// Let LStreamsManager know which logs we're showing, so that loading more
+	// (earlier) logs works as expected. It also cancels whatever query might be
+	// in progress, so that its results don't override the cached ones.
+	app.lsman.RestoreLogs(logResp)
+
+	return nil
+}
+
+// estimateLogRespSize returns a rough estimate of the memory (in bytes)
+// occupied by the given response; it's used to limit the total size of the
+// results cached in the query history.
+func estimateLogRespSize(resp *core.LogRespTotal) int {
+	// Rough size of a LogMsg and a minute stats item themselves, without the
+	// strings and maps they refer to.
+	const logMsgOverhead = 200
+	const minuteStatsItemOverhead = 32
+
+	size := len(resp.MinuteStats) * minuteStatsItemOverhead
+
+	for _, msg := range resp.Logs {
+		size += logMsgOverhead
+		size += len(msg.LogFilename) + len(msg.Msg) + len(msg.OrigLine)
+
+		for k, v := range msg.Context {
+			size += len(k) + len(v)
+		}
+	}
+
+	return size
+}
+
 func combineErrors(errs []error) error {
 	var totalErr error
 	if len(errs) == 1 {
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -45,39 +44,10 @@ func (app *nerdlogApp) handleCmd(cmd string) {
 		app.mainView.doQuery(doQueryParams{})
 
 	case "w", "write":
-		//if len(parts) < 2 {
-		//app.printError(":write requires an argument: the filename to write")
-		//return
-		//}
+		app.handleWriteCmd(parts[1:])
 
-		//fname := parts[1]
-
-		fname := "/tmp/last_nerdlog"
-		if len(parts) >= 2 {
-			fname = parts[1]
-		}
-
-		if app.lastLogResp == nil {
-			app.printError("No logs yet")
-			return
-		}
-
-		lfile, err := os.Create(fname)
-		if err != nil {
-			app.printError(fmt.Sprintf("Failed to open %s for writing: %s", fname, err))
-			return
-		}
-
-		for _, logMsg := range app.lastLogResp.Logs {
-			fmt.Fprintf(lfile, "%s <ssh -t %s vim +%d %s>\n",
-				logMsg.OrigLine,
-				logMsg.Context["lstream"], logMsg.LogLinenumber, logMsg.LogFilename,
-			)
-		}
-
-		lfile.Close()
-
-		app.printMsg(fmt.Sprintf("Saved to %s", fname))
+	case "writestats":
+		app.handleWriteStatsCmd(parts[1:])
 
 	case "set":
 		if len(parts) < 2 || len(parts[1]) == 0 {
@@ -124,9 +94,7 @@ func (app *nerdlogApp) handleCmd(cmd string) {
 			return
 		}
 
-		if err := app.unmarshalAndApplyQuery(item.Str, doQueryParams{
-			dontAddHistoryItem: true,
-		}); err != nil {
+		if err := app.applyHistoryItem(item); err != nil {
 			// This shouldn't happen really provided a sane history.
 			app.printError(err.Error())
 			return
@@ -141,9 +109,7 @@ func (app *nerdlogApp) handleCmd(cmd string) {
 			return
 		}
 
-		if err := app.unmarshalAndApplyQuery(item.Str, doQueryParams{
-			dontAddHistoryItem: true,
-		}); err != nil {
+		if err := app.applyHistoryItem(item); err != nil {
 			// This shouldn't happen really provided a sane history.
 			app.printError(err.Error())
 			return
@@ -160,6 +126,9 @@ func (app *nerdlogApp) handleCmd(cmd string) {
 	case "reconnect":
 		app.mainView.reconnect(true)
 
+	case "retry":
+		app.mainView.retry()
+
 	case "disconnect":
 		app.mainView.disconnect()
 
@@ -174,6 +143,9 @@ func (app *nerdlogApp) handleCmd(cmd string) {
 	case "conndebug", "cdebug":
 		app.mainView.showConnDebugInfo()
 
+	case "timeformat", "tf":
+		app.mainView.showTimeFormatInfo()
+
 	case "querydebug", "qdebug", "debug":
 		app.mainView.showLastQueryDebugInfo()
 
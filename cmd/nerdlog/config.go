@@ -1,19 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/dimonomid/nerdlog/core"
+	"github.com/dimonomid/ssh_config"
 	"github.com/juju/errors"
 	"gopkg.in/yaml.v2"
 )
 
 type ConfigLogStreams struct {
 	LogStreams core.ConfigLogStreams `yaml:"log_streams"`
+	Groups     core.ConfigGroups     `yaml:"groups"`
 }
 
+// invalidLabelChars contains characters which can't be used in tag and group
+// names, since they have special meaning in the logstreams spec.
+const invalidLabelChars = ",&!@ \t"
+
 func LoadLogstreamsConfigFromFile(path string) (*ConfigLogStreams, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -53,7 +62,130 @@ func LoadLogstreamsConfigFromFile(path string) (*ConfigLogStreams, error) {
 				"%s: both sudo and sudo_mode are set; please only use one of them", k,
 			)
 		}
+
+		if cls.Options.Reconnect != "" {
+			if _, err := core.ParseReconnectPolicy(core.DefaultReconnectPolicy, cls.Options.Reconnect); err != nil {
+				return nil, errors.Errorf(
+					"%s: invalid reconnect %q: %s", k, cls.Options.Reconnect, err.Error(),
+				)
+			}
+		}
+
+		if _, err := core.NewLogParserChain(cls.Options.Parsers); err != nil {
+			return nil, errors.Errorf("%s: invalid parsers: %s", k, err.Error())
+		}
+
+		if _, err := core.CompileParseRegex(cls.Options.ParseRegex); err != nil {
+			return nil, errors.Errorf("%s: invalid parse_regex: %s", k, err.Error())
+		}
+
+		if _, err := core.ParseMultilineRule(cls.Options.Multiline); err != nil {
+			return nil, errors.Errorf("%s: invalid multiline: %s", k, err.Error())
+		}
+
+		if cls.Options.TimeFormat != "" {
+			if _, err := core.ParseTimeFormatSpec(cls.Options.TimeFormat); err != nil {
+				return nil, errors.Errorf("%s: invalid time_format: %s", k, err.Error())
+			}
+		}
+
+		if cls.Options.Timezone != "" {
+			if _, err := time.LoadLocation(cls.Options.Timezone); err != nil {
+				return nil, errors.Errorf("%s: invalid timezone: %s", k, err.Error())
+			}
+		}
+
+		if _, err := core.ParseClockCorrection(cls.Options.ClockCorrection); err != nil {
+			return nil, errors.Errorf("%s: invalid clock_correction: %s", k, err.Error())
+		}
+
+		if _, err := core.NewLevelRules(cls.Options.Levels); err != nil {
+			return nil, errors.Errorf("%s: invalid levels: %s", k, err.Error())
+		}
+
+		for _, tag := range cls.Tags {
+			if tag == "" || strings.ContainsAny(tag, invalidLabelChars) {
+				return nil, errors.Errorf(
+					"%s: invalid tag %q; tags must be non-empty and must not contain any of %q",
+					k, tag, invalidLabelChars,
+				)
+			}
+		}
+	}
+
+	for name := range cfg.Groups {
+		if name == "" || strings.ContainsAny(name, invalidLabelChars) {
+			return nil, errors.Errorf(
+				"invalid group name %q; group names must be non-empty and must not contain any of %q",
+				name, invalidLabelChars,
+			)
+		}
 	}
 
 	return &cfg, nil
 }
+
+// loadLogstreamsConfig loads the logstreams config from the given path. If
+// the path is empty or the file doesn't exist, empty configs are returned.
+func loadLogstreamsConfig(path string) (core.ConfigLogStreams, core.ConfigGroups, error) {
+	if path == "" {
+		return nil, nil, nil
+	}
+
+	cfg, err := LoadLogstreamsConfigFromFile(path)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, nil, nil
+		}
+
+		return nil, nil, errors.Annotatef(
+			err,
+			"reading logstreams config from %s (path is configurable via --lstreams-config)",
+			path,
+		)
+	}
+
+	return cfg.LogStreams, cfg.Groups, nil
+}
+
+// loadSSHConfig loads the ssh config from the given path. If the path is
+// empty or the file doesn't exist, nil config is returned.
+//
+// If the config has a Match directive, which the parser doesn't support yet,
+// then the config is parsed again ignoring Match, and matchIgnored is true, so
+// that the caller can warn the user about it.
+func loadSSHConfig(path string) (cfg *ssh_config.Config, matchIgnored bool, err error) {
+	if path == "" {
+		return nil, false, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+
+		return nil, false, errors.Annotatef(
+			err,
+			"reading ssh config from %s (path is configurable via --ssh-config)",
+			path,
+		)
+	}
+
+	cfg, err = ssh_config.Decode(bytes.NewReader(data), false)
+	if err == nil {
+		return cfg, false, nil
+	}
+
+	// Try again but ignoring Match
+	cfg, err = ssh_config.Decode(bytes.NewReader(data), true)
+	if err != nil {
+		return nil, false, errors.Annotatef(
+			err,
+			"parsing ssh config from %s (path is configurable via --ssh-config)",
+			path,
+		)
+	}
+
+	return cfg, true, nil
+}
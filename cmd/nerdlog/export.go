@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+)
+
+// exportFormat is the format in which logs are written by :write and
+// "nerdlog query".
+type exportFormat string
+
+const (
+	// exportFormatRaw is just the original log lines.
+	exportFormatRaw exportFormat = "raw"
+
+	// exportFormatText is the original log lines followed by a command to
+	// open the log file at the corresponding line, like
+	// "<ssh -t myhost vim +123 /var/log/syslog>".
+	exportFormatText exportFormat = "text"
+
+	// exportFormatJSONL, exportFormatCSV and exportFormatTSV contain the
+	// fields as per the select query.
+	exportFormatJSONL exportFormat = "jsonl"
+	exportFormatCSV   exportFormat = "csv"
+	exportFormatTSV   exportFormat = "tsv"
+)
+
+const exportFormatsHelp = "'raw' prints original log lines, 'text' also adds a command to open the log file at the corresponding line, 'jsonl', 'csv' and 'tsv' print the fields as per the select query"
+
+// defaultExportMaxNumLines is the default max number of lines to write when
+// loading all the pages of logs.
+const defaultExportMaxNumLines = 10000
+
+var validExportFormats = []exportFormat{
+	exportFormatRaw, exportFormatText, exportFormatJSONL, exportFormatCSV, exportFormatTSV,
+}
+
+func parseExportFormat(s string) (exportFormat, error) {
+	for _, f := range validExportFormats {
+		if s == string(f) {
+			return f, nil
+		}
+	}
+
+	validStrs := make([]string, 0, len(validExportFormats))
+	for _, f := range validExportFormats {
+		validStrs = append(validStrs, string(f))
+	}
+
+	return "", errors.Errorf(
+		"invalid format %q, valid ones are: %s", s, strings.Join(validStrs, ", "),
+	)
+}
+
+// exportFormatByFilename returns the format implied by the filename
+// extension, or exportFormatText if there's no such extension.
+func exportFormatByFilename(fname string) exportFormat {
+	switch strings.ToLower(filepath.Ext(fname)) {
+	case ".jsonl", ".ndjson":
+		return exportFormatJSONL
+	case ".csv":
+		return exportFormatCSV
+	case ".tsv":
+		return exportFormatTSV
+	}
+
+	return exportFormatText
+}
+
+// writeLogs writes the logs in the given format. The select query and the
+// timezone are only used by the formats which have separate fields.
+func writeLogs(
+	w io.Writer,
+	logs []core.LogMsg,
+	format exportFormat,
+	sqp *SelectQueryParsed,
+	tz *time.Location,
+) error {
+	switch format {
+	case exportFormatRaw:
+		for _, msg := range logs {
+			if _, err := fmt.Fprintln(w, msg.OrigLine); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+	case exportFormatText:
+		for _, msg := range logs {
+			if _, err := fmt.Fprintf(w, "%s <ssh -t %s vim +%d %s>\n",
+				msg.OrigLine,
+				msg.Context["lstream"], msg.LogLinenumber, msg.LogFilename,
+			); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+	case exportFormatJSONL:
+		for _, msg := range logs {
+			if err := writeJSONObject(w, logMsgFields(msg, sqp, tz)); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+	case exportFormatCSV, exportFormatTSV:
+		return errors.Trace(writeLogsTable(w, logs, format, sqp, tz))
+
+	default:
+		return errors.Errorf("invalid format %q", format)
+	}
+
+	return nil
+}
+
+// tsvEscaper escapes the values in TSV, so that every row is a single line.
+var tsvEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	"\t", "\\t",
+	"\n", "\\n",
+	"\r", "\\r",
+)
+
+// writeLogsTable writes the logs as CSV or TSV, with the header. Since every
+// row has to have the same columns, these are the columns for all the logs,
+// same as in the logs table in the UI.
+func writeLogsTable(
+	w io.Writer,
+	logs []core.LogMsg,
+	format exportFormat,
+	sqp *SelectQueryParsed,
+	tz *time.Location,
+) error {
+	cols := sqp.Columns(logs)
+
+	var writeRow func(row []string) error
+
+	// cw is only set for CSV; csv.Writer buffers the data, so it needs to be
+	// flushed at the end.
+	var cw *csv.Writer
+
+	switch format {
+	case exportFormatCSV:
+		cw = csv.NewWriter(w)
+		writeRow = cw.Write
+
+	case exportFormatTSV:
+		writeRow = func(row []string) error {
+			for i, v := range row {
+				row[i] = tsvEscaper.Replace(v)
+			}
+
+			_, err := fmt.Fprintln(w, strings.Join(row, "\t"))
+			return err
+		}
+
+	default:
+		return errors.Errorf("invalid table format %q", format)
+	}
+
+	row := make([]string, len(cols))
+	for i, col := range cols {
+		row[i] = col.DisplayName
+	}
+
+	if err := writeRow(row); err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, msg := range logs {
+		row := make([]string, len(cols))
+		for i, col := range cols {
+			row[i], _ = logMsgFieldValue(msg, col.Name, tz)
+		}
+
+		if err := writeRow(row); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if cw != nil {
+		cw.Flush()
+
+		return errors.Trace(cw.Error())
+	}
+
+	return nil
+}
+
+// logMsgField is a single field of a log message, as selected by the select
+// query.
+type logMsgField struct {
+	name  string
+	value interface{}
+}
+
+// logMsgFields returns the fields of the message as per the select query, in
+// the same order as the columns in the logs table (see
+// SelectQueryParsed.Columns), named as per their DisplayName. The fields
+// which the message doesn't have are omitted.
+func logMsgFields(msg core.LogMsg, sqp *SelectQueryParsed, tz *time.Location) []logMsgField {
+	cols := sqp.Columns([]core.LogMsg{msg})
+
+	ret := make([]logMsgField, 0, len(cols))
+	for _, col := range cols {
+		if v, ok := logMsgFieldValue(msg, col.Name, tz); ok {
+			ret = append(ret, logMsgField{name: col.DisplayName, value: v})
+		}
+	}
+
+	return ret
+}
+
+// logMsgFieldValue returns the value of the field with the given name, and
+// whether the message has this field at all.
+func logMsgFieldValue(msg core.LogMsg, name string, tz *time.Location) (string, bool) {
+	switch name {
+	case FieldNameTime:
+		return msg.Time.In(tz).Format(time.RFC3339Nano), true
+	case FieldNameMessage:
+		return msg.Msg, true
+	default:
+		v, ok := msg.Context[name]
+		return v, ok
+	}
+}
+
+// writeJSONObject writes the fields as a single-line JSON object, preserving
+// the order of fields.
+func writeJSONObject(w io.Writer, fields []logMsgField) error {
+	buf := []byte{'{'}
+
+	for i, fld := range fields {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+
+		k, err := json.Marshal(fld.name)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		v, err := json.Marshal(fld.value)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		buf = append(buf, k...)
+		buf = append(buf, ':')
+		buf = append(buf, v...)
+	}
+
+	buf = append(buf, '}', '\n')
+
+	_, err := w.Write(buf)
+	return errors.Trace(err)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteLogs(t *testing.T) {
+	logs := []core.LogMsg{
+		{
+			Time: time.Date(2025, 4, 18, 18, 13, 5, 0, time.UTC),
+			Msg:  "hello, \"world\"\tagain",
+			Context: map[string]string{
+				"lstream":    "host-01",
+				"level_name": "info",
+			},
+			LogFilename:   "/var/log/syslog",
+			LogLinenumber: 10,
+			OrigLine:      "Apr 18 18:13:05 host-01 myapp: hello",
+		},
+		{
+			Time: time.Date(2025, 4, 18, 18, 14, 0, 0, time.UTC),
+			Msg:  "bye",
+			Context: map[string]string{
+				"lstream": "host-02",
+				"pid":     "123",
+			},
+			LogFilename:   "/var/log/messages",
+			LogLinenumber: 20,
+			OrigLine:      "Apr 18 18:14:00 host-02 myapp[123]: bye",
+		},
+	}
+
+	type testCase struct {
+		descr string
+
+		format      exportFormat
+		selectQuery SelectQuery
+
+		want string
+	}
+
+	testCases := []testCase{
+		{
+			descr:       "raw",
+			format:      exportFormatRaw,
+			selectQuery: DefaultSelectQuery,
+			want: "Apr 18 18:13:05 host-01 myapp: hello\n" +
+				"Apr 18 18:14:00 host-02 myapp[123]: bye\n",
+		},
+		{
+			descr:       "text",
+			format:      exportFormatText,
+			selectQuery: DefaultSelectQuery,
+			want: "Apr 18 18:13:05 host-01 myapp: hello <ssh -t host-01 vim +10 /var/log/syslog>\n" +
+				"Apr 18 18:14:00 host-02 myapp[123]: bye <ssh -t host-02 vim +20 /var/log/messages>\n",
+		},
+		{
+			descr:       "csv with all fields",
+			format:      exportFormatCSV,
+			selectQuery: DefaultSelectQuery,
+			want: "time,message,lstream,level_name,pid\n" +
+				"2025-04-18T18:13:05Z,\"hello, \"\"world\"\"\tagain\",host-01,info,\n" +
+				"2025-04-18T18:14:00Z,bye,host-02,,123\n",
+		},
+		{
+			descr:       "tsv with explicit fields, sticky one first",
+			format:      exportFormatTSV,
+			selectQuery: "message, lstream AS host STICKY",
+			want: "host\tmessage\n" +
+				"host-01\thello, \"world\"\\tagain\n" +
+				"host-02\tbye\n",
+		},
+		{
+			descr:       "jsonl",
+			format:      exportFormatJSONL,
+			selectQuery: "time, message, pid",
+			want: `{"time":"2025-04-18T18:13:05Z","message":"hello, \"world\"\tagain"}` + "\n" +
+				`{"time":"2025-04-18T18:14:00Z","message":"bye","pid":"123"}` + "\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.descr, func(t *testing.T) {
+			sqp, err := ParseSelectQuery(tc.selectQuery)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			var buf bytes.Buffer
+			err = writeLogs(&buf, logs, tc.format, sqp, time.UTC)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, buf.String())
+		})
+	}
+}
+
+// failingWriter fails all writes, like a file on a full disk.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+func TestWriteLogsWriteError(t *testing.T) {
+	logs := []core.LogMsg{
+		{
+			Time:    time.Date(2025, 4, 18, 18, 13, 5, 0, time.UTC),
+			Msg:     "hello",
+			Context: map[string]string{"lstream": "host-01"},
+		},
+	}
+
+	sqp, err := ParseSelectQuery(DefaultSelectQuery)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, format := range []exportFormat{exportFormatCSV, exportFormatTSV} {
+		err := writeLogs(failingWriter{}, logs, format, sqp, time.UTC)
+		assert.EqualError(t, err, "no space left on device", "format %s", format)
+	}
+}
+
+func TestParseWriteCmdArgs(t *testing.T) {
+	type testCase struct {
+		descr string
+		args  []string
+
+		want    writeCmdParams
+		wantErr string
+	}
+
+	testCases := []testCase{
+		{
+			descr: "no args",
+			want: writeCmdParams{
+				fname:       "/tmp/last_nerdlog",
+				format:      exportFormatText,
+				maxNumLines: defaultExportMaxNumLines,
+			},
+		},
+		{
+			descr: "format from extension",
+			args:  []string{"/tmp/foo.csv"},
+			want: writeCmdParams{
+				fname:       "/tmp/foo.csv",
+				format:      exportFormatCSV,
+				maxNumLines: defaultExportMaxNumLines,
+			},
+		},
+		{
+			descr: "explicit format and all",
+			args:  []string{"++format=jsonl", "++all", "/tmp/foo.csv"},
+			want: writeCmdParams{
+				fname:       "/tmp/foo.csv",
+				format:      exportFormatJSONL,
+				all:         true,
+				maxNumLines: defaultExportMaxNumLines,
+			},
+		},
+		{
+			descr: "all with limit",
+			args:  []string{"/tmp/foo", "++all=500"},
+			want: writeCmdParams{
+				fname:       "/tmp/foo",
+				format:      exportFormatText,
+				all:         true,
+				maxNumLines: 500,
+			},
+		},
+		{
+			descr:   "invalid format",
+			args:    []string{"++format=xml"},
+			wantErr: `invalid format "xml", valid ones are: raw, text, jsonl, csv, tsv`,
+		},
+		{
+			descr:   "invalid limit",
+			args:    []string{"++all=0"},
+			wantErr: `invalid max number of lines "0" for ++all`,
+		},
+		{
+			descr:   "unknown option",
+			args:    []string{"++foo"},
+			wantErr: `unknown option "++foo"; valid ones are ++format and ++all`,
+		},
+		{
+			descr:   "two filenames",
+			args:    []string{"foo", "bar"},
+			wantErr: "only one filename can be given",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.descr, func(t *testing.T) {
+			got, err := parseWriteCmdArgs(tc.args)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
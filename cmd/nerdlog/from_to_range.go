@@ -83,3 +83,34 @@ func parseAndInferTimeOrDur(timezone *time.Location, layout, s string) (TimeOrDu
 
 	return t, nil
 }
+
+// QueryRange returns the absolute time range to query, the same way the UI
+// calculates it: relative durations are relative to now (and only negative
+// ones are meaningful, so positive ones are reversed), both ends are snapped
+// to the 1m grid rounding forward, and if from is after to, they're swapped.
+// If the range is open-ended, the returned to is zero.
+func (ftr *FromToRange) QueryRange(now time.Time) (from, to time.Time) {
+	fromTD, toTD := ftr.From, ftr.To
+
+	if !fromTD.IsAbsolute() && fromTD.Dur > 0 {
+		fromTD.Dur = -fromTD.Dur
+	}
+
+	if !toTD.IsAbsolute() && toTD.Dur > 0 {
+		toTD.Dur = -toTD.Dur
+	}
+
+	from = truncateCeil(fromTD.AbsoluteTime(now), 1*time.Minute)
+
+	if toTD.IsZero() {
+		return from, time.Time{}
+	}
+
+	to = truncateCeil(toTD.AbsoluteTime(now), 1*time.Minute)
+
+	if from.After(to) {
+		from, to = to, from
+	}
+
+	return from, to
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dimonomid/clock"
+	"github.com/dimonomid/nerdlog/client"
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+)
+
+// headlessParams are the params shared by all the headless subcommands, like
+// "nerdlog query" and "nerdlog serve".
+type headlessParams struct {
+	lstreams string
+
+	lstreamsConfigPath string
+	luaScriptPath      string
+	sshConfigPath      string
+	sshKeys            []string
+
+	optionSets []string
+	logLevel   log.LogLevel
+
+	noJournalctlAccessWarn bool
+}
+
+func headlessParamsFromFlags(flags *commonFlags) (headlessParams, error) {
+	logLevel, err := parseLogLevel(*flags.logLevel)
+	if err != nil {
+		return headlessParams{}, errors.Annotatef(err, "--loglevel")
+	}
+
+	lstreams := *flags.lstreams
+	if lstreams == "" {
+		lstreams = "localhost"
+	}
+
+	return headlessParams{
+		lstreams: lstreams,
+
+		lstreamsConfigPath: *flags.lstreamsConfig,
+		luaScriptPath:      *flags.luaScript,
+		sshConfigPath:      *flags.sshConfig,
+		sshKeys:            *flags.sshKeys,
+
+		optionSets: *flags.set,
+		logLevel:   logLevel,
+
+		noJournalctlAccessWarn: *flags.noJournalctlAccessWarn,
+	}, nil
+}
+
+// newOptions returns the default options with the ones from the command line
+// applied.
+func (p *headlessParams) newOptions() (*OptionsShared, error) {
+	options := NewOptionsShared(defaultOptions())
+	for _, expr := range p.optionSets {
+		if _, err := setOption(options, expr); err != nil {
+			return nil, errors.Annotatef(err, "setting options from command line")
+		}
+	}
+
+	return options, nil
+}
+
+// newClient loads the configs and creates a new client which starts
+// connecting to the logstreams. Since there is no UI to report issues to,
+// they're printed to stderr.
+func (p *headlessParams) newClient(opts Options) (*client.Client, error) {
+	logstreamsCfg, groupsCfg, err := loadLogstreamsConfig(p.lstreamsConfigPath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	sshConfig, matchIgnored, err := loadSSHConfig(p.sshConfigPath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if matchIgnored && os.Getenv("NERDLOG_NO_WARN_SSH_MATCH") == "" {
+		fmt.Fprintf(os.Stderr, "Warning: SSH config %s has a Match directive, it'll be ignored. To disable this warning, set NERDLOG_NO_WARN_SSH_MATCH environment variable to 1.\n", p.sshConfigPath)
+	}
+
+	c, err := client.New(client.ClientParams{
+		LStreams: p.lstreams,
+
+		ConfigLogStreams: logstreamsCfg,
+		ConfigGroups:     groupsCfg,
+		SSHConfig:        sshConfig,
+		SSHKeys:          p.sshKeys,
+
+		TransportMode:   opts.DefaultTransportMode,
+		ReconnectPolicy: &opts.ReconnectPolicy,
+
+		LuaScript: p.luaScriptPath,
+
+		ClientID: os.Getenv("USER"),
+
+		OnDataRequest: func(req *core.ShellConnDataRequest) {
+			// There's no way to ask the user for anything in headless mode, so just
+			// let them know.
+			fmt.Fprintf(os.Stderr, "Warning: %s requested, but it's not supported in headless mode: %s\n", req.Title, req.Message)
+			req.ResponseCh <- ""
+		},
+
+		OnBootstrapIssue: func(issue core.BootstrapIssue) {
+			if issue.Err != "" {
+				fmt.Fprintf(os.Stderr, "Error: %s: %s\n", issue.LStreamName, issue.Err)
+			}
+
+			if issue.WarnJournalctlNoAdminAccess && !p.noJournalctlAccessWarn {
+				fmt.Fprintf(os.Stderr, "Warning: %s: journalctl is being used, but the user doesn't have access to all the system logs. Use --no-journalctl-access-warning to suppress this message.\n", issue.LStreamName)
+			}
+
+			if issue.WarnClockSkew != 0 {
+				fmt.Fprintf(os.Stderr, "Warning: %s: the host clock is %s, so the order of messages across logstreams might be misleading. Use the clock_correction logstream option to correct the timestamps and suppress this message.\n", issue.LStreamName, formatClockSkew(issue.WarnClockSkew))
+			}
+		},
+
+		Logger: log.NewLogger(p.logLevel),
+
+		Clock: clock.New(),
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "lstreams")
+	}
+
+	return c, nil
+}
+
+// printLuaErrors prints the errors from the user Lua script, if any, to
+// stderr; in the TUI, they're shown by :qdebug instead.
+func printLuaErrors(resp *core.LogRespTotal) {
+	lstreamNames := make([]string, 0, len(resp.DebugInfo))
+	for name := range resp.DebugInfo {
+		lstreamNames = append(lstreamNames, name)
+	}
+	sort.Strings(lstreamNames)
+
+	for _, name := range lstreamNames {
+		for _, errMsg := range resp.DebugInfo[name].LuaErrors {
+			fmt.Fprintf(os.Stderr, "Warning: %s: lua: %s\n", name, errMsg)
+		}
+	}
+}
+
+// formatConnErrs returns a human-readable list of the logstreams which are
+// not connected yet, together with the last connection errors, if any.
+func formatConnErrs(state core.LStreamsManagerState) string {
+	var names []string
+	for connState, lstreams := range state.LStreamsByState {
+		if connState == core.LStreamClientStateConnectedIdle ||
+			connState == core.LStreamClientStateConnectedBusy {
+			continue
+		}
+
+		for name := range lstreams {
+			if errStr := state.ConnDetailsByLStream[name].Err; errStr != "" {
+				name += ": " + errStr
+			}
+
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return "unknown logstreams"
+	}
+
+	return strings.Join(names, "; ")
+}
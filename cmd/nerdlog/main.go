@@ -10,6 +10,7 @@ import (
 	"github.com/dimonomid/nerdlog/clipboard"
 	"github.com/dimonomid/nerdlog/log"
 	"github.com/dimonomid/nerdlog/version"
+	"github.com/juju/errors"
 	"github.com/spf13/pflag"
 )
 
@@ -24,34 +25,29 @@ func main() {
 		os.Exit(1)
 	}
 
-	defaultSSHKeys := []string{
-		filepath.Join(homeDir, ".ssh", "id_ed25519"),
-		filepath.Join(homeDir, ".ssh", "id_ecdsa"),
-		filepath.Join(homeDir, ".ssh", "id_rsa"),
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "query":
+			os.Exit(runQueryCmd(os.Args[2:], homeDir))
+		case "serve":
+			os.Exit(runServeCmd(os.Args[2:], homeDir))
+		case "watch":
+			os.Exit(runWatchCmd(os.Args[2:], homeDir))
+		case "metrics":
+			os.Exit(runMetricsCmd(os.Args[2:], homeDir))
+		}
 	}
 
 	var (
 		flagVersion = pflag.BoolP("version", "v", false, "Print version info and exit")
 
-		flagTime             = pflag.StringP("time", "t", "", "Time range in the same format as accepted by the UI. Examples: '1h', 'Mar27 12:00'")
-		flagLStreamsConfig   = pflag.String("lstreams-config", filepath.Join(homeDir, ".config", "nerdlog", "logstreams.yaml"), "logstreams config file to use; set to an empty string to disable reading logstreams config")
 		flagCmdHistoryFile   = pflag.String("cmdhistory-file", filepath.Join(homeDir, ".nerdlog_history"), "Command-line history file")
 		flagQueryHistoryFile = pflag.String("queryhistory-file", filepath.Join(homeDir, ".nerdlog_query_history"), "Query history file")
-		flagLStreams         = pflag.StringP("lstreams", "h", "", "Logstreams to connect to, as comma-separated glob patterns, e.g. 'foo-*,bar-*'")
-		flagQuery            = pflag.StringP("pattern", "p", "", "Initial awk pattern to use")
-		flagSelectQuery      = pflag.StringP("selquery", "s", "", "SELECT-like query to specify which fields to show, like 'time STICKY, message, lstream, level_name AS level, *'")
-		flagLogLevel         = pflag.String("loglevel", "error", "This is NOT about the logs that nerdlog fetches from the remote servers, it's rather about nerdlog's own log. Valid values are: error, warning, info, verbose1, verbose2 or verbose3")
-		flagSSHConfig        = pflag.String("ssh-config", filepath.Join(homeDir, ".ssh", "config"), "ssh config file to use; set to an empty string to disable reading ssh config")
-		flagSSHKeys          = pflag.StringSlice("ssh-key", defaultSSHKeys, "ssh keys to use; only the first existing file will be used")
-
-		// NOTE: we specifically use StringArray and not StringSlice here, because we
-		// don't want it to interpret commas in the values, like "--set foo=123,bar=234", since
-		// it messes with more complicated option syntax like 'transport=custom:some "arbitrary command"'
-		flagSet = pflag.StringArray("set", []string{}, "Initial option values in the form option=value, in the same way you'd specify them for the :set command. This flag can be given multiple times")
-
-		flagNoJournalctlAccessWarn = pflag.Bool("no-journalctl-access-warning", false, "Suppress the warning when journalctl is being used by the user who can't read all system logs")
 	)
 
+	flags := addCommonFlags(pflag.CommandLine, homeDir)
+	qFlags := addQueryFlags(pflag.CommandLine)
+
 	pflag.Parse()
 
 	if *flagVersion {
@@ -78,23 +74,23 @@ func main() {
 	initialSelectQuery := DefaultSelectQuery
 	connectRightAway := false
 
-	if *flagTime != "" {
-		initialTime = *flagTime
+	if *qFlags.time != "" {
+		initialTime = *qFlags.time
 		connectRightAway = true
 	}
 
-	if *flagLStreams != "" {
-		initialLStreams = *flagLStreams
+	if *flags.lstreams != "" {
+		initialLStreams = *flags.lstreams
 		connectRightAway = true
 	}
 
-	if *flagQuery != "" {
-		initialQuery = *flagQuery
+	if *qFlags.pattern != "" {
+		initialQuery = *qFlags.pattern
 		connectRightAway = true
 	}
 
-	if *flagSelectQuery != "" {
-		initialSelectQuery = SelectQuery(*flagSelectQuery)
+	if *qFlags.selectQuery != "" {
+		initialSelectQuery = SelectQuery(*qFlags.selectQuery)
 		connectRightAway = true
 	}
 
@@ -123,37 +119,26 @@ func main() {
 		fmt.Printf("NOTE: X Clipboard is not available: %s\n", clipboard.InitErr.Error())
 	}
 
-	logLevel := log.Info
-	if *flagLogLevel == "error" {
-		logLevel = log.Error
-	} else if *flagLogLevel == "warning" {
-		logLevel = log.Warning
-	} else if *flagLogLevel == "info" {
-		logLevel = log.Info
-	} else if *flagLogLevel == "verbose1" {
-		logLevel = log.Verbose1
-	} else if *flagLogLevel == "verbose2" {
-		logLevel = log.Verbose2
-	} else if *flagLogLevel == "verbose3" {
-		logLevel = log.Verbose3
-	} else {
-		fmt.Fprintf(os.Stderr, "Invalid --loglevel, try error, warning, info, verbose1, verbose2 or verbose3")
+	logLevel, err := parseLogLevel(*flags.logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --loglevel: %s\n", err)
 		os.Exit(1)
 	}
 
 	app, err := newNerdlogApp(
 		nerdlogAppParams{
-			initialOptionSets:    *flagSet,
+			initialOptionSets:    *flags.set,
 			initialQueryData:     initialQueryData,
 			connectRightAway:     connectRightAway,
 			clipboardInitErr:     clipboard.InitErr,
 			logLevel:             logLevel,
-			sshConfigPath:        *flagSSHConfig,
-			logstreamsConfigPath: *flagLStreamsConfig,
+			sshConfigPath:        *flags.sshConfig,
+			logstreamsConfigPath: *flags.lstreamsConfig,
 			cmdHistoryFile:       *flagCmdHistoryFile,
-			sshKeys:              *flagSSHKeys,
+			luaScriptPath:        *flags.luaScript,
+			sshKeys:              *flags.sshKeys,
 
-			noJournalctlAccessWarn: *flagNoJournalctlAccessWarn,
+			noJournalctlAccessWarn: *flags.noJournalctlAccessWarn,
 		},
 		queryCLHistory,
 	)
@@ -178,3 +163,79 @@ func main() {
 
 	fmt.Println("Have a nice day.")
 }
+
+// commonFlags are the flags shared by the TUI and all the headless
+// subcommands like "nerdlog query", "nerdlog serve" or "nerdlog watch".
+type commonFlags struct {
+	lstreams *string
+
+	lstreamsConfig *string
+	luaScript      *string
+	sshConfig      *string
+	sshKeys        *[]string
+
+	set      *[]string
+	logLevel *string
+
+	noJournalctlAccessWarn *bool
+}
+
+func addCommonFlags(fs *pflag.FlagSet, homeDir string) *commonFlags {
+	defaultSSHKeys := []string{
+		filepath.Join(homeDir, ".ssh", "id_ed25519"),
+		filepath.Join(homeDir, ".ssh", "id_ecdsa"),
+		filepath.Join(homeDir, ".ssh", "id_rsa"),
+	}
+
+	return &commonFlags{
+		lstreams: fs.StringP("lstreams", "h", "", "Logstreams to connect to, as comma-separated glob patterns, e.g. 'foo-*,bar-*'"),
+
+		lstreamsConfig: fs.String("lstreams-config", filepath.Join(homeDir, ".config", "nerdlog", "logstreams.yaml"), "logstreams config file to use; set to an empty string to disable reading logstreams config"),
+		luaScript:      fs.String("lua-script", "", "Lua script to invoke for every log line, to parse it in a custom way; logstreams can override it with the lua_script option in the logstreams config"),
+		sshConfig:      fs.String("ssh-config", filepath.Join(homeDir, ".ssh", "config"), "ssh config file to use; set to an empty string to disable reading ssh config"),
+		sshKeys:        fs.StringSlice("ssh-key", defaultSSHKeys, "ssh keys to use; only the first existing file will be used"),
+
+		// NOTE: we specifically use StringArray and not StringSlice here, because we
+		// don't want it to interpret commas in the values, like "--set foo=123,bar=234", since
+		// it messes with more complicated option syntax like 'transport=custom:some "arbitrary command"'
+		set:      fs.StringArray("set", []string{}, "Initial option values in the form option=value, in the same way you'd specify them for the :set command. This flag can be given multiple times"),
+		logLevel: fs.String("loglevel", "error", "This is NOT about the logs that nerdlog fetches from the remote servers, it's rather about nerdlog's own log. Valid values are: error, warning, info, verbose1, verbose2 or verbose3"),
+
+		noJournalctlAccessWarn: fs.Bool("no-journalctl-access-warning", false, "Suppress the warning when journalctl is being used by the user who can't read all system logs"),
+	}
+}
+
+// queryFlags are the flags specifying the query, shared by the TUI and the
+// "nerdlog query" subcommand.
+type queryFlags struct {
+	time        *string
+	pattern     *string
+	selectQuery *string
+}
+
+func addQueryFlags(fs *pflag.FlagSet) *queryFlags {
+	return &queryFlags{
+		time:        fs.StringP("time", "t", "", "Time range in the same format as accepted by the UI. Examples: '1h', 'Mar27 12:00'"),
+		pattern:     fs.StringP("pattern", "p", "", "Initial awk pattern to use"),
+		selectQuery: fs.StringP("selquery", "s", "", "SELECT-like query to specify which fields to show, like 'time STICKY, message, lstream, level_name AS level, *'"),
+	}
+}
+
+func parseLogLevel(s string) (log.LogLevel, error) {
+	switch s {
+	case "error":
+		return log.Error, nil
+	case "warning":
+		return log.Warning, nil
+	case "info":
+		return log.Info, nil
+	case "verbose1":
+		return log.Verbose1, nil
+	case "verbose2":
+		return log.Verbose2, nil
+	case "verbose3":
+		return log.Verbose3, nil
+	}
+
+	return 0, errors.Errorf("%q is not a valid log level, try error, warning, info, verbose1, verbose2 or verbose3", s)
+}
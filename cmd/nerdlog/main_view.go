@@ -47,6 +47,7 @@ type MainViewParams struct {
 
 	OnDisconnectRequest OnDisconnectRequest
 	OnReconnectRequest  OnReconnectRequest
+	OnRetryRequest      OnRetryRequest
 
 	// TODO: support command history
 	OnCmd OnCmdCallback
@@ -139,6 +140,9 @@ type MainView struct {
 
 	curHMState *core.LStreamsManagerState
 	curLogResp *core.LogRespTotal
+	// curLogRespCachedAt is non-zero if curLogResp was taken from the history
+	// cache instead of being queried; it's the time when it was cached.
+	curLogRespCachedAt time.Time
 	// statsFrom and statsTo represent the first and last element present
 	// in curLogResp.MinuteStats. Note that this range might be smaller than
 	// (from, to), because for some minute stats might be missing. statsFrom
@@ -170,6 +174,7 @@ type OnLogQueryCallback func(params core.QueryLogsParams)
 type OnLStreamsChange func(lstreamsSpec string) error
 type OnDisconnectRequest func()
 type OnReconnectRequest func()
+type OnRetryRequest func()
 type OnCmdCallback func(cmd string, opts CmdOpts)
 
 var (
@@ -663,22 +668,7 @@ func NewMainView(params *MainViewParams) *MainView {
 		}
 	}).SetSelectedFunc(func(row int, column int) {
 		if row == rowIdxLoadOlder {
-			// Request to load more (older) logs
-
-			// Do the query to core
-			mv.params.OnLogQuery(core.QueryLogsParams{
-				From:  mv.actualFrom,
-				To:    mv.actualToForQuery,
-				Query: mv.query,
-
-				LoadEarlier: true,
-			})
-
-			// Update the cell text
-			mv.logsTable.SetCell(
-				rowIdxLoadOlder, 0,
-				newTableCellButton("... loading ..."),
-			)
+			mv.loadEarlier()
 			return
 		}
 
@@ -1203,54 +1193,16 @@ func (mv *MainView) updateTableHeader(msgs []core.LogMsg) (colNames []string) {
 	}
 
 	numSticky := 0
-	fields := make([]SelectQueryField, 0, len(mv.selectQuery.Fields))
+	explicit := make(map[string]struct{}, len(mv.selectQuery.Fields))
 	for _, fld := range mv.selectQuery.Fields {
-		fields = append(fields, fld)
+		explicit[fld.Name] = struct{}{}
 
 		if fld.Sticky {
 			numSticky++
 		}
 	}
 
-	// Move sticky ones to the front
-	sort.SliceStable(fields, func(i, j int) bool {
-		vi := 1
-		if fields[i].Sticky {
-			vi = 0
-		}
-
-		vj := 1
-		if fields[j].Sticky {
-			vj = 0
-		}
-
-		return vi < vj
-	})
-
-	explicit := make(map[string]struct{}, len(fields))
-	for _, v := range fields {
-		explicit[v.Name] = struct{}{}
-	}
-
-	if mv.selectQuery.IncludeAll {
-		var implicitFields []SelectQueryField
-		for v := range existingTags {
-			if _, ok := explicit[v]; ok {
-				continue
-			}
-
-			implicitFields = append(implicitFields, SelectQueryField{
-				Name:        v,
-				DisplayName: v,
-			})
-		}
-
-		sort.Slice(implicitFields, func(i, j int) bool {
-			return implicitFields[i].Name < implicitFields[j].Name
-		})
-
-		fields = append(fields, implicitFields...)
-	}
+	fields := mv.selectQuery.Columns(msgs)
 
 	colNames = make([]string, 0, len(fields))
 	for i, fld := range fields {
@@ -1282,6 +1234,13 @@ func (mv *MainView) updateTableHeader(msgs []core.LogMsg) (colNames []string) {
 func (mv *MainView) applyLogs(resp *core.LogRespTotal) {
 	mv.curLogResp = resp
 
+	// Loading more (earlier) logs keeps the rest of the logs as they were, so
+	// only reset the cached flag if we've replaced all logs.
+	if !resp.LoadedEarlier {
+		mv.curLogRespCachedAt = time.Time{}
+		mv.bumpStatusLineLeft()
+	}
+
 	oldNumRows := mv.logsTable.GetRowCount()
 	selectedRow, _ := mv.logsTable.GetSelection()
 	offsetRow, offsetCol := mv.logsTable.GetOffset()
@@ -1303,6 +1262,36 @@ func (mv *MainView) applyLogs(resp *core.LogRespTotal) {
 	mv.printMsg(fmt.Sprintf("Query took: %s", resp.QueryDur.Round(1*time.Millisecond)), nlMsgLevelInfo)
 }
 
+// applyCachedLogs is like applyQueryEditData followed by applyLogs, but
+// instead of actually querying logs, it shows the given cached response.
+func (mv *MainView) applyCachedLogs(
+	data QueryFull, resp *core.LogRespTotal, cachedAt time.Time,
+) error {
+	if err := mv.applyQueryEditData(data, doQueryParams{}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// applyQueryEditData has scheduled the query, but we don't need it.
+	mv.doQueryParamsOnceConnected = nil
+
+	// The response might have been loaded with LoadedEarlier, but now it
+	// replaces whatever logs we had.
+	respCopy := *resp
+	respCopy.LoadedEarlier = false
+
+	mv.applyLogs(&respCopy)
+
+	mv.curLogRespCachedAt = cachedAt
+	mv.bumpStatusLineLeft()
+
+	mv.printMsg(fmt.Sprintf(
+		"Showing cached results from %s; press F5 to refresh",
+		cachedAt.In(mv.params.Options.GetTimezone()).Format("15:04:05"),
+	), nlMsgLevelInfo)
+
+	return nil
+}
+
 func (mv *MainView) getLastQueryDebugInfo() string {
 	if mv.curLogResp == nil {
 		return "-- No query results --"
@@ -1341,6 +1330,30 @@ func (mv *MainView) getLastQueryDebugInfo() string {
 				sb.WriteString("\n")
 			}
 		}
+
+		if len(debugInfo.LuaErrors) > 0 {
+			if sb.Len() > 0 {
+				sb.WriteString("\n")
+			}
+
+			sb.WriteString(fmt.Sprintf("%s lua errors:\n", lstreamName))
+			for _, line := range debugInfo.LuaErrors {
+				sb.WriteString(line)
+				sb.WriteString("\n")
+			}
+		}
+
+		if len(debugInfo.ParseRegexMisses) > 0 {
+			if sb.Len() > 0 {
+				sb.WriteString("\n")
+			}
+
+			sb.WriteString(fmt.Sprintf("%s parse_regex misses:\n", lstreamName))
+			for _, line := range debugInfo.ParseRegexMisses {
+				sb.WriteString(line)
+				sb.WriteString("\n")
+			}
+		}
 	}
 
 	ret := sb.String()
@@ -1396,6 +1409,22 @@ func (mv *MainView) getConnDebugInfo() string {
 
 			sb.WriteString(fmt.Sprintf("%s connection error: %s\n", lstreamName, connDetails.Err))
 		}
+
+		if connDetails.Connected && connDetails.PingRTT > 0 {
+			if sb.Len() > 0 {
+				sb.WriteString("\n")
+			}
+
+			sb.WriteString(fmt.Sprintf("%s ping RTT: %s\n", lstreamName, connDetails.PingRTT.Round(time.Millisecond)))
+		}
+
+		if connDetails.Connected && connDetails.ClockSkew != 0 {
+			if sb.Len() > 0 {
+				sb.WriteString("\n")
+			}
+
+			sb.WriteString(fmt.Sprintf("%s clock offset: %s\n", lstreamName, formatClockSkew(connDetails.ClockSkew)))
+		}
 	}
 
 	ret := sb.String()
@@ -1406,6 +1435,16 @@ func (mv *MainView) getConnDebugInfo() string {
 	return ret
 }
 
+// formatClockSkew returns a human-readable description of the clock skew of a
+// host relative to the local clock, like "ahead by 1.5s".
+func formatClockSkew(skew time.Duration) string {
+	if skew < 0 {
+		return fmt.Sprintf("behind by %s", (-skew).Round(time.Millisecond))
+	}
+
+	return fmt.Sprintf("ahead by %s", skew.Round(time.Millisecond))
+}
+
 func (mv *MainView) showConnDebugInfo() {
 	text := mv.getConnDebugInfo()
 
@@ -1415,6 +1454,88 @@ func (mv *MainView) showConnDebugInfo() {
 	})
 }
 
+func (mv *MainView) getTimeFormatInfo() string {
+	if mv.curHMState == nil {
+		return "-- No time format info --"
+	}
+
+	tfbs := mv.curHMState.TimeFormatByLStream
+
+	lstreamNames := make([]string, 0, len(tfbs))
+	for lstreamName := range tfbs {
+		lstreamNames = append(lstreamNames, lstreamName)
+	}
+	sort.Strings(lstreamNames)
+
+	var sb strings.Builder
+
+	for _, lstreamName := range lstreamNames {
+		tfInfo := tfbs[lstreamName]
+
+		if sb.Len() > 0 {
+			sb.WriteString("\n")
+		}
+
+		sb.WriteString(fmt.Sprintf("%s time format %s\n", lstreamName, tfInfo.Source))
+
+		if descr := tfInfo.Descr; descr != nil {
+			sb.WriteString(fmt.Sprintf("Timestamp layout: %q\n", descr.TimestampLayout))
+			sb.WriteString(fmt.Sprintf("Timestamp location: %s\n", formatTimestampLocation(descr.TimestampLocation)))
+			sb.WriteString(fmt.Sprintf("Minute key layout: %q\n", descr.MinuteKeyLayout))
+			if descr.UTC {
+				sb.WriteString("Converted to UTC using the offset in timestamps\n")
+			}
+			sb.WriteString("Awk expressions:\n")
+			sb.WriteString(fmt.Sprintf("  month: %s\n", descr.AWKExpr.Month))
+			sb.WriteString(fmt.Sprintf("  year: %s\n", descr.AWKExpr.Year))
+			sb.WriteString(fmt.Sprintf("  day: %s\n", descr.AWKExpr.Day))
+			sb.WriteString(fmt.Sprintf("  hhmm: %s\n", descr.AWKExpr.HHMM))
+			sb.WriteString(fmt.Sprintf("  minute key: %s\n", descr.AWKExpr.MinuteKey))
+		}
+
+		if tfInfo.Err != "" {
+			sb.WriteString(fmt.Sprintf("Error: %s\n", tfInfo.Err))
+		}
+
+		if len(tfInfo.ExampleLogLines) > 0 {
+			sb.WriteString("Example log lines:\n")
+			for _, line := range tfInfo.ExampleLogLines {
+				sb.WriteString(line)
+				sb.WriteString("\n")
+			}
+		}
+	}
+
+	ret := sb.String()
+	if ret == "" {
+		ret = "-- No time format info --"
+	}
+
+	return ret
+}
+
+func formatTimestampLocation(loc core.TimestampLocation) string {
+	switch {
+	case loc.Field != 0:
+		return fmt.Sprintf("field %d", loc.Field)
+	case loc.Regex != "":
+		return fmt.Sprintf("after the regex %q", loc.Regex)
+	default:
+		return "beginning of the line"
+	}
+}
+
+func (mv *MainView) showTimeFormatInfo() {
+	// NOTE: escaping, since the awk expressions and log lines contain brackets
+	// which would otherwise be interpreted as tview tags.
+	text := tview.Escape(mv.getTimeFormatInfo())
+
+	mv.showMessagebox("time_format_info", "Time format info", text, &MessageboxParams{
+		BackgroundColor: tcell.ColorDarkBlue,
+		CopyButton:      true,
+	})
+}
+
 func (mv *MainView) formatLogs() {
 	resp := mv.curLogResp
 	if resp == nil {
@@ -1481,7 +1602,7 @@ func (mv *MainView) formatLogs() {
 			case FieldNameTime:
 				cell = newTableCellLogmsg(timeStr).SetTextColor(tcell.ColorLightBlue)
 			case FieldNameMessage:
-				cell = newTableCellLogmsg(tview.Escape(msg.Msg)).SetTextColor(msgColor)
+				cell = newTableCellLogmsg(formatMultilineValue(msg.Msg)).SetTextColor(msgColor)
 			default:
 				cell = newTableCellLogmsg(msg.Context[colName]).SetTextColor(msgColor)
 			}
@@ -1522,6 +1643,16 @@ func (mv *MainView) bumpStatusLineLeft() {
 	sb.WriteString(" ")
 	sb.WriteString(getStatuslineNumStr("🖳", numOther, "red"))
 
+	if numGivenUp := len(lsmanState.LStreamsByState[core.LStreamClientStateGivenUp]); numGivenUp > 0 {
+		sb.WriteString(fmt.Sprintf(" | [red]%d given up[-] (:retry)", numGivenUp))
+	}
+
+	if !mv.curLogRespCachedAt.IsZero() {
+		sb.WriteString(" | [yellow]cached at ")
+		sb.WriteString(mv.curLogRespCachedAt.In(mv.params.Options.GetTimezone()).Format("15:04"))
+		sb.WriteString("[-]")
+	}
+
 	sb.WriteString(" | ")
 	sb.WriteString(mv.lstreamsSpec)
 
@@ -1720,6 +1851,24 @@ func (mv *MainView) doQuery(params doQueryParams) {
 	})
 }
 
+// loadEarlier requests to load more (older) logs for the current query.
+func (mv *MainView) loadEarlier() {
+	// Do the query to core
+	mv.params.OnLogQuery(core.QueryLogsParams{
+		From:  mv.actualFrom,
+		To:    mv.actualToForQuery,
+		Query: mv.query,
+
+		LoadEarlier: true,
+	})
+
+	// Update the cell text
+	mv.logsTable.SetCell(
+		rowIdxLoadOlder, 0,
+		newTableCellButton("... loading ..."),
+	)
+}
+
 func (mv *MainView) DoQuery(dqp doQueryParams) {
 	mv.params.App.QueueUpdateDraw(func() {
 		mv.doQuery(dqp)
@@ -2001,6 +2150,12 @@ func (mv *MainView) openQueryEditView() {
 	mv.queryEditView.Show(mv.getQueryFull())
 }
 
+// retry makes the logstreams which have given up reconnecting start
+// reconnecting again.
+func (mv *MainView) retry() {
+	mv.params.OnRetryRequest()
+}
+
 func (mv *MainView) disconnect() {
 	mv.curLogResp = nil
 	mv.sendLStreamsChangeOnNextQuery = true
@@ -2009,13 +2164,12 @@ func (mv *MainView) disconnect() {
 
 // handleQueryError shows the right messagebox based on the error cause.
 func (mv *MainView) handleQueryError(err error) {
-	if errors.Cause(err) == core.ErrBusyWithAnotherQuery ||
-		errors.Cause(err) == core.ErrNotYetConnected {
-		// In this particular error ("busy with another query"), show a dialog
-		// with the additional button "Details", which can be used to open the
-		// details of the query in progress.
+	if errors.Cause(err) == core.ErrNotYetConnected {
+		// In this particular error ("not connected yet"), show a dialog with the
+		// additional button "Details", which can be used to open the details of
+		// the connection in progress.
 
-		msgID := "busyWithAnotherQuery"
+		msgID := "notYetConnected"
 
 		mv.showMessagebox(
 			msgID,
@@ -2144,3 +2298,19 @@ func (mv *MainView) timezoneStr(referenceTime time.Time) string {
 
 	return zone
 }
+
+// formatMultilineValue returns the escaped value to be shown in a table cell:
+// for multi-line values (like grouped stack traces), only the first line is
+// shown, followed by the number of the remaining lines; the full value can be
+// seen in the row details.
+func formatMultilineValue(val string) string {
+	idx := strings.IndexByte(val, '\n')
+	if idx < 0 {
+		return tview.Escape(val)
+	}
+
+	return fmt.Sprintf(
+		"%s [lightgray::i](+%d lines)[-::-]",
+		tview.Escape(val[:idx]), strings.Count(val[idx:], "\n"),
+	)
+}
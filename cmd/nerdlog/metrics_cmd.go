@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dimonomid/nerdlog/client"
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+	"github.com/spf13/pflag"
+)
+
+// metricsCmdParams are the params for the "nerdlog metrics" command.
+type metricsCmdParams struct {
+	headlessParams
+
+	config *MetricsConfig
+
+	listen         string
+	interval       time.Duration
+	recountWindow  time.Duration
+	connectTimeout time.Duration
+}
+
+// runMetricsCmd runs the "nerdlog metrics" command: it connects to the
+// logstreams, periodically runs the queries from the config, and serves the
+// match counts in the Prometheus text format. Returns the exit code.
+func runMetricsCmd(args []string, homeDir string) int {
+	fs := pflag.NewFlagSet("metrics", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: nerdlog metrics --config <file> [flags]\n\nPeriodically runs the queries from the config, and serves the match counts in the Prometheus text format at /metrics.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+
+	flags := addCommonFlags(fs, homeDir)
+
+	var (
+		flagConfig         = fs.String("config", "", "Metrics config file with the named queries (required)")
+		flagListen         = fs.String("listen", "127.0.0.1:9797", "Address to serve the metrics at")
+		flagInterval       = fs.Duration("interval", 1*time.Minute, "How often to run the queries")
+		flagRecountWindow  = fs.Duration("recount-window", 3*time.Minute, "How far back the minutes are queried again, to count the lines written late or coming from logstreams which were failing")
+		flagConnectTimeout = fs.Duration("connect-timeout", 1*time.Minute, "How long to wait for all logstreams to connect initially")
+	)
+
+	if err := fs.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+
+		return 2
+	}
+
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Error: unexpected arguments: %q\n", fs.Args())
+		return 2
+	}
+
+	if *flagConfig == "" {
+		fmt.Fprintf(os.Stderr, "Error: --config is required\n")
+		return 2
+	}
+
+	if *flagInterval < time.Second {
+		fmt.Fprintf(os.Stderr, "Error: --interval can't be less than 1s\n")
+		return 2
+	}
+
+	if *flagRecountWindow < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --recount-window can't be negative\n")
+		return 2
+	}
+
+	hp, err := headlessParamsFromFlags(flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 2
+	}
+
+	cfg, err := loadMetricsConfig(*flagConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 2
+	}
+
+	params := metricsCmdParams{
+		headlessParams: hp,
+
+		config: cfg,
+
+		listen:         *flagListen,
+		interval:       *flagInterval,
+		recountWindow:  *flagRecountWindow,
+		connectTimeout: *flagConnectTimeout,
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := runMetrics(ctx, params); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func runMetrics(ctx context.Context, params metricsCmdParams) error {
+	options, err := params.newOptions()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	listener, err := net.Listen("tcp", params.listen)
+	if err != nil {
+		return errors.Annotatef(err, "listening")
+	}
+
+	c, err := params.newClient(options.GetAll())
+	if err != nil {
+		listener.Close()
+		return errors.Trace(err)
+	}
+	defer c.Close()
+
+	mc := newMetricsCollector(params.config.Queries, params.recountWindow, time.Now())
+
+	srv := &http.Server{Handler: mc}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(listener)
+	}()
+
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "Serving the metrics at http://%s/metrics\n", listener.Addr())
+
+	connectCtx, cancel := context.WithTimeout(ctx, params.connectTimeout)
+	defer cancel()
+
+	if err := c.WaitConnected(connectCtx); err != nil {
+		if errors.Cause(err) == context.DeadlineExceeded {
+			return errors.Errorf("timed out connecting: %s", formatConnErrs(c.State()))
+		}
+
+		return errors.Annotatef(err, "connecting")
+	}
+
+	ticker := time.NewTicker(params.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case err := <-errCh:
+			return errors.Annotatef(err, "serving")
+		case <-ctx.Done():
+			return nil
+		}
+
+		for _, q := range params.config.Queries {
+			if err := runMetricsQuery(ctx, c, mc, q); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+
+				fmt.Fprintf(os.Stderr, "Error: query %q: %s\n", q.Name, err)
+			}
+		}
+	}
+}
+
+// runMetricsQuery runs the query for the minutes which weren't counted yet,
+// and updates the collector.
+func runMetricsQuery(
+	ctx context.Context, c *client.Client, mc *metricsCollector, q MetricsQueryConfig,
+) error {
+	now := time.Now()
+
+	from, to, ok := mc.nextRange(q.Name, now)
+	if !ok {
+		return nil
+	}
+
+	resp, err := c.Query(ctx, core.QueryLogsParams{
+		// We only need the stats, but at least one log line is always
+		// requested, so keep it to a minimum.
+		MaxNumLines: 1,
+		From:        from,
+		To:          to,
+		Query:       q.Pattern,
+	})
+	if err != nil {
+		mc.updateFailed(q.Name)
+		return err
+	}
+
+	mc.update(q.Name, resp, from, to, now)
+
+	return nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// MetricsConfig is the config for "nerdlog metrics": the list of named
+// queries whose match counts should be exported.
+type MetricsConfig struct {
+	Queries []MetricsQueryConfig `yaml:"queries"`
+}
+
+// MetricsQueryConfig is a single named query.
+type MetricsQueryConfig struct {
+	// Name is used as the "query" label value.
+	Name string `yaml:"name"`
+
+	// Pattern is the awk pattern, same as in the UI, like "/OOM/".
+	Pattern string `yaml:"pattern"`
+}
+
+func loadMetricsConfig(path string) (*MetricsConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "reading metrics config %s", path)
+	}
+
+	var cfg MetricsConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, errors.Annotatef(err, "unmarshaling yaml from %s", path)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, errors.Annotatef(err, "%s", path)
+	}
+
+	return &cfg, nil
+}
+
+func (cfg *MetricsConfig) validate() error {
+	if len(cfg.Queries) == 0 {
+		return errors.Errorf("no queries")
+	}
+
+	names := map[string]struct{}{}
+	for i, q := range cfg.Queries {
+		if q.Name == "" {
+			return errors.Errorf("query #%d: name is empty", i+1)
+		}
+
+		if _, ok := names[q.Name]; ok {
+			return errors.Errorf("query %q: duplicate name", q.Name)
+		}
+
+		names[q.Name] = struct{}{}
+	}
+
+	return nil
+}
+
+// metricsQueryState is the state of a single named query.
+type metricsQueryState struct {
+	// startedAt is the minute since which the matches are counted; the earlier
+	// minutes are never queried.
+	startedAt time.Time
+
+	// countedUntil is the time until which (exclusively) the minutes were
+	// already counted; the next query should start from here, or earlier if
+	// the minutes within the recount window need to be queried again.
+	countedUntil time.Time
+
+	// matchesByLStream is the total number of matches so far, per logstream.
+	matchesByLStream map[string]int
+
+	// recentByLStream contains, per logstream, the number of matches already
+	// counted for every minute (as a unix timestamp) within the recount
+	// window, so that when these minutes are queried again, only the
+	// difference is added.
+	recentByLStream map[string]map[int64]int
+
+	numErrors   int
+	lastSuccess time.Time
+}
+
+// metricsCollector keeps the counters for all the named queries, and serves
+// them in the Prometheus text format.
+type metricsCollector struct {
+	queries []MetricsQueryConfig
+
+	// recountWindow is how far back (from the beginning of the current minute)
+	// the minutes are queried again, to count the lines which were written
+	// (or became available, e.g. because the logstream reconnected) late.
+	recountWindow time.Duration
+
+	mtx    sync.Mutex
+	states map[string]*metricsQueryState
+}
+
+// newMetricsCollector creates a collector which starts counting from the
+// minute containing now; the earlier minutes are never counted, so that the
+// counters start from zero, as Prometheus expects.
+func newMetricsCollector(
+	queries []MetricsQueryConfig, recountWindow time.Duration, now time.Time,
+) *metricsCollector {
+	mc := &metricsCollector{
+		queries:       queries,
+		recountWindow: recountWindow,
+		states:        make(map[string]*metricsQueryState, len(queries)),
+	}
+
+	for _, q := range queries {
+		mc.states[q.Name] = &metricsQueryState{
+			startedAt:        now.Truncate(time.Minute),
+			countedUntil:     now.Truncate(time.Minute),
+			matchesByLStream: map[string]int{},
+			recentByLStream:  map[string]map[int64]int{},
+		}
+	}
+
+	return mc
+}
+
+// nextRange returns the time range which should be queried next for the
+// given query: from the last counted minute (or from the beginning of the
+// recount window, whichever is earlier) until the beginning of the current
+// minute, since the current one is not complete yet. If there's nothing to
+// query yet, ok is false.
+func (mc *metricsCollector) nextRange(queryName string, now time.Time) (from, to time.Time, ok bool) {
+	mc.mtx.Lock()
+	defer mc.mtx.Unlock()
+
+	st := mc.states[queryName]
+
+	to = now.Truncate(time.Minute)
+	from = st.countedUntil
+	if recountFrom := mc.recountFrom(to); recountFrom.Before(from) {
+		from = recountFrom
+	}
+
+	if from.Before(st.startedAt) {
+		from = st.startedAt
+	}
+
+	return from, to, to.After(from)
+}
+
+// recountFrom returns the beginning of the recount window, given its end.
+func (mc *metricsCollector) recountFrom(to time.Time) time.Time {
+	return to.Add(-mc.recountWindow).Truncate(time.Minute)
+}
+
+// update adds the counts from the resp for the range [from, to), which must be
+// the same range as returned by nextRange. For the minutes which were already
+// counted before, only the new matches (if any) are added.
+func (mc *metricsCollector) update(
+	queryName string, resp *core.LogRespTotal, from, to, now time.Time,
+) {
+	mc.mtx.Lock()
+	defer mc.mtx.Unlock()
+
+	st := mc.states[queryName]
+
+	for lstream, minuteStats := range resp.MinuteStatsByLStream {
+		// Make sure that every logstream has a series, even if there were no
+		// matches yet.
+		st.matchesByLStream[lstream] += 0
+
+		recent := st.recentByLStream[lstream]
+		if recent == nil {
+			recent = map[int64]int{}
+			st.recentByLStream[lstream] = recent
+		}
+
+		for minute, item := range minuteStats {
+			t := time.Unix(minute, 0)
+			if t.Before(from) || !t.Before(to) {
+				continue
+			}
+
+			// The counters can only go up, so if there are fewer matches than
+			// before (e.g. the logs were rotated away), just ignore it.
+			if item.NumMsgs > recent[minute] {
+				st.matchesByLStream[lstream] += item.NumMsgs - recent[minute]
+				recent[minute] = item.NumMsgs
+			}
+		}
+	}
+
+	// Forget the minutes which won't be queried again.
+	recountFrom := mc.recountFrom(to)
+	for _, recent := range st.recentByLStream {
+		for minute := range recent {
+			if time.Unix(minute, 0).Before(recountFrom) {
+				delete(recent, minute)
+			}
+		}
+	}
+
+	st.countedUntil = to
+	st.lastSuccess = now
+}
+
+// updateFailed records that the query has failed; the range will be queried
+// again next time.
+func (mc *metricsCollector) updateFailed(queryName string) {
+	mc.mtx.Lock()
+	defer mc.mtx.Unlock()
+
+	mc.states[queryName].numErrors++
+}
+
+// writeTo writes all the metrics in the Prometheus text format.
+func (mc *metricsCollector) writeTo(w io.Writer) error {
+	mc.mtx.Lock()
+	defer mc.mtx.Unlock()
+
+	var sb strings.Builder
+
+	sb.WriteString("# HELP nerdlog_query_matches_total Number of messages matching the query, counted by whole minutes.\n")
+	sb.WriteString("# TYPE nerdlog_query_matches_total counter\n")
+	for _, q := range mc.queries {
+		st := mc.states[q.Name]
+
+		lstreams := make([]string, 0, len(st.matchesByLStream))
+		for lstream := range st.matchesByLStream {
+			lstreams = append(lstreams, lstream)
+		}
+		sort.Strings(lstreams)
+
+		for _, lstream := range lstreams {
+			fmt.Fprintf(
+				&sb, "nerdlog_query_matches_total{query=\"%s\",lstream=\"%s\"} %d\n",
+				promLabelEscaper.Replace(q.Name), promLabelEscaper.Replace(lstream),
+				st.matchesByLStream[lstream],
+			)
+		}
+	}
+
+	sb.WriteString("# HELP nerdlog_query_errors_total Number of times the query has failed.\n")
+	sb.WriteString("# TYPE nerdlog_query_errors_total counter\n")
+	for _, q := range mc.queries {
+		fmt.Fprintf(
+			&sb, "nerdlog_query_errors_total{query=\"%s\"} %d\n",
+			promLabelEscaper.Replace(q.Name), mc.states[q.Name].numErrors,
+		)
+	}
+
+	sb.WriteString("# HELP nerdlog_query_last_success_timestamp_seconds When the query last succeeded, as a unix timestamp; 0 if never.\n")
+	sb.WriteString("# TYPE nerdlog_query_last_success_timestamp_seconds gauge\n")
+	for _, q := range mc.queries {
+		var ts int64
+		if lastSuccess := mc.states[q.Name].lastSuccess; !lastSuccess.IsZero() {
+			ts = lastSuccess.Unix()
+		}
+
+		fmt.Fprintf(
+			&sb, "nerdlog_query_last_success_timestamp_seconds{query=\"%s\"} %d\n",
+			promLabelEscaper.Replace(q.Name), ts,
+		)
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return errors.Trace(err)
+}
+
+func (mc *metricsCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mc.writeTo(w)
+}
+
+// promLabelEscaper escapes the label values as per the Prometheus text
+// format.
+var promLabelEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	"\"", "\\\"",
+	"\n", "\\n",
+)
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsCollector(t *testing.T) {
+	minute := func(mm int) time.Time {
+		return time.Date(2025, 4, 18, 18, mm, 0, 0, time.UTC)
+	}
+
+	queries := []MetricsQueryConfig{
+		{Name: "oom", Pattern: "/OOM/"},
+		{Name: `5xx "errors"`, Pattern: "/5[0-9][0-9] /"},
+	}
+
+	// Without the recount window, every minute is only queried once.
+	mc := newMetricsCollector(queries, 0, minute(10).Add(30*time.Second))
+
+	// The current minute is not complete yet, so there's nothing to query.
+	_, _, ok := mc.nextRange("oom", minute(10).Add(50*time.Second))
+	assert.False(t, ok)
+
+	from, to, ok := mc.nextRange("oom", minute(12).Add(5*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, minute(10), from)
+	assert.Equal(t, minute(12), to)
+
+	mc.update("oom", &core.LogRespTotal{
+		MinuteStatsByLStream: map[string]map[int64]core.MinuteStatsItem{
+			"host-01": {
+				minute(10).Unix(): {NumMsgs: 2},
+				minute(11).Unix(): {NumMsgs: 1},
+				// Out of range, must be ignored.
+				minute(12).Unix(): {NumMsgs: 100},
+			},
+			"host-02": nil,
+		},
+	}, from, to, minute(12).Add(5*time.Second))
+
+	// Next time, only the newer minutes are queried.
+	from, to, ok = mc.nextRange("oom", minute(13).Add(5*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, minute(12), from)
+	assert.Equal(t, minute(13), to)
+
+	mc.update("oom", &core.LogRespTotal{
+		MinuteStatsByLStream: map[string]map[int64]core.MinuteStatsItem{
+			"host-01": nil,
+			"host-02": {minute(12).Unix(): {NumMsgs: 4}},
+		},
+	}, from, to, minute(13).Add(5*time.Second))
+
+	mc.updateFailed(`5xx "errors"`)
+
+	var buf bytes.Buffer
+	assert.NoError(t, mc.writeTo(&buf))
+	assert.Equal(t, `# HELP nerdlog_query_matches_total Number of messages matching the query, counted by whole minutes.
+# TYPE nerdlog_query_matches_total counter
+nerdlog_query_matches_total{query="oom",lstream="host-01"} 3
+nerdlog_query_matches_total{query="oom",lstream="host-02"} 4
+# HELP nerdlog_query_errors_total Number of times the query has failed.
+# TYPE nerdlog_query_errors_total counter
+nerdlog_query_errors_total{query="oom"} 0
+nerdlog_query_errors_total{query="5xx \"errors\""} 1
+# HELP nerdlog_query_last_success_timestamp_seconds When the query last succeeded, as a unix timestamp; 0 if never.
+# TYPE nerdlog_query_last_success_timestamp_seconds gauge
+nerdlog_query_last_success_timestamp_seconds{query="oom"} 1744999985
+nerdlog_query_last_success_timestamp_seconds{query="5xx \"errors\""} 0
+`, buf.String())
+
+	rec := httptest.NewRecorder()
+	mc.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, buf.String(), rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	mc.ServeHTTP(rec, httptest.NewRequest("GET", "/foo", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestMetricsCollectorRecount(t *testing.T) {
+	minute := func(mm int) time.Time {
+		return time.Date(2025, 4, 18, 18, mm, 0, 0, time.UTC)
+	}
+
+	queries := []MetricsQueryConfig{{Name: "oom", Pattern: "/OOM/"}}
+	mc := newMetricsCollector(queries, 2*time.Minute, minute(10).Add(30*time.Second))
+
+	matches := func() map[string]int {
+		return mc.states["oom"].matchesByLStream
+	}
+
+	// The recount window doesn't go beyond the start.
+	from, to, ok := mc.nextRange("oom", minute(11).Add(5*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, minute(10), from)
+	assert.Equal(t, minute(11), to)
+
+	mc.update("oom", &core.LogRespTotal{
+		MinuteStatsByLStream: map[string]map[int64]core.MinuteStatsItem{
+			"host-01": {minute(10).Unix(): {NumMsgs: 2}},
+			"host-02": nil,
+		},
+	}, from, to, minute(11).Add(5*time.Second))
+	assert.Equal(t, map[string]int{"host-01": 2, "host-02": 0}, matches())
+
+	// The minutes within the window are queried again, and the late lines are
+	// counted, but the ones counted already are not counted twice.
+	from, to, ok = mc.nextRange("oom", minute(12).Add(5*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, minute(10), from)
+	assert.Equal(t, minute(12), to)
+
+	mc.update("oom", &core.LogRespTotal{
+		MinuteStatsByLStream: map[string]map[int64]core.MinuteStatsItem{
+			"host-01": {
+				minute(10).Unix(): {NumMsgs: 3},
+				minute(11).Unix(): {NumMsgs: 1},
+			},
+			// host-02 was disconnected before, and now it has its logs available.
+			"host-02": {minute(10).Unix(): {NumMsgs: 5}},
+		},
+	}, from, to, minute(12).Add(5*time.Second))
+	assert.Equal(t, map[string]int{"host-01": 4, "host-02": 5}, matches())
+
+	// The window moves on, and the older minutes are forgotten.
+	from, to, ok = mc.nextRange("oom", minute(13).Add(5*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, minute(11), from)
+	assert.Equal(t, minute(13), to)
+
+	mc.update("oom", &core.LogRespTotal{
+		MinuteStatsByLStream: map[string]map[int64]core.MinuteStatsItem{
+			"host-01": {
+				// Fewer than before (e.g. rotated away), so it's ignored.
+				minute(11).Unix(): {NumMsgs: 0},
+				minute(12).Unix(): {NumMsgs: 1},
+			},
+		},
+	}, from, to, minute(13).Add(5*time.Second))
+	assert.Equal(t, map[string]int{"host-01": 5, "host-02": 5}, matches())
+	assert.Equal(t, map[string]map[int64]int{
+		"host-01": {minute(11).Unix(): 1, minute(12).Unix(): 1},
+		"host-02": {},
+	}, mc.states["oom"].recentByLStream)
+
+	// If the query keeps failing for longer than the window, the query starts
+	// from the last counted minute.
+	mc.updateFailed("oom")
+	from, to, ok = mc.nextRange("oom", minute(20).Add(5*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, minute(13), from)
+	assert.Equal(t, minute(20), to)
+}
+
+func TestMetricsConfigValidate(t *testing.T) {
+	cfg := MetricsConfig{}
+	assert.EqualError(t, cfg.validate(), "no queries")
+
+	cfg = MetricsConfig{Queries: []MetricsQueryConfig{{Pattern: "/foo/"}}}
+	assert.EqualError(t, cfg.validate(), "query #1: name is empty")
+
+	cfg = MetricsConfig{Queries: []MetricsQueryConfig{
+		{Name: "foo", Pattern: "/foo/"},
+		{Name: "foo", Pattern: "/bar/"},
+	}}
+	assert.EqualError(t, cfg.validate(), `query "foo": duplicate name`)
+}
@@ -18,6 +18,21 @@ type Options struct {
 	MaxNumLines int
 
 	DefaultTransportMode *core.TransportMode
+
+	// ReconnectPolicy is the default reconnect policy, which can be overridden
+	// per logstream in the logstreams config.
+	ReconnectPolicy core.ReconnectPolicy
+}
+
+// defaultOptions returns the options which nerdlog starts with, before any
+// --set flags or :set commands are applied.
+func defaultOptions() Options {
+	return Options{
+		Timezone:             time.Local,
+		MaxNumLines:          250,
+		DefaultTransportMode: core.NewTransportModeSSHLib(),
+		ReconnectPolicy:      core.DefaultReconnectPolicy,
+	}
 }
 
 type OptionsShared struct {
@@ -50,6 +65,12 @@ func (o *OptionsShared) GetTransportMode() *core.TransportMode {
 	return o.options.DefaultTransportMode
 }
 
+func (o *OptionsShared) GetReconnectPolicy() core.ReconnectPolicy {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.ReconnectPolicy
+}
+
 func (o *OptionsShared) GetAll() Options {
 	o.mtx.Lock()
 	defer o.mtx.Unlock()
@@ -124,6 +145,21 @@ var AllOptions = map[string]*OptionMeta{
 		},
 		Help: "How to connect to remote hosts",
 	}, // }}}
+	"reconnect": { // {{{
+		Get: func(o *Options) string {
+			return o.ReconnectPolicy.String()
+		},
+		Set: func(o *Options, value string) error {
+			policy, err := core.ParseReconnectPolicy(o.ReconnectPolicy, value)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			o.ReconnectPolicy = *policy
+			return nil
+		},
+		Help: "Reconnect policy, like \"initial=2s,multiplier=2,max=1m,attempts=0,jitter=0.2\"",
+	}, // }}}
 }
 
 func OptionMetaByName(name string) *OptionMeta {
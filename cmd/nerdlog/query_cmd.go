@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+
+	"github.com/dimonomid/nerdlog/client"
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+	"github.com/spf13/pflag"
+)
+
+// queryCmdParams are the params for the headless "nerdlog query" command.
+type queryCmdParams struct {
+	headlessParams
+
+	timeRange   string
+	pattern     string
+	selectQuery SelectQuery
+
+	format exportFormat
+
+	// If all is true, we keep loading earlier logs until everything is loaded,
+	// or maxNumLines is reached.
+	all         bool
+	maxNumLines int
+
+	// If stats is true, the number of messages per minute is printed after the
+	// logs.
+	stats bool
+
+	// If statsOut is not empty, the stats are also written to this file, as
+	// per statsParams; "-" means stdout, in which case the logs are not
+	// printed.
+	statsOut    string
+	statsParams statsExportParams
+
+	connectTimeout time.Duration
+}
+
+// runQueryCmd runs the headless "nerdlog query" command: it connects to the
+// logstreams, runs a single query, prints the results to stdout, and returns
+// the exit code.
+func runQueryCmd(args []string, homeDir string) int {
+	fs := pflag.NewFlagSet("query", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: nerdlog query [flags]\n\nRuns a single query without the TUI, and prints the results to stdout.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+
+	flags := addCommonFlags(fs, homeDir)
+	qFlags := addQueryFlags(fs)
+
+	var (
+		flagFormat          = fs.String("format", string(exportFormatRaw), "Output format: "+exportFormatsHelp)
+		flagAll             = fs.Bool("all", false, "Keep loading earlier logs until all of them are loaded, or --max-lines is reached")
+		flagMaxLines        = fs.Int("max-lines", defaultExportMaxNumLines, "With --all, the max number of log lines to print (the latest ones are printed); 0 means no limit")
+		flagStats           = fs.Bool("stats", false, "After the logs, also print the number of messages per minute")
+		flagStatsOut        = fs.String("stats-out", "", "Write the message counts to the given file (\"-\" for stdout, in which case the logs are not printed)")
+		flagStatsFormat     = fs.String("stats-format", "", "Format for --stats-out: csv or json; by default, implied by the file extension, or csv")
+		flagStatsInterval   = fs.String("stats-interval", defaultStatsInterval.String(), "Bucket size for --stats-out, must be a whole number of minutes which divides 24h")
+		flagStatsPerLStream = fs.Bool("stats-per-lstream", false, "For --stats-out, also break down the counts per logstream")
+		flagConnectTimeout  = fs.Duration("connect-timeout", 1*time.Minute, "How long to wait for all logstreams to connect")
+	)
+
+	if err := fs.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+
+		return 2
+	}
+
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Error: unexpected arguments: %q\n", fs.Args())
+		return 2
+	}
+
+	hp, err := headlessParamsFromFlags(flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 2
+	}
+
+	format, err := parseExportFormat(*flagFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --format: %s\n", err)
+		return 2
+	}
+
+	if *flagStats && (format == exportFormatCSV || format == exportFormatTSV) {
+		fmt.Fprintf(os.Stderr, "--stats is not supported with the %s format\n", format)
+		return 2
+	}
+
+	var statsParams statsExportParams
+	if *flagStatsOut != "" {
+		if *flagStats && *flagStatsOut == "-" {
+			fmt.Fprintf(os.Stderr, "--stats can't be used with --stats-out=-\n")
+			return 2
+		}
+
+		statsParams.format = statsFormatByFilename(*flagStatsOut)
+		if *flagStatsFormat != "" {
+			statsParams.format, err = parseStatsFormat(*flagStatsFormat)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid --stats-format: %s\n", err)
+				return 2
+			}
+		}
+
+		statsParams.interval, err = parseStatsInterval(*flagStatsInterval)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --stats-interval: %s\n", err)
+			return 2
+		}
+
+		statsParams.perLStream = *flagStatsPerLStream
+	}
+
+	params := queryCmdParams{
+		headlessParams: hp,
+
+		timeRange:   *qFlags.time,
+		pattern:     *qFlags.pattern,
+		selectQuery: SelectQuery(*qFlags.selectQuery),
+
+		format:      format,
+		all:         *flagAll,
+		maxNumLines: *flagMaxLines,
+		stats:       *flagStats,
+
+		statsOut:    *flagStatsOut,
+		statsParams: statsParams,
+
+		connectTimeout: *flagConnectTimeout,
+	}
+
+	if params.timeRange == "" {
+		params.timeRange = "-1h"
+	}
+
+	if params.selectQuery == "" {
+		params.selectQuery = DefaultSelectQuery
+	}
+
+	// Cancel the query on Ctrl+C, so that it doesn't keep running on the hosts.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if err := runQuery(ctx, params, os.Stdout); err != nil {
+		if qErr, ok := errors.Cause(err).(*client.QueryError); ok {
+			for _, e := range qErr.Errs {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		}
+
+		return 1
+	}
+
+	return 0
+}
+
+func runQuery(ctx context.Context, params queryCmdParams, out io.Writer) error {
+	sqp, err := ParseSelectQuery(params.selectQuery)
+	if err != nil {
+		return errors.Annotatef(err, "select query")
+	}
+
+	options, err := params.newOptions()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	opts := options.GetAll()
+
+	ftr, err := ParseFromToRange(opts.Timezone, params.timeRange)
+	if err != nil {
+		return errors.Annotatef(err, "time")
+	}
+
+	c, err := params.newClient(opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer c.Close()
+
+	connectCtx, cancel := context.WithTimeout(ctx, params.connectTimeout)
+	defer cancel()
+
+	if err := c.WaitConnected(connectCtx); err != nil {
+		if errors.Cause(err) == context.DeadlineExceeded {
+			return errors.Errorf("timed out connecting: %s", formatConnErrs(c.State()))
+		}
+
+		return errors.Annotatef(err, "connecting")
+	}
+
+	now := time.Now()
+	from, to := ftr.QueryRange(now)
+	queryParams := core.QueryLogsParams{
+		MaxNumLines: opts.MaxNumLines,
+		From:        from,
+		To:          to,
+		Query:       params.pattern,
+	}
+
+	var resp *core.LogRespTotal
+	if params.all {
+		resp, err = c.QueryAll(ctx, queryParams, params.maxNumLines)
+	} else {
+		resp, err = c.Query(ctx, queryParams)
+	}
+	if err != nil {
+		return err
+	}
+
+	printLuaErrors(resp)
+
+	w := bufio.NewWriter(out)
+
+	if params.statsOut != "" {
+		sp := params.statsParams
+		sp.tz = opts.Timezone
+		sp.from = from
+		sp.to = to
+		if sp.to.IsZero() {
+			sp.to = truncateCeil(now, time.Minute)
+		}
+
+		if params.statsOut == "-" {
+			if err := writeStats(w, resp, sp); err != nil {
+				return errors.Annotatef(err, "writing stats")
+			}
+
+			return errors.Annotatef(w.Flush(), "writing stats")
+		}
+
+		if err := writeStatsToFile(params.statsOut, resp, sp); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if err := writeQueryResult(w, resp, params.format, sqp, params.stats, opts.Timezone); err != nil {
+		return errors.Annotatef(err, "writing results")
+	}
+
+	if err := w.Flush(); err != nil {
+		return errors.Annotatef(err, "writing results")
+	}
+
+	if len(resp.Logs) < resp.NumMsgsTotal && !params.all {
+		fmt.Fprintf(
+			os.Stderr, "Printed %d out of %d messages; use --all to load more\n",
+			len(resp.Logs), resp.NumMsgsTotal,
+		)
+	}
+
+	return nil
+}
+
+// writeQueryResult writes the logs from the resp in the given format, and if
+// stats is true, the number of messages per minute after that.
+func writeQueryResult(
+	w io.Writer,
+	resp *core.LogRespTotal,
+	format exportFormat,
+	sqp *SelectQueryParsed,
+	stats bool,
+	tz *time.Location,
+) error {
+	if err := writeLogs(w, resp.Logs, format, sqp, tz); err != nil {
+		return errors.Trace(err)
+	}
+
+	if !stats {
+		return nil
+	}
+
+	minutes := make([]int64, 0, len(resp.MinuteStats))
+	for minute := range resp.MinuteStats {
+		minutes = append(minutes, minute)
+	}
+	sort.Slice(minutes, func(i, j int) bool { return minutes[i] < minutes[j] })
+
+	if format != exportFormatJSONL && len(minutes) > 0 {
+		if _, err := fmt.Fprintln(w, "# minute stats"); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	for _, minute := range minutes {
+		minuteStr := time.Unix(minute, 0).In(tz).Format(time.RFC3339)
+		numMsgs := resp.MinuteStats[minute].NumMsgs
+
+		var err error
+
+		switch format {
+		case exportFormatJSONL:
+			err = writeJSONObject(w, []logMsgField{
+				{name: "minute", value: minuteStr},
+				{name: "num_msgs", value: json.Number(fmt.Sprint(numMsgs))},
+			})
+		default:
+			_, err = fmt.Fprintf(w, "%s %d\n", minuteStr, numMsgs)
+		}
+
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteQueryResult(t *testing.T) {
+	resp := &core.LogRespTotal{
+		MinuteStats: map[int64]core.MinuteStatsItem{
+			1745000040: {NumMsgs: 3},
+			1744999980: {NumMsgs: 1},
+		},
+		Logs: []core.LogMsg{
+			{
+				Time: time.Date(2025, 4, 18, 18, 13, 5, 0, time.UTC),
+				Msg:  "hello \"world\"",
+				Context: map[string]string{
+					"lstream":    "host-01",
+					"level_name": "info",
+					"pid":        "123",
+				},
+				OrigLine: "Apr 18 18:13:05 host-01 myapp[123]: hello \"world\"",
+			},
+			{
+				Time: time.Date(2025, 4, 18, 18, 14, 0, 0, time.UTC),
+				Msg:  "bye",
+				Context: map[string]string{
+					"lstream": "host-02",
+				},
+				OrigLine: "Apr 18 18:14:00 host-02 myapp: bye",
+			},
+		},
+	}
+
+	type testCase struct {
+		descr string
+
+		format      exportFormat
+		selectQuery SelectQuery
+		stats       bool
+
+		want string
+	}
+
+	testCases := []testCase{
+		{
+			descr:       "raw",
+			format:      exportFormatRaw,
+			selectQuery: DefaultSelectQuery,
+			want: "Apr 18 18:13:05 host-01 myapp[123]: hello \"world\"\n" +
+				"Apr 18 18:14:00 host-02 myapp: bye\n",
+		},
+		{
+			descr:       "raw with stats",
+			format:      exportFormatRaw,
+			selectQuery: DefaultSelectQuery,
+			stats:       true,
+			want: "Apr 18 18:13:05 host-01 myapp[123]: hello \"world\"\n" +
+				"Apr 18 18:14:00 host-02 myapp: bye\n" +
+				"# minute stats\n" +
+				"2025-04-18T18:13:00Z 1\n" +
+				"2025-04-18T18:14:00Z 3\n",
+		},
+		{
+			descr:       "jsonl with all fields",
+			format:      exportFormatJSONL,
+			selectQuery: DefaultSelectQuery,
+			want: `{"time":"2025-04-18T18:13:05Z","message":"hello \"world\"","lstream":"host-01","level_name":"info","pid":"123"}` + "\n" +
+				`{"time":"2025-04-18T18:14:00Z","message":"bye","lstream":"host-02"}` + "\n",
+		},
+		{
+			descr:       "jsonl with explicit fields and stats",
+			format:      exportFormatJSONL,
+			selectQuery: "lstream AS host, level_name AS level, message",
+			stats:       true,
+			want: `{"host":"host-01","level":"info","message":"hello \"world\""}` + "\n" +
+				`{"host":"host-02","message":"bye"}` + "\n" +
+				`{"minute":"2025-04-18T18:13:00Z","num_msgs":1}` + "\n" +
+				`{"minute":"2025-04-18T18:14:00Z","num_msgs":3}` + "\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.descr, func(t *testing.T) {
+			sqp, err := ParseSelectQuery(tc.selectQuery)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			var buf bytes.Buffer
+			err = writeQueryResult(&buf, resp, tc.format, sqp, tc.stats, time.UTC)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, buf.String())
+		})
+	}
+}
+
+func TestFromToRangeQueryRange(t *testing.T) {
+	now := time.Date(2025, 4, 18, 18, 13, 5, 0, time.UTC)
+
+	ftr, err := ParseFromToRange(time.UTC, "-1h")
+	assert.NoError(t, err)
+
+	from, to := ftr.QueryRange(now)
+	assert.Equal(t, time.Date(2025, 4, 18, 17, 14, 0, 0, time.UTC), from)
+	assert.True(t, to.IsZero())
+
+	// Positive durations are reversed, and from/to are swapped if needed.
+	ftr, err = ParseFromToRange(time.UTC, "1h to 2h")
+	assert.NoError(t, err)
+
+	from, to = ftr.QueryRange(now)
+	assert.Equal(t, time.Date(2025, 4, 18, 16, 14, 0, 0, time.UTC), from)
+	assert.Equal(t, time.Date(2025, 4, 18, 17, 14, 0, 0, time.UTC), to)
+}
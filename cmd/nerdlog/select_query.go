@@ -1,8 +1,10 @@
 package main
 
 import (
+	"sort"
 	"strings"
 
+	"github.com/dimonomid/nerdlog/core"
 	"github.com/juju/errors"
 )
 
@@ -153,3 +155,54 @@ func (sqp *SelectQueryParsed) Marshal() SelectQuery {
 
 	return SelectQuery(sb.String())
 }
+
+// Columns returns the fields to show as columns for the given messages: first
+// all the explicitly selected fields, with the sticky ones moved to the front,
+// and then, if IncludeAll is set, all the other fields present in the
+// messages, in lexicographical order.
+func (sqp *SelectQueryParsed) Columns(msgs []core.LogMsg) []SelectQueryField {
+	fields := make([]SelectQueryField, 0, len(sqp.Fields))
+	fields = append(fields, sqp.Fields...)
+
+	// Move sticky ones to the front
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fields[i].Sticky && !fields[j].Sticky
+	})
+
+	if !sqp.IncludeAll {
+		return fields
+	}
+
+	explicit := make(map[string]struct{}, len(fields))
+	for _, v := range fields {
+		explicit[v.Name] = struct{}{}
+	}
+
+	existingTags := map[string]struct{}{
+		FieldNameTime:    {},
+		FieldNameMessage: {},
+	}
+	for _, msg := range msgs {
+		for name := range msg.Context {
+			existingTags[name] = struct{}{}
+		}
+	}
+
+	var implicitFields []SelectQueryField
+	for v := range existingTags {
+		if _, ok := explicit[v]; ok {
+			continue
+		}
+
+		implicitFields = append(implicitFields, SelectQueryField{
+			Name:        v,
+			DisplayName: v,
+		})
+	}
+
+	sort.Slice(implicitFields, func(i, j int) bool {
+		return implicitFields[i].Name < implicitFields[j].Name
+	})
+
+	return append(fields, implicitFields...)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+	"github.com/spf13/pflag"
+)
+
+// serveCmdParams are the params for the "nerdlog serve" command.
+type serveCmdParams struct {
+	headlessParams
+
+	listen         string
+	token          string
+	connectTimeout time.Duration
+}
+
+// runServeCmd runs the "nerdlog serve" command: it connects to the
+// logstreams and serves the HTTP/JSON API until interrupted, and returns the
+// exit code.
+func runServeCmd(args []string, homeDir string) int {
+	fs := pflag.NewFlagSet("serve", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: nerdlog serve [flags]\n\nServes the HTTP/JSON API to query the logstreams.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+
+	flags := addCommonFlags(fs, homeDir)
+
+	var (
+		flagListen         = fs.String("listen", "127.0.0.1:8080", "Address to listen at")
+		flagToken          = fs.String("token", "", "If set, every request must have the header 'Authorization: Bearer <token>'. Can also be set via the NERDLOG_API_TOKEN environment variable")
+		flagConnectTimeout = fs.Duration("connect-timeout", 30*time.Second, "How long a query waits for all logstreams to connect")
+	)
+
+	if err := fs.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+
+		return 2
+	}
+
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Error: unexpected arguments: %q\n", fs.Args())
+		return 2
+	}
+
+	hp, err := headlessParamsFromFlags(flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 2
+	}
+
+	params := serveCmdParams{
+		headlessParams: hp,
+
+		listen:         *flagListen,
+		token:          *flagToken,
+		connectTimeout: *flagConnectTimeout,
+	}
+
+	if params.token == "" {
+		params.token = os.Getenv("NERDLOG_API_TOKEN")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := runServe(ctx, params); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func runServe(ctx context.Context, params serveCmdParams) error {
+	options, err := params.newOptions()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	listener, err := net.Listen("tcp", params.listen)
+	if err != nil {
+		return errors.Annotatef(err, "listening")
+	}
+
+	if params.token == "" && !isLoopbackAddr(listener.Addr()) {
+		fmt.Fprintf(os.Stderr, "Warning: listening at non-loopback %s without a token, anyone who can reach it can query the logs\n", listener.Addr())
+	}
+
+	c, err := params.newClient(options.GetAll())
+	if err != nil {
+		listener.Close()
+		return errors.Trace(err)
+	}
+	defer c.Close()
+
+	srv := &http.Server{
+		Handler: newAPIServer(apiServerParams{
+			Client:   c,
+			Options:  options,
+			LStreams: params.lstreams,
+
+			Token:          params.token,
+			LoopbackOnly:   isLoopbackAddr(listener.Addr()),
+			ConnectTimeout: params.connectTimeout,
+
+			Logger: log.NewLogger(params.logLevel),
+		}),
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(listener)
+	}()
+
+	fmt.Fprintf(os.Stderr, "Serving the API at http://%s\n", listener.Addr())
+
+	select {
+	case err := <-errCh:
+		return errors.Annotatef(err, "serving")
+
+	case <-ctx.Done():
+	}
+
+	fmt.Fprintf(os.Stderr, "Shutting down...\n")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return errors.Annotatef(err, "shutting down")
+	}
+
+	return nil
+}
+
+func isLoopbackAddr(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
+}
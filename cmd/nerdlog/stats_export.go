@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+)
+
+// statsFormat is the format in which the minute stats are written by
+// :writestats and "nerdlog query --stats-out".
+type statsFormat string
+
+const (
+	// statsFormatCSV is a header followed by a row per bucket.
+	statsFormatCSV statsFormat = "csv"
+
+	// statsFormatJSON is a single JSON object with all the buckets.
+	statsFormatJSON statsFormat = "json"
+)
+
+// defaultStatsInterval is the default bucket size for the stats export, which
+// matches the granularity of the data we get from the logstreams.
+const defaultStatsInterval = 1 * time.Minute
+
+func parseStatsFormat(s string) (statsFormat, error) {
+	switch statsFormat(s) {
+	case statsFormatCSV, statsFormatJSON:
+		return statsFormat(s), nil
+	}
+
+	return "", errors.Errorf("invalid stats format %q, valid ones are: csv, json", s)
+}
+
+// statsFormatByFilename returns the format implied by the filename extension,
+// or statsFormatCSV if there's no such extension.
+func statsFormatByFilename(fname string) statsFormat {
+	if strings.ToLower(filepath.Ext(fname)) == ".json" {
+		return statsFormatJSON
+	}
+
+	return statsFormatCSV
+}
+
+// parseStatsInterval parses the bucket size for the stats export. Since the
+// data we have is per minute, and the buckets are aligned to midnight, the
+// interval has to be a whole number of minutes which divides 24h.
+func parseStatsInterval(s string) (time.Duration, error) {
+	interval, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Errorf("invalid interval %q", s)
+	}
+
+	if interval < time.Minute || interval%time.Minute != 0 || (24*time.Hour)%interval != 0 {
+		return 0, errors.Errorf(
+			"invalid interval %q: it must be a whole number of minutes which divides 24h, like 1m, 5m, 15m, 1h", s,
+		)
+	}
+
+	return interval, nil
+}
+
+// statsExportParams specifies how the minute stats should be exported.
+type statsExportParams struct {
+	format   statsFormat
+	interval time.Duration
+
+	// If perLStream is true, the counts are also broken down per logstream.
+	perLStream bool
+
+	// tz is the timezone used to format the time of the buckets; it also
+	// affects the bucketing itself, since buckets are aligned to midnight in
+	// this timezone.
+	tz *time.Location
+
+	// from and to is the time range of the query; all the buckets in this range
+	// are written, even if they have no messages. If to is zero, the range
+	// ends after the last bucket with messages.
+	from, to time.Time
+}
+
+// statsBucket is a single bucket of the exported stats.
+type statsBucket struct {
+	time  time.Time
+	count int
+
+	// byLStream is only populated if statsExportParams.perLStream is true.
+	byLStream map[string]int
+}
+
+// bucketStart returns the start of the bucket which t falls into; buckets are
+// aligned to midnight in the timezone tz.
+func bucketStart(t time.Time, interval time.Duration, tz *time.Location) time.Time {
+	t = t.In(tz)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, tz)
+
+	return midnight.Add(t.Sub(midnight) / interval * interval)
+}
+
+// bucketStats groups the minute stats from the resp into buckets as per the
+// params, and returns the buckets sorted by time, as well as the sorted
+// logstream names (only if params.perLStream is true).
+func bucketStats(
+	resp *core.LogRespTotal, params statsExportParams,
+) (buckets []statsBucket, lstreams []string) {
+	bucketsByTime := map[int64]*statsBucket{}
+
+	getBucket := func(t time.Time) *statsBucket {
+		start := bucketStart(t, params.interval, params.tz)
+
+		b, ok := bucketsByTime[start.Unix()]
+		if !ok {
+			b = &statsBucket{time: start}
+			if params.perLStream {
+				b.byLStream = map[string]int{}
+			}
+
+			bucketsByTime[start.Unix()] = b
+		}
+
+		return b
+	}
+
+	// Create all the empty buckets in the range first; we go minute by minute
+	// instead of adding the interval, because with DST changes the buckets are
+	// not always the same length.
+	if !params.from.IsZero() && !params.to.IsZero() {
+		for t := params.from; t.Before(params.to); t = t.Add(time.Minute) {
+			getBucket(t)
+		}
+	}
+
+	for minute, item := range resp.MinuteStats {
+		getBucket(time.Unix(minute, 0)).count += item.NumMsgs
+	}
+
+	if params.perLStream {
+		for lstream, minuteStats := range resp.MinuteStatsByLStream {
+			lstreams = append(lstreams, lstream)
+
+			for minute, item := range minuteStats {
+				getBucket(time.Unix(minute, 0)).byLStream[lstream] += item.NumMsgs
+			}
+		}
+
+		sort.Strings(lstreams)
+	}
+
+	buckets = make([]statsBucket, 0, len(bucketsByTime))
+	for _, b := range bucketsByTime {
+		buckets = append(buckets, *b)
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].time.Before(buckets[j].time) })
+
+	return buckets, lstreams
+}
+
+// writeStats writes the minute stats from the resp as per the params.
+func writeStats(w io.Writer, resp *core.LogRespTotal, params statsExportParams) error {
+	buckets, lstreams := bucketStats(resp, params)
+
+	switch params.format {
+	case statsFormatCSV:
+		return errors.Trace(writeStatsCSV(w, buckets, lstreams, params))
+	case statsFormatJSON:
+		return errors.Trace(writeStatsJSON(w, buckets, lstreams, params))
+	default:
+		return errors.Errorf("invalid stats format %q", params.format)
+	}
+}
+
+// writeStatsCSV writes the buckets as CSV: the time and the total count, and
+// if params.perLStream is true, then also a column per logstream.
+func writeStatsCSV(
+	w io.Writer, buckets []statsBucket, lstreams []string, params statsExportParams,
+) error {
+	cw := csv.NewWriter(w)
+
+	header := []string{"time", "count"}
+	header = append(header, lstreams...)
+
+	if err := cw.Write(header); err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, b := range buckets {
+		row := []string{b.time.In(params.tz).Format(time.RFC3339), fmt.Sprint(b.count)}
+		for _, lstream := range lstreams {
+			row = append(row, fmt.Sprint(b.byLStream[lstream]))
+		}
+
+		if err := cw.Write(row); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	cw.Flush()
+
+	return errors.Trace(cw.Error())
+}
+
+type statsJSON struct {
+	IntervalSeconds int               `json:"interval_seconds"`
+	Timezone        string            `json:"timezone"`
+	Buckets         []statsBucketJSON `json:"buckets"`
+}
+
+type statsBucketJSON struct {
+	Time      string         `json:"time"`
+	Count     int            `json:"count"`
+	ByLStream map[string]int `json:"by_lstream,omitempty"`
+}
+
+// writeStatsJSON writes the buckets as a single JSON object; if
+// params.perLStream is true, every bucket also has the counts for every
+// logstream.
+func writeStatsJSON(
+	w io.Writer, buckets []statsBucket, lstreams []string, params statsExportParams,
+) error {
+	sj := statsJSON{
+		IntervalSeconds: int(params.interval / time.Second),
+		Timezone:        params.tz.String(),
+		Buckets:         make([]statsBucketJSON, 0, len(buckets)),
+	}
+
+	for _, b := range buckets {
+		bj := statsBucketJSON{
+			Time:  b.time.In(params.tz).Format(time.RFC3339),
+			Count: b.count,
+		}
+
+		if params.perLStream {
+			bj.ByLStream = make(map[string]int, len(lstreams))
+			for _, lstream := range lstreams {
+				bj.ByLStream[lstream] = b.byLStream[lstream]
+			}
+		}
+
+		sj.Buckets = append(sj.Buckets, bj)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return errors.Trace(enc.Encode(sj))
+}
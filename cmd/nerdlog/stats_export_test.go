@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteStats(t *testing.T) {
+	minute := func(hh, mm int) int64 {
+		return time.Date(2025, 4, 18, hh, mm, 0, 0, time.UTC).Unix()
+	}
+
+	resp := &core.LogRespTotal{
+		MinuteStats: map[int64]core.MinuteStatsItem{
+			minute(18, 1): {NumMsgs: 3},
+			minute(18, 4): {NumMsgs: 1},
+			minute(18, 7): {NumMsgs: 2},
+		},
+		MinuteStatsByLStream: map[string]map[int64]core.MinuteStatsItem{
+			"host-02": {
+				minute(18, 1): {NumMsgs: 1},
+				minute(18, 7): {NumMsgs: 2},
+			},
+			"host-01": {
+				minute(18, 1): {NumMsgs: 2},
+				minute(18, 4): {NumMsgs: 1},
+			},
+		},
+	}
+
+	kyiv, err := time.LoadLocation("Europe/Kyiv")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	type testCase struct {
+		descr  string
+		params statsExportParams
+		want   string
+	}
+
+	testCases := []testCase{
+		{
+			descr: "csv, 1m, no range",
+			params: statsExportParams{
+				format:   statsFormatCSV,
+				interval: time.Minute,
+				tz:       time.UTC,
+			},
+			want: "time,count\n" +
+				"2025-04-18T18:01:00Z,3\n" +
+				"2025-04-18T18:04:00Z,1\n" +
+				"2025-04-18T18:07:00Z,2\n",
+		},
+		{
+			descr: "csv, 5m, range is zero-filled",
+			params: statsExportParams{
+				format:   statsFormatCSV,
+				interval: 5 * time.Minute,
+				tz:       time.UTC,
+				from:     time.Date(2025, 4, 18, 17, 55, 0, 0, time.UTC),
+				to:       time.Date(2025, 4, 18, 18, 15, 0, 0, time.UTC),
+			},
+			want: "time,count\n" +
+				"2025-04-18T17:55:00Z,0\n" +
+				"2025-04-18T18:00:00Z,4\n" +
+				"2025-04-18T18:05:00Z,2\n" +
+				"2025-04-18T18:10:00Z,0\n",
+		},
+		{
+			descr: "csv, per lstream, other timezone",
+			params: statsExportParams{
+				format:     statsFormatCSV,
+				interval:   5 * time.Minute,
+				perLStream: true,
+				tz:         kyiv,
+			},
+			want: "time,count,host-01,host-02\n" +
+				"2025-04-18T21:00:00+03:00,4,3,1\n" +
+				"2025-04-18T21:05:00+03:00,2,0,2\n",
+		},
+		{
+			descr: "json, per lstream",
+			params: statsExportParams{
+				format:     statsFormatJSON,
+				interval:   time.Hour,
+				perLStream: true,
+				tz:         time.UTC,
+			},
+			want: `{
+  "interval_seconds": 3600,
+  "timezone": "UTC",
+  "buckets": [
+    {
+      "time": "2025-04-18T18:00:00Z",
+      "count": 6,
+      "by_lstream": {
+        "host-01": 3,
+        "host-02": 3
+      }
+    }
+  ]
+}
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.descr, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := writeStats(&buf, resp, tc.params)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, buf.String())
+		})
+	}
+}
+
+func TestBucketStart(t *testing.T) {
+	// Buckets are aligned to midnight in the given timezone, not to UTC.
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	got := bucketStart(time.Date(2025, 4, 18, 18, 13, 0, 0, time.UTC), 2*time.Hour, kolkata)
+	assert.Equal(t, time.Date(2025, 4, 18, 22, 0, 0, 0, kolkata).Unix(), got.Unix())
+
+	got = bucketStart(time.Date(2025, 4, 18, 18, 13, 0, 0, time.UTC), 2*time.Hour, time.UTC)
+	assert.Equal(t, time.Date(2025, 4, 18, 18, 0, 0, 0, time.UTC), got)
+}
+
+func TestParseWriteStatsCmdArgs(t *testing.T) {
+	kyiv, err := time.LoadLocation("Europe/Kyiv")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	type testCase struct {
+		descr string
+		args  []string
+
+		want    writeStatsCmdParams
+		wantErr string
+	}
+
+	testCases := []testCase{
+		{
+			descr: "no args",
+			want: writeStatsCmdParams{
+				fname:    "/tmp/last_nerdlog_stats.csv",
+				format:   statsFormatCSV,
+				interval: time.Minute,
+			},
+		},
+		{
+			descr: "json format without filename",
+			args:  []string{"++format=json"},
+			want: writeStatsCmdParams{
+				fname:    "/tmp/last_nerdlog_stats.json",
+				format:   statsFormatJSON,
+				interval: time.Minute,
+			},
+		},
+		{
+			descr: "all options",
+			args:  []string{"++interval=15m", "++per-lstream", "++tz=Europe/Kyiv", "/tmp/foo.json"},
+			want: writeStatsCmdParams{
+				fname:      "/tmp/foo.json",
+				format:     statsFormatJSON,
+				interval:   15 * time.Minute,
+				perLStream: true,
+				tz:         kyiv,
+			},
+		},
+		{
+			descr:   "interval not dividing a day",
+			args:    []string{"++interval=7m"},
+			wantErr: `invalid interval "7m": it must be a whole number of minutes which divides 24h, like 1m, 5m, 15m, 1h`,
+		},
+		{
+			descr:   "interval less than a minute",
+			args:    []string{"++interval=30s"},
+			wantErr: `invalid interval "30s": it must be a whole number of minutes which divides 24h, like 1m, 5m, 15m, 1h`,
+		},
+		{
+			descr:   "invalid format",
+			args:    []string{"++format=xml"},
+			wantErr: `invalid stats format "xml", valid ones are: csv, json`,
+		},
+		{
+			descr:   "invalid timezone",
+			args:    []string{"++tz=Foo/Bar"},
+			wantErr: `invalid timezone "Foo/Bar"`,
+		},
+		{
+			descr:   "missing value",
+			args:    []string{"++tz"},
+			wantErr: "++tz requires a value",
+		},
+		{
+			descr:   "unknown option",
+			args:    []string{"++all"},
+			wantErr: `unknown option "++all"; valid ones are ++format, ++interval, ++per-lstream and ++tz`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.descr, func(t *testing.T) {
+			got, err := parseWriteStatsCmdArgs(tc.args)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dimonomid/nerdlog/client"
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+	"github.com/spf13/pflag"
+)
+
+// watchCmdParams are the params for the "nerdlog watch" command.
+type watchCmdParams struct {
+	headlessParams
+
+	// timeRange is the sliding window, like "-5m".
+	timeRange string
+	pattern   string
+
+	// interval is how often the query is rerun.
+	interval time.Duration
+
+	watchParams
+
+	// execCmd is the shell command to run when triggered; if empty, the
+	// trigger is just printed to stdout.
+	execCmd string
+
+	connectTimeout time.Duration
+}
+
+// runWatchCmd runs the "nerdlog watch" command: it connects to the
+// logstreams, reruns the query periodically, and runs the command every time
+// it's triggered. Returns the exit code.
+func runWatchCmd(args []string, homeDir string) int {
+	fs := pflag.NewFlagSet("watch", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: nerdlog watch [flags]\n\nReruns the query periodically over a sliding time window, and runs a local command when the number of matching messages reaches the threshold, or when new matching messages appear.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+
+	flags := addCommonFlags(fs, homeDir)
+
+	var (
+		flagTime           = fs.StringP("time", "t", "-5m", "Sliding time window to query, in the same format as accepted by the UI")
+		flagPattern        = fs.StringP("pattern", "p", "", "awk pattern to use")
+		flagInterval       = fs.Duration("interval", 30*time.Second, "How often to rerun the query")
+		flagThreshold      = fs.Int("threshold", 0, "Trigger when the number of matching messages in the window reaches this value (and then again only after it drops below); 0 disables it")
+		flagOnNew          = fs.Bool("on-new", false, "Trigger when new matching messages appear; the ones which are there on the first run are not considered new")
+		flagMaxSamples     = fs.Int("max-samples", 10, "Max number of sample log lines to pass to the command")
+		flagExec           = fs.String("exec", "", "Shell command to run when triggered; the sample lines are passed on stdin, and the details in NERDLOG_WATCH_* environment variables. If empty, triggers are printed to stdout")
+		flagConnectTimeout = fs.Duration("connect-timeout", 1*time.Minute, "How long to wait for all logstreams to connect initially")
+	)
+
+	if err := fs.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+
+		return 2
+	}
+
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Error: unexpected arguments: %q\n", fs.Args())
+		return 2
+	}
+
+	if *flagThreshold <= 0 && !*flagOnNew {
+		fmt.Fprintf(os.Stderr, "Error: nothing to watch for, need either --threshold or --on-new\n")
+		return 2
+	}
+
+	if *flagMaxSamples < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --max-samples can't be negative\n")
+		return 2
+	}
+
+	if *flagInterval < time.Second {
+		fmt.Fprintf(os.Stderr, "Error: --interval can't be less than 1s\n")
+		return 2
+	}
+
+	hp, err := headlessParamsFromFlags(flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 2
+	}
+
+	params := watchCmdParams{
+		headlessParams: hp,
+
+		timeRange: *flagTime,
+		pattern:   *flagPattern,
+		interval:  *flagInterval,
+
+		watchParams: watchParams{
+			threshold:  *flagThreshold,
+			onNew:      *flagOnNew,
+			maxSamples: *flagMaxSamples,
+		},
+
+		execCmd:        *flagExec,
+		connectTimeout: *flagConnectTimeout,
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := runWatch(ctx, params); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func runWatch(ctx context.Context, params watchCmdParams) error {
+	options, err := params.newOptions()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	opts := options.GetAll()
+
+	ftr, err := ParseFromToRange(opts.Timezone, params.timeRange)
+	if err != nil {
+		return errors.Annotatef(err, "time")
+	}
+
+	c, err := params.newClient(opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer c.Close()
+
+	connectCtx, cancel := context.WithTimeout(ctx, params.connectTimeout)
+	defer cancel()
+
+	if err := c.WaitConnected(connectCtx); err != nil {
+		if errors.Cause(err) == context.DeadlineExceeded {
+			return errors.Errorf("timed out connecting: %s", formatConnErrs(c.State()))
+		}
+
+		return errors.Annotatef(err, "connecting")
+	}
+
+	w := newWatcher(params.watchParams)
+
+	ticker := time.NewTicker(params.interval)
+	defer ticker.Stop()
+
+	for {
+		from, to := ftr.QueryRange(time.Now())
+
+		resp, err := c.Query(ctx, core.QueryLogsParams{
+			MaxNumLines: opts.MaxNumLines,
+			From:        from,
+			To:          to,
+			Query:       params.pattern,
+		})
+
+		switch {
+		case ctx.Err() != nil:
+			return nil
+
+		case err != nil:
+			// Don't give up on errors, since they might be temporary, like a
+			// logstream being reconnected; just report and keep watching.
+			if qErr, ok := err.(*client.QueryError); ok {
+				for _, e := range qErr.Errs {
+					fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+				}
+			} else {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			}
+
+		default:
+			if trigger := w.check(resp, from); trigger != nil {
+				if err := runWatchAction(ctx, params, trigger, os.Stdout); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// runWatchAction runs the command for the trigger, or if there's no command,
+// prints the trigger to out.
+func runWatchAction(
+	ctx context.Context, params watchCmdParams, trigger *watchTrigger, out io.Writer,
+) error {
+	var samples strings.Builder
+	for _, msg := range trigger.samples {
+		samples.WriteString(msg.OrigLine)
+		samples.WriteString("\n")
+	}
+
+	if params.execCmd == "" {
+		_, err := fmt.Fprintf(
+			out, "%s: triggered by %s: %d messages in the window, %d new\n%s",
+			time.Now().Format(time.RFC3339), strings.Join(trigger.reasons, ", "),
+			trigger.count, trigger.numNew, samples.String(),
+		)
+		return errors.Trace(err)
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", params.execCmd)
+	cmd.Stdin = strings.NewReader(samples.String())
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(
+		os.Environ(),
+		"NERDLOG_WATCH_REASONS="+strings.Join(trigger.reasons, ","),
+		fmt.Sprintf("NERDLOG_WATCH_COUNT=%d", trigger.count),
+		fmt.Sprintf("NERDLOG_WATCH_NUM_NEW=%d", trigger.numNew),
+		"NERDLOG_WATCH_LSTREAMS="+params.lstreams,
+		"NERDLOG_WATCH_TIME="+params.timeRange,
+		"NERDLOG_WATCH_PATTERN="+params.pattern,
+	)
+
+	if err := cmd.Run(); err != nil {
+		return errors.Annotatef(err, "running %q", params.execCmd)
+	}
+
+	return nil
+}
+
+// watchParams specify when the watcher is triggered.
+type watchParams struct {
+	// threshold, if positive, is the number of messages in the window which
+	// triggers the watcher.
+	threshold int
+
+	// If onNew is true, the watcher is triggered by new messages.
+	onNew bool
+
+	// maxSamples is the max number of messages in watchTrigger.samples.
+	maxSamples int
+}
+
+const (
+	watchReasonThreshold = "threshold"
+	watchReasonNewLines  = "new_lines"
+)
+
+// watchTrigger describes why the watcher was triggered.
+type watchTrigger struct {
+	// reasons contains watchReasonThreshold and/or watchReasonNewLines.
+	reasons []string
+
+	// count is the total number of messages in the window.
+	count int
+
+	// numNew is the number of new messages; only set if watchParams.onNew is
+	// true.
+	numNew int
+
+	// samples are the latest new messages, or if there are no new ones, just
+	// the latest messages.
+	samples []core.LogMsg
+}
+
+// watcher keeps the state between the query reruns, so that we aren't
+// triggered twice for the same thing.
+type watcher struct {
+	params watchParams
+
+	// aboveThreshold is whether the last count was at or above the threshold;
+	// we only trigger again after it drops below.
+	aboveThreshold bool
+
+	// seen contains the keys (see watchMsgKey) of the messages seen so far,
+	// mapped to their times, so that we can forget the ones which are out of
+	// the window.
+	seen map[string]time.Time
+
+	// initialized is false until the first check; the messages seen on the
+	// first check are not considered new.
+	initialized bool
+}
+
+func newWatcher(params watchParams) *watcher {
+	return &watcher{
+		params: params,
+		seen:   map[string]time.Time{},
+	}
+}
+
+// check checks the response from the latest rerun of the query, and returns
+// the trigger if the watcher is triggered, or nil otherwise. windowFrom is
+// the beginning of the window of this query.
+func (w *watcher) check(resp *core.LogRespTotal, windowFrom time.Time) *watchTrigger {
+	trigger := &watchTrigger{
+		count: resp.NumMsgsTotal,
+	}
+
+	if w.params.threshold > 0 {
+		above := resp.NumMsgsTotal >= w.params.threshold
+		if above && !w.aboveThreshold {
+			trigger.reasons = append(trigger.reasons, watchReasonThreshold)
+		}
+
+		w.aboveThreshold = above
+	}
+
+	var newMsgs []core.LogMsg
+	if w.params.onNew {
+		for key, t := range w.seen {
+			if t.Before(windowFrom) {
+				delete(w.seen, key)
+			}
+		}
+
+		for _, msg := range resp.Logs {
+			key := watchMsgKey(msg)
+			if _, ok := w.seen[key]; ok {
+				continue
+			}
+
+			w.seen[key] = msg.Time
+			if w.initialized {
+				newMsgs = append(newMsgs, msg)
+			}
+		}
+
+		if len(newMsgs) > 0 {
+			trigger.reasons = append(trigger.reasons, watchReasonNewLines)
+			trigger.numNew = len(newMsgs)
+		}
+	}
+
+	w.initialized = true
+
+	if len(trigger.reasons) == 0 {
+		return nil
+	}
+
+	samples := newMsgs
+	if len(samples) == 0 {
+		samples = resp.Logs
+	}
+
+	if len(samples) > w.params.maxSamples {
+		samples = samples[len(samples)-w.params.maxSamples:]
+	}
+
+	trigger.samples = samples
+
+	return trigger
+}
+
+// watchMsgKey returns the key identifying the message across the query
+// reruns. NOTE that msg.Time is not used, since it might be corrected for the
+// clock skew of the host (see the clock_correction option), which is measured
+// again on every reconnect; the original timestamp is a part of OrigLine
+// anyway.
+func watchMsgKey(msg core.LogMsg) string {
+	return fmt.Sprintf(
+		"%s\x00%s\x00%d\x00%s",
+		msg.Context["lstream"], msg.LogFilename, msg.LogLinenumber, msg.OrigLine,
+	)
+}
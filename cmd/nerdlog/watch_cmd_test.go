@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func watchTestMsg(minute int, line string) core.LogMsg {
+	return core.LogMsg{
+		Time:     time.Date(2025, 4, 18, 18, minute, 0, 0, time.UTC),
+		Context:  map[string]string{"lstream": "host-01"},
+		OrigLine: line,
+	}
+}
+
+func watchTestResp(numMsgsTotal int, logs ...core.LogMsg) *core.LogRespTotal {
+	return &core.LogRespTotal{
+		Logs:         logs,
+		NumMsgsTotal: numMsgsTotal,
+	}
+}
+
+func TestWatcherThreshold(t *testing.T) {
+	w := newWatcher(watchParams{threshold: 3, maxSamples: 2})
+	from := time.Date(2025, 4, 18, 18, 0, 0, 0, time.UTC)
+
+	assert.Nil(t, w.check(watchTestResp(2, watchTestMsg(1, "a"), watchTestMsg(2, "b")), from))
+
+	trigger := w.check(watchTestResp(3, watchTestMsg(1, "a"), watchTestMsg(2, "b"), watchTestMsg(3, "c")), from)
+	if assert.NotNil(t, trigger) {
+		assert.Equal(t, []string{watchReasonThreshold}, trigger.reasons)
+		assert.Equal(t, 3, trigger.count)
+		assert.Equal(t, []core.LogMsg{watchTestMsg(2, "b"), watchTestMsg(3, "c")}, trigger.samples)
+	}
+
+	// Still above the threshold, so it's not triggered again.
+	assert.Nil(t, w.check(watchTestResp(4), from))
+
+	// Dropped below and then crossed it again.
+	assert.Nil(t, w.check(watchTestResp(1), from))
+	assert.NotNil(t, w.check(watchTestResp(5), from))
+}
+
+func TestWatcherOnNew(t *testing.T) {
+	w := newWatcher(watchParams{onNew: true, maxSamples: 10})
+	from := time.Date(2025, 4, 18, 18, 0, 0, 0, time.UTC)
+
+	// The messages which are there on the first check are not new.
+	assert.Nil(t, w.check(watchTestResp(2, watchTestMsg(1, "a"), watchTestMsg(2, "b")), from))
+	assert.Nil(t, w.check(watchTestResp(2, watchTestMsg(1, "a"), watchTestMsg(2, "b")), from))
+
+	trigger := w.check(watchTestResp(3, watchTestMsg(1, "a"), watchTestMsg(2, "b"), watchTestMsg(3, "c")), from)
+	if assert.NotNil(t, trigger) {
+		assert.Equal(t, []string{watchReasonNewLines}, trigger.reasons)
+		assert.Equal(t, 1, trigger.numNew)
+		assert.Equal(t, []core.LogMsg{watchTestMsg(3, "c")}, trigger.samples)
+	}
+
+	// The window moved on, so the old messages are forgotten, but the ones still
+	// in the window are not reported again.
+	from = time.Date(2025, 4, 18, 18, 2, 0, 0, time.UTC)
+	assert.Nil(t, w.check(watchTestResp(2, watchTestMsg(2, "b"), watchTestMsg(3, "c")), from))
+	assert.Equal(t, 2, len(w.seen))
+}
+
+func TestWatcherOnNewClockSkew(t *testing.T) {
+	w := newWatcher(watchParams{onNew: true, maxSamples: 10})
+	from := time.Date(2025, 4, 18, 18, 0, 0, 0, time.UTC)
+
+	msg := watchTestMsg(1, "Apr 18 18:01:00 host-01 myapp: a")
+	msg.LogFilename = "/var/log/syslog"
+	msg.LogLinenumber = 10
+	assert.Nil(t, w.check(watchTestResp(1, msg), from))
+
+	// After a reconnect, the clock skew was measured differently, so the
+	// corrected time of the same message is different; it's still not new.
+	msg.Time = msg.Time.Add(-1500 * time.Millisecond)
+	assert.Nil(t, w.check(watchTestResp(1, msg), from))
+
+	// But the same line at a different place in the file is new.
+	msg2 := msg
+	msg2.LogLinenumber = 11
+	trigger := w.check(watchTestResp(2, msg, msg2), from)
+	if assert.NotNil(t, trigger) {
+		assert.Equal(t, 1, trigger.numNew)
+	}
+}
+
+func TestRunWatchAction(t *testing.T) {
+	params := watchCmdParams{
+		headlessParams: headlessParams{lstreams: "host-*"},
+		timeRange:      "-5m",
+		pattern:        "/panic/",
+		execCmd:        `echo "$NERDLOG_WATCH_REASONS $NERDLOG_WATCH_COUNT $NERDLOG_WATCH_NUM_NEW $NERDLOG_WATCH_LSTREAMS $NERDLOG_WATCH_TIME $NERDLOG_WATCH_PATTERN"; cat`,
+	}
+
+	trigger := &watchTrigger{
+		reasons: []string{watchReasonThreshold, watchReasonNewLines},
+		count:   12,
+		numNew:  2,
+		samples: []core.LogMsg{watchTestMsg(1, "line a"), watchTestMsg(2, "line b")},
+	}
+
+	var buf bytes.Buffer
+	err := runWatchAction(context.Background(), params, trigger, &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "threshold,new_lines 12 2 host-* -5m /panic/\nline a\nline b\n", buf.String())
+}
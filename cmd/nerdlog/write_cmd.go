@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+)
+
+// defaultWriteFilename is used by :write if no filename is given.
+const defaultWriteFilename = "/tmp/last_nerdlog"
+
+// writeCmdParams are the params of the :write command, which looks like this:
+//
+//	:w[rite] [++format=<format>] [++all[=<max lines>]] [filename]
+type writeCmdParams struct {
+	fname  string
+	format exportFormat
+
+	// If all is true, then before writing, all the remaining (older) logs are
+	// loaded, until there are maxNumLines of them.
+	all         bool
+	maxNumLines int
+}
+
+// pendingWrite is a :write command which is waiting for the older logs to be
+// loaded.
+type pendingWrite struct {
+	params writeCmdParams
+
+	// numLogs is how many logs we had when we requested to load more.
+	numLogs int
+}
+
+func parseWriteCmdArgs(args []string) (writeCmdParams, error) {
+	ret := writeCmdParams{
+		maxNumLines: defaultExportMaxNumLines,
+	}
+
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "++") {
+			if ret.fname != "" {
+				return writeCmdParams{}, errors.Errorf("only one filename can be given")
+			}
+
+			ret.fname = arg
+			continue
+		}
+
+		optParts := strings.SplitN(arg[2:], "=", 2)
+		switch optParts[0] {
+		case "format":
+			if len(optParts) != 2 {
+				return writeCmdParams{}, errors.Errorf("++format requires a value, like ++format=csv")
+			}
+
+			format, err := parseExportFormat(optParts[1])
+			if err != nil {
+				return writeCmdParams{}, errors.Trace(err)
+			}
+
+			ret.format = format
+
+		case "all":
+			ret.all = true
+
+			if len(optParts) == 2 {
+				n, err := strconv.Atoi(optParts[1])
+				if err != nil || n <= 0 {
+					return writeCmdParams{}, errors.Errorf("invalid max number of lines %q for ++all", optParts[1])
+				}
+
+				ret.maxNumLines = n
+			}
+
+		default:
+			return writeCmdParams{}, errors.Errorf("unknown option %q; valid ones are ++format and ++all", arg)
+		}
+	}
+
+	if ret.fname == "" {
+		ret.fname = defaultWriteFilename
+	}
+
+	if ret.format == "" {
+		ret.format = exportFormatByFilename(ret.fname)
+	}
+
+	return ret, nil
+}
+
+// needMoreLogs returns whether we need to load more logs before writing.
+func (p *writeCmdParams) needMoreLogs(resp *core.LogRespTotal) bool {
+	return p.all && len(resp.Logs) < resp.NumMsgsTotal && len(resp.Logs) < p.maxNumLines
+}
+
+func (app *nerdlogApp) handleWriteCmd(args []string) {
+	params, err := parseWriteCmdArgs(args)
+	if err != nil {
+		app.printError(capitalizeFirstRune(err.Error()))
+		return
+	}
+
+	if app.lastLogResp == nil {
+		app.printError("No logs yet")
+		return
+	}
+
+	if params.needMoreLogs(app.lastLogResp) {
+		app.pendingWrite = &pendingWrite{
+			params:  params,
+			numLogs: len(app.lastLogResp.Logs),
+		}
+
+		app.printMsg(fmt.Sprintf(
+			"Loading more logs before writing: %d out of %d", len(app.lastLogResp.Logs), app.lastLogResp.NumMsgsTotal,
+		))
+		app.mainView.loadEarlier()
+		return
+	}
+
+	app.writeLogs(params, app.lastLogResp.Logs)
+}
+
+// handlePendingWrite should be called after every log response is applied;
+// if there's a pending write, then it either loads more logs, or writes them.
+func (app *nerdlogApp) handlePendingWrite(resp *core.LogRespTotal) {
+	pw := app.pendingWrite
+	if pw == nil {
+		return
+	}
+
+	if !resp.LoadedEarlier {
+		// Some other query was made meanwhile, so the logs are not what the user
+		// wanted to write.
+		app.pendingWrite = nil
+		app.printError(fmt.Sprintf("Writing to %s was cancelled by the new query", pw.params.fname))
+		return
+	}
+
+	// If we didn't get anything new, there's no point to keep going.
+	if pw.params.needMoreLogs(resp) && len(resp.Logs) > pw.numLogs {
+		pw.numLogs = len(resp.Logs)
+
+		app.printMsg(fmt.Sprintf(
+			"Loading more logs before writing: %d out of %d", len(resp.Logs), resp.NumMsgsTotal,
+		))
+		app.mainView.loadEarlier()
+		return
+	}
+
+	app.pendingWrite = nil
+	app.writeLogs(pw.params, resp.Logs)
+}
+
+// writeLogs writes the logs to the file as per the params, and lets the user
+// know the result.
+func (app *nerdlogApp) writeLogs(params writeCmdParams, logs []core.LogMsg) {
+	if params.all && len(logs) > params.maxNumLines {
+		logs = logs[len(logs)-params.maxNumLines:]
+	}
+
+	if err := writeLogsToFile(params, logs, app.mainView.selectQuery, app.options.GetTimezone()); err != nil {
+		app.printError(capitalizeFirstRune(err.Error()))
+		return
+	}
+
+	app.printMsg(fmt.Sprintf("Saved %d lines to %s (%s)", len(logs), params.fname, params.format))
+}
+
+func writeLogsToFile(
+	params writeCmdParams, logs []core.LogMsg, sqp *SelectQueryParsed, tz *time.Location,
+) error {
+	lfile, err := os.Create(params.fname)
+	if err != nil {
+		return errors.Annotatef(err, "failed to open %s for writing", params.fname)
+	}
+
+	w := bufio.NewWriter(lfile)
+
+	if err := writeLogs(w, logs, params.format, sqp, tz); err != nil {
+		lfile.Close()
+		return errors.Annotatef(err, "writing to %s", params.fname)
+	}
+
+	if err := w.Flush(); err != nil {
+		lfile.Close()
+		return errors.Annotatef(err, "writing to %s", params.fname)
+	}
+
+	// Closing explicitly to return the error, since it might mean that the
+	// data wasn't actually written.
+	return errors.Trace(lfile.Close())
+}
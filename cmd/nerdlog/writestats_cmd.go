@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+)
+
+// defaultWriteStatsFilename is used by :writestats if no filename is given;
+// the extension is replaced as per the format.
+const defaultWriteStatsFilename = "/tmp/last_nerdlog_stats"
+
+// writeStatsCmdParams are the params of the :writestats command, which looks
+// like this:
+//
+//	:writestats [++format=<csv|json>] [++interval=<dur>] [++per-lstream] [++tz=<zone>] [filename]
+type writeStatsCmdParams struct {
+	fname      string
+	format     statsFormat
+	interval   time.Duration
+	perLStream bool
+
+	// tz is nil if the timezone wasn't given explicitly, in which case the
+	// timezone from the options should be used.
+	tz *time.Location
+}
+
+func parseWriteStatsCmdArgs(args []string) (writeStatsCmdParams, error) {
+	ret := writeStatsCmdParams{
+		interval: defaultStatsInterval,
+	}
+
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "++") {
+			if ret.fname != "" {
+				return writeStatsCmdParams{}, errors.Errorf("only one filename can be given")
+			}
+
+			ret.fname = arg
+			continue
+		}
+
+		optParts := strings.SplitN(arg[2:], "=", 2)
+		optName := optParts[0]
+
+		needValue := func() (string, error) {
+			if len(optParts) != 2 {
+				return "", errors.Errorf("++%s requires a value", optName)
+			}
+
+			return optParts[1], nil
+		}
+
+		switch optName {
+		case "format":
+			value, err := needValue()
+			if err != nil {
+				return writeStatsCmdParams{}, errors.Trace(err)
+			}
+
+			format, err := parseStatsFormat(value)
+			if err != nil {
+				return writeStatsCmdParams{}, errors.Trace(err)
+			}
+
+			ret.format = format
+
+		case "interval":
+			value, err := needValue()
+			if err != nil {
+				return writeStatsCmdParams{}, errors.Trace(err)
+			}
+
+			interval, err := parseStatsInterval(value)
+			if err != nil {
+				return writeStatsCmdParams{}, errors.Trace(err)
+			}
+
+			ret.interval = interval
+
+		case "per-lstream":
+			ret.perLStream = true
+
+		case "tz":
+			value, err := needValue()
+			if err != nil {
+				return writeStatsCmdParams{}, errors.Trace(err)
+			}
+
+			tz, err := time.LoadLocation(value)
+			if err != nil {
+				return writeStatsCmdParams{}, errors.Errorf("invalid timezone %q", value)
+			}
+
+			ret.tz = tz
+
+		default:
+			return writeStatsCmdParams{}, errors.Errorf(
+				"unknown option %q; valid ones are ++format, ++interval, ++per-lstream and ++tz", arg,
+			)
+		}
+	}
+
+	if ret.format == "" {
+		if ret.fname != "" {
+			ret.format = statsFormatByFilename(ret.fname)
+		} else {
+			ret.format = statsFormatCSV
+		}
+	}
+
+	if ret.fname == "" {
+		ret.fname = defaultWriteStatsFilename + "." + string(ret.format)
+	}
+
+	return ret, nil
+}
+
+func (app *nerdlogApp) handleWriteStatsCmd(args []string) {
+	params, err := parseWriteStatsCmdArgs(args)
+	if err != nil {
+		app.printError(capitalizeFirstRune(err.Error()))
+		return
+	}
+
+	if app.lastLogResp == nil {
+		app.printError("No logs yet")
+		return
+	}
+
+	tz := params.tz
+	if tz == nil {
+		tz = app.options.GetTimezone()
+	}
+
+	sp := statsExportParams{
+		format:     params.format,
+		interval:   params.interval,
+		perLStream: params.perLStream,
+		tz:         tz,
+		from:       app.mainView.actualFrom,
+		to:         app.mainView.actualTo,
+	}
+
+	if err := writeStatsToFile(params.fname, app.lastLogResp, sp); err != nil {
+		app.printError(capitalizeFirstRune(err.Error()))
+		return
+	}
+
+	app.printMsg(fmt.Sprintf("Saved stats to %s (%s, %s buckets)", params.fname, params.format, params.interval))
+}
+
+func writeStatsToFile(fname string, resp *core.LogRespTotal, params statsExportParams) error {
+	sfile, err := os.Create(fname)
+	if err != nil {
+		return errors.Annotatef(err, "failed to open %s for writing", fname)
+	}
+	defer sfile.Close()
+
+	w := bufio.NewWriter(sfile)
+
+	if err := writeStats(w, resp, params); err != nil {
+		return errors.Annotatef(err, "writing to %s", fname)
+	}
+
+	if err := w.Flush(); err != nil {
+		return errors.Annotatef(err, "writing to %s", fname)
+	}
+
+	return errors.Trace(sfile.Close())
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// ClockSkewWarnThreshold is the clock skew of a host (as measured during
+// bootstrap) above which a warning is shown, unless the clock correction is
+// configured for the logstream.
+const ClockSkewWarnThreshold = 2 * time.Second
+
+const clockCorrectionAuto = "auto"
+
+// ClockCorrection specifies how to correct the timestamps of the logs from a
+// host whose clock is skewed relative to the local clock, so that the logs
+// from multiple hosts are merged in the right order.
+type ClockCorrection struct {
+	// Auto means that the clock skew measured during bootstrap is used.
+	Auto bool
+
+	// Skew is how much the host clock is ahead of the local clock (negative if
+	// it's behind); only used if Auto is false.
+	Skew time.Duration
+}
+
+// ParseClockCorrection parses the clock correction spec: either "auto", to
+// use the clock skew measured during bootstrap, or a duration like "1.5s" or
+// "-200ms", meaning that the host clock is ahead (or behind, if negative) of
+// the local clock by that much. An empty spec means no correction, and then
+// the returned ClockCorrection is nil.
+func ParseClockCorrection(spec string) (*ClockCorrection, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "":
+		return nil, nil
+	case clockCorrectionAuto:
+		return &ClockCorrection{Auto: true}, nil
+	}
+
+	skew, err := time.ParseDuration(spec)
+	if err != nil {
+		return nil, errors.Errorf("expected either %q or a duration like \"1.5s\", got %q", clockCorrectionAuto, spec)
+	}
+
+	return &ClockCorrection{Skew: skew}, nil
+}
+
+// getSkew returns the skew to subtract from the timestamps of the logs, given
+// the skew measured during bootstrap.
+func (cc *ClockCorrection) getSkew(measured time.Duration) time.Duration {
+	if cc == nil {
+		return 0
+	}
+
+	if cc.Auto {
+		return measured
+	}
+
+	return cc.Skew
+}
+
+// parseHostTime parses the host time printed by the agent during bootstrap:
+// a unix timestamp in seconds, optionally with a fractional part, like
+// "1741777080" or "1741777080.123456".
+func parseHostTime(s string) (time.Time, error) {
+	secsStr, fracStr := s, ""
+	if idx := strings.IndexByte(s, '.'); idx >= 0 {
+		secsStr, fracStr = s[:idx], s[idx+1:]
+	}
+
+	secs, err := strconv.ParseInt(secsStr, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid host time %q", s)
+	}
+
+	var nsecs int64
+	if fracStr != "" {
+		// Only nanoseconds precision is supported, the rest is ignored.
+		if len(fracStr) > 9 {
+			fracStr = fracStr[:9]
+		}
+
+		nsecs, err = strconv.ParseInt(fracStr+strings.Repeat("0", 9-len(fracStr)), 10, 64)
+		if err != nil || nsecs < 0 {
+			return time.Time{}, errors.Errorf("invalid host time %q", s)
+		}
+	}
+
+	return time.Unix(secs, nsecs).UTC(), nil
+}
+
+// shiftMinuteStats returns the minute stats corrected for the clock skew of
+// the host, so that the timeline histogram matches the corrected timestamps of
+// the logs. Since the stats only have a resolution of one minute, the skew is
+// rounded to whole minutes, so e.g. a skew of a few seconds doesn't affect the
+// stats at all.
+func shiftMinuteStats(
+	stats map[int64]MinuteStatsItem, skew time.Duration,
+) map[int64]MinuteStatsItem {
+	shift := int64(skew.Round(time.Minute) / time.Second)
+	if shift == 0 {
+		return stats
+	}
+
+	ret := make(map[int64]MinuteStatsItem, len(stats))
+	for k, v := range stats {
+		ret[k-shift] = v
+	}
+
+	return ret
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+
+	return d
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type parseClockCorrectionTestCase struct {
+	name      string
+	spec      string
+	expected  *ClockCorrection
+	expectErr string
+}
+
+func TestParseClockCorrection(t *testing.T) {
+	testCases := []parseClockCorrectionTestCase{
+		{
+			name:     "empty spec",
+			spec:     "",
+			expected: nil,
+		},
+		{
+			name:     "auto",
+			spec:     "auto",
+			expected: &ClockCorrection{Auto: true},
+		},
+		{
+			name:     "host is ahead",
+			spec:     "1.5s",
+			expected: &ClockCorrection{Skew: 1500 * time.Millisecond},
+		},
+		{
+			name:     "host is behind",
+			spec:     " -200ms ",
+			expected: &ClockCorrection{Skew: -200 * time.Millisecond},
+		},
+		{
+			name:      "invalid",
+			spec:      "foo",
+			expectErr: `expected either "auto" or a duration like "1.5s", got "foo"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := ParseClockCorrection(tc.spec)
+
+			if tc.expectErr != "" {
+				assert.EqualError(t, err, tc.expectErr)
+				assert.Nil(t, result)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestClockCorrectionGetSkew(t *testing.T) {
+	measured := 3 * time.Second
+
+	var noCorrection *ClockCorrection
+	assert.Equal(t, time.Duration(0), noCorrection.getSkew(measured))
+	assert.Equal(t, measured, (&ClockCorrection{Auto: true}).getSkew(measured))
+	assert.Equal(t, -time.Second, (&ClockCorrection{Skew: -time.Second}).getSkew(measured))
+}
+
+func TestParseHostTime(t *testing.T) {
+	got, err := parseHostTime("1741777080")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 3, 12, 10, 58, 0, 0, time.UTC), got)
+
+	got, err = parseHostTime("1741777080.123456")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 3, 12, 10, 58, 0, 123456000, time.UTC), got)
+
+	got, err = parseHostTime("1741777080.1234567891")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 3, 12, 10, 58, 0, 123456789, time.UTC), got)
+
+	_, err = parseHostTime("")
+	assert.EqualError(t, err, `invalid host time ""`)
+
+	_, err = parseHostTime("1741777080.-5")
+	assert.EqualError(t, err, `invalid host time "1741777080.-5"`)
+}
+
+func TestShiftMinuteStats(t *testing.T) {
+	stats := map[int64]MinuteStatsItem{
+		1741777020: {NumMsgs: 3},
+		1741777080: {NumMsgs: 5},
+	}
+
+	// Skew of less than half a minute doesn't affect the stats.
+	assert.Equal(t, stats, shiftMinuteStats(stats, 29*time.Second))
+	assert.Equal(t, stats, shiftMinuteStats(stats, -10*time.Second))
+
+	assert.Equal(t, map[int64]MinuteStatsItem{
+		1741776960: {NumMsgs: 3},
+		1741777020: {NumMsgs: 5},
+	}, shiftMinuteStats(stats, 30*time.Second))
+
+	assert.Equal(t, map[int64]MinuteStatsItem{
+		1741777140: {NumMsgs: 3},
+		1741777200: {NumMsgs: 5},
+	}, shiftMinuteStats(stats, -2*time.Minute))
+}
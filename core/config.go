@@ -4,6 +4,12 @@ import "sort"
 
 type ConfigLogStreams map[string]ConfigLogStream
 
+// ConfigGroups maps a group name to the list of logstream spec entries which
+// the group consists of. Every entry can be anything that the logstreams input
+// accepts: a host, a glob, a tag like "tag:db", another group like "@prod",
+// or an intersection like "@prod & tag:api".
+type ConfigGroups map[string][]string
+
 type ConfigLogStream struct {
 	// HostAddr is the actual host to connect to.
 	//
@@ -32,6 +38,10 @@ type ConfigLogStream struct {
 	// the LStreamsResolver).
 	LogFiles []string `yaml:"log_files"`
 
+	// Tags are arbitrary labels like "db" or "api", which can be used in the
+	// logstreams input as "tag:db", to select all the logstreams having the tag.
+	Tags []string `yaml:"tags,omitempty"`
+
 	Options ConfigLogStreamOptions `yaml:"options"`
 }
 
@@ -54,6 +64,75 @@ type ConfigLogStreamOptions struct {
 	// custom env vars for tests, like: "export TZ=America/New_York", but
 	// might be useful outside of tests as well.
 	ShellInit []string `yaml:"shell_init,omitempty"`
+
+	// Reconnect overrides the reconnect policy for this logstream; the format
+	// is the same as in the reconnect option, like "attempts=5,max=30s". Only
+	// the specified parts are overridden, the rest is taken from the option.
+	Reconnect string `yaml:"reconnect,omitempty"`
+
+	// LuaScript is the path to a local Lua script which is invoked for every
+	// log line of this logstream, and can modify the message, level and
+	// context; see luaParseFuncName for details. It overrides the global
+	// script, if any.
+	LuaScript string `yaml:"lua_script,omitempty"`
+
+	// Parsers is the chain of parsers applied to every log message after the
+	// timestamp is parsed, like ["syslog", "json"]; see NewLogParser for the
+	// format of every item. If empty, DefaultLogParsers are used.
+	Parsers []string `yaml:"parsers,omitempty"`
+
+	// ParseRegex is a regex (in the Go syntax) applied to every log message
+	// after the Parsers; its named groups become context fields, and the
+	// groups "message" and "level" become the message and level. Lines not
+	// matching it are reported in the debug info. See CompileParseRegex.
+	ParseRegex string `yaml:"parse_regex,omitempty"`
+
+	// Multiline configures grouping of multi-line messages like stack traces
+	// into a single event: either "no_timestamp", meaning that lines not
+	// starting with a timestamp are continuations of the previous line, or
+	// "regex:" followed by an awk regex matching the continuation lines. See
+	// ParseMultilineRule.
+	Multiline string `yaml:"multiline,omitempty"`
+
+	// TimeFormat, if not empty, is the time format of the logs, either a
+	// Go-style layout like "2006-01-02 15:04:05" or a strftime one like
+	// "%Y-%m-%d %H:%M:%S"; then it's used instead of autodetecting it. See
+	// ParseTimeFormatSpec.
+	TimeFormat string `yaml:"time_format,omitempty"`
+
+	// Timezone, if not empty, is the IANA timezone name like "Europe/Berlin"
+	// or "UTC", which the logs without an explicit offset in timestamps are in;
+	// then it's used instead of the timezone detected on the host.
+	Timezone string `yaml:"timezone,omitempty"`
+
+	// ClockCorrection, if not empty, corrects the timestamps of the logs for
+	// the skew of the host clock relative to the local clock, so that the logs
+	// are merged with other logstreams in the right order: either "auto" to use
+	// the skew measured when connecting, or a duration like "1.5s" or "-200ms"
+	// meaning that the host clock is ahead (or behind) by that much. See
+	// ParseClockCorrection.
+	ClockCorrection string `yaml:"clock_correction,omitempty"`
+
+	// Levels are the rules to determine the level of the log messages, applied
+	// after the parsers unless they've already figured the level; the first
+	// matching rule wins. See NewLevelRules.
+	Levels []ConfigLevelRule `yaml:"levels,omitempty"`
+
+	// LevelGuessing, if set to false, disables guessing the level from the
+	// message text like "[E]" or "error", which is otherwise done if neither
+	// the parsers nor the Levels rules have figured the level.
+	LevelGuessing *bool `yaml:"level_guessing,omitempty"`
+}
+
+// ConfigLevelRule is a single rule to determine the level of a log message.
+type ConfigLevelRule struct {
+	// Regex is matched against the message.
+	Regex string `yaml:"regex"`
+
+	// Level is either the level to use if the regex matches ("error", "warn",
+	// "info" or "debug"), or the way to map the value captured by the regex to
+	// the level: "name", "severity", "pri" or "numeric". See NewLevelRules.
+	Level string `yaml:"level"`
 }
 
 func (lss ConfigLogStreams) Keys() []string {
@@ -67,6 +146,21 @@ func (lss ConfigLogStreams) Keys() []string {
 	return keys
 }
 
+// KeysByTag returns the sorted keys of all the logstreams having the given tag.
+func (lss ConfigLogStreams) KeysByTag(tag string) []string {
+	var keys []string
+	for _, k := range lss.Keys() {
+		for _, t := range lss[k].Tags {
+			if t == tag {
+				keys = append(keys, k)
+				break
+			}
+		}
+	}
+
+	return keys
+}
+
 // EffectiveSudoMode returns the SudoMode considering all fields that can
 // affect it: Sudo and SudoMode.
 func (opts ConfigLogStreamOptions) EffectiveSudoMode() SudoMode {
@@ -30,6 +30,13 @@ type QueryLogsParams struct {
 	// rebuild it from scratch (no-op for journalctl logstreams, because there's
 	// no nerdlog-maintained index for journalctl).
 	RefreshIndex bool
+
+	// RespCh, if non-nil, is where the response to this query will be sent,
+	// instead of being sent as an update to LStreamsManagerParams.UpdatesCh.
+	// Exactly one response is sent for every query, even if it's cancelled
+	// (then the response contains ErrQueryCancelled), so the channel must be
+	// buffered, to never block the LStreamsManager.
+	RespCh chan<- *LogRespTotal
 }
 
 // LogResp is a log response from a single logstream
@@ -46,6 +53,13 @@ type LogResp struct {
 
 	// DebugInfo contains info collected during this particular query.
 	DebugInfo LogstreamDebugInfo
+
+	// ClockSkew is how much the host clock is ahead of the local clock, as per
+	// the clock_correction option; the LStreamsManager subtracts it from the
+	// timestamps of Logs before merging them with other logstreams, and from
+	// the keys of MinuteStats (rounded to whole minutes). Zero if the
+	// timestamps shouldn't be corrected.
+	ClockSkew time.Duration
 }
 
 type LogstreamDebugInfo struct {
@@ -53,6 +67,16 @@ type LogstreamDebugInfo struct {
 	// info printed by the agent script.
 	AgentStdout []string
 	AgentStderr []string
+
+	// LuaErrors contains the errors from the user Lua script, if any. The lines
+	// for which the script has failed are still returned, just without the
+	// changes from the script.
+	LuaErrors []string `json:",omitempty"`
+
+	// ParseRegexMisses contains the lines which didn't match the parse_regex
+	// logstream option, if any. Such lines are still returned, just without
+	// the fields from the regex.
+	ParseRegexMisses []string `json:",omitempty"`
 }
 
 // LogRespTotal is a log response from a LStreamsManager. It's merged from
@@ -66,6 +90,10 @@ type LogRespTotal struct {
 	// the minute starting at this timestamp.
 	MinuteStats map[int64]MinuteStatsItem
 
+	// MinuteStatsByLStream is the same as MinuteStats, but broken down by the
+	// logstream name.
+	MinuteStatsByLStream map[string]map[int64]MinuteStatsItem
+
 	Logs []LogMsg
 
 	// NumMsgsTotal is the total number of messages in the time range (and
@@ -80,6 +108,10 @@ type LogRespTotal struct {
 
 	// QueryDur shows how long the query took.
 	QueryDur time.Duration
+
+	// logsCtx is the snapshot of the LStreamsManager's internal state which
+	// corresponds to this response; it's used by LStreamsManager.RestoreLogs.
+	logsCtx manLogsCtx
 }
 
 type MinuteStatsItem struct {
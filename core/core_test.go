@@ -60,6 +60,13 @@ type CoreTestStep struct {
 
 	// If Query is non-nil, we'll send a query to the LStreamsManager.
 	Query *CoreTestStepQuery `yaml:"query"`
+
+	// If StartQuery is non-nil, we'll send a query to the LStreamsManager
+	// without waiting for the results; it's useful to have it superseded by
+	// the next query.
+	StartQuery *CoreTestStepStartQuery `yaml:"start_query"`
+
+	CheckNoProcesses *CoreTestStepCheckNoProcesses `yaml:"check_no_processes"`
 }
 
 type CoreTestStepCheckState struct {
@@ -83,6 +90,25 @@ type CoreTestStepQuery struct {
 	Want string `yaml:"want"`
 }
 
+type CoreTestStepStartQuery struct {
+	Params CoreTestStepQueryParams `yaml:"params"`
+
+	// WaitProcess, if not empty, is a prefix of some argument (including the
+	// 0th one) of a process which we wait for to appear after starting the
+	// query, to make sure that the query is actually running by the time we
+	// proceed to the next step.
+	WaitProcess string `yaml:"wait_process"`
+}
+
+// CoreTestStepCheckNoProcesses checks that, within a few seconds, there are
+// no processes with any argument starting with any of the given prefixes.
+// Just like WaitProcess above, it only works if the test host is the local
+// machine, and processes can be listed via /proc; otherwise the whole
+// scenario is skipped.
+type CoreTestStepCheckNoProcesses struct {
+	ArgPrefixes []string `yaml:"arg_prefixes"`
+}
+
 // CoreTestStepQueryParams converts into QueryLogsParams (from core.go).
 type CoreTestStepQueryParams struct {
 	MaxNumLines int `yaml:"max_num_lines"`
@@ -173,6 +199,14 @@ func runCoreTestScenario(t *testing.T, tsCtx *coreTestScenarioContext) error {
 		return errors.Annotatef(err, "current_time must not be zero in %s", testScenarioDescrFname)
 	}
 
+	// Skip the scenario upfront if it needs to check local processes but we
+	// can't list them, so that it doesn't silently pass without checking.
+	if tc.needsLocalProcesses() {
+		if _, err := os.Stat("/proc/self/cmdline"); err != nil {
+			t.Skipf("can't list local processes: %s", err.Error())
+		}
+	}
+
 	clockMock := clock.NewMock()
 	clockMock.Set(tc.CurrentTime.Time)
 
@@ -251,6 +285,26 @@ func runCoreTestScenario(t *testing.T, tsCtx *coreTestScenarioContext) error {
 			}
 
 			assert.Equal(t, string(wantLogResp), logRespStr, assertArgs...)
+		} else if startQuery := step.StartQuery; startQuery != nil {
+			if isFirstQuery {
+				startQuery.Params.RefreshIndex = true
+				isFirstQuery = false
+			}
+
+			if err := manTH.StartQuery(startQuery.Params); err != nil {
+				return errors.Annotatef(err, "test step #%d: starting query %+v", i, startQuery.Params)
+			}
+
+			if startQuery.WaitProcess != "" {
+				err := waitLocalProcesses(startQuery.WaitProcess, true)
+				if err != nil {
+					return errors.Annotatef(err, "test step #%d", i)
+				}
+			}
+		} else if checkNoProcesses := step.CheckNoProcesses; checkNoProcesses != nil {
+			for _, prefix := range checkNoProcesses.ArgPrefixes {
+				assert.NoError(t, waitLocalProcesses(prefix, false), assertArgs...)
+			}
 		}
 	}
 
@@ -305,6 +359,15 @@ func newLStreamsManagerTestHelper(
 		}
 
 		options := testCfg.Options
+
+		// Make the host clock match the mocked one, so that there is no clock
+		// skew, unless the test scenario overrides it in its own shell_init.
+		// Also let the scenario refer to its own files, e.g. helper scripts.
+		options.ShellInit = append([]string{
+			fmt.Sprintf("export NERDLOG_HOST_TIME_MOCK=%d", clockMock.Now().Unix()),
+			fmt.Sprintf("export NERDLOG_CORE_TEST_SCENARIO_DIR=%s", tsCtx.testScenarioDir),
+		}, options.ShellInit...)
+
 		for _, envVar := range provisioned.ExtraEnv {
 			options.ShellInit = append(options.ShellInit, fmt.Sprintf("export %s", envVar))
 		}
@@ -434,15 +497,24 @@ func (th *LStreamsManagerTestHelper) WaitConnected() {
 }
 
 func (th *LStreamsManagerTestHelper) QueryLogs(params CoreTestStepQueryParams) (*LogRespTotal, error) {
+	if err := th.StartQuery(params); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return th.WaitNextLogResp()
+}
+
+// StartQuery sends the query without waiting for the results.
+func (th *LStreamsManagerTestHelper) StartQuery(params CoreTestStepQueryParams) error {
 	// Sanity check that there is no existing pending log resp
 	existing := th.nextLogResp()
 	if existing != nil {
-		return existing, errors.Errorf("there was existing pending log resp")
+		return errors.Errorf("there was existing pending log resp")
 	}
 
 	th.manager.QueryLogs(params.RealParams())
 
-	return th.WaitNextLogResp()
+	return nil
 }
 
 func (th *LStreamsManagerTestHelper) GetLSMState() *LStreamsManagerState {
@@ -485,6 +557,75 @@ func (th *LStreamsManagerTestHelper) CloseAndWait() error {
 	}
 }
 
+// needsLocalProcesses returns whether any of the steps needs to list the
+// local processes.
+func (tc *CoreTestScenarioYaml) needsLocalProcesses() bool {
+	for _, step := range tc.TestSteps {
+		if step.CheckNoProcesses != nil ||
+			(step.StartQuery != nil && step.StartQuery.WaitProcess != "") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// waitLocalProcesses waits for a few seconds until there are (if wantExist
+// is true) or there are no (if wantExist is false) local processes with some
+// argument starting with the given prefix. The caller must make sure that
+// processes can be listed, see needsLocalProcesses.
+func waitLocalProcesses(argPrefix string, wantExist bool) error {
+	start := time.Now()
+
+	for {
+		cmdlines := findLocalProcesses(argPrefix)
+		if (len(cmdlines) > 0) == wantExist {
+			return nil
+		}
+
+		if time.Since(start) > 5*time.Second {
+			if wantExist {
+				return errors.Errorf("timed out waiting for a process %q", argPrefix)
+			}
+
+			return errors.Errorf(
+				"timed out waiting for processes %q to exit: %s",
+				argPrefix, strings.Join(cmdlines, "; "),
+			)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// findLocalProcesses returns the command lines (with the args joined by
+// spaces) of the local processes with some argument starting with the given
+// prefix. NOTE that it intentionally doesn't just look for a substring in the
+// whole command line, since then it would also find e.g. the shell which runs
+// the tests, if the prefix happens to be mentioned in its command.
+func findLocalProcesses(argPrefix string) []string {
+	paths, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+
+	var ret []string
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			// The process has probably exited already.
+			continue
+		}
+
+		args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+		for _, arg := range args {
+			if strings.HasPrefix(arg, argPrefix) {
+				ret = append(ret, strings.Join(args, " "))
+				break
+			}
+		}
+	}
+
+	return ret
+}
+
 func formatLogResp(logResp *LogRespTotal) string {
 	var sb strings.Builder
 
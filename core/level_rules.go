@@ -0,0 +1,228 @@
+package core
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// LevelRuleName means that the captured value is a level name like
+	// "ERROR", "warning" or "I"; see parseLogLevelName.
+	LevelRuleName = "name"
+
+	// LevelRuleSeverity means that the captured value is a numeric syslog
+	// severity, from 0 (emerg) to 7 (debug).
+	LevelRuleSeverity = "severity"
+
+	// LevelRulePRI means that the captured value is a syslog PRI value, like
+	// "13" in "<13>", which is facility * 8 + severity.
+	LevelRulePRI = "pri"
+
+	// LevelRuleNumeric means that the captured value is a numeric level as
+	// used by bunyan, pino and the like: 10 is trace, 20 is debug, 30 is info,
+	// 40 is warn, 50 is error and 60 is fatal.
+	LevelRuleNumeric = "numeric"
+)
+
+// levelRuleCaptureGroup is the name of the capture group which contains the
+// value to be mapped to the level; if there's no such group, the first one
+// is used.
+const levelRuleCaptureGroup = "level"
+
+// LevelRules is a list of rules to determine the level of the log message;
+// the first matching rule wins.
+type LevelRules struct {
+	rules []levelRule
+}
+
+type levelRule struct {
+	re *regexp.Regexp
+
+	// groupIdx is the index of the capture group with the value to map; only
+	// used if mapValue is not nil.
+	groupIdx int
+
+	// Exactly one of level and mapValue is set: level is used as is if the
+	// regex matches, and mapValue maps the captured value to the level.
+	level    LogLevel
+	mapValue func(v string) LogLevel
+}
+
+// NewLevelRules creates the LevelRules from the config. Every rule has a regex
+// matched against the message, and a level, which is either the level to use
+// if the regex matches ("error", "warn", "info" or "debug"), or one of the
+// LevelRuleName, LevelRuleSeverity, LevelRulePRI or LevelRuleNumeric, which
+// mean that the value captured by the regex (by the group named "level", or
+// by the first group) should be mapped to the level.
+//
+// For an empty config, it returns nil, which is a valid LevelRules which
+// doesn't match anything.
+func NewLevelRules(cfgRules []ConfigLevelRule) (*LevelRules, error) {
+	if len(cfgRules) == 0 {
+		return nil, nil
+	}
+
+	ret := &LevelRules{
+		rules: make([]levelRule, 0, len(cfgRules)),
+	}
+
+	for i, cfgRule := range cfgRules {
+		rule, err := newLevelRule(cfgRule)
+		if err != nil {
+			return nil, errors.Annotatef(err, "rule #%d", i+1)
+		}
+
+		ret.rules = append(ret.rules, rule)
+	}
+
+	return ret, nil
+}
+
+func newLevelRule(cfgRule ConfigLevelRule) (levelRule, error) {
+	if cfgRule.Regex == "" {
+		return levelRule{}, errors.Errorf("regex is required")
+	}
+
+	re, err := regexp.Compile(cfgRule.Regex)
+	if err != nil {
+		return levelRule{}, errors.Trace(err)
+	}
+
+	rule := levelRule{re: re}
+
+	switch strings.ToLower(cfgRule.Level) {
+	case string(LogLevelError):
+		rule.level = LogLevelError
+		return rule, nil
+	case string(LogLevelWarn):
+		rule.level = LogLevelWarn
+		return rule, nil
+	case string(LogLevelInfo):
+		rule.level = LogLevelInfo
+		return rule, nil
+	case string(LogLevelDebug):
+		rule.level = LogLevelDebug
+		return rule, nil
+
+	case LevelRuleName:
+		rule.mapValue = parseLogLevelName
+	case LevelRuleSeverity:
+		rule.mapValue = levelFromSyslogSeverity
+	case LevelRulePRI:
+		rule.mapValue = levelFromSyslogPRI
+	case LevelRuleNumeric:
+		rule.mapValue = levelFromNumeric
+
+	default:
+		return levelRule{}, errors.Errorf(
+			"invalid level %q; valid ones are: %q, %q, %q, %q, %q, %q, %q, %q",
+			cfgRule.Level,
+			LogLevelError, LogLevelWarn, LogLevelInfo, LogLevelDebug,
+			LevelRuleName, LevelRuleSeverity, LevelRulePRI, LevelRuleNumeric,
+		)
+	}
+
+	// The value needs to be captured, find the group.
+	rule.groupIdx = re.SubexpIndex(levelRuleCaptureGroup)
+	if rule.groupIdx < 0 {
+		if re.NumSubexp() == 0 {
+			return levelRule{}, errors.Errorf(
+				"level %q requires a capture group in the regex", cfgRule.Level,
+			)
+		}
+
+		rule.groupIdx = 1
+	}
+
+	return rule, nil
+}
+
+// Apply sets the level of the message according to the first matching rule,
+// and returns whether the level was set. It's fine to call it on nil
+// LevelRules, then it always returns false.
+func (lr *LevelRules) Apply(logMsg *LogMsg) bool {
+	if lr == nil {
+		return false
+	}
+
+	for _, rule := range lr.rules {
+		if rule.mapValue == nil {
+			if rule.re.MatchString(logMsg.Msg) {
+				logMsg.Level = rule.level
+				return true
+			}
+
+			continue
+		}
+
+		matches := rule.re.FindStringSubmatch(logMsg.Msg)
+		if matches == nil {
+			continue
+		}
+
+		// If the captured value can't be mapped, try the next rules.
+		if level := rule.mapValue(matches[rule.groupIdx]); level != LogLevelUnknown {
+			logMsg.Level = level
+			return true
+		}
+	}
+
+	return false
+}
+
+// levelFromSyslogSeverity maps the syslog severity from 0 (emerg) to 7 (debug)
+// to the LogLevel.
+func levelFromSyslogSeverity(v string) LogLevel {
+	severity, err := strconv.Atoi(v)
+	if err != nil || severity < 0 || severity > 7 {
+		return LogLevelUnknown
+	}
+
+	switch {
+	case severity <= 3:
+		// emerg, alert, crit, err
+		return LogLevelError
+	case severity == 4:
+		return LogLevelWarn
+	case severity <= 6:
+		// notice, info
+		return LogLevelInfo
+	default:
+		return LogLevelDebug
+	}
+}
+
+// levelFromSyslogPRI maps the syslog PRI value (facility * 8 + severity) to
+// the LogLevel.
+func levelFromSyslogPRI(v string) LogLevel {
+	pri, err := strconv.Atoi(v)
+	// The max facility is 23 (local7).
+	if err != nil || pri < 0 || pri > 23*8+7 {
+		return LogLevelUnknown
+	}
+
+	return levelFromSyslogSeverity(strconv.Itoa(pri % 8))
+}
+
+// levelFromNumeric maps the numeric level as used by bunyan, pino and the
+// like to the LogLevel.
+func levelFromNumeric(v string) LogLevel {
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return LogLevelUnknown
+	}
+
+	switch {
+	case n >= 50:
+		return LogLevelError
+	case n >= 40:
+		return LogLevelWarn
+	case n >= 30:
+		return LogLevelInfo
+	default:
+		return LogLevelDebug
+	}
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevelRules(t *testing.T) {
+	rules, err := NewLevelRules([]ConfigLevelRule{
+		{Regex: `^<(?P<level>[0-9]+)>`, Level: "pri"},
+		{Regex: `"level":([0-9]+)`, Level: "numeric"},
+		{Regex: `sev=([0-9])`, Level: "severity"},
+		{Regex: `^\[(?P<level>[A-Za-z]+)\]`, Level: "name"},
+		{Regex: `\b[1-9][0-9]* errors? found\b`, Level: "warn"},
+		{Regex: `\berrors? found\b`, Level: "info"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	type testCase struct {
+		msg       string
+		wantLevel LogLevel
+		wantOK    bool
+	}
+
+	testCases := []testCase{
+		{msg: "<11>foo", wantLevel: LogLevelError, wantOK: true},
+		{msg: "<13>foo", wantLevel: LogLevelInfo, wantOK: true},
+		{msg: "<15>foo", wantLevel: LogLevelDebug, wantOK: true},
+		{msg: "<12>foo", wantLevel: LogLevelWarn, wantOK: true},
+		{msg: `{"level":50,"msg":"foo"}`, wantLevel: LogLevelError, wantOK: true},
+		{msg: `{"level":30,"msg":"foo"}`, wantLevel: LogLevelInfo, wantOK: true},
+		{msg: `{"level":10,"msg":"foo"}`, wantLevel: LogLevelDebug, wantOK: true},
+		{msg: "foo sev=4", wantLevel: LogLevelWarn, wantOK: true},
+		{msg: "[WARNING] foo", wantLevel: LogLevelWarn, wantOK: true},
+		{msg: "3 errors found", wantLevel: LogLevelWarn, wantOK: true},
+		{msg: "0 errors found", wantLevel: LogLevelInfo, wantOK: true},
+
+		// Values which can't be mapped fall through to the next rules.
+		{msg: "<999>foo", wantOK: false},
+		{msg: "[verbose] foo", wantOK: false},
+		{msg: "foo sev=9", wantOK: false},
+
+		{msg: "something else", wantOK: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.msg, func(t *testing.T) {
+			logMsg := LogMsg{Msg: tc.msg}
+			assert.Equal(t, tc.wantOK, rules.Apply(&logMsg))
+			assert.Equal(t, tc.wantLevel, logMsg.Level)
+		})
+	}
+
+	// Nil rules don't match anything.
+	var nilRules *LevelRules
+	assert.False(t, nilRules.Apply(&LogMsg{Msg: "error"}))
+}
+
+func TestNewLevelRulesErrors(t *testing.T) {
+	rules, err := NewLevelRules(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, rules)
+
+	_, err = NewLevelRules([]ConfigLevelRule{{Regex: "", Level: "error"}})
+	assert.EqualError(t, err, "rule #1: regex is required")
+
+	_, err = NewLevelRules([]ConfigLevelRule{{Regex: "(", Level: "error"}})
+	assert.Error(t, err)
+
+	_, err = NewLevelRules([]ConfigLevelRule{
+		{Regex: "foo", Level: "error"},
+		{Regex: "bar", Level: "critical"},
+	})
+	assert.EqualError(t, err, `rule #2: invalid level "critical"; valid ones are: "error", "warn", "info", "debug", "name", "severity", "pri", "numeric"`)
+
+	_, err = NewLevelRules([]ConfigLevelRule{{Regex: "<[0-9]+>", Level: "pri"}})
+	assert.EqualError(t, err, `rule #1: level "pri" requires a capture group in the regex`)
+}
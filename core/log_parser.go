@@ -0,0 +1,652 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// LogParser parses a single log message further, after the timestamp was
+// parsed and removed from the Msg. It can update the Msg, Level and Context
+// of the LogMsg.
+//
+// Parsers are applied as a chain (see LogParserChain), so every parser
+// receives what the previous one has left in the Msg: e.g. the syslog parser
+// strips the envelope like "myhost myprogram[1234]: ", and the next parser
+// can parse the rest of the payload.
+//
+// If the message is not in the format a parser understands, the parser should
+// leave it untouched and return nil; an error means that the line is broken,
+// and it will fail to parse.
+type LogParser interface {
+	Parse(logMsg *LogMsg) error
+}
+
+// LogParserFunc is an adapter to use ordinary functions as LogParser.
+type LogParserFunc func(logMsg *LogMsg) error
+
+func (f LogParserFunc) Parse(logMsg *LogMsg) error {
+	return f(logMsg)
+}
+
+// LogParserFactory creates a LogParser. The arg is everything after the
+// colon in the parser spec, like "foo" in "regex:foo"; it's an empty string
+// if there's no colon.
+type LogParserFactory func(arg string) (LogParser, error)
+
+var (
+	logParsersMtx sync.Mutex
+	logParsers    = map[string]LogParserFactory{}
+)
+
+// RegisterLogParser registers the parser factory under the given name, so
+// that it can be used in the "parsers" logstream option. It panics if a
+// parser with this name is already registered.
+func RegisterLogParser(name string, factory LogParserFactory) {
+	logParsersMtx.Lock()
+	defer logParsersMtx.Unlock()
+
+	if _, ok := logParsers[name]; ok {
+		panic(fmt.Sprintf("log parser %q is already registered", name))
+	}
+
+	logParsers[name] = factory
+}
+
+// LogParserNames returns the sorted names of all the registered parsers.
+func LogParserNames() []string {
+	logParsersMtx.Lock()
+	defer logParsersMtx.Unlock()
+
+	names := make([]string, 0, len(logParsers))
+	for name := range logParsers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// NewLogParser creates a parser from the spec, which is either just the name
+// of a registered parser like "syslog", or the name followed by a colon and
+// an argument, like "regex:^(?P<message>.*)$".
+func NewLogParser(spec string) (LogParser, error) {
+	name, arg := spec, ""
+	if idx := strings.IndexByte(spec, ':'); idx >= 0 {
+		name, arg = spec[:idx], spec[idx+1:]
+	}
+
+	logParsersMtx.Lock()
+	factory, ok := logParsers[name]
+	logParsersMtx.Unlock()
+
+	if !ok {
+		return nil, errors.Errorf(
+			"unknown parser %q; valid ones are: %s", name, strings.Join(LogParserNames(), ", "),
+		)
+	}
+
+	parser, err := factory(arg)
+	if err != nil {
+		return nil, errors.Annotatef(err, "parser %s", name)
+	}
+
+	return parser, nil
+}
+
+// DefaultLogParsers is the parser chain used for logstreams which don't
+// specify any parsers.
+var DefaultLogParsers = []string{"syslog"}
+
+// LogParserChain applies multiple parsers in order.
+type LogParserChain struct {
+	parsers []LogParser
+}
+
+// NewLogParserChain creates a chain from the parser specs (see
+// NewLogParser). If specs is empty, DefaultLogParsers are used.
+func NewLogParserChain(specs []string) (*LogParserChain, error) {
+	if len(specs) == 0 {
+		specs = DefaultLogParsers
+	}
+
+	chain := &LogParserChain{}
+	for _, spec := range specs {
+		parser, err := NewLogParser(spec)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		chain.parsers = append(chain.parsers, parser)
+	}
+
+	return chain, nil
+}
+
+func (c *LogParserChain) Parse(logMsg *LogMsg) error {
+	for _, parser := range c.parsers {
+		if err := parser.Parse(logMsg); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	RegisterLogParser("syslog", newSyslogParser)
+	RegisterLogParser("json", newJSONParser)
+	RegisterLogParser("logfmt", newLogfmtParser)
+	RegisterLogParser("regex", newRegexParser)
+	RegisterLogParser("passthrough", newPassthroughParser)
+}
+
+// NOTE: the "s" flag is needed for grouped multi-line messages, so that the
+// payload includes all the lines.
+var syslogRegex = regexp.MustCompile(`(?s)^(\S+)\s+(\S+?)(?:\[(\d+)\])?:\s+(.*)`)
+
+// rfc5424Regex matches the RFC 5424 syslog message with the timestamp already
+// removed, like "<34>1 myhost myapp 1234 ID47 [sd@1 k="v"] Something
+// happened". The groups are: PRI, version, hostname, app-name, procid, msgid,
+// and the rest, which is structured data followed by the message.
+var rfc5424Regex = regexp.MustCompile(`(?s)^<(\d{1,3})>(\d{1,2}) (\S+) (\S+) (\S+) (\S+) (.*)`)
+
+// rfc5424NilValue is used in RFC 5424 messages for the missing fields.
+const rfc5424NilValue = "-"
+
+// newSyslogParser creates the parser which takes the Msg looking like this:
+//
+//	"myhost myprogram[1234]: Something happened"
+//
+// And if it indeed looks like a syslog message, it extracts the hostname,
+// program and pid from it, populates them in the Context, and updates the
+// message to contain the rest of the payload.
+//
+// It also understands RFC 5424 messages, see parseRFC5424.
+func newSyslogParser(arg string) (LogParser, error) {
+	if arg != "" {
+		return nil, errors.Errorf("no argument expected")
+	}
+
+	return LogParserFunc(func(logMsg *LogMsg) error {
+		if parseRFC5424(logMsg) {
+			return nil
+		}
+
+		matches := syslogRegex.FindStringSubmatch(logMsg.Msg)
+		if len(matches) == 0 {
+			// Message doesn't match syslog pattern, no-op
+			return nil
+		}
+
+		logMsg.Context["hostname"] = matches[1]
+		logMsg.Context["program"] = matches[2]
+		logMsg.Context["pid"] = matches[3]
+
+		logMsg.Msg = matches[4]
+		return nil
+	}), nil
+}
+
+// parseRFC5424 parses the RFC 5424 message with the timestamp already removed,
+// like this:
+//
+//	<34>1 myhost myapp 1234 ID47 [exampleSDID@32473 iut="3" eventID="1011"] Something happened
+//
+// The hostname, app-name and procid become the "hostname", "program" and
+// "pid" context fields, just like with the traditional syslog; PRI, version
+// and msgid become "pri", "version" and "msgid", and structured data params
+// become the fields like "exampleSDID@32473.iut". The severity from PRI
+// becomes the Level. If the message doesn't look like RFC 5424, it's left
+// untouched and false is returned.
+func parseRFC5424(logMsg *LogMsg) bool {
+	matches := rfc5424Regex.FindStringSubmatch(logMsg.Msg)
+	if len(matches) == 0 {
+		return false
+	}
+
+	level := levelFromSyslogPRI(matches[1])
+	if level == LogLevelUnknown {
+		// Invalid PRI
+		return false
+	}
+
+	sdParams, rest, ok := parseRFC5424StructuredData(matches[7])
+	if !ok {
+		return false
+	}
+
+	nilToEmpty := func(s string) string {
+		if s == rfc5424NilValue {
+			return ""
+		}
+		return s
+	}
+
+	logMsg.Context["pri"] = matches[1]
+	logMsg.Context["version"] = matches[2]
+	logMsg.Context["hostname"] = nilToEmpty(matches[3])
+	logMsg.Context["program"] = nilToEmpty(matches[4])
+	logMsg.Context["pid"] = nilToEmpty(matches[5])
+	if msgID := nilToEmpty(matches[6]); msgID != "" {
+		logMsg.Context["msgid"] = msgID
+	}
+
+	for _, param := range sdParams {
+		setContextField(logMsg, param.key, param.value)
+	}
+
+	logMsg.Level = level
+
+	// The message might start with the BOM, meaning that it's UTF-8.
+	logMsg.Msg = strings.TrimPrefix(rest, "\ufeff")
+
+	return true
+}
+
+// parseRFC5424StructuredData parses the structured data at the beginning of
+// the string, which is either a "-", or one or more elements like
+// `[exampleSDID@32473 iut="3" eventID="1011"]`, and returns the params (with
+// keys like "exampleSDID@32473.iut"), and the rest of the string after the
+// structured data and the space, if any. If the structured data is invalid,
+// ok is false.
+func parseRFC5424StructuredData(s string) (params []logfmtPair, rest string, ok bool) {
+	if s == rfc5424NilValue || strings.HasPrefix(s, rfc5424NilValue+" ") {
+		return nil, strings.TrimPrefix(s[1:], " "), true
+	}
+
+	if !strings.HasPrefix(s, "[") {
+		return nil, "", false
+	}
+
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+
+		// SD-ID is terminated by either a space or "]".
+		idEnd := strings.IndexAny(s, " ]")
+		if idEnd <= 0 {
+			return nil, "", false
+		}
+
+		sdID := s[:idEnd]
+		s = s[idEnd:]
+
+		for strings.HasPrefix(s, " ") {
+			s = s[1:]
+
+			eqIdx := strings.Index(s, `="`)
+			if eqIdx <= 0 {
+				return nil, "", false
+			}
+
+			name := s[:eqIdx]
+			s = s[eqIdx+2:]
+
+			// The value is terminated by an unescaped quote; backslash escapes
+			// '"', '\' and ']'.
+			var sb strings.Builder
+			closed := false
+			for i := 0; i < len(s); i++ {
+				c := s[i]
+				if c == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+					sb.WriteByte(s[i+1])
+					i++
+					continue
+				}
+
+				if c == '"' {
+					s = s[i+1:]
+					closed = true
+					break
+				}
+
+				sb.WriteByte(c)
+			}
+
+			if !closed {
+				return nil, "", false
+			}
+
+			params = append(params, logfmtPair{
+				key:   sdID + "." + name,
+				value: sb.String(),
+			})
+		}
+
+		if !strings.HasPrefix(s, "]") {
+			return nil, "", false
+		}
+		s = s[1:]
+	}
+
+	if s != "" && !strings.HasPrefix(s, " ") {
+		return nil, "", false
+	}
+
+	return params, strings.TrimPrefix(s, " "), true
+}
+
+// newJSONParser creates the parser which, if the Msg is a JSON object,
+// puts its fields into the Context; the "msg" or "message" field becomes the
+// Msg, and "level" becomes the Level, if it's a known one.
+//
+// Nested objects are flattened, with the keys joined with a dot: e.g.
+// {"http":{"status":500}} becomes the "http.status" field. Arrays and other
+// non-string values are kept as JSON.
+func newJSONParser(arg string) (LogParser, error) {
+	if arg != "" {
+		return nil, errors.Errorf("no argument expected")
+	}
+
+	return LogParserFunc(func(logMsg *LogMsg) error {
+		payload := strings.TrimSpace(logMsg.Msg)
+		if !strings.HasPrefix(payload, "{") {
+			return nil
+		}
+
+		dec := json.NewDecoder(strings.NewReader(payload))
+		dec.UseNumber()
+
+		var obj map[string]interface{}
+		if err := dec.Decode(&obj); err != nil || dec.More() {
+			// Not a valid JSON object, so leave it as is.
+			return nil
+		}
+
+		msgKey := ""
+		for _, k := range []string{"msg", "message"} {
+			if _, ok := obj[k]; ok {
+				msgKey = k
+				break
+			}
+		}
+
+		for k, v := range obj {
+			switch {
+			case msgKey != "" && k == msgKey:
+				logMsg.Msg = jsonValueString(v)
+			case k == "level":
+				setLevelField(logMsg, jsonValueString(v))
+			default:
+				flattenJSONField(logMsg, k, v)
+			}
+		}
+
+		return nil
+	}), nil
+}
+
+// flattenJSONField sets the context field with the given key; if the value
+// is an object, then every field of it is set instead, recursively, with the
+// key like "key.subkey".
+func flattenJSONField(logMsg *LogMsg, key string, v interface{}) {
+	obj, ok := v.(map[string]interface{})
+	if !ok || len(obj) == 0 {
+		setContextField(logMsg, key, jsonValueString(v))
+		return
+	}
+
+	for k, subv := range obj {
+		flattenJSONField(logMsg, key+"."+k, subv)
+	}
+}
+
+// jsonValueString returns strings as is, and the JSON representation of
+// everything else.
+func jsonValueString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// newLogfmtParser creates the parser which, if the Msg is a sequence of
+// logfmt pairs like `level=warn msg="slow query" dur=1.2s`, puts them into the
+// Context; the "msg" or "message" field becomes the Msg, and "level" becomes
+// the Level, if it's a known one. If any part of the Msg is not a valid pair,
+// the Msg is left untouched.
+func newLogfmtParser(arg string) (LogParser, error) {
+	if arg != "" {
+		return nil, errors.Errorf("no argument expected")
+	}
+
+	return LogParserFunc(func(logMsg *LogMsg) error {
+		pairs, ok := parseLogfmt(logMsg.Msg)
+		if !ok {
+			return nil
+		}
+
+		// Prefer "msg" if both "msg" and "message" are present.
+		msgKey := ""
+		for _, p := range pairs {
+			if p.key == "msg" || (p.key == "message" && msgKey == "") {
+				msgKey = p.key
+			}
+		}
+
+		for _, p := range pairs {
+			switch {
+			case msgKey != "" && p.key == msgKey:
+				logMsg.Msg = p.value
+			case p.key == "level":
+				setLevelField(logMsg, p.value)
+			default:
+				setContextField(logMsg, p.key, p.value)
+			}
+		}
+
+		return nil
+	}), nil
+}
+
+type logfmtPair struct {
+	key   string
+	value string
+}
+
+// parseLogfmt parses the string like `foo=bar baz="hello \"world\"" qux=`;
+// values can be either bare or double-quoted with Go-style escapes. If
+// something in the string is not a valid pair, or if there are no pairs at
+// all, ok is false.
+func parseLogfmt(s string) (pairs []logfmtPair, ok bool) {
+	s = strings.TrimSpace(s)
+
+	for s != "" {
+		eqIdx := strings.IndexByte(s, '=')
+		if eqIdx <= 0 {
+			return nil, false
+		}
+
+		key := s[:eqIdx]
+		if strings.ContainsAny(key, " \t\"") {
+			return nil, false
+		}
+
+		s = s[eqIdx+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			// Find the closing quote, skipping the escaped ones.
+			end := -1
+			for i := 1; i < len(s); i++ {
+				if s[i] == '\\' {
+					i++
+					continue
+				}
+
+				if s[i] == '"' {
+					end = i
+					break
+				}
+			}
+
+			if end < 0 {
+				return nil, false
+			}
+
+			var err error
+			value, err = strconv.Unquote(s[:end+1])
+			if err != nil {
+				return nil, false
+			}
+
+			s = s[end+1:]
+			if s != "" && s[0] != ' ' && s[0] != '\t' {
+				return nil, false
+			}
+		} else {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+
+			value = s[:end]
+			if strings.ContainsRune(value, '"') {
+				return nil, false
+			}
+
+			s = s[end:]
+		}
+
+		pairs = append(pairs, logfmtPair{key: key, value: value})
+		s = strings.TrimLeft(s, " \t")
+	}
+
+	return pairs, len(pairs) > 0
+}
+
+// newRegexParser creates the parser which matches the Msg against the regex
+// given as the arg, and puts the named groups into the Context; the group
+// named "message" becomes the Msg, and "level" becomes the Level. If the Msg
+// doesn't match, it's left untouched.
+func newRegexParser(arg string) (LogParser, error) {
+	if arg == "" {
+		return nil, errors.Errorf("regex is required, like regex:^(?P<message>.*)$")
+	}
+
+	re, err := regexp.Compile(arg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return LogParserFunc(func(logMsg *LogMsg) error {
+		applyRegexGroups(re, logMsg)
+		return nil
+	}), nil
+}
+
+// CompileParseRegex compiles the regex given as the parse_regex logstream
+// option; it must have at least one named group. For an empty string, it
+// returns nil.
+func CompileParseRegex(s string) (*regexp.Regexp, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	hasNamed := false
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			hasNamed = true
+			break
+		}
+	}
+
+	if !hasNamed {
+		return nil, errors.Errorf("regex has no named groups, like (?P<message>.*)")
+	}
+
+	return re, nil
+}
+
+// applyRegexGroups matches the Msg against the regex, and puts the named
+// groups into the Context; the group named "message" becomes the Msg, and
+// "level" becomes the Level. If the Msg doesn't match, it's left untouched
+// and false is returned.
+func applyRegexGroups(re *regexp.Regexp, logMsg *LogMsg) bool {
+	matches := re.FindStringSubmatch(logMsg.Msg)
+	if len(matches) == 0 {
+		return false
+	}
+
+	for i, name := range re.SubexpNames() {
+		if name == "" {
+			continue
+		}
+
+		switch name {
+		case "message":
+			logMsg.Msg = matches[i]
+		case "level":
+			setLevelField(logMsg, matches[i])
+		default:
+			setContextField(logMsg, name, matches[i])
+		}
+	}
+
+	return true
+}
+
+// newPassthroughParser creates the parser which leaves the Msg as is; it's
+// useful to disable the default parsers for a logstream.
+func newPassthroughParser(arg string) (LogParser, error) {
+	if arg != "" {
+		return nil, errors.Errorf("no argument expected")
+	}
+
+	return LogParserFunc(func(logMsg *LogMsg) error {
+		return nil
+	}), nil
+}
+
+// setContextField sets the context field, unless it's "lstream", which is
+// used by nerdlog itself and can't be overridden by parsers.
+func setContextField(logMsg *LogMsg, key, value string) {
+	if key == "lstream" {
+		return
+	}
+
+	logMsg.Context[key] = value
+}
+
+// setLevelField sets the Level from the level field value; if it's not a
+// known level name, the value is put in the Context as is.
+func setLevelField(logMsg *LogMsg, value string) {
+	if level := parseLogLevelName(value); level != LogLevelUnknown {
+		logMsg.Level = level
+		return
+	}
+
+	setContextField(logMsg, "level", value)
+}
+
+// parseLogLevelName maps commonly used level names like "ERROR", "warning",
+// "I" etc to the LogLevel; for unknown ones, LogLevelUnknown is returned.
+func parseLogLevelName(s string) LogLevel {
+	switch strings.ToLower(s) {
+	case "fatal", "panic", "crit", "critical", "alert", "emerg", "emergency",
+		"error", "err", "erro", "e", "f":
+		return LogLevelError
+	case "warn", "warning", "w":
+		return LogLevelWarn
+	case "info", "information", "notice", "i":
+		return LogLevelInfo
+	case "debug", "debu", "trace", "d":
+		return LogLevelDebug
+	default:
+		return LogLevelUnknown
+	}
+}
@@ -0,0 +1,272 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogParserChain(t *testing.T) {
+	type testCase struct {
+		name    string
+		parsers []string
+		msg     string
+
+		wantMsg   string
+		wantLevel LogLevel
+		wantCtx   map[string]string
+	}
+
+	testCases := []testCase{
+		{
+			name:    "default syslog",
+			parsers: nil,
+			msg:     "myhost myprogram[1234]: Something happened",
+
+			wantMsg: "Something happened",
+			wantCtx: map[string]string{
+				"lstream":  "foo",
+				"hostname": "myhost",
+				"program":  "myprogram",
+				"pid":      "1234",
+			},
+		},
+		{
+			name:    "syslog not matching",
+			parsers: []string{"syslog"},
+			msg:     "just some text",
+
+			wantMsg: "just some text",
+			wantCtx: map[string]string{"lstream": "foo"},
+		},
+		{
+			name:    "syslog RFC 5424",
+			parsers: nil,
+			msg:     `<34>1 myhost su 1234 ID47 [exampleSDID@32473 iut="3" eventSource="App\"lic\\ation\]"][examplePriority@32473 class="high"] ` + "\ufeff'su root' failed",
+
+			wantMsg:   "'su root' failed",
+			wantLevel: LogLevelError,
+			wantCtx: map[string]string{
+				"lstream":                       "foo",
+				"pri":                           "34",
+				"version":                       "1",
+				"hostname":                      "myhost",
+				"program":                       "su",
+				"pid":                           "1234",
+				"msgid":                         "ID47",
+				"exampleSDID@32473.iut":         "3",
+				"exampleSDID@32473.eventSource": `App"lic\ation]`,
+				"examplePriority@32473.class":   "high",
+			},
+		},
+		{
+			name:    "syslog RFC 5424 with nil values",
+			parsers: []string{"syslog"},
+			msg:     `<165>1 myhost - - - - Something happened`,
+
+			wantMsg:   "Something happened",
+			wantLevel: LogLevelInfo,
+			wantCtx: map[string]string{
+				"lstream":  "foo",
+				"pri":      "165",
+				"version":  "1",
+				"hostname": "myhost",
+				"program":  "",
+				"pid":      "",
+			},
+		},
+		{
+			name:    "syslog RFC 5424 with invalid structured data",
+			parsers: []string{"syslog"},
+			msg:     `<165>1 myhost app - - [foo bar] Something happened`,
+
+			wantMsg: `<165>1 myhost app - - [foo bar] Something happened`,
+			wantCtx: map[string]string{"lstream": "foo"},
+		},
+		{
+			name:    "syslog and json",
+			parsers: []string{"syslog", "json"},
+			msg:     `myhost myprogram: {"msg":"hello","level":"WARN","n":5,"lstream":"bar","ok":true}`,
+
+			wantMsg:   "hello",
+			wantLevel: LogLevelWarn,
+			wantCtx: map[string]string{
+				"lstream":  "foo",
+				"hostname": "myhost",
+				"program":  "myprogram",
+				"pid":      "",
+				"n":        "5",
+				"ok":       "true",
+			},
+		},
+		{
+			name:    "json nested",
+			parsers: []string{"syslog", "json"},
+			msg:     `myhost myapp[123]: {"level":"error","req_id":"abc","http":{"status":500,"req":{"path":"/foo"}},"tags":["a","b"],"extra":{},"none":null}`,
+
+			wantLevel: LogLevelError,
+			wantMsg:   `{"level":"error","req_id":"abc","http":{"status":500,"req":{"path":"/foo"}},"tags":["a","b"],"extra":{},"none":null}`,
+			wantCtx: map[string]string{
+				"lstream":       "foo",
+				"hostname":      "myhost",
+				"program":       "myapp",
+				"pid":           "123",
+				"req_id":        "abc",
+				"http.status":   "500",
+				"http.req.path": "/foo",
+				"tags":          `["a","b"]`,
+				"extra":         "{}",
+				"none":          "null",
+			},
+		},
+		{
+			name:    "json with unknown level",
+			parsers: []string{"json"},
+			msg:     `{"message":"hello","level":"verbose"}`,
+
+			wantMsg: "hello",
+			wantCtx: map[string]string{
+				"lstream": "foo",
+				"level":   "verbose",
+			},
+		},
+		{
+			name:    "invalid json",
+			parsers: []string{"json"},
+			msg:     `{"message":"hello"`,
+
+			wantMsg: `{"message":"hello"`,
+			wantCtx: map[string]string{"lstream": "foo"},
+		},
+		{
+			name:    "logfmt",
+			parsers: []string{"syslog", "logfmt"},
+			msg:     `myhost myapp[123]: level=warn msg="slow query \"foo\"" dur=1.2s sql="SELECT * FROM t WHERE a = 1" empty= message=bar`,
+
+			wantMsg:   `slow query "foo"`,
+			wantLevel: LogLevelWarn,
+			wantCtx: map[string]string{
+				"lstream":  "foo",
+				"hostname": "myhost",
+				"program":  "myapp",
+				"pid":      "123",
+				"dur":      "1.2s",
+				"sql":      "SELECT * FROM t WHERE a = 1",
+				"empty":    "",
+				"message":  "bar",
+			},
+		},
+		{
+			name:    "logfmt not matching",
+			parsers: []string{"logfmt"},
+			msg:     `Something happened: foo=bar`,
+
+			wantMsg: `Something happened: foo=bar`,
+			wantCtx: map[string]string{"lstream": "foo"},
+		},
+		{
+			name:    "logfmt unterminated quote",
+			parsers: []string{"logfmt"},
+			msg:     `level=info msg="foo bar`,
+
+			wantMsg: `level=info msg="foo bar`,
+			wantCtx: map[string]string{"lstream": "foo"},
+		},
+		{
+			name:    "regex",
+			parsers: []string{`regex:^(?P<level>[A-Z]+) \[(?P<module>\w+)\] (?P<message>.*)$`},
+			msg:     "ERROR [db] Connection lost",
+
+			wantMsg:   "Connection lost",
+			wantLevel: LogLevelError,
+			wantCtx: map[string]string{
+				"lstream": "foo",
+				"module":  "db",
+			},
+		},
+		{
+			name:    "passthrough",
+			parsers: []string{"passthrough"},
+			msg:     "myhost myprogram[1234]: Something happened",
+
+			wantMsg: "myhost myprogram[1234]: Something happened",
+			wantCtx: map[string]string{"lstream": "foo"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			chain, err := NewLogParserChain(tc.parsers)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			logMsg := LogMsg{
+				Msg:     tc.msg,
+				Context: map[string]string{"lstream": "foo"},
+			}
+
+			assert.NoError(t, chain.Parse(&logMsg))
+			assert.Equal(t, tc.wantMsg, logMsg.Msg)
+			assert.Equal(t, tc.wantLevel, logMsg.Level)
+			assert.Equal(t, tc.wantCtx, logMsg.Context)
+		})
+	}
+}
+
+func TestNewLogParserErrors(t *testing.T) {
+	_, err := NewLogParser("foo")
+	assert.EqualError(t, err, `unknown parser "foo"; valid ones are: json, logfmt, passthrough, regex, syslog`)
+
+	_, err = NewLogParser("syslog:foo")
+	assert.EqualError(t, err, "parser syslog: no argument expected")
+
+	_, err = NewLogParser("regex")
+	assert.EqualError(t, err, "parser regex: regex is required, like regex:^(?P<message>.*)$")
+
+	_, err = NewLogParser("regex:(")
+	assert.Error(t, err)
+
+	_, err = NewLogParserChain([]string{"syslog", "bar"})
+	assert.Error(t, err)
+}
+
+func TestRegisterLogParser(t *testing.T) {
+	assert.Panics(t, func() {
+		RegisterLogParser("syslog", newSyslogParser)
+	})
+}
+
+func TestCompileParseRegex(t *testing.T) {
+	re, err := CompileParseRegex("")
+	assert.NoError(t, err)
+	assert.Nil(t, re)
+
+	_, err = CompileParseRegex("^foo (.*)$")
+	assert.EqualError(t, err, "regex has no named groups, like (?P<message>.*)")
+
+	_, err = CompileParseRegex("(")
+	assert.Error(t, err)
+
+	re, err = CompileParseRegex(`^(?P<level>[A-Z]+) user=(?P<user>\w+) (?P<message>.*)$`)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	logMsg := LogMsg{
+		Msg:     "WARN user=john Something happened",
+		Context: map[string]string{"lstream": "foo"},
+	}
+	assert.True(t, applyRegexGroups(re, &logMsg))
+	assert.Equal(t, "Something happened", logMsg.Msg)
+	assert.Equal(t, LogLevelWarn, logMsg.Level)
+	assert.Equal(t, map[string]string{"lstream": "foo", "user": "john"}, logMsg.Context)
+
+	logMsg = LogMsg{
+		Msg:     "not matching",
+		Context: map[string]string{"lstream": "foo"},
+	}
+	assert.False(t, applyRegexGroups(re, &logMsg))
+	assert.Equal(t, "not matching", logMsg.Msg)
+	assert.Equal(t, map[string]string{"lstream": "foo"}, logMsg.Context)
+}
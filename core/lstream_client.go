@@ -7,6 +7,7 @@ import (
 	_ "embed"
 	"fmt"
 	"io"
+	"math/rand"
 	"regexp"
 	"strconv"
 	"strings"
@@ -60,24 +61,60 @@ const queryLogsTimestampUntilSecondsTimeLayout = "2006-01-02 15:04:05"
 // TODO: better naming.
 const queryLogsTimestampUntilPreciseTimeLayout = "2006-01-02T15:04:05.000000"
 
+// queryCancelLine is written to the shell's stdin to cancel the currently
+// running query: the agent script reads it and kills the query. If the query
+// is already done by the time the shell gets it, it's a no-op command for the
+// shell.
+const queryCancelLine = ": nerdlog_cancel_query\n"
+
 //go:embed nerdlog_agent.sh
 var nerdlogAgentSh string
 
-var syslogRegex = regexp.MustCompile(`^(\S+)\s+(\S+?)(?:\[(\d+)\])?:\s+(.*)`)
-
 type LStreamClient struct {
 	params LStreamClientParams
 
 	transport ShellTransport
 
+	// luaScript is the user Lua script invoked for every log line; nil if there
+	// is no script, or if it failed to load, in which case luaScriptErr is set.
+	luaScript    *luaScript
+	luaScriptErr error
+
+	// logParsers is the chain of parsers applied to every log message after
+	// the timestamp is parsed.
+	logParsers *LogParserChain
+
+	// parseRegex is applied to every log message after logParsers; nil if
+	// there's no parse_regex option.
+	parseRegex *regexp.Regexp
+
+	// multiline is the rule to group multi-line messages; nil if they are not
+	// grouped.
+	multiline *MultilineRule
+
+	// levelRules are applied if the parsers haven't figured the level; nil if
+	// there are no rules.
+	levelRules *LevelRules
+
 	connectUpdCh chan ShellConnUpdate
 	enqueueCmdCh chan lstreamCmd
 
-	// timezone is a string received from the logstream
+	reconnectPolicy   ReconnectPolicy
+	reconnectPolicyCh chan ReconnectPolicy
+
+	// timezone is either from the timezone option, or a string received from
+	// the logstream
 	timezone string
 	// location is loaded based on the timezone. If failed, it'll be UTC.
 	location *time.Location
 
+	// clockCorrection is parsed from the clock_correction option; nil if the
+	// timestamps shouldn't be corrected.
+	clockCorrection *ClockCorrection
+	// clockSkew is how much the host clock is ahead of the local clock, as
+	// measured during the last bootstrap; zero if it's unknown.
+	clockSkew time.Duration
+
 	// exampleLogLines are the lines that we received during logstream bootstrap.
 	// We'll try to do log format autodetection based on that.
 	exampleLogLines []string
@@ -164,6 +201,33 @@ type ConnDetails struct {
 	// Connected shows whether the connection has already succeeded. Unlike other
 	// fields in this struct, it's set by the LStreamsManager manually.
 	Connected bool
+
+	// PingRTT is the round-trip time of the last successful ping over the
+	// current connection; zero if there were no pings yet. Just like Connected,
+	// it's set by the LStreamsManager manually.
+	PingRTT time.Duration
+
+	// ClockSkew is how much the host clock is ahead of the local clock
+	// (negative if it's behind), as measured during bootstrap. Just like
+	// Connected, it's set by the LStreamsManager manually.
+	ClockSkew time.Duration
+}
+
+// TimeFormatInfo describes the time format of a logstream and how it was
+// determined; it's only used for debugging.
+type TimeFormatInfo struct {
+	// Descr is the time format; nil if it couldn't be determined.
+	Descr *TimeFormatDescr
+
+	// Source is a human-readable description of where the time format comes
+	// from, like "detected from 4 example log lines".
+	Source string
+
+	// ExampleLogLines are the log lines received during bootstrap.
+	ExampleLogLines []string
+
+	// Err is the error message if the time format couldn't be determined.
+	Err string
 }
 
 type BootstrapDetails struct {
@@ -175,6 +239,10 @@ type BootstrapDetails struct {
 	// instead of a generic warning message to make it possible to suppress it
 	// with a flag.
 	WarnJournalctlNoAdminAccess bool
+
+	// WarnClockSkew, if non-zero, is the clock skew of the host which exceeds
+	// ClockSkewWarnThreshold, while no clock correction is configured.
+	WarnClockSkew time.Duration
 }
 
 func (c *connCtx) getStdoutLinesCh() chan string {
@@ -205,6 +273,18 @@ type LStreamClientUpdate struct {
 	BootstrapDetails *BootstrapDetails
 	BusyStage        *BusyStage
 
+	// PingRTT, if non-nil, is the round-trip time of a ping which has just
+	// succeeded.
+	PingRTT *time.Duration
+
+	// ClockSkew, if non-nil, is the clock skew of the host which has just
+	// been measured during bootstrap.
+	ClockSkew *time.Duration
+
+	// TimeFormat, if non-nil, is the time format which has just been
+	// determined (or failed to be) during bootstrap.
+	TimeFormat *TimeFormatInfo
+
 	DataRequest *ShellConnDataRequest
 
 	// If TornDown is true, it means it's the last update from that client.
@@ -234,9 +314,32 @@ type LStreamClientParams struct {
 
 	UpdatesCh chan<- *LStreamClientUpdate
 
+	// ReconnectPolicy specifies how to reconnect after failed connection
+	// attempts. It can be changed later with SetReconnectPolicy.
+	ReconnectPolicy ReconnectPolicy
+
+	// PingInterval is how long the connection should be idle before we ping
+	// the logstream to check whether the connection is still alive. If zero,
+	// DefaultPingInterval is used.
+	PingInterval time.Duration
+
+	// PingTimeout is how long to wait for a ping response before considering
+	// the connection dead and reconnecting. If zero, DefaultPingTimeout is
+	// used.
+	PingTimeout time.Duration
+
+	// LuaScript is the path to the Lua script which is invoked for every log
+	// line, see ConfigLogStreamOptions.LuaScript. If empty, there's no script.
+	LuaScript string
+
 	Clock clock.Clock
 }
 
+const (
+	DefaultPingInterval = 40 * time.Second
+	DefaultPingTimeout  = 15 * time.Second
+)
+
 // createTransport creates a shell transport accordingly to the provided
 // config. The config must be valid (e.g. it should contain exactly one item),
 // otherwise createTransport panics.
@@ -301,23 +404,45 @@ func NewLStreamClient(params LStreamClientParams) *LStreamClient {
 		fmt.Sprintf("LSClient_%s", params.LogStream.Name),
 	)
 
+	if params.PingInterval == 0 {
+		params.PingInterval = DefaultPingInterval
+	}
+
+	if params.PingTimeout == 0 {
+		params.PingTimeout = DefaultPingTimeout
+	}
+
 	transport := createTransport(params.LogStream.Transport, params.SSHKeys, params.Logger)
 
+	var script *luaScript
+	var scriptErr error
+	if params.LuaScript != "" {
+		script, scriptErr = newLuaScript(params.LuaScript)
+		if scriptErr != nil {
+			params.Logger.Errorf("Failed to load lua script: %s", scriptErr.Error())
+		}
+	}
+
 	lsc := &LStreamClient{
 		params: params,
 
 		transport: transport,
 
-		timezone: "UTC",
-		location: time.UTC,
-
 		state:        LStreamClientStateDisconnected,
 		enqueueCmdCh: make(chan lstreamCmd, 32),
 
+		reconnectPolicy:   params.ReconnectPolicy,
+		reconnectPolicyCh: make(chan ReconnectPolicy, 1),
+
 		disconnectReqCh:              make(chan disconnectReq, 1),
 		disconnectedBeforeTeardownCh: make(chan struct{}),
+
+		luaScript:    script,
+		luaScriptErr: scriptErr,
 	}
 
+	lsc.parseOptions(params.LogStream.Options)
+
 	//debugFile, _ := os.Create("/tmp/lsclient_debug.log")
 	//lsc.debugFile = debugFile
 
@@ -328,6 +453,55 @@ func NewLStreamClient(params LStreamClientParams) *LStreamClient {
 	return lsc
 }
 
+// parseOptions parses the logstream options and sets the corresponding fields.
+// The options are normally already validated when the config is loaded, but
+// just in case, an invalid option is logged and the default is used instead.
+func (lsc *LStreamClient) parseOptions(opts LogStreamOptions) {
+	logInvalid := func(what, fallback string, err error) {
+		lsc.params.Logger.Errorf("Invalid %s, %s: %s", what, fallback, err.Error())
+	}
+
+	var err error
+
+	lsc.logParsers, err = NewLogParserChain(opts.Parsers)
+	if err != nil {
+		logInvalid("parsers", "will use the default ones", err)
+		lsc.logParsers, _ = NewLogParserChain(nil)
+	}
+
+	lsc.parseRegex, err = CompileParseRegex(opts.ParseRegex)
+	if err != nil {
+		logInvalid("parse_regex", "will not use it", err)
+	}
+
+	lsc.multiline, err = ParseMultilineRule(opts.Multiline)
+	if err != nil {
+		logInvalid("multiline rule", "will not group multi-line messages", err)
+	}
+
+	lsc.levelRules, err = NewLevelRules(opts.Levels)
+	if err != nil {
+		logInvalid("level rules", "will not use them", err)
+	}
+
+	lsc.timezone = "UTC"
+	lsc.location = time.UTC
+	if opts.Timezone != "" {
+		loc, err := time.LoadLocation(opts.Timezone)
+		if err != nil {
+			logInvalid("timezone", "will detect it on the host", err)
+		} else {
+			lsc.timezone = opts.Timezone
+			lsc.location = loc
+		}
+	}
+
+	lsc.clockCorrection, err = ParseClockCorrection(opts.ClockCorrection)
+	if err != nil {
+		logInvalid("clock correction", "will not correct timestamps", err)
+	}
+}
+
 func (lsc *LStreamClient) SendFoo() {
 }
 
@@ -339,6 +513,11 @@ const (
 	LStreamClientStateDisconnecting LStreamClientState = "disconnecting"
 	LStreamClientStateConnectedIdle LStreamClientState = "connected_idle"
 	LStreamClientStateConnectedBusy LStreamClientState = "connected_busy"
+
+	// LStreamClientStateGivenUp means that the connection has failed too many
+	// times in a row (as per the ReconnectPolicy), and we don't try to
+	// reconnect anymore, until Reconnect is called explicitly.
+	LStreamClientStateGivenUp LStreamClientState = "given_up"
 )
 
 func isStateConnected(state LStreamClientState) bool {
@@ -421,13 +600,49 @@ func (lsc *LStreamClient) sendCmdResp(resp interface{}, err error) {
 		return
 	}
 
+	var queryID int
+	if lsc.curCmdCtx.cmd.queryLogs != nil {
+		queryID = lsc.curCmdCtx.cmd.queryLogs.queryID
+	}
+
 	lsc.curCmdCtx.cmd.respCh <- lstreamCmdRes{
 		hostname: lsc.params.LogStream.Name,
+		queryID:  queryID,
 		resp:     resp,
 		err:      err,
 	}
 }
 
+// cancelQueryLogs drops all queued queryLogs commands, and if the currently
+// running command is queryLogs, asks the agent to cancel it. The cancelled
+// query still finishes as usual (with an error), it just happens sooner.
+func (lsc *LStreamClient) cancelQueryLogs() {
+	cmdQueue := lsc.cmdQueue[:0]
+	for _, cmd := range lsc.cmdQueue {
+		if cmd.queryLogs != nil {
+			lsc.params.Logger.Verbose1f("Dropping queued queryLogs command")
+			continue
+		}
+
+		cmdQueue = append(cmdQueue, cmd)
+	}
+	lsc.cmdQueue = cmdQueue
+
+	if lsc.state != LStreamClientStateConnectedBusy {
+		return
+	}
+
+	cmdCtx := lsc.curCmdCtx
+	if cmdCtx == nil || cmdCtx.cmd.queryLogs == nil || cmdCtx.queryLogsCtx.cancelled {
+		return
+	}
+
+	lsc.params.Logger.Verbose1f("Cancelling the running queryLogs command")
+
+	cmdCtx.queryLogsCtx.cancelled = true
+	lsc.conn.conn.Stdin().Write([]byte(queryCancelLine))
+}
+
 func (lsc *LStreamClient) run() {
 	ticker := time.NewTicker(1 * time.Second)
 	var connectAfter time.Time
@@ -454,8 +669,16 @@ func (lsc *LStreamClient) run() {
 
 				if res.Err != nil {
 					lsc.params.Logger.Errorf("Shell connection failed: %s", res.Err.Error())
+
+					givenUp := lsc.reconnectPolicy.GivenUp(lsc.numConnAttempts)
+
+					errMsg := fmt.Sprintf("attempt %d: %s", lsc.numConnAttempts, res.Err.Error())
+					if givenUp {
+						errMsg += " (giving up)"
+					}
+
 					lsc.sendUpdate(&LStreamClientUpdate{
-						ConnDetails: lsc.makeConnDetailsMsg(fmt.Sprintf("attempt %d: %s", lsc.numConnAttempts, res.Err.Error())),
+						ConnDetails: lsc.makeConnDetailsMsg(errMsg),
 					})
 
 					lsc.changeState(LStreamClientStateDisconnected)
@@ -464,7 +687,15 @@ func (lsc *LStreamClient) run() {
 						continue
 					}
 
-					connectAfter = lsc.params.Clock.Now().Add(2 * time.Second)
+					if givenUp {
+						lsc.params.Logger.Errorf("Giving up after %d attempts", lsc.numConnAttempts)
+						lsc.changeState(LStreamClientStateGivenUp)
+						continue
+					}
+
+					delay := lsc.reconnectPolicy.Delay(lsc.numConnAttempts, rand.Float64)
+					lsc.params.Logger.Infof("Will reconnect in %s", delay)
+					connectAfter = lsc.params.Clock.Now().Add(delay)
 					continue
 				}
 
@@ -494,6 +725,12 @@ func (lsc *LStreamClient) run() {
 			}
 
 		case cmd := <-lsc.enqueueCmdCh:
+			// Cancellation is not a real command, handle it right away.
+			if cmd.cancelQueryLogs != nil {
+				lsc.cancelQueryLogs()
+				continue
+			}
+
 			// Require a connection.
 			if !isStateConnected(lsc.state) {
 				lsc.sendCmdResp(nil, errors.Errorf("not connected"))
@@ -550,15 +787,30 @@ func (lsc *LStreamClient) run() {
 
 				switch {
 				case cmdCtx.cmd.bootstrap != nil:
+					hostTimePrefix := "host_time:"
 					tzPrefix := "host_timezone:"
 					logLinePrefix := "example_log_line:"
 
-					if strings.HasPrefix(line, tzPrefix) {
+					if strings.HasPrefix(line, hostTimePrefix) {
+						// NOTE: the skew includes the latency of receiving the line, but
+						// it's negligible compared to the skews we care about.
+						hostTime, err := parseHostTime(strings.TrimPrefix(line, hostTimePrefix))
+						if err != nil {
+							lsc.params.Logger.Errorf("Error: %s, clock skew is unknown\n", err.Error())
+						} else {
+							lsc.clockSkew = hostTime.Sub(lsc.params.Clock.Now())
+							lsc.params.Logger.Verbose1f("Got logstream clock skew: %s\n", lsc.clockSkew)
+						}
+					} else if strings.HasPrefix(line, tzPrefix) {
 						tz := strings.TrimPrefix(line, tzPrefix)
 						lsc.params.Logger.Verbose1f("Got logstream timezone: %s\n", tz)
 
 						location, err := time.LoadLocation(tz)
-						if err != nil {
+						if lsc.hasTimezoneOption() {
+							lsc.params.Logger.Verbose1f(
+								"Ignoring logstream timezone, using %s from the options\n", lsc.timezone,
+							)
+						} else if err != nil {
 							lsc.params.Logger.Errorf("Error: failed to load location %s, will use UTC\n", tz)
 							// TODO: send an update and then the receiver should show a message
 							// to the user
@@ -596,13 +848,15 @@ func (lsc *LStreamClient) run() {
 							continue
 						}
 
-						t, err := time.ParseInLocation(lsc.timeFormat.MinuteKeyLayout, parts[0], lsc.location)
+						t, err := time.ParseInLocation(lsc.timeFormat.MinuteKeyLayout, parts[0], lsc.agentLocation())
 						if err != nil {
 							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing mstats"))
 							continue
 						}
 
-						t = InferYear(lsc.params.Clock.Now(), t)
+						if t.Year() == 0 {
+							t = InferYear(lsc.params.Clock.Now(), t)
+						}
 						t = t.UTC()
 
 						n, err := strconv.Atoi(parts[1])
@@ -636,9 +890,19 @@ func (lsc *LStreamClient) run() {
 							fromLinenumber: logNumberOfLines,
 						})
 
-					case strings.HasPrefix(line, "m:"):
+					case strings.HasPrefix(line, "m:"), strings.HasPrefix(line, "mm:"):
 						// msg:Mar 26 17:08:34 localhost myapp[21134]: Mar 26 17:08:34.476329 foo bar foo bar
-						msg := strings.TrimPrefix(line, "m:")
+						//
+						// Or, for grouped multi-line messages, "mm:" followed by the same,
+						// but with newlines and backslashes escaped.
+						isMultiline := strings.HasPrefix(line, "mm:")
+						prefix := "m:"
+						if isMultiline {
+							prefix = "mm:"
+						}
+
+						msg := strings.TrimPrefix(line, prefix)
+
 						idx := strings.IndexRune(msg, ':')
 						if idx <= 0 {
 							cmdCtx.errs = append(cmdCtx.errs, errors.Errorf("parsing log msg: no line number in %q", line))
@@ -648,6 +912,15 @@ func (lsc *LStreamClient) run() {
 						logLinenoStr := msg[:idx]
 						msg = msg[idx+1:]
 
+						if isMultiline {
+							var err error
+							msg, err = unescapeMultiline(msg)
+							if err != nil {
+								cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing multi-line log msg %q", line))
+								continue
+							}
+						}
+
 						logLinenoCombined, err := strconv.Atoi(logLinenoStr)
 						if err != nil {
 							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing log msg: invalid line number in %q", line))
@@ -685,12 +958,24 @@ func (lsc *LStreamClient) run() {
 							OrigLine: msg,
 						}
 
-						err = lsc.parseLine(&logMsg)
+						err = lsc.parseLine(&logMsg, &respCtx.parseRegexMisses)
 						if err != nil {
 							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing log msg %q", line))
 							continue
 						}
 
+						// Errors from the user Lua script don't fail the query; the line
+						// is just left as parsed by the default rules, and the error is
+						// reported in the debug info.
+						if lsc.luaScript != nil && !respCtx.luaTimedOut {
+							if err := lsc.luaScript.parse(&logMsg); err != nil {
+								respCtx.luaErrs.add(&logMsg, err)
+								if err == errLuaParseTimeout {
+									respCtx.luaTimedOut = true
+								}
+							}
+						}
+
 						if logMsg.Time.Before(respCtx.lastTime) {
 							// Time has decreased: this might happen if the previous log line
 							// had a precise timestamp with microseconds (coming from the app
@@ -826,15 +1111,21 @@ func (lsc *LStreamClient) run() {
 			//}
 
 		case <-ticker.C:
-			if lsc.state == LStreamClientStateConnectedIdle && time.Since(lastUpdTime) > 40*time.Second {
+			if lsc.state == LStreamClientStateConnectedIdle && lsc.params.Clock.Since(lastUpdTime) > lsc.params.PingInterval {
 				lsc.startCmd(lstreamCmd{
 					ping: &lstreamCmdPing{},
 				})
-			} else if !connectAfter.IsZero() {
+			} else if lsc.isPingOverdue() {
+				lsc.handlePingTimeout()
+			} else if !connectAfter.IsZero() && !lsc.params.Clock.Now().Before(connectAfter) {
 				connectAfter = time.Time{}
 				lsc.changeState(LStreamClientStateConnecting)
 			}
 
+		case policy := <-lsc.reconnectPolicyCh:
+			lsc.params.Logger.Infof("Setting reconnect policy: %s", policy)
+			lsc.reconnectPolicy = policy
+
 		case req := <-lsc.disconnectReqCh:
 			lsc.params.Logger.Infof("Received disconnect message (teardown:%v)", req.teardown)
 
@@ -848,9 +1139,14 @@ func (lsc *LStreamClient) run() {
 
 			// If we're already disconnected, consider ourselves torn-down already.
 			// Otherwise, initiate disconnection.
-			if lsc.state == LStreamClientStateDisconnected {
+			if lsc.state == LStreamClientStateDisconnected || lsc.state == LStreamClientStateGivenUp {
 				if req.teardown {
 					close(lsc.disconnectedBeforeTeardownCh)
+				} else if lsc.state == LStreamClientStateGivenUp {
+					// We've given up reconnecting before, but now we're explicitly asked
+					// to reconnect, so start over.
+					lsc.numConnAttempts = 0
+					lsc.changeState(LStreamClientStateConnecting)
 				}
 			} else {
 				lsc.changeState(LStreamClientStateDisconnecting)
@@ -858,6 +1154,10 @@ func (lsc *LStreamClient) run() {
 
 		case <-lsc.disconnectedBeforeTeardownCh:
 			lsc.params.Logger.Infof("Teardown completed")
+			if lsc.luaScript != nil {
+				lsc.luaScript.Close()
+			}
+
 			lsc.sendUpdate(&LStreamClientUpdate{
 				TornDown: true,
 			})
@@ -990,6 +1290,63 @@ func (lsc *LStreamClient) Close(changeName string) {
 	}
 }
 
+// isPingOverdue returns whether we're waiting for a ping response for longer
+// than PingTimeout.
+func (lsc *LStreamClient) isPingOverdue() bool {
+	if lsc.state != LStreamClientStateConnectedBusy {
+		return false
+	}
+
+	cmdCtx := lsc.curCmdCtx
+	if cmdCtx == nil || cmdCtx.pingCtx == nil {
+		return false
+	}
+
+	return lsc.params.Clock.Since(cmdCtx.pingCtx.startedAt) > lsc.params.PingTimeout
+}
+
+// handlePingTimeout is called when the ping response didn't arrive in time,
+// which most likely means that the connection is dead (e.g. the laptop was
+// sleeping, or VPN reconnected), even though the transport didn't notice it.
+// We drop the connection and reconnect.
+func (lsc *LStreamClient) handlePingTimeout() {
+	msg := fmt.Sprintf(
+		"No response to ping in %s, the connection seems dead; reconnecting",
+		lsc.params.PingTimeout,
+	)
+	lsc.params.Logger.Errorf("%s", msg)
+
+	lsc.sendCmdResp(nil, errors.Errorf("ping timeout"))
+
+	lsc.changeState(LStreamClientStateDisconnected)
+	if lsc.tearingDown {
+		close(lsc.disconnectedBeforeTeardownCh)
+		return
+	}
+
+	lsc.changeState(LStreamClientStateConnecting)
+
+	// Entering the Connecting state resets the debug messages, so add ours
+	// afterwards, to let the user know why we're reconnecting.
+	lsc.connDebugMessages = append(lsc.connDebugMessages, msg)
+	lsc.sendUpdate(&LStreamClientUpdate{
+		ConnDetails: lsc.makeConnDetailsMsg(""),
+	})
+}
+
+// SetReconnectPolicy changes the reconnect policy; it takes effect after the
+// next failed connection attempt.
+func (lsc *LStreamClient) SetReconnectPolicy(policy ReconnectPolicy) {
+	// Only the LStreamsManager calls it, so there's a single sender, and thus
+	// the send below never blocks after we've drained the channel.
+	select {
+	case <-lsc.reconnectPolicyCh:
+	default:
+	}
+
+	lsc.reconnectPolicyCh <- policy
+}
+
 func (lsc *LStreamClient) Reconnect() {
 	select {
 	case lsc.disconnectReqCh <- disconnectReq{
@@ -1018,6 +1375,11 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 
 		cmdCtx.bootstrapCtx = &lstreamCmdCtxBootstrap{}
 
+		// The example log lines and the host time will be printed by the
+		// bootstrap again.
+		lsc.exampleLogLines = nil
+		lsc.clockSkew = 0
+
 		stdinBuf := lsc.conn.conn.Stdin()
 
 		stdinBuf.Write([]byte("echo reset_output\n"))
@@ -1069,7 +1431,9 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 
 	case cmdCtx.cmd.ping != nil:
 		lsc.params.Logger.Verbose3f("Starting command: ping %+v", cmdCtx.cmd.ping)
-		cmdCtx.pingCtx = &lstreamCmdCtxPing{}
+		cmdCtx.pingCtx = &lstreamCmdCtxPing{
+			startedAt: lsc.params.Clock.Now(),
+		}
 
 		cmd := "whoami\n"
 		stdinBuf := lsc.conn.conn.Stdin()
@@ -1081,6 +1445,7 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 		cmdCtx.queryLogsCtx = &lstreamCmdCtxQueryLogs{
 			Resp: &LogResp{
 				MinuteStats: map[int64]MinuteStatsItem{},
+				ClockSkew:   lsc.clockCorrection.getSkew(lsc.clockSkew),
 			},
 		}
 
@@ -1096,6 +1461,7 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 		}
 
 		parts = append(parts, lsc.getTimeEnvVars()...)
+		parts = append(parts, lsc.getQueryTZEnvVars()...)
 
 		parts = append(
 			parts,
@@ -1110,12 +1476,14 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 			parts = append(parts, "--logfile-prev", shellQuote(logFilePrev))
 		}
 
+		agentLocation := lsc.agentLocation()
+
 		if !cmdCtx.cmd.queryLogs.from.IsZero() {
-			parts = append(parts, "--from", shellQuote(cmdCtx.cmd.queryLogs.from.In(lsc.location).Format(queryLogsArgsTimeLayout)))
+			parts = append(parts, "--from", shellQuote(cmdCtx.cmd.queryLogs.from.In(agentLocation).Format(queryLogsArgsTimeLayout)))
 		}
 
 		if !cmdCtx.cmd.queryLogs.to.IsZero() {
-			parts = append(parts, "--to", shellQuote(cmdCtx.cmd.queryLogs.to.In(lsc.location).Format(queryLogsArgsTimeLayout)))
+			parts = append(parts, "--to", shellQuote(cmdCtx.cmd.queryLogs.to.In(agentLocation).Format(queryLogsArgsTimeLayout)))
 		}
 
 		if cmdCtx.cmd.queryLogs.linesUntil > 0 {
@@ -1128,12 +1496,12 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 			parts = append(parts,
 				"--timestamp-until-seconds",
 				shellQuote(
-					nextWholeSecondTime.In(lsc.location).Format(queryLogsTimestampUntilSecondsTimeLayout),
+					nextWholeSecondTime.In(agentLocation).Format(queryLogsTimestampUntilSecondsTimeLayout),
 				),
 
 				"--timestamp-until-precise",
 				shellQuote(
-					tu.time.In(lsc.location).Format(queryLogsTimestampUntilPreciseTimeLayout),
+					tu.time.In(agentLocation).Format(queryLogsTimestampUntilPreciseTimeLayout),
 				),
 
 				"--skip-n-latest", shellQuote(strconv.Itoa(tu.numMsgs)),
@@ -1145,6 +1513,7 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 		}
 
 		parts = append(parts, agentQueryTimeFormatArgs(&lsc.timeFormat.AWKExpr)...)
+		parts = append(parts, lsc.multiline.agentArgs()...)
 
 		if cmdCtx.cmd.queryLogs.query != "" {
 			parts = append(parts, shellQuote(cmdCtx.cmd.queryLogs.query))
@@ -1154,7 +1523,11 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 			parts = append(parts, "|", "gzip", ";", "echo", gzipEndMarker)
 		}
 
-		cmd := strings.Join(parts, " ") + "\n"
+		// NOTE: no newline here, since the command_done markers (see below) have
+		// to be echoed in the same line: while the query is running, the agent
+		// reads the shell's stdin waiting for the queryCancelLine, so nothing
+		// else should be left there.
+		cmd := strings.Join(parts, " ") + " ; "
 		lsc.params.Logger.Verbose2f("Executing query command(%s): %s", lsc.params.LogStream.Name, cmd)
 
 		lsc.conn.conn.Stdin().Write([]byte(cmd))
@@ -1171,8 +1544,9 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 	}
 
 	stdinBuf := lsc.conn.conn.Stdin()
-	stdinBuf.Write([]byte(fmt.Sprintf("echo 'command_done:%d'\n", cmdCtx.idx)))
-	stdinBuf.Write([]byte(fmt.Sprintf("echo 'command_done:%d' 1>&2\n", cmdCtx.idx)))
+	stdinBuf.Write([]byte(fmt.Sprintf(
+		"echo 'command_done:%d' ; echo 'command_done:%d' 1>&2\n", cmdCtx.idx, cmdCtx.idx,
+	)))
 
 	lsc.changeState(LStreamClientStateConnectedBusy)
 }
@@ -1194,6 +1568,48 @@ func (lsc *LStreamClient) getTimeEnvVars() []string {
 	}
 }
 
+// getQueryTZEnvVars returns the TZ env var for the query command, if needed;
+// see getAgentTZ.
+func (lsc *LStreamClient) getQueryTZEnvVars() []string {
+	tz := lsc.getAgentTZ()
+	if tz == "" {
+		return nil
+	}
+
+	return []string{fmt.Sprintf("TZ=%s", shellQuote(tz))}
+}
+
+// getAgentTZ returns the timezone that the agent should use for queries, or
+// an empty string if the host timezone is fine. Unless we use the timezone of
+// the host, the agent needs to use the same timezone as we do, so that the
+// times it computes (using mktime and strftime in awk, or journalctl --since
+// and --until) match ours.
+func (lsc *LStreamClient) getAgentTZ() string {
+	if !lsc.timeFormat.UTC && !lsc.hasTimezoneOption() {
+		return ""
+	}
+
+	return lsc.agentLocation().String()
+}
+
+// hasTimezoneOption returns whether the timezone comes from the timezone
+// option, as opposed to being detected on the host.
+func (lsc *LStreamClient) hasTimezoneOption() bool {
+	return lsc.params.LogStream.Options.Timezone != "" && lsc.timezone == lsc.params.LogStream.Options.Timezone
+}
+
+// agentLocation returns the location of the times that the agent works with:
+// the --from and --to arguments, the minute keys, etc. Normally it's the
+// location of the logstream, but if the timestamps have explicit offsets, the
+// agent converts them to UTC; see TimeFormatDescr.UTC.
+func (lsc *LStreamClient) agentLocation() *time.Location {
+	if lsc.timeFormat.UTC {
+		return time.UTC
+	}
+
+	return lsc.location
+}
+
 func roundUpToNextSecond(t time.Time) time.Time {
 	if t.Nanosecond() == 0 {
 		return t
@@ -1214,11 +1630,20 @@ func (lsc *LStreamClient) getLStreamNerdlogAgentPath() string {
 // getLStreamIndexFilePath returns the logstream-side path to the index file for
 // the particular log stream.
 func (lsc *LStreamClient) getLStreamIndexFilePath() string {
-	return fmt.Sprintf(
+	ret := fmt.Sprintf(
 		"/tmp/nerdlog_agent_index_%s_%s",
 		lsc.params.ClientID,
 		filepathToId(lsc.params.LogStream.LogFileLast()),
 	)
+
+	// The index contains the times computed by the agent, so if it uses a
+	// non-default timezone, make sure we don't reuse the index built with
+	// another one.
+	if tz := lsc.getAgentTZ(); tz != "" {
+		ret += "_tz_" + filepathToId(tz)
+	}
+
+	return ret
 }
 
 // filepathToId takes a path and returns a string suitable to be used as
@@ -1333,15 +1758,43 @@ func (lsc *LStreamClient) handleCommandResultsIfDone(cmdCtx *lstreamCmdCtx) {
 				})
 			}
 
-			// Let's now try to autodetect the envelope log format.
-			timeFormat, err := GetTimeFormatDescrFromLogLines(lsc.exampleLogLines)
+			// Report the clock skew, and if it's too large and the timestamps are
+			// not going to be corrected, warn about it.
+			clockSkew := lsc.clockSkew
+			lsc.sendUpdate(&LStreamClientUpdate{
+				ClockSkew: &clockSkew,
+			})
+
+			if lsc.clockCorrection == nil && absDuration(clockSkew) > ClockSkewWarnThreshold {
+				lsc.sendUpdate(&LStreamClientUpdate{
+					BootstrapDetails: &BootstrapDetails{
+						WarnClockSkew: clockSkew,
+					},
+				})
+			}
+
+			// Let's now figure the time format: either take it from the options,
+			// or try to autodetect it.
+			timeFormat, source, err := lsc.getTimeFormat()
+			tfInfo := &TimeFormatInfo{
+				Descr:           timeFormat,
+				Source:          source,
+				ExampleLogLines: lsc.exampleLogLines,
+			}
+			if err != nil {
+				tfInfo.Err = err.Error()
+			}
+			lsc.sendUpdate(&LStreamClientUpdate{
+				TimeFormat: tfInfo,
+			})
+
 			if err != nil {
 				cmdCtx.errs = append(cmdCtx.errs, err)
 			} else {
 				// All good
 				lsc.params.Logger.Infof(
-					"Detected time format based on %d log lines: %q",
-					len(lsc.exampleLogLines),
+					"Time format %s: %q",
+					source,
 					timeFormat.TimestampLayout,
 				)
 				lsc.timeFormat = timeFormat
@@ -1374,13 +1827,33 @@ func (lsc *LStreamClient) handleCommandResultsIfDone(cmdCtx *lstreamCmdCtx) {
 		lsc.changeState(LStreamClientStateDisconnected)
 
 	case cmdCtx.cmd.ping != nil:
+		rtt := lsc.params.Clock.Since(cmdCtx.pingCtx.startedAt)
+		lsc.params.Logger.Verbose1f("Ping RTT: %s", rtt)
+
 		lsc.sendCmdResp(nil, nil)
+		lsc.sendUpdate(&LStreamClientUpdate{
+			PingRTT: &rtt,
+		})
 		lsc.changeState(LStreamClientStateConnectedIdle)
 
 	case cmdCtx.cmd.queryLogs != nil:
 		resp := cmdCtx.queryLogsCtx.Resp
 		resp.DebugInfo.AgentStdout = cmdCtx.unhandledStdout
 		resp.DebugInfo.AgentStderr = cmdCtx.unhandledStderr
+		resp.DebugInfo.LuaErrors = cmdCtx.queryLogsCtx.luaErrs.messages()
+		if cmdCtx.queryLogsCtx.luaTimedOut {
+			resp.DebugInfo.LuaErrors = append(
+				resp.DebugInfo.LuaErrors,
+				"lua script timed out, so it wasn't used for the rest of the lines",
+			)
+		}
+		resp.DebugInfo.ParseRegexMisses = cmdCtx.queryLogsCtx.parseRegexMisses.messages()
+		if lsc.luaScriptErr != nil {
+			resp.DebugInfo.LuaErrors = append(
+				[]string{fmt.Sprintf("lua script not used: %s", lsc.luaScriptErr.Error())},
+				resp.DebugInfo.LuaErrors...,
+			)
+		}
 		lsc.sendCmdResp(resp, summaryCmdError(cmdCtx))
 		lsc.changeState(LStreamClientStateConnectedIdle)
 
@@ -1446,73 +1919,95 @@ type parseLineResult struct {
 	ctxMap map[string]string
 }
 
-func (lsc *LStreamClient) parseLine(logMsg *LogMsg) error {
+// parseLine parses the timestamp, the message, level and context of the log
+// line; if the line doesn't match the parse_regex, it's added to
+// parseRegexMisses, but it's not an error.
+func (lsc *LStreamClient) parseLine(logMsg *LogMsg, parseRegexMisses *lineErrs) error {
 	if err := lsc.parseLogMsgTimestamp(logMsg); err != nil {
 		return errors.Annotatef(err, "parsing time")
 	}
 
-	// TODO: offload envelope parsing to Lua (and make it usable from
-	// the user Lua scripts as well).
-	if err := lsc.parseLogMsgEnvelopeDefault(logMsg); err != nil {
-		return errors.Annotatef(err, "parsing envelope")
+	if err := lsc.logParsers.Parse(logMsg); err != nil {
+		return errors.Annotatef(err, "parsing message")
 	}
 
-	// TODO: offload the custom parsing to Lua
-	if err := lsc.parseLogMsgLevelDefault(logMsg); err != nil {
-		return errors.Annotatef(err, "custom parsing")
+	if lsc.parseRegex != nil && !applyRegexGroups(lsc.parseRegex, logMsg) {
+		parseRegexMisses.add(logMsg, errors.New("doesn't match parse_regex"))
 	}
 
-	// TODO: invoke user Lua script, if present.
+	// If none of the parsers has figured the level, try the level rules, and
+	// then try to guess it, unless disabled.
+	if logMsg.Level == LogLevelUnknown && !lsc.levelRules.Apply(logMsg) {
+		if lsc.levelGuessingEnabled() {
+			if err := lsc.parseLogMsgLevelDefault(logMsg); err != nil {
+				return errors.Annotatef(err, "guessing level")
+			}
+		}
+	}
+
+	// NOTE: the user Lua script, if any, is invoked by the caller, since its
+	// errors are handled differently: they don't fail the line.
 
 	return nil
 }
 
-func (lsc *LStreamClient) parseLogMsgTimestamp(logMsg *LogMsg) error {
-	msg := logMsg.Msg
+// getTimeFormat returns the time format for the logstream: if the
+// time_format option is set, it's used; otherwise the time format is detected
+// from the example log lines. The returned source is a human-readable
+// description of where the time format comes from.
+func (lsc *LStreamClient) getTimeFormat() (*TimeFormatDescr, string, error) {
+	if spec := lsc.params.LogStream.Options.TimeFormat; spec != "" {
+		source := fmt.Sprintf("from the time_format option %q", spec)
+
+		timeFormat, err := GetTimeFormatDescrFromSpec(spec, lsc.exampleLogLines)
+		if err != nil {
+			return nil, source, errors.Annotatef(err, "time_format option")
+		}
 
-	timeLayout := lsc.timeFormat.TimestampLayout
-	timestampLen := len(timeLayout)
+		return timeFormat, source, nil
+	}
+
+	source := fmt.Sprintf("detected from %d example log lines", len(lsc.exampleLogLines))
 
-	// If the layout ends with the offset like "Z07" or "Z07:00", but the
-	// actual timestamp string is in UTC and it ends with just "Z", we then
-	// need to remove that extra
-	zIdx := strings.Index(timeLayout, "Z07")
-	if zIdx >= 0 && len(msg) >= zIdx && msg[zIdx] == 'Z' {
-		// We have a Z in the timestamp, so there should be no offset after it.
-		timestampLen = zIdx + 1
+	timeFormat, err := GetTimeFormatDescrFromLogLines(lsc.exampleLogLines)
+	if err != nil {
+		return nil, source, errors.Trace(err)
 	}
 
-	if len(msg) < timestampLen {
-		return errors.Errorf("line %q is too short to have a timestamp", msg)
+	return timeFormat, source, nil
+}
+
+func (lsc *LStreamClient) parseLogMsgTimestamp(logMsg *LogMsg) error {
+	// If the timestamp is not at the beginning of the line, msgPrefix is what
+	// precedes it.
+	offset, err := lsc.timeFormat.TimestampLocation.timestampOffset(logMsg.Msg)
+	if err != nil {
+		return errors.Annotatef(err, "locating timestamp in line %q", logMsg.Msg)
 	}
 
-	t, err := time.ParseInLocation(timeLayout, msg[:timestampLen], lsc.location)
+	msgPrefix := logMsg.Msg[:offset]
+	msg := logMsg.Msg[offset:]
+
+	timeLayout := lsc.timeFormat.TimestampLayout
+
+	var t time.Time
+	var timestampLen int
+	if isEpochLayout(timeLayout) {
+		t, timestampLen, err = parseEpochTimestamp(msg, timeLayout)
+	} else {
+		t, timestampLen, err = parseLayoutTimestamp(msg, timeLayout, lsc.location)
+	}
 	if err != nil {
 		return errors.Annotatef(err, "parsing time in log msg")
 	}
 
-	// If the location we get from the actual logs doesn't match what we have,
-	// trust the logs more.
-	//
-	// NOTE: this new timezone is still not fully effective until the next query,
-	// because even the request itself was likely done wrong. Also, if mstats are
-	// already parsed, their timestamp is also wrong (that one can technically be
-	// solved by printing mstats after logs). Maybe we should somehow show a
-	// warning that the timezone was overridden.
-
-	// TODO: uncomment when it's well tested; right now it doesn't work well
-	// because e.g. if the timezone is "America/New_York", but then in the logs
-	// we have "-05:00", which is a different timezone (not New York, but a fixed
-	// one), and so we'll always be overwriting this timezone here. Most of the
-	// time it's pretty much harmless, but on the edge of DST it will do the
-	// wrong thing.
-	//if t.Location() != lsc.location {
-	//lsc.params.Logger.Infof(
-	//"Log line timestamp has a different location: %s instead of %s; trusting logs more",
-	//t.Location(), lsc.location,
-	//)
-	//lsc.location = t.Location()
-	//}
+	// NOTE: if the timestamp has an explicit offset, it's always respected by
+	// the time.ParseInLocation, and lsc.location is only used for timestamps
+	// without an offset. We don't update lsc.location based on the offsets
+	// seen in the logs though: a fixed offset like "-05:00" is not the same as
+	// the "America/New_York" timezone, and would be wrong after the DST
+	// switch. Instead, for such timestamps, the agent converts them to UTC
+	// (see TimeFormatDescr.UTC), so lsc.location doesn't matter there at all.
 
 	if t.Year() == 0 {
 		t = InferYear(lsc.params.Clock.Now(), t)
@@ -1520,44 +2015,37 @@ func (lsc *LStreamClient) parseLogMsgTimestamp(logMsg *LogMsg) error {
 	t = t.UTC()
 
 	// Parsed the time successfully; update it in the LogMsg, and also remove the
-	// leading timestamp from the message.
+	// timestamp from the message.
 	logMsg.Time = t
-	logMsg.Msg = strings.TrimSpace(msg[len(timeLayout):])
+	logMsg.Msg = cutTimestamp(msgPrefix, msg[timestampLen:])
 
 	return nil
 }
 
-// parseLogMsgEnvelopeDefault takes the LogMsg where the time was already
-// stripped from the Msg, so for syslog, it looks like this:
-//
-//	"myhost myprogram[1234]: Something happened"
-//
-// If the Msg indeed looks like a syslog message, it extracts the hostname,
-// program and pid from it, populates them in the Context, and updates the
-// message to contain the rest of the payload.
-//
-// If the Msg doesn't have this structure, parseLogMsgEnvelopeDefault is a
-// no-op.
-func (lsc *LStreamClient) parseLogMsgEnvelopeDefault(logMsg *LogMsg) error {
-	matches := syslogRegex.FindStringSubmatch(logMsg.Msg)
-	if len(matches) == 0 {
-		// Message doesn't match syslog pattern, no-op
-		// TODO: we might want to support more formats
-		return nil
+// cutTimestamp joins the parts of the message before and after the timestamp;
+// if the timestamp was in brackets, like "[10/Oct/2024:13:55:36 +0000]", the
+// brackets are removed as well.
+func cutTimestamp(before, after string) string {
+	if strings.HasSuffix(before, "[") && strings.HasPrefix(after, "]") {
+		before = before[:len(before)-1]
+		after = after[1:]
 	}
 
-	// Extract fields from regex match
-	hostname := matches[1]
-	program := matches[2]
-	pid := matches[3]
-	rest := matches[4]
+	before = strings.TrimSpace(before)
+	after = strings.TrimSpace(after)
+
+	if before == "" || after == "" {
+		return before + after
+	}
 
-	logMsg.Context["hostname"] = hostname
-	logMsg.Context["program"] = program
-	logMsg.Context["pid"] = pid
+	return before + " " + after
+}
 
-	logMsg.Msg = rest
-	return nil
+// levelGuessingEnabled returns whether we should try to guess the level from
+// the message text; it's enabled unless the level_guessing option is false.
+func (lsc *LStreamClient) levelGuessingEnabled() bool {
+	guessing := lsc.params.LogStream.Options.LevelGuessing
+	return guessing == nil || *guessing
 }
 
 // parseLogMsgLevelDefault tries to guess what the level of the message could
@@ -0,0 +1,229 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeShellTransport just counts the connection attempts, and never actually
+// connects.
+type fakeShellTransport struct {
+	numConnects int
+}
+
+func (t *fakeShellTransport) Connect(resCh chan<- ShellConnUpdate) {
+	t.numConnects++
+}
+
+type fakeShellConn struct {
+	stdin  bytes.Buffer
+	closed bool
+}
+
+func (c *fakeShellConn) Stdin() io.Writer  { return &c.stdin }
+func (c *fakeShellConn) Stdout() io.Reader { return &bytes.Buffer{} }
+func (c *fakeShellConn) Stderr() io.Reader { return &bytes.Buffer{} }
+func (c *fakeShellConn) Close()            { c.closed = true }
+
+type pingTestHelper struct {
+	lsc       *LStreamClient
+	clock     *clock.Mock
+	transport *fakeShellTransport
+	conn      *fakeShellConn
+	updatesCh chan *LStreamClientUpdate
+	respCh    chan lstreamCmdRes
+}
+
+// newPingTestHelper creates an LStreamClient (without running it) which is
+// connected and busy with a ping sent at the current time of the mocked
+// clock.
+func newPingTestHelper(pingTimeout time.Duration) *pingTestHelper {
+	clockMock := clock.NewMock()
+	clockMock.Set(time.Date(2025, 3, 12, 10, 58, 0, 0, time.UTC))
+
+	th := &pingTestHelper{
+		clock:     clockMock,
+		transport: &fakeShellTransport{},
+		conn:      &fakeShellConn{},
+		updatesCh: make(chan *LStreamClientUpdate, 32),
+		respCh:    make(chan lstreamCmdRes, 1),
+	}
+
+	th.lsc = &LStreamClient{
+		params: LStreamClientParams{
+			LogStream:   LogStream{Name: "testhost-1"},
+			Logger:      log.NewLogger(log.Error),
+			UpdatesCh:   th.updatesCh,
+			PingTimeout: pingTimeout,
+			Clock:       clockMock,
+		},
+		transport: th.transport,
+		state:     LStreamClientStateConnectedBusy,
+		conn:      &connCtx{conn: th.conn},
+		curCmdCtx: &lstreamCmdCtx{
+			cmd: lstreamCmd{
+				respCh: th.respCh,
+				ping:   &lstreamCmdPing{},
+			},
+			pingCtx: &lstreamCmdCtxPing{
+				startedAt: clockMock.Now(),
+			},
+		},
+		disconnectedBeforeTeardownCh: make(chan struct{}),
+	}
+
+	return th
+}
+
+// drainUpdates returns all the updates sent so far.
+func (th *pingTestHelper) drainUpdates() []*LStreamClientUpdate {
+	var ret []*LStreamClientUpdate
+	for {
+		select {
+		case upd := <-th.updatesCh:
+			ret = append(ret, upd)
+		default:
+			return ret
+		}
+	}
+}
+
+type isPingOverdueTestCase struct {
+	name string
+
+	// elapsed is how much time passes after the ping was sent.
+	elapsed time.Duration
+
+	// setup, if not nil, modifies the client before checking.
+	setup func(lsc *LStreamClient)
+
+	want bool
+}
+
+func TestIsPingOverdue(t *testing.T) {
+	testCases := []isPingOverdueTestCase{
+		{
+			name:    "just sent",
+			elapsed: 0,
+			want:    false,
+		},
+		{
+			name:    "within timeout",
+			elapsed: 14 * time.Second,
+			want:    false,
+		},
+		{
+			name:    "exactly at timeout",
+			elapsed: 15 * time.Second,
+			want:    false,
+		},
+		{
+			name:    "past timeout",
+			elapsed: 15*time.Second + time.Millisecond,
+			want:    true,
+		},
+		{
+			name:    "idle",
+			elapsed: time.Minute,
+			setup: func(lsc *LStreamClient) {
+				lsc.state = LStreamClientStateConnectedIdle
+			},
+			want: false,
+		},
+		{
+			name:    "busy with a query",
+			elapsed: time.Minute,
+			setup: func(lsc *LStreamClient) {
+				lsc.curCmdCtx = &lstreamCmdCtx{
+					cmd: lstreamCmd{
+						queryLogs: &lstreamCmdQueryLogs{},
+					},
+					queryLogsCtx: &lstreamCmdCtxQueryLogs{},
+				}
+			},
+			want: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			th := newPingTestHelper(15 * time.Second)
+			if tc.setup != nil {
+				tc.setup(th.lsc)
+			}
+
+			th.clock.Add(tc.elapsed)
+			assert.Equal(t, tc.want, th.lsc.isPingOverdue())
+		})
+	}
+}
+
+func TestHandlePingTimeout(t *testing.T) {
+	th := newPingTestHelper(15 * time.Second)
+	th.clock.Add(16 * time.Second)
+
+	th.lsc.handlePingTimeout()
+
+	// The pending ping gets an error response.
+	select {
+	case res := <-th.respCh:
+		assert.EqualError(t, res.err, "ping timeout")
+	default:
+		t.Fatalf("no response to the ping command")
+	}
+
+	// The dead connection is closed, and we're reconnecting.
+	assert.True(t, th.conn.closed)
+	assert.Equal(t, 1, th.transport.numConnects)
+	assert.Equal(t, LStreamClientStateConnecting, th.lsc.state)
+	assert.Nil(t, th.lsc.curCmdCtx)
+
+	var states []LStreamClientUpdateState
+	var lastConnDetails *ConnDetails
+	for _, upd := range th.drainUpdates() {
+		if upd.State != nil {
+			states = append(states, *upd.State)
+		}
+
+		if upd.ConnDetails != nil {
+			lastConnDetails = upd.ConnDetails
+		}
+	}
+
+	assert.Equal(t, []LStreamClientUpdateState{
+		{OldState: LStreamClientStateConnectedBusy, NewState: LStreamClientStateDisconnected},
+		{OldState: LStreamClientStateDisconnected, NewState: LStreamClientStateConnecting},
+	}, states)
+
+	// And the user can see why.
+	if assert.NotNil(t, lastConnDetails) {
+		assert.Equal(t, []string{
+			"No response to ping in 15s, the connection seems dead; reconnecting",
+		}, lastConnDetails.Messages)
+	}
+}
+
+func TestHandlePingTimeoutTearingDown(t *testing.T) {
+	th := newPingTestHelper(15 * time.Second)
+	th.lsc.tearingDown = true
+	th.clock.Add(16 * time.Second)
+
+	th.lsc.handlePingTimeout()
+
+	// When tearing down, we don't reconnect.
+	assert.True(t, th.conn.closed)
+	assert.Equal(t, 0, th.transport.numConnects)
+	assert.Equal(t, LStreamClientStateDisconnected, th.lsc.state)
+
+	select {
+	case <-th.lsc.disconnectedBeforeTeardownCh:
+	default:
+		t.Fatalf("disconnectedBeforeTeardownCh is not closed")
+	}
+}
@@ -12,6 +12,11 @@ type lstreamCmd struct {
 	bootstrap *lstreamCmdBootstrap
 	ping      *lstreamCmdPing
 	queryLogs *lstreamCmdQueryLogs
+
+	// cancelQueryLogs is special: it's not queued like other commands, but
+	// handled right away, by cancelling all queryLogs commands (both the one
+	// currently running, if any, and all the queued ones).
+	cancelQueryLogs *lstreamCmdCancelQueryLogs
 }
 
 type lstreamCmdCtx struct {
@@ -50,6 +55,10 @@ type lstreamCmdCtx struct {
 type lstreamCmdRes struct {
 	hostname string
 
+	// queryID is copied from lstreamCmdQueryLogs.queryID, if the command was
+	// queryLogs.
+	queryID int
+
 	err  error
 	resp interface{}
 }
@@ -70,9 +79,17 @@ type lstreamCmdCtxBootstrap struct {
 type lstreamCmdPing struct{}
 
 type lstreamCmdCtxPing struct {
+	// startedAt is when the ping was sent, used to check the deadline and to
+	// measure the round-trip time.
+	startedAt time.Time
 }
 
 type lstreamCmdQueryLogs struct {
+	// queryID is an arbitrary ID which is just copied to the lstreamCmdRes, so
+	// that the receiver can discard responses to queries which have been
+	// superseded by newer ones.
+	queryID int
+
 	maxNumLines int
 
 	from time.Time
@@ -99,10 +116,23 @@ type lstreamCmdQueryLogs struct {
 type lstreamCmdCtxQueryLogs struct {
 	Resp *LogResp
 
+	// cancelled is set to true once we've asked the agent to cancel the query.
+	cancelled bool
+
 	logfiles []logfileWithStartingLinenumber
 	lastTime time.Time
+
+	luaErrs          lineErrs
+	parseRegexMisses lineErrs
+
+	// luaTimedOut is set once the Lua script has timed out on some line; then
+	// it's not used for the rest of the lines, so that a script which loops
+	// forever doesn't block the client for a second per line.
+	luaTimedOut bool
 }
 
+type lstreamCmdCancelQueryLogs struct{}
+
 type logfileWithStartingLinenumber struct {
 	filename       string
 	fromLinenumber int
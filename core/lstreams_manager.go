@@ -15,9 +15,13 @@ import (
 	"github.com/dimonomid/nerdlog/log"
 )
 
-var ErrBusyWithAnotherQuery = errors.Errorf("busy with another query")
 var ErrNotYetConnected = errors.Errorf("not connected to all lstreams yet")
 
+// ErrQueryCancelled is sent to QueryLogsParams.RespCh when the query is
+// cancelled before it completes: explicitly with CancelQuery, or because it
+// was superseded by another query, or because the logstreams have changed.
+var ErrQueryCancelled = errors.Errorf("query cancelled")
+
 type LStreamsManager struct {
 	params LStreamsManagerParams
 
@@ -33,6 +37,9 @@ type LStreamsManager struct {
 	// lscBusyStages only contains items for lstreams which are in the
 	// LStreamClientStateConnectedBusy state.
 	lscBusyStages map[string]BusyStage
+	// lscTimeFormats contains the time formats of the lstreams which have
+	// already been bootstrapped (or failed to).
+	lscTimeFormats map[string]TimeFormatInfo
 
 	// lscPendingTeardown contains info about LStreamClient-s that are being torn
 	// down. NOTE that when a LStreamClient starts tearing down, its key changes
@@ -56,10 +63,16 @@ type LStreamsManager struct {
 	torndownCh chan struct{}
 
 	curQueryLogsCtx *manQueryLogsCtx
+	// nextQueryID is the ID which will be assigned to the next query.
+	nextQueryID int
 
 	curLogs manLogsCtx
 
 	defaultTransportMode *TransportMode
+
+	// reconnectPolicy is the default reconnect policy, which can be
+	// overridden for individual logstreams.
+	reconnectPolicy ReconnectPolicy
 }
 
 type LStreamsManagerParams struct {
@@ -67,6 +80,10 @@ type LStreamsManagerParams struct {
 	// ~/.config/nerdlog/logstreams.yaml.
 	ConfigLogStreams ConfigLogStreams
 
+	// ConfigGroups contains named groups of logstreams, typically coming from
+	// the same ~/.config/nerdlog/logstreams.yaml.
+	ConfigGroups ConfigGroups
+
 	// SSHConfig contains the general ssh config, typically coming from
 	// ~/.ssh/config.
 	SSHConfig *ssh_config.Config
@@ -81,6 +98,21 @@ type LStreamsManagerParams struct {
 
 	InitialDefaultTransportMode *TransportMode
 
+	// InitialReconnectPolicy is the default reconnect policy, which can be
+	// overridden for individual logstreams. If nil, DefaultReconnectPolicy is
+	// used.
+	InitialReconnectPolicy *ReconnectPolicy
+
+	// PingInterval and PingTimeout are passed to every LStreamClient as is, see
+	// LStreamClientParams for details.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	// LuaScript is the path to the global Lua script which is invoked for every
+	// log line, see ConfigLogStreamOptions.LuaScript. Individual logstreams
+	// can override it in the config.
+	LuaScript string
+
 	// ClientID is just an arbitrary string (should be filename-friendly though)
 	// which will be appended to the nerdlog_agent.sh and its index filenames.
 	//
@@ -102,6 +134,11 @@ func NewLStreamsManager(params LStreamsManagerParams) *LStreamsManager {
 
 	params.Logger = params.Logger.WithNamespaceAppended("LSMan")
 
+	reconnectPolicy := DefaultReconnectPolicy
+	if params.InitialReconnectPolicy != nil {
+		reconnectPolicy = *params.InitialReconnectPolicy
+	}
+
 	lsman := &LStreamsManager{
 		params: params,
 
@@ -109,6 +146,7 @@ func NewLStreamsManager(params LStreamsManagerParams) *LStreamsManager {
 		lscStates:          map[string]LStreamClientState{},
 		lscConnDetails:     map[string]ConnDetails{},
 		lscBusyStages:      map[string]BusyStage{},
+		lscTimeFormats:     map[string]TimeFormatInfo{},
 		lscPendingTeardown: map[string]int{},
 
 		lstreamUpdatesCh: make(chan *LStreamClientUpdate, 1024),
@@ -119,6 +157,7 @@ func NewLStreamsManager(params LStreamsManagerParams) *LStreamsManager {
 		torndownCh:    make(chan struct{}, 1),
 
 		defaultTransportMode: params.InitialDefaultTransportMode,
+		reconnectPolicy:      reconnectPolicy,
 	}
 
 	if err := lsman.setLStreams(params.InitialLStreams); err != nil {
@@ -169,6 +208,66 @@ func (lsman *LStreamsManager) setDefaultTransportMode(defaultTransportMode *Tran
 	lsman.sendStateUpdate()
 }
 
+// SetReconnectPolicy sets the default reconnect policy, which can be
+// overridden for individual logstreams. It takes effect right away for all
+// the existing logstreams.
+func (lsman *LStreamsManager) SetReconnectPolicy(policy ReconnectPolicy) {
+	resCh := make(chan struct{}, 1)
+
+	lsman.reqCh <- lstreamsManagerReq{
+		setReconnectPolicy: &lstreamsManagerReqSetReconnectPolicy{
+			policy: policy,
+			resCh:  resCh,
+		},
+	}
+
+	<-resCh
+}
+
+func (lsman *LStreamsManager) setReconnectPolicy(policy ReconnectPolicy) {
+	// If unchanged, then do nothing.
+	if lsman.reconnectPolicy == policy {
+		return
+	}
+
+	lsman.reconnectPolicy = policy
+
+	for key, lsc := range lsman.lscs {
+		lsc.SetReconnectPolicy(lsman.getReconnectPolicy(lsman.parsedLogStreams[key]))
+	}
+}
+
+// getLuaScript returns the path to the Lua script for the given logstream:
+// either its own one, or the global one.
+func (lsman *LStreamsManager) getLuaScript(ls LogStream) string {
+	if ls.Options.LuaScript != "" {
+		return ls.Options.LuaScript
+	}
+
+	return lsman.params.LuaScript
+}
+
+// getReconnectPolicy returns the reconnect policy for the given logstream:
+// the default one, with the per-logstream overrides applied.
+func (lsman *LStreamsManager) getReconnectPolicy(ls LogStream) ReconnectPolicy {
+	if ls.Options.Reconnect == "" {
+		return lsman.reconnectPolicy
+	}
+
+	policy, err := ParseReconnectPolicy(lsman.reconnectPolicy, ls.Options.Reconnect)
+	if err != nil {
+		// The config is supposed to be validated when loaded, so it shouldn't
+		// happen, but if it does, just fall back to the default policy.
+		lsman.params.Logger.Errorf(
+			"Invalid reconnect policy %q for %s, using the default: %s",
+			ls.Options.Reconnect, ls.Name, err.Error(),
+		)
+		return lsman.reconnectPolicy
+	}
+
+	return *policy
+}
+
 // LocalShellCommand is used when the host is "localhost".
 const LocalShellCommand = "/bin/sh"
 
@@ -184,6 +283,7 @@ func (lsman *LStreamsManager) setLStreams(lstreamsStr string) error {
 		DefaultTransportMode: lsman.defaultTransportMode,
 
 		ConfigLogStreams: lsman.params.ConfigLogStreams,
+		ConfigGroups:     lsman.params.ConfigGroups,
 		SSHConfig:        lsman.params.SSHConfig,
 	})
 
@@ -213,6 +313,7 @@ func (lsman *LStreamsManager) updateHAs() {
 		delete(lsman.lscStates, key)
 		delete(lsman.lscConnDetails, key)
 		delete(lsman.lscBusyStages, key)
+		delete(lsman.lscTimeFormats, key)
 
 		keyNew := fmt.Sprintf("OLD_%s_%s", lsman.randomString(4), key)
 		lsman.lscPendingTeardown[keyNew] += 1
@@ -233,7 +334,14 @@ func (lsman *LStreamsManager) updateHAs() {
 			Logger:    lsman.params.Logger,
 			ClientID:  lsman.params.ClientID, //fmt.Sprintf("%s-%d", lsman.params.ClientID, rand.Int()),
 			UpdatesCh: lsman.lstreamUpdatesCh,
-			Clock:     lsman.params.Clock,
+
+			ReconnectPolicy: lsman.getReconnectPolicy(ls),
+			PingInterval:    lsman.params.PingInterval,
+			PingTimeout:     lsman.params.PingTimeout,
+
+			LuaScript: lsman.getLuaScript(ls),
+
+			Clock: lsman.params.Clock,
 		})
 		lsman.lscs[key] = lsc
 		lsman.lscStates[key] = LStreamClientStateDisconnected
@@ -290,6 +398,21 @@ func (lsman *LStreamsManager) run() {
 				lsman.params.Logger.Verbose1f("ConnDetails for %s: %+v", upd.Name, *upd.ConnDetails)
 				lsman.lscConnDetails[upd.Name] = *upd.ConnDetails
 				lsman.sendStateUpdate()
+			} else if upd.PingRTT != nil {
+				if cd, ok := lsman.lscConnDetails[upd.Name]; ok {
+					cd.PingRTT = *upd.PingRTT
+					lsman.lscConnDetails[upd.Name] = cd
+					lsman.sendStateUpdate()
+				}
+			} else if upd.ClockSkew != nil {
+				if cd, ok := lsman.lscConnDetails[upd.Name]; ok {
+					cd.ClockSkew = *upd.ClockSkew
+					lsman.lscConnDetails[upd.Name] = cd
+					lsman.sendStateUpdate()
+				}
+			} else if upd.TimeFormat != nil {
+				lsman.lscTimeFormats[upd.Name] = *upd.TimeFormat
+				lsman.sendStateUpdate()
 			} else if upd.BootstrapDetails != nil {
 				lsman.params.Logger.Verbose1f("BootstrapDetails for %s: %+v", upd.Name, *upd.BootstrapDetails)
 
@@ -299,6 +422,7 @@ func (lsman *LStreamsManager) run() {
 						Err:         upd.BootstrapDetails.Err,
 
 						WarnJournalctlNoAdminAccess: upd.BootstrapDetails.WarnJournalctlNoAdminAccess,
+						WarnClockSkew:               upd.BootstrapDetails.WarnClockSkew,
 					},
 				}
 				lsman.params.UpdatesCh <- upd
@@ -364,31 +488,30 @@ func (lsman *LStreamsManager) run() {
 			switch {
 			case req.queryLogs != nil:
 				if len(lsman.lscs) == 0 {
-					lsman.sendLogRespUpdate(&LogRespTotal{
+					lsman.sendLogRespUpdate(req.queryLogs, &LogRespTotal{
 						Errs: []error{errors.Errorf("no matching lstreams to get logs from")},
 					})
 					continue
 				}
 
 				if lsman.numNotConnected > 0 {
-					lsman.sendLogRespUpdate(&LogRespTotal{
+					lsman.sendLogRespUpdate(req.queryLogs, &LogRespTotal{
 						Errs: []error{ErrNotYetConnected},
 					})
 					continue
 				}
 
-				if lsman.curQueryLogsCtx != nil {
-					lsman.sendLogRespUpdate(&LogRespTotal{
-						Errs: []error{ErrBusyWithAnotherQuery},
-					})
-					continue
-				}
-
 				if req.queryLogs.MaxNumLines == 0 {
 					panic("req.queryLogs.MaxNumLines is zero")
 				}
 
+				// If some other query is still in progress, the new one supersedes it.
+				lsman.cancelQueryLogs()
+
+				lsman.nextQueryID++
+
 				lsman.curQueryLogsCtx = &manQueryLogsCtx{
+					queryID:   lsman.nextQueryID,
 					req:       req.queryLogs,
 					startTime: lsman.params.Clock.Now(),
 					resps:     make(map[string]*LogResp, len(lsman.lscs)),
@@ -400,6 +523,7 @@ func (lsman *LStreamsManager) run() {
 
 				for lstreamName, lsc := range lsman.lscs {
 					cmdQueryLogs := lstreamCmdQueryLogs{
+						queryID:     lsman.curQueryLogsCtx.queryID,
 						maxNumLines: req.queryLogs.MaxNumLines,
 
 						from:  req.queryLogs.From,
@@ -447,21 +571,24 @@ func (lsman *LStreamsManager) run() {
 				r := req.updLStreams
 				lsman.params.Logger.Infof("LStreams manager: update logstreams spec: %s", r.logStreamsSpec)
 
-				if lsman.curQueryLogsCtx != nil {
-					r.resCh <- ErrBusyWithAnotherQuery
-					continue
-				}
-
 				if err := lsman.setLStreams(r.logStreamsSpec); err != nil {
-					r.resCh <- errors.Trace(err)
+					r.resCh <- lstreamsManagerResUpdLStreams{err: errors.Trace(err)}
 					continue
 				}
 
+				// The in-progress query (if any) is for the old logstreams, so cancel it.
+				lsman.cancelQueryLogs()
+
 				lsman.updateHAs()
 				lsman.updateLStreamsByState()
 				lsman.sendStateUpdate()
 
-				r.resCh <- nil
+				names := make(map[string]struct{}, len(lsman.parsedLogStreams))
+				for name := range lsman.parsedLogStreams {
+					names[name] = struct{}{}
+				}
+
+				r.resCh <- lstreamsManagerResUpdLStreams{names: names}
 
 			case req.setDefaultTransportMode != nil:
 				r := req.setDefaultTransportMode
@@ -471,6 +598,30 @@ func (lsman *LStreamsManager) run() {
 
 				r.resCh <- struct{}{}
 
+			case req.setReconnectPolicy != nil:
+				r := req.setReconnectPolicy
+				lsman.params.Logger.Infof("LStreams manager: setting reconnectPolicy: %s", r.policy)
+
+				lsman.setReconnectPolicy(r.policy)
+
+				r.resCh <- struct{}{}
+
+			case req.restoreLogs != nil:
+				// Whatever query is in progress, its results would override the
+				// restored logs, so cancel it.
+				if lsman.curQueryLogsCtx != nil {
+					lsman.cancelQueryLogs()
+					lsman.sendStateUpdate()
+				}
+
+				lsman.curLogs = req.restoreLogs.logsCtx.clone()
+
+			case req.cancelQuery:
+				if lsman.curQueryLogsCtx != nil {
+					lsman.cancelQueryLogs()
+					lsman.sendStateUpdate()
+				}
+
 			case req.ping:
 				for _, lsc := range lsman.lscs {
 					lsc.EnqueueCmd(lstreamCmd{
@@ -480,10 +631,7 @@ func (lsman *LStreamsManager) run() {
 
 			case req.reconnect:
 				lsman.params.Logger.Infof("Reconnect command")
-				if lsman.curQueryLogsCtx != nil {
-					lsman.params.Logger.Infof("Forgetting the in-progress query")
-					lsman.curQueryLogsCtx = nil
-				}
+				lsman.forgetQueryLogs()
 				for _, lsc := range lsman.lscs {
 					lsc.Reconnect()
 				}
@@ -494,12 +642,17 @@ func (lsman *LStreamsManager) run() {
 				// already, but we don't know it yet (we'll know once we receive updates
 				// in this same event loop, and _then_ we'll update all the data etc).
 
+			case req.retry:
+				lsman.params.Logger.Infof("Retry command")
+				for name, lsc := range lsman.lscs {
+					if lsman.lscStates[name] == LStreamClientStateGivenUp {
+						lsc.Reconnect()
+					}
+				}
+
 			case req.disconnect:
 				lsman.params.Logger.Infof("Disconnect command")
-				if lsman.curQueryLogsCtx != nil {
-					lsman.params.Logger.Infof("Forgetting the in-progress query")
-					lsman.curQueryLogsCtx = nil
-				}
+				lsman.forgetQueryLogs()
 				lsman.setLStreams("")
 
 				lsman.updateHAs()
@@ -511,6 +664,12 @@ func (lsman *LStreamsManager) run() {
 			lsman.params.Logger.Verbose1f("Got a response from %v: %+v", resp.hostname, resp)
 
 			switch {
+			case lsman.curQueryLogsCtx != nil && resp.queryID != lsman.curQueryLogsCtx.queryID:
+				lsman.params.Logger.Verbose1f(
+					"Dropping response from %s to the superseded query %d",
+					resp.hostname, resp.queryID,
+				)
+
 			case lsman.curQueryLogsCtx != nil:
 				if resp.err != nil {
 					lsman.params.Logger.Errorf("Got an error response from %v: %s", resp.hostname, resp.err)
@@ -601,6 +760,45 @@ func getEarliestTimeAndNumMsgs(logs []LogMsg) *timeAndNumMsgs {
 	return ret
 }
 
+// cancelQueryLogs forgets the in-progress query (if any), and asks all the
+// LStreamClient-s to cancel it on their side, so that they're ready for the
+// next query sooner. Whatever responses to the cancelled query are still
+// received later, they are discarded based on the query ID.
+func (lsman *LStreamsManager) cancelQueryLogs() {
+	if lsman.curQueryLogsCtx == nil {
+		return
+	}
+
+	lsman.params.Logger.Infof("Cancelling the in-progress query %d", lsman.curQueryLogsCtx.queryID)
+
+	for _, lsc := range lsman.lscs {
+		lsc.EnqueueCmd(lstreamCmd{
+			cancelQueryLogs: &lstreamCmdCancelQueryLogs{},
+		})
+	}
+
+	lsman.forgetQueryLogs()
+}
+
+// forgetQueryLogs forgets the in-progress query (if any) without cancelling
+// it on the logstreams; if the query has a RespCh, ErrQueryCancelled is sent
+// there.
+func (lsman *LStreamsManager) forgetQueryLogs() {
+	if lsman.curQueryLogsCtx == nil {
+		return
+	}
+
+	lsman.params.Logger.Infof("Forgetting the in-progress query %d", lsman.curQueryLogsCtx.queryID)
+
+	if respCh := lsman.curQueryLogsCtx.req.RespCh; respCh != nil {
+		respCh <- &LogRespTotal{
+			Errs: []error{ErrQueryCancelled},
+		}
+	}
+
+	lsman.curQueryLogsCtx = nil
+}
+
 func (lsman *LStreamsManager) getNumLStreamClientsTearingDown() int {
 	numPending := 0
 	for _, v := range lsman.lscPendingTeardown {
@@ -630,14 +828,29 @@ type lstreamsManagerReq struct {
 	queryLogs               *QueryLogsParams
 	updLStreams             *lstreamsManagerReqUpdLStreams
 	setDefaultTransportMode *lstreamsManagerReqSetDefaultTransportMode
+	setReconnectPolicy      *lstreamsManagerReqSetReconnectPolicy
+	restoreLogs             *LogRespTotal
+	cancelQuery             bool
 	ping                    bool
 	reconnect               bool
+	retry                   bool
 	disconnect              bool
 }
 
 type lstreamsManagerReqUpdLStreams struct {
 	logStreamsSpec string
-	resCh          chan<- error
+	resCh          chan<- lstreamsManagerResUpdLStreams
+}
+
+type lstreamsManagerResUpdLStreams struct {
+	// names are the names of the logstreams resolved from the spec.
+	names map[string]struct{}
+	err   error
+}
+
+type lstreamsManagerReqSetReconnectPolicy struct {
+	policy ReconnectPolicy
+	resCh  chan<- struct{}
 }
 
 type lstreamsManagerReqSetDefaultTransportMode struct {
@@ -653,7 +866,16 @@ func (lsman *LStreamsManager) QueryLogs(params QueryLogsParams) {
 }
 
 func (lsman *LStreamsManager) SetLStreams(logStreamsSpec string) error {
-	resCh := make(chan error, 1)
+	_, err := lsman.SetLStreamsGetNames(logStreamsSpec)
+	return errors.Trace(err)
+}
+
+// SetLStreamsGetNames is like SetLStreams, but also returns the names of the
+// logstreams resolved from the spec.
+func (lsman *LStreamsManager) SetLStreamsGetNames(
+	logStreamsSpec string,
+) (map[string]struct{}, error) {
+	resCh := make(chan lstreamsManagerResUpdLStreams, 1)
 
 	lsman.reqCh <- lstreamsManagerReq{
 		updLStreams: &lstreamsManagerReqUpdLStreams{
@@ -662,7 +884,31 @@ func (lsman *LStreamsManager) SetLStreams(logStreamsSpec string) error {
 		},
 	}
 
-	return <-resCh
+	res := <-resCh
+	if res.err != nil {
+		return nil, errors.Trace(res.err)
+	}
+
+	return res.names, nil
+}
+
+// RestoreLogs makes the LStreamsManager treat the given response (which must
+// be previously received from the same LStreamsManager) as the last one, so
+// that the subsequent queries with LoadEarlier continue from there. It's
+// useful when the client shows some cached results instead of querying them
+// again.
+func (lsman *LStreamsManager) RestoreLogs(resp *LogRespTotal) {
+	lsman.reqCh <- lstreamsManagerReq{
+		restoreLogs: resp,
+	}
+}
+
+// CancelQuery cancels the in-progress query, if any. If the query has a
+// RespCh, ErrQueryCancelled is sent there; otherwise, no response is sent.
+func (lsman *LStreamsManager) CancelQuery() {
+	lsman.reqCh <- lstreamsManagerReq{
+		cancelQuery: true,
+	}
 }
 
 func (lsman *LStreamsManager) Ping() {
@@ -677,6 +923,15 @@ func (lsman *LStreamsManager) Reconnect() {
 	}
 }
 
+// Retry makes the logstreams which have given up reconnecting (as per their
+// reconnect policy) start reconnecting again. Unlike Reconnect, it doesn't
+// affect other logstreams.
+func (lsman *LStreamsManager) Retry() {
+	lsman.reqCh <- lstreamsManagerReq{
+		retry: true,
+	}
+}
+
 func (lsman *LStreamsManager) Disconnect() {
 	lsman.reqCh <- lstreamsManagerReq{
 		disconnect: true,
@@ -684,6 +939,8 @@ func (lsman *LStreamsManager) Disconnect() {
 }
 
 type manQueryLogsCtx struct {
+	queryID int
+
 	req *QueryLogsParams
 
 	startTime time.Time
@@ -703,7 +960,32 @@ type manLogsCtx struct {
 
 type manLogsNodeCtx struct {
 	logs          []LogMsg
+	minuteStats   map[int64]MinuteStatsItem
 	isMaxNumLines bool
+
+	// clockSkew is subtracted from the timestamps of the logs when merging
+	// them with other logstreams, see LogResp.ClockSkew. The logs themselves
+	// keep the original timestamps, since those are used to query more logs.
+	// The minuteStats above are already corrected, see shiftMinuteStats.
+	clockSkew time.Duration
+}
+
+// clone returns a copy of the manLogsCtx which can be modified without
+// affecting the original one. NOTE that logs and minuteStats are never
+// modified in-place (only replaced), so they are not copied.
+func (lc manLogsCtx) clone() manLogsCtx {
+	ret := manLogsCtx{
+		minuteStats:  lc.minuteStats,
+		numMsgsTotal: lc.numMsgsTotal,
+		perNode:      make(map[string]*manLogsNodeCtx, len(lc.perNode)),
+	}
+
+	for k, v := range lc.perNode {
+		pn := *v
+		ret.perNode[k] = &pn
+	}
+
+	return ret
 }
 
 type LStreamsManagerUpdate struct {
@@ -737,6 +1019,7 @@ type LStreamsManagerState struct {
 
 	ConnDetailsByLStream map[string]ConnDetails
 	BusyStageByLStream   map[string]BusyStage
+	TimeFormatByLStream  map[string]TimeFormatInfo
 
 	// TearingDown contains logstream names whic are in the process of teardown.
 	TearingDown []string
@@ -751,6 +1034,10 @@ type BootstrapIssue struct {
 	// instead of a generic warning message to make it possible to suppress it
 	// with a flag.
 	WarnJournalctlNoAdminAccess bool
+
+	// WarnClockSkew, if non-zero, is the clock skew of the host which exceeds
+	// ClockSkewWarnThreshold, while no clock correction is configured.
+	WarnClockSkew time.Duration
 }
 
 func (lsman *LStreamsManager) updateLStreamsByState() {
@@ -790,6 +1077,11 @@ func (lsman *LStreamsManager) sendStateUpdate() {
 		busyStagesCopy[k] = v
 	}
 
+	timeFormatsCopy := make(map[string]TimeFormatInfo, len(lsman.lscTimeFormats))
+	for k, v := range lsman.lscTimeFormats {
+		timeFormatsCopy[k] = v
+	}
+
 	tearingDown := make([]string, 0, len(lsman.lscPendingTeardown))
 	for k, num := range lsman.lscPendingTeardown {
 		for i := 0; i < num; i++ {
@@ -808,6 +1100,7 @@ func (lsman *LStreamsManager) sendStateUpdate() {
 			Busy:                 lsman.curQueryLogsCtx != nil,
 			ConnDetailsByLStream: connDetailsCopy,
 			BusyStageByLStream:   busyStagesCopy,
+			TimeFormatByLStream:  timeFormatsCopy,
 			TearingDown:          tearingDown,
 		},
 	}
@@ -815,11 +1108,18 @@ func (lsman *LStreamsManager) sendStateUpdate() {
 	lsman.params.UpdatesCh <- upd
 }
 
-func (lsman *LStreamsManager) sendLogRespUpdate(resp *LogRespTotal) {
+// sendLogRespUpdate sends the response to the given query: to its RespCh if
+// it's set, or otherwise as an update to UpdatesCh.
+func (lsman *LStreamsManager) sendLogRespUpdate(req *QueryLogsParams, resp *LogRespTotal) {
 	if lsman.curQueryLogsCtx != nil {
 		resp.QueryDur = time.Since(lsman.curQueryLogsCtx.startTime)
 	}
 
+	if req.RespCh != nil {
+		req.RespCh <- resp
+		return
+	}
+
 	lsman.params.UpdatesCh <- LStreamsManagerUpdate{
 		LogResp: resp,
 	}
@@ -839,7 +1139,7 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 			return errs2[i].Error() < errs2[j].Error()
 		})
 
-		lsman.sendLogRespUpdate(&LogRespTotal{
+		lsman.sendLogRespUpdate(lsman.curQueryLogsCtx.req, &LogRespTotal{
 			Errs: errs2,
 		})
 
@@ -855,7 +1155,8 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 		}
 
 		for nodeName, resp := range resps {
-			for k, v := range resp.MinuteStats {
+			minuteStats := shiftMinuteStats(resp.MinuteStats, resp.ClockSkew)
+			for k, v := range minuteStats {
 				lsman.curLogs.minuteStats[k] = MinuteStatsItem{
 					NumMsgs: lsman.curLogs.minuteStats[k].NumMsgs + v.NumMsgs,
 				}
@@ -865,7 +1166,9 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 
 			lsman.curLogs.perNode[nodeName] = &manLogsNodeCtx{
 				logs:          resp.Logs,
+				minuteStats:   minuteStats,
 				isMaxNumLines: len(resp.Logs) == lsman.curQueryLogsCtx.req.MaxNumLines,
+				clockSkew:     resp.ClockSkew,
 			}
 		}
 	} else {
@@ -874,6 +1177,7 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 			pn := lsman.curLogs.perNode[nodeName]
 			pn.logs = append(resp.Logs, pn.logs...)
 			pn.isMaxNumLines = len(resp.Logs) == lsman.curQueryLogsCtx.req.MaxNumLines
+			pn.clockSkew = resp.ClockSkew
 		}
 	}
 
@@ -884,21 +1188,37 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 	}
 
 	ret := &LogRespTotal{
-		MinuteStats:   lsman.curLogs.minuteStats,
-		NumMsgsTotal:  lsman.curLogs.numMsgsTotal,
-		LoadedEarlier: lsman.curQueryLogsCtx.req.LoadEarlier,
-		DebugInfo:     debugInfo,
+		MinuteStats:          lsman.curLogs.minuteStats,
+		MinuteStatsByLStream: make(map[string]map[int64]MinuteStatsItem, len(lsman.curLogs.perNode)),
+		NumMsgsTotal:         lsman.curLogs.numMsgsTotal,
+		LoadedEarlier:        lsman.curQueryLogsCtx.req.LoadEarlier,
+		DebugInfo:            debugInfo,
+
+		logsCtx: lsman.curLogs.clone(),
 	}
 
 	var logsCoveredSince time.Time
 
-	for _, pn := range lsman.curLogs.perNode {
+	for nodeName, pn := range lsman.curLogs.perNode {
+		firstIdx := len(ret.Logs)
 		ret.Logs = append(ret.Logs, pn.logs...)
 
+		// Correct the timestamps for the clock skew of the host, so that the logs
+		// are sorted properly below. It only affects the copies in ret.Logs.
+		if pn.clockSkew != 0 {
+			for i := firstIdx; i < len(ret.Logs); i++ {
+				ret.Logs[i].Time = ret.Logs[i].Time.Add(-pn.clockSkew)
+			}
+		}
+
+		ret.MinuteStatsByLStream[nodeName] = pn.minuteStats
+
 		// If the timespan covered by logs from this logstream is shorter than what
 		// we've seen before, remember it.
-		if pn.isMaxNumLines && logsCoveredSince.Before(pn.logs[0].Time) {
-			logsCoveredSince = pn.logs[0].Time
+		if pn.isMaxNumLines {
+			if coveredSince := pn.logs[0].Time.Add(-pn.clockSkew); logsCoveredSince.Before(coveredSince) {
+				logsCoveredSince = coveredSince
+			}
 		}
 	}
 
@@ -918,7 +1238,7 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 	})
 	ret.Logs = ret.Logs[coveredSinceIdx:]
 
-	lsman.sendLogRespUpdate(ret)
+	lsman.sendLogRespUpdate(lsman.curQueryLogsCtx.req, ret)
 }
 
 func (lsman *LStreamsManager) randomString(length int) string {
@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/dimonomid/nerdlog/shellescape"
@@ -27,6 +28,11 @@ type LStreamsResolverParams struct {
 	// ~/.config/nerdlog/logstreams.yaml.
 	ConfigLogStreams ConfigLogStreams
 
+	// ConfigGroups is the named groups of logstreams, typically coming from the
+	// same ~/.config/nerdlog/logstreams.yaml; they can be referred to as
+	// "@groupname" in the logstreams spec.
+	ConfigGroups ConfigGroups
+
 	// SSHConfig is the general SSH config, typically coming from ~/.ssh/config
 	SSHConfig *ssh_config.Config
 }
@@ -97,6 +103,51 @@ type LogStreamOptions struct {
 	// custom env vars for tests, like: "export TZ=America/New_York", but
 	// might be useful outside of tests as well.
 	ShellInit []string
+
+	// Reconnect is the reconnect policy spec for this logstream, see
+	// ConfigLogStreamOptions.Reconnect. If empty, the default policy is used.
+	Reconnect string
+
+	// LuaScript is the path to the Lua script for this logstream, see
+	// ConfigLogStreamOptions.LuaScript. If empty, the global script is used,
+	// if any.
+	LuaScript string
+
+	// Parsers is the parser chain for this logstream, see
+	// ConfigLogStreamOptions.Parsers. If empty, DefaultLogParsers are used.
+	Parsers []string
+
+	// ParseRegex is the regex applied after the Parsers, see
+	// ConfigLogStreamOptions.ParseRegex. If empty, no regex is applied.
+	ParseRegex string
+
+	// Multiline is the multiline rule spec for this logstream, see
+	// ConfigLogStreamOptions.Multiline. If empty, multi-line messages are not
+	// grouped.
+	Multiline string
+
+	// TimeFormat is the time format spec for this logstream, see
+	// ConfigLogStreamOptions.TimeFormat. If empty, the time format is
+	// autodetected.
+	TimeFormat string
+
+	// Timezone is the timezone of the logs, see
+	// ConfigLogStreamOptions.Timezone. If empty, the timezone is detected on
+	// the host.
+	Timezone string
+
+	// ClockCorrection is the clock correction spec for this logstream, see
+	// ConfigLogStreamOptions.ClockCorrection. If empty, the timestamps are not
+	// corrected.
+	ClockCorrection string
+
+	// Levels are the rules to determine the level of the log messages, see
+	// ConfigLogStreamOptions.Levels.
+	Levels []ConfigLevelRule
+
+	// LevelGuessing, if false, disables guessing the level from the message
+	// text, see ConfigLogStreamOptions.LevelGuessing. If nil, it's enabled.
+	LevelGuessing *bool
 }
 
 // SudoMode can be used to configure nerdlog to read log files with "sudo -n".
@@ -165,17 +216,32 @@ func (ls LogStream) LogFilePrev() (string, bool) {
 // - "myuser@myserver.com:22"
 // - "myuser@myserver.com"
 // - "myserver.com"
+// - "myserver-*"
+// - "tag:db" (all logstreams from the config having the tag "db")
+// - "@prod" (the group "prod" from the config)
+//
+// Entries are separated by commas, and the result is the union of all the
+// entries. An entry can also be an intersection like "@prod & tag:api", where
+// any operand can be negated with "!", like "@prod & !tag:db".
 func (r *LStreamsResolver) Resolve(lstreamsStr string) (map[string]LogStream, error) {
 	lstreamsStr = strings.TrimSpace(lstreamsStr)
 
-	parsedLogStreams := map[string]LogStream{}
-
 	// Special case for an empty input: it's allowed and just results in no
 	// logstreams.
 	if lstreamsStr == "" {
-		return parsedLogStreams, nil
+		return map[string]LogStream{}, nil
 	}
 
+	return r.resolveSpec(lstreamsStr, nil)
+}
+
+// resolveSpec is like Resolve, but it also takes the stack of groups being
+// resolved, to detect cycles.
+func (r *LStreamsResolver) resolveSpec(
+	lstreamsStr string, groupsStack []string,
+) (map[string]LogStream, error) {
+	parsedLogStreams := map[string]LogStream{}
+
 	// TODO: when json is supported, splitting by commas will need to be improved.
 	parts := strings.Split(lstreamsStr, ",")
 	for i, part := range parts {
@@ -185,25 +251,238 @@ func (r *LStreamsResolver) Resolve(lstreamsStr string) (map[string]LogStream, er
 			return nil, errors.Errorf("entry #%d is empty", i+1)
 		}
 
-		cfs, err := r.parseLogStreamSpecEntry(part)
+		lstreams, err := r.resolveEntry(part, groupsStack)
 		if err != nil {
 			return nil, errors.Annotatef(err, "parsing entry #%d (%s)", i+1, part)
 		}
 
-		for _, ch := range cfs {
-			key := ch.Name
+		for _, key := range sortedLogStreamNames(lstreams) {
+			ls := lstreams[key]
 
-			if _, exists := parsedLogStreams[key]; exists {
+			// The same logstream might be selected by multiple entries (e.g. a tag
+			// and a group, or just the same name twice), which is fine as long as
+			// it's the same logstream.
+			if existing, exists := parsedLogStreams[key]; exists && !isSameLogStream(existing, ls) {
 				return nil, errors.Errorf("the logstream %s is present at least twice", key)
 			}
 
-			parsedLogStreams[key] = ch
+			parsedLogStreams[key] = ls
 		}
 	}
 
 	return parsedLogStreams, nil
 }
 
+// isSameLogStream returns whether the two logstreams are the same, i.e. they
+// have the same name, transport and log files. The options are not compared,
+// since they're derived from the config based on the name anyway.
+func isSameLogStream(a, b LogStream) bool {
+	if a.Name != b.Name || len(a.LogFiles) != len(b.LogFiles) {
+		return false
+	}
+
+	for i := range a.LogFiles {
+		if a.LogFiles[i] != b.LogFiles[i] {
+			return false
+		}
+	}
+
+	return isSameTransport(a.Transport, b.Transport)
+}
+
+func isSameTransport(a, b ConfigLogStreamShellTransport) bool {
+	switch {
+	case a.SSHLib != nil && b.SSHLib != nil:
+		if a.SSHLib.Host != b.SSHLib.Host {
+			return false
+		}
+
+		if a.SSHLib.Jumphost == nil || b.SSHLib.Jumphost == nil {
+			return a.SSHLib.Jumphost == nil && b.SSHLib.Jumphost == nil
+		}
+
+		return *a.SSHLib.Jumphost == *b.SSHLib.Jumphost
+
+	case a.CustomCmd != nil && b.CustomCmd != nil:
+		if a.CustomCmd.ShellCommand != b.CustomCmd.ShellCommand ||
+			len(a.CustomCmd.EnvOverride) != len(b.CustomCmd.EnvOverride) {
+			return false
+		}
+
+		for k, v := range a.CustomCmd.EnvOverride {
+			if bv, ok := b.CustomCmd.EnvOverride[k]; !ok || bv != v {
+				return false
+			}
+		}
+
+		return true
+
+	case a.Localhost != nil && b.Localhost != nil:
+		return true
+	}
+
+	return false
+}
+
+// resolveEntry resolves a single entry of the logstreams spec, which is
+// either a single operand (see resolveOperand), or an intersection of
+// operands like "@prod & tag:api & !myhost-01".
+func (r *LStreamsResolver) resolveEntry(
+	entry string, groupsStack []string,
+) (map[string]LogStream, error) {
+	operands := strings.Split(entry, "&")
+	if len(operands) == 1 {
+		if strings.HasPrefix(entry, "!") {
+			return nil, errors.Errorf(
+				"negation is only supported in intersections, like \"@prod & !tag:db\"",
+			)
+		}
+
+		return r.resolveOperand(entry, groupsStack)
+	}
+
+	var ret map[string]LogStream
+	var excluded []map[string]LogStream
+
+	for _, operand := range operands {
+		operand = strings.TrimSpace(operand)
+
+		negated := false
+		if strings.HasPrefix(operand, "!") {
+			negated = true
+			operand = strings.TrimSpace(operand[1:])
+		}
+
+		if operand == "" {
+			return nil, errors.Errorf("empty operand in %q", entry)
+		}
+
+		lstreams, err := r.resolveOperand(operand, groupsStack)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if negated {
+			excluded = append(excluded, lstreams)
+			continue
+		}
+
+		if ret == nil {
+			ret = lstreams
+			continue
+		}
+
+		for key := range ret {
+			if _, ok := lstreams[key]; !ok {
+				delete(ret, key)
+			}
+		}
+	}
+
+	if ret == nil {
+		return nil, errors.Errorf("%q: at least one operand must not be negated", entry)
+	}
+
+	for _, lstreams := range excluded {
+		for key := range lstreams {
+			delete(ret, key)
+		}
+	}
+
+	if len(ret) == 0 {
+		return nil, errors.Errorf("%q didn't match anything", entry)
+	}
+
+	return ret, nil
+}
+
+// resolveOperand resolves a single operand, which is either a group like
+// "@prod", a tag like "tag:db", or a logstream spec entry as accepted by
+// parseLogStreamSpecEntry.
+func (r *LStreamsResolver) resolveOperand(
+	operand string, groupsStack []string,
+) (map[string]LogStream, error) {
+	ret := map[string]LogStream{}
+
+	switch {
+	case strings.HasPrefix(operand, "@"):
+		groupName := operand[1:]
+
+		groupEntries, ok := r.params.ConfigGroups[groupName]
+		if !ok {
+			return nil, errors.Errorf("group %q is not defined", groupName)
+		}
+
+		for _, name := range groupsStack {
+			if name == groupName {
+				return nil, errors.Errorf(
+					"group %q includes itself: %s",
+					groupName, strings.Join(append(groupsStack, groupName), " -> "),
+				)
+			}
+		}
+
+		if len(groupEntries) == 0 {
+			return nil, errors.Errorf("group %q is empty", groupName)
+		}
+
+		lstreams, err := r.resolveSpec(
+			strings.Join(groupEntries, ","), append(groupsStack, groupName),
+		)
+		if err != nil {
+			return nil, errors.Annotatef(err, "resolving group %q", groupName)
+		}
+
+		return lstreams, nil
+
+	case strings.HasPrefix(operand, "tag:"):
+		tag := strings.TrimPrefix(operand, "tag:")
+
+		keys := r.params.ConfigLogStreams.KeysByTag(tag)
+		if len(keys) == 0 {
+			return nil, errors.Errorf("no logstreams with the tag %q", tag)
+		}
+
+		for _, key := range keys {
+			lstreams, err := r.parseLogStreamSpecEntry(key)
+			if err != nil {
+				return nil, errors.Annotatef(err, "resolving %s with the tag %q", key, tag)
+			}
+
+			for _, ls := range lstreams {
+				ret[ls.Name] = ls
+			}
+		}
+
+	default:
+		lstreams, err := r.parseLogStreamSpecEntry(operand)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		for _, ls := range lstreams {
+			if _, exists := ret[ls.Name]; exists {
+				return nil, errors.Errorf("the logstream %s is present at least twice", ls.Name)
+			}
+
+			ret[ls.Name] = ls
+		}
+	}
+
+	return ret, nil
+}
+
+func sortedLogStreamNames(lstreams map[string]LogStream) []string {
+	names := make([]string, 0, len(lstreams))
+	for name := range lstreams {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
 // draftLogStream is a draft version of LogStream; it's used as temporary
 // storage in the process of resolving logstreams.
 type draftLogStream struct {
@@ -428,8 +707,18 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 			Transport: transport,
 			LogFiles:  ls.logFiles,
 			Options: LogStreamOptions{
-				SudoMode:  ls.options.SudoMode,
-				ShellInit: ls.options.ShellInit,
+				SudoMode:        ls.options.SudoMode,
+				ShellInit:       ls.options.ShellInit,
+				Reconnect:       ls.options.Reconnect,
+				LuaScript:       ls.options.LuaScript,
+				Parsers:         ls.options.Parsers,
+				ParseRegex:      ls.options.ParseRegex,
+				Multiline:       ls.options.Multiline,
+				TimeFormat:      ls.options.TimeFormat,
+				Timezone:        ls.options.Timezone,
+				ClockCorrection: ls.options.ClockCorrection,
+				Levels:          ls.options.Levels,
+				LevelGuessing:   ls.options.LevelGuessing,
 			},
 		})
 	}
@@ -580,6 +869,46 @@ func expandFromLogStreamsConfig(
 				lsCopy.options.Transport = matchedItem.Options.Transport
 			}
 
+			if lsCopy.options.Reconnect == "" {
+				lsCopy.options.Reconnect = matchedItem.Options.Reconnect
+			}
+
+			if lsCopy.options.LuaScript == "" {
+				lsCopy.options.LuaScript = matchedItem.Options.LuaScript
+			}
+
+			if lsCopy.options.Parsers == nil {
+				lsCopy.options.Parsers = matchedItem.Options.Parsers
+			}
+
+			if lsCopy.options.ParseRegex == "" {
+				lsCopy.options.ParseRegex = matchedItem.Options.ParseRegex
+			}
+
+			if lsCopy.options.Multiline == "" {
+				lsCopy.options.Multiline = matchedItem.Options.Multiline
+			}
+
+			if lsCopy.options.TimeFormat == "" {
+				lsCopy.options.TimeFormat = matchedItem.Options.TimeFormat
+			}
+
+			if lsCopy.options.Timezone == "" {
+				lsCopy.options.Timezone = matchedItem.Options.Timezone
+			}
+
+			if lsCopy.options.ClockCorrection == "" {
+				lsCopy.options.ClockCorrection = matchedItem.Options.ClockCorrection
+			}
+
+			if lsCopy.options.Levels == nil {
+				lsCopy.options.Levels = matchedItem.Options.Levels
+			}
+
+			if lsCopy.options.LevelGuessing == nil {
+				lsCopy.options.LevelGuessing = matchedItem.Options.LevelGuessing
+			}
+
 			if len(lsCopy.logFiles) == 0 {
 				lsCopy.logFiles = matchedItem.LogFiles
 			}
@@ -111,6 +111,7 @@ type resolverTestCase struct {
 	osUser string
 
 	configLogStreams ConfigLogStreams
+	configGroups     ConfigGroups
 	sshConfig        *ssh_config.Config
 
 	// input is the logstream spec string that we're feeding to Resolve()
@@ -137,6 +138,7 @@ func runResolverTestCase(t *testing.T, tc resolverTestCase) {
 		CurOSUser:            tc.osUser,
 		DefaultTransportMode: NewTransportModeSSHLib(),
 		ConfigLogStreams:     tc.configLogStreams,
+		ConfigGroups:         tc.configGroups,
 		SSHConfig:            tc.sshConfig,
 	})
 
@@ -148,6 +150,7 @@ func runResolverTestCase(t *testing.T, tc resolverTestCase) {
 		CurOSUser:            tc.osUser,
 		DefaultTransportMode: customCmdTransport,
 		ConfigLogStreams:     tc.configLogStreams,
+		ConfigGroups:         tc.configGroups,
 		SSHConfig:            tc.sshConfig,
 	})
 
@@ -2448,3 +2451,205 @@ func TestLStreamsResolverCustomTransport(t *testing.T) {
 		})
 	}
 }
+
+var testConfigLogStreamsTagged = ConfigLogStreams(map[string]ConfigLogStream{
+	"prod-api-01": ConfigLogStream{
+		Tags: []string{"api"},
+	},
+	"prod-api-02": ConfigLogStream{
+		Tags: []string{"api"},
+	},
+	"prod-db-01": ConfigLogStream{
+		Tags: []string{"db"},
+	},
+	"stage-api-01": ConfigLogStream{
+		Tags: []string{"api"},
+	},
+})
+
+var testConfigGroups = ConfigGroups(map[string][]string{
+	"prod":    {"prod-*"},
+	"all":     {"@prod", "stage-*"},
+	"cycle-a": {"@cycle-b"},
+	"cycle-b": {"@cycle-a"},
+	"empty":   {},
+})
+
+func makeTaggedTestLogStreams(names ...string) map[string]LogStream {
+	ret := make(map[string]LogStream, len(names))
+	for _, name := range names {
+		ret[name] = LogStream{
+			Name: name,
+			Transport: ConfigLogStreamShellTransport{
+				SSHLib: &ConfigLogStreamShellTransportSSHLib{
+					Host: ConfigHost{
+						Addr: name + ":22",
+						User: "osuser",
+					},
+				},
+			},
+			LogFiles: []string{"auto", "auto"},
+		}
+	}
+
+	return ret
+}
+
+func TestLStreamsResolverGroupsAndTags(t *testing.T) {
+	tests := []resolverTestCase{
+		{
+			name:        "tag",
+			input:       "tag:db",
+			wantStreams: makeTaggedTestLogStreams("prod-db-01"),
+		},
+		{
+			name:        "group",
+			input:       "@prod",
+			wantStreams: makeTaggedTestLogStreams("prod-api-01", "prod-api-02", "prod-db-01"),
+		},
+		{
+			name:  "nested group",
+			input: "@all",
+			wantStreams: makeTaggedTestLogStreams(
+				"prod-api-01", "prod-api-02", "prod-db-01", "stage-api-01",
+			),
+		},
+		{
+			name:        "intersection",
+			input:       "@prod & tag:api",
+			wantStreams: makeTaggedTestLogStreams("prod-api-01", "prod-api-02"),
+		},
+		{
+			name:        "intersection with negation",
+			input:       "tag:api & !@prod",
+			wantStreams: makeTaggedTestLogStreams("stage-api-01"),
+		},
+		{
+			name:        "union of overlapping entries",
+			input:       "tag:db, @prod & !tag:api, prod-db-01",
+			wantStreams: makeTaggedTestLogStreams("prod-db-01"),
+		},
+		{
+			name:        "same logstream twice",
+			input:       "prod-db-01, prod-db-01",
+			wantStreams: makeTaggedTestLogStreams("prod-db-01"),
+		},
+		{
+			name:        "same logstream via a tag and by name",
+			input:       "tag:db, prod-db-01",
+			wantStreams: makeTaggedTestLogStreams("prod-db-01"),
+		},
+		{
+			name:    "intersection matching nothing",
+			input:   "tag:db & tag:api",
+			wantErr: `parsing entry #1 (tag:db & tag:api): "tag:db & tag:api" didn't match anything`,
+		},
+		{
+			name:    "negation only",
+			input:   "!tag:db",
+			wantErr: `parsing entry #1 (!tag:db): negation is only supported in intersections, like "@prod & !tag:db"`,
+		},
+		{
+			name:    "unknown tag",
+			input:   "tag:foo",
+			wantErr: `parsing entry #1 (tag:foo): no logstreams with the tag "foo"`,
+		},
+		{
+			name:    "unknown group",
+			input:   "@foo",
+			wantErr: `parsing entry #1 (@foo): group "foo" is not defined`,
+		},
+		{
+			name:    "empty group",
+			input:   "@empty",
+			wantErr: `parsing entry #1 (@empty): group "empty" is empty`,
+		},
+		{
+			name:    "group cycle",
+			input:   "@cycle-a",
+			wantErr: `parsing entry #1 (@cycle-a): resolving group "cycle-a": parsing entry #1 (@cycle-b): resolving group "cycle-b": parsing entry #1 (@cycle-a): group "cycle-a" includes itself: cycle-a -> cycle-b -> cycle-a`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.osUser = "osuser"
+			tt.configLogStreams = testConfigLogStreamsTagged
+			tt.configGroups = testConfigGroups
+
+			// Nothing here is specific to the transport, so just derive the
+			// expectations for ssh-bin from the ssh-lib ones.
+			if tt.wantErr == "" {
+				tt.wantStreamsCustomCmd = map[string]LogStream{}
+				for name := range tt.wantStreams {
+					tt.wantStreamsCustomCmd[name] = LogStream{
+						Name: name,
+						Transport: ConfigLogStreamShellTransport{
+							CustomCmd: &ConfigLogStreamShellTransportCustomCmd{
+								ShellCommand: "ssh -o 'BatchMode=yes' ${NLPORT:+-p ${NLPORT}} ${NLUSER:+${NLUSER}@}${NLHOST} /bin/sh",
+								EnvOverride: map[string]string{
+									"NLHOST": name,
+								},
+							},
+						},
+						LogFiles: []string{"auto", "auto"},
+					}
+				}
+			}
+
+			runResolverTestCase(t, tt)
+		})
+	}
+}
+
+func TestIsSameLogStream(t *testing.T) {
+	base := makeTaggedTestLogStreams("prod-db-01")["prod-db-01"]
+	base.Options.ShellInit = []string{"export TZ=UTC"}
+
+	same := base
+	same.LogFiles = []string{"auto", "auto"}
+	same.Transport.SSHLib = &ConfigLogStreamShellTransportSSHLib{
+		Host: base.Transport.SSHLib.Host,
+	}
+	// The options are not compared.
+	same.Options = LogStreamOptions{}
+	assert.True(t, isSameLogStream(base, same))
+
+	differentLogFiles := base
+	differentLogFiles.LogFiles = []string{"/var/log/messages", "/var/log/messages.1"}
+	assert.False(t, isSameLogStream(base, differentLogFiles))
+
+	differentUser := base
+	differentUser.Transport.SSHLib = &ConfigLogStreamShellTransportSSHLib{
+		Host: ConfigHost{Addr: "prod-db-01:22", User: "someoneelse"},
+	}
+	assert.False(t, isSameLogStream(base, differentUser))
+
+	withJumphost := base
+	withJumphost.Transport.SSHLib = &ConfigLogStreamShellTransportSSHLib{
+		Host:     base.Transport.SSHLib.Host,
+		Jumphost: &ConfigHost{Addr: "bastion:22", User: "osuser"},
+	}
+	assert.False(t, isSameLogStream(base, withJumphost))
+	assert.True(t, isSameLogStream(withJumphost, withJumphost))
+
+	customCmd := LogStream{
+		Name: "prod-db-01",
+		Transport: ConfigLogStreamShellTransport{
+			CustomCmd: &ConfigLogStreamShellTransportCustomCmd{
+				ShellCommand: "ssh ${NLHOST} /bin/sh",
+				EnvOverride:  map[string]string{"NLHOST": "prod-db-01"},
+			},
+		},
+		LogFiles: []string{"auto", "auto"},
+	}
+	assert.False(t, isSameLogStream(base, customCmd))
+	assert.True(t, isSameLogStream(customCmd, customCmd))
+
+	differentEnv := customCmd
+	differentEnv.Transport.CustomCmd = &ConfigLogStreamShellTransportCustomCmd{
+		ShellCommand: "ssh ${NLHOST} /bin/sh",
+		EnvOverride:  map[string]string{"NLHOST": "prod-db-02"},
+	}
+	assert.False(t, isSameLogStream(customCmd, differentEnv))
+}
@@ -0,0 +1,220 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaParseFuncName is the name of the global function which a user Lua
+// script must define; it's called for every log line, after the default
+// parsing is done.
+//
+// It receives a single table argument with the following fields:
+//
+//   - orig_line: the raw log line, as it is in the log file (read-only);
+//   - time: the parsed time, as unix timestamp in seconds (read-only);
+//   - message: the message, without the timestamp and the syslog envelope;
+//   - level: one of "error", "warn", "info", "debug", or "" if unknown;
+//   - context: a table with the context fields, like hostname, program, pid.
+//
+// The function can modify message, level and context in this table, and the
+// changes will be applied to the LogMsg.
+const luaParseFuncName = "parse_line"
+
+// luaParseTimeout is how long a single call of the parse_line function can
+// take; if it takes longer (e.g. the script loops forever), the call is
+// aborted and errLuaParseTimeout is returned.
+const luaParseTimeout = 1 * time.Second
+
+var errLuaParseTimeout = errors.Errorf("%s timed out", luaParseFuncName)
+
+// maxLineErrsPerQuery is how many per-line errors (like Lua errors) we keep
+// for a single query; the rest is only counted.
+const maxLineErrsPerQuery = 10
+
+// luaScript is a user Lua script which is invoked for every log line. It's
+// not thread-safe, so every LStreamClient has its own instance.
+type luaScript struct {
+	path string
+
+	L         *lua.LState
+	parseFunc *lua.LFunction
+
+	// timeout is luaParseTimeout, but can be changed by tests.
+	timeout time.Duration
+}
+
+// newLuaScript loads the Lua script from the given file, and makes sure it
+// defines the parse_line function.
+func newLuaScript(path string) (*luaScript, error) {
+	code, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "reading lua script")
+	}
+
+	return newLuaScriptFromString(path, string(code))
+}
+
+func newLuaScriptFromString(path, code string) (*luaScript, error) {
+	L := lua.NewState()
+
+	fn, err := L.Load(strings.NewReader(code), path)
+	if err != nil {
+		L.Close()
+		return nil, errors.Annotatef(err, "loading lua script %s", path)
+	}
+
+	L.Push(fn)
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, errors.Annotatef(err, "running lua script %s", path)
+	}
+
+	parseFunc, ok := L.GetGlobal(luaParseFuncName).(*lua.LFunction)
+	if !ok {
+		L.Close()
+		return nil, errors.Errorf("lua script %s doesn't define the %s function", path, luaParseFuncName)
+	}
+
+	return &luaScript{
+		path:      path,
+		L:         L,
+		parseFunc: parseFunc,
+		timeout:   luaParseTimeout,
+	}, nil
+}
+
+func (ls *luaScript) Close() {
+	ls.L.Close()
+}
+
+// parse invokes the parse_line function for the given message, and applies
+// the changes it made. If the script fails, the logMsg is left untouched. If
+// the script takes longer than ls.timeout, errLuaParseTimeout is returned.
+func (ls *luaScript) parse(logMsg *LogMsg) error {
+	L := ls.L
+
+	ctxTable := L.NewTable()
+	for k, v := range logMsg.Context {
+		ctxTable.RawSetString(k, lua.LString(v))
+	}
+
+	msgTable := L.NewTable()
+	msgTable.RawSetString("orig_line", lua.LString(logMsg.OrigLine))
+	msgTable.RawSetString("time", lua.LNumber(float64(logMsg.Time.UnixNano())/1e9))
+	msgTable.RawSetString("message", lua.LString(logMsg.Msg))
+	msgTable.RawSetString("level", lua.LString(logMsg.Level))
+	msgTable.RawSetString("context", ctxTable)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ls.timeout)
+	L.SetContext(ctx)
+
+	err := L.CallByParam(lua.P{
+		Fn:      ls.parseFunc,
+		NRet:    0,
+		Protect: true,
+	}, msgTable)
+
+	L.RemoveContext()
+	cancel()
+
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return errLuaParseTimeout
+		}
+
+		return errors.Trace(err)
+	}
+
+	msg, ok := msgTable.RawGetString("message").(lua.LString)
+	if !ok {
+		return errors.Errorf("message must be a string, got %s", msgTable.RawGetString("message").Type())
+	}
+
+	level, err := luaLogLevel(msgTable.RawGetString("level"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	newCtxTable, ok := msgTable.RawGetString("context").(*lua.LTable)
+	if !ok {
+		return errors.Errorf("context must be a table, got %s", msgTable.RawGetString("context").Type())
+	}
+
+	newCtx := make(map[string]string, len(logMsg.Context))
+
+	var ctxErr error
+	newCtxTable.ForEach(func(k, v lua.LValue) {
+		if ctxErr != nil {
+			return
+		}
+
+		switch v.Type() {
+		case lua.LTString, lua.LTNumber, lua.LTBool:
+			newCtx[k.String()] = v.String()
+		default:
+			ctxErr = errors.Errorf("context field %q must be a string, number or boolean, got %s", k.String(), v.Type())
+		}
+	})
+	if ctxErr != nil {
+		return ctxErr
+	}
+
+	// The lstream is used by nerdlog itself, so the script can't change it.
+	newCtx["lstream"] = logMsg.Context["lstream"]
+
+	logMsg.Msg = string(msg)
+	logMsg.Level = level
+	logMsg.Context = newCtx
+
+	return nil
+}
+
+func luaLogLevel(v lua.LValue) (LogLevel, error) {
+	if v == lua.LNil {
+		return LogLevelUnknown, nil
+	}
+
+	if s, ok := v.(lua.LString); ok {
+		switch level := LogLevel(s); level {
+		case LogLevelUnknown, LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError:
+			return level, nil
+		}
+	}
+
+	return "", errors.Errorf(
+		"invalid level %q; valid ones are: %q, %q, %q, %q, or empty string",
+		v.String(), LogLevelError, LogLevelWarn, LogLevelInfo, LogLevelDebug,
+	)
+}
+
+// lineErrs collects the per-line errors during a single query, like errors
+// from the Lua script.
+type lineErrs struct {
+	errs  []string
+	total int
+}
+
+func (le *lineErrs) add(logMsg *LogMsg, err error) {
+	le.total++
+	if len(le.errs) < maxLineErrsPerQuery {
+		le.errs = append(le.errs, fmt.Sprintf("line %q: %s", logMsg.OrigLine, err.Error()))
+	}
+}
+
+// messages returns the human-readable messages about the errors, to be
+// included in the debug info.
+func (le *lineErrs) messages() []string {
+	if le.total <= len(le.errs) {
+		return le.errs
+	}
+
+	ret := append([]string{}, le.errs...)
+	return append(ret, fmt.Sprintf("... and %d more", le.total-len(le.errs)))
+}
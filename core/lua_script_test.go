@@ -0,0 +1,168 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLuaScriptParse(t *testing.T) {
+	script, err := newLuaScriptFromString("test.lua", `
+function parse_line(msg)
+  -- Like "[req=abc123] user=john Something happened"
+  local req, rest = string.match(msg.message, "^%[req=(%w+)%] (.*)$")
+  if req == nil then
+    return
+  end
+
+  msg.context.request_id = req
+  msg.context.program = nil
+  msg.context.lstream = "hacked"
+
+  for k, v in string.gmatch(rest, "(%w+)=(%w+)") do
+    msg.context[k] = v
+  end
+
+  msg.message = string.gsub(rest, "%w+=%w+ ", "")
+  if string.find(msg.orig_line, "Something") then
+    msg.level = "warn"
+  end
+  msg.context.unix_time = msg.time
+end
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer script.Close()
+
+	logMsg := LogMsg{
+		Time:     time.Date(2025, 4, 18, 18, 13, 5, 0, time.UTC),
+		Msg:      "[req=abc123] user=john Something happened",
+		OrigLine: "Apr 18 18:13:05 myhost myprog: [req=abc123] user=john Something happened",
+		Level:    LogLevelInfo,
+		Context: map[string]string{
+			"lstream": "myhost",
+			"program": "myprog",
+		},
+	}
+
+	assert.NoError(t, script.parse(&logMsg))
+	assert.Equal(t, "Something happened", logMsg.Msg)
+	assert.Equal(t, LogLevelWarn, logMsg.Level)
+	assert.Equal(t, map[string]string{
+		"lstream":    "myhost",
+		"request_id": "abc123",
+		"user":       "john",
+		"unix_time":  "1744999985",
+	}, logMsg.Context)
+
+	// Non-matching line is left as is.
+	logMsg2 := LogMsg{
+		Msg:     "foo",
+		Context: map[string]string{"lstream": "myhost"},
+	}
+	assert.NoError(t, script.parse(&logMsg2))
+	assert.Equal(t, "foo", logMsg2.Msg)
+	assert.Equal(t, map[string]string{"lstream": "myhost"}, logMsg2.Context)
+}
+
+func TestLuaScriptErrors(t *testing.T) {
+	_, err := newLuaScriptFromString("test.lua", `function foo() end`)
+	assert.EqualError(t, err, "lua script test.lua doesn't define the parse_line function")
+
+	_, err = newLuaScriptFromString("test.lua", `function parse_line(msg`)
+	assert.Error(t, err)
+
+	type testCase struct {
+		code    string
+		wantErr string
+	}
+
+	testCases := []testCase{
+		{
+			code:    `msg.level = "critical"`,
+			wantErr: `invalid level "critical"; valid ones are: "error", "warn", "info", "debug", or empty string`,
+		},
+		{
+			code:    `msg.message = nil`,
+			wantErr: "message must be a string, got nil",
+		},
+		{
+			code:    `msg.context.foo = {}`,
+			wantErr: `context field "foo" must be a string, number or boolean, got table`,
+		},
+		{
+			code:    `error("boom")`,
+			wantErr: "boom",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.code, func(t *testing.T) {
+			script, err := newLuaScriptFromString("test.lua", fmt.Sprintf("function parse_line(msg) %s end", tc.code))
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer script.Close()
+
+			logMsg := LogMsg{
+				Msg:     "foo",
+				Context: map[string]string{"lstream": "myhost"},
+			}
+
+			err = script.parse(&logMsg)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.wantErr)
+			}
+
+			// On errors, the message is left untouched.
+			assert.Equal(t, "foo", logMsg.Msg)
+			assert.Equal(t, map[string]string{"lstream": "myhost"}, logMsg.Context)
+		})
+	}
+}
+
+func TestLuaScriptTimeout(t *testing.T) {
+	script, err := newLuaScriptFromString("test.lua", `
+function parse_line(msg)
+  if msg.message == "loop" then
+    while true do end
+  end
+  msg.message = "parsed: " .. msg.message
+end
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer script.Close()
+
+	script.timeout = 50 * time.Millisecond
+
+	logMsg := LogMsg{Msg: "loop", Context: map[string]string{"lstream": "myhost"}}
+	start := time.Now()
+	assert.Equal(t, errLuaParseTimeout, script.parse(&logMsg))
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	assert.Equal(t, "loop", logMsg.Msg)
+
+	// The script is still usable after that.
+	logMsg = LogMsg{Msg: "foo", Context: map[string]string{"lstream": "myhost"}}
+	assert.NoError(t, script.parse(&logMsg))
+	assert.Equal(t, "parsed: foo", logMsg.Msg)
+}
+
+func TestLineErrsMessages(t *testing.T) {
+	var le lineErrs
+	assert.Nil(t, le.messages())
+
+	for i := 0; i < maxLineErrsPerQuery+3; i++ {
+		le.add(&LogMsg{OrigLine: "foo"}, errors.New("boom"))
+	}
+
+	msgs := le.messages()
+	assert.Equal(t, maxLineErrsPerQuery+1, len(msgs))
+	assert.Equal(t, `line "foo": boom`, msgs[0])
+	assert.Equal(t, "... and 3 more", msgs[maxLineErrsPerQuery])
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// MultilineNoTimestamp is the multiline rule spec which means that lines
+	// not starting with a timestamp are continuations of the previous line.
+	MultilineNoTimestamp = "no_timestamp"
+
+	// multilineRegexPrefix is the prefix of the multiline rule spec like
+	// "regex:^\s", which means that lines matching the regex are continuations
+	// of the previous line.
+	multilineRegexPrefix = "regex:"
+)
+
+// MultilineRule describes how multi-line messages (like stack traces) are
+// grouped by the agent into a single event: such an event is counted once in
+// the stats, and returned as a single LogMsg, with the lines joined with "\n".
+type MultilineRule struct {
+	// NoTimestamp means that lines which don't start with a timestamp are
+	// continuations of the previous line.
+	NoTimestamp bool
+
+	// Regex, if not empty, is an awk (POSIX extended) regex matching the
+	// continuation lines.
+	Regex string
+}
+
+// ParseMultilineRule parses the multiline rule spec, which is either
+// "no_timestamp", or "regex:" followed by the regex matching continuation
+// lines. For an empty spec, it returns nil, which means that multi-line
+// messages are not grouped.
+func ParseMultilineRule(spec string) (*MultilineRule, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+
+	case spec == MultilineNoTimestamp:
+		return &MultilineRule{NoTimestamp: true}, nil
+
+	case strings.HasPrefix(spec, multilineRegexPrefix):
+		re := strings.TrimPrefix(spec, multilineRegexPrefix)
+		if re == "" {
+			return nil, errors.Errorf("regex is empty")
+		}
+
+		// The regex is used by awk, so make sure it's a valid POSIX one.
+		if _, err := regexp.CompilePOSIX(re); err != nil {
+			return nil, errors.Annotatef(err, "invalid regex")
+		}
+
+		return &MultilineRule{Regex: re}, nil
+
+	default:
+		return nil, errors.Errorf(
+			"invalid multiline rule %q; valid ones are: %q, or %q followed by a regex",
+			spec, MultilineNoTimestamp, multilineRegexPrefix,
+		)
+	}
+}
+
+// agentArgs returns the nerdlog_agent.sh args for this rule; it's fine to call
+// it on a nil rule, then there are no args.
+func (r *MultilineRule) agentArgs() []string {
+	switch {
+	case r == nil:
+		return nil
+	case r.NoTimestamp:
+		return []string{"--multiline-no-timestamp"}
+	case r.Regex != "":
+		return []string{"--multiline-regex", shellQuote(r.Regex)}
+	}
+
+	return nil
+}
+
+// unescapeMultiline reverses the escaping done by the agent for the "mm:"
+// records: "\n" becomes a newline and "\\" becomes a backslash.
+func unescapeMultiline(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(s))
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+
+		if i+1 >= len(s) {
+			return "", errors.Errorf("trailing backslash")
+		}
+
+		i++
+		switch s[i] {
+		case 'n':
+			sb.WriteByte('\n')
+		case '\\':
+			sb.WriteByte('\\')
+		default:
+			return "", errors.Errorf("invalid escape sequence \\%c", s[i])
+		}
+	}
+
+	return sb.String(), nil
+}
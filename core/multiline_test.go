@@ -0,0 +1,49 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMultilineRule(t *testing.T) {
+	rule, err := ParseMultilineRule("")
+	assert.NoError(t, err)
+	assert.Nil(t, rule)
+	assert.Nil(t, rule.agentArgs())
+
+	rule, err = ParseMultilineRule("no_timestamp")
+	assert.NoError(t, err)
+	assert.Equal(t, &MultilineRule{NoTimestamp: true}, rule)
+	assert.Equal(t, []string{"--multiline-no-timestamp"}, rule.agentArgs())
+
+	rule, err = ParseMultilineRule(`regex:^([ \t]|Caused by)`)
+	assert.NoError(t, err)
+	assert.Equal(t, &MultilineRule{Regex: `^([ \t]|Caused by)`}, rule)
+	assert.Equal(t, []string{"--multiline-regex", `'^([ \t]|Caused by)'`}, rule.agentArgs())
+
+	_, err = ParseMultilineRule("regex:")
+	assert.EqualError(t, err, "regex is empty")
+
+	_, err = ParseMultilineRule("regex:(")
+	assert.Error(t, err)
+
+	_, err = ParseMultilineRule("foo")
+	assert.EqualError(t, err, `invalid multiline rule "foo"; valid ones are: "no_timestamp", or "regex:" followed by a regex`)
+}
+
+func TestUnescapeMultiline(t *testing.T) {
+	s, err := unescapeMultiline(`foo\nbar\\n\\\nbaz`)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo\nbar\\n\\\nbaz", s)
+
+	s, err = unescapeMultiline("no escapes")
+	assert.NoError(t, err)
+	assert.Equal(t, "no escapes", s)
+
+	_, err = unescapeMultiline(`foo\`)
+	assert.EqualError(t, err, "trailing backslash")
+
+	_, err = unescapeMultiline(`foo\t`)
+	assert.EqualError(t, err, `invalid escape sequence \t`)
+}
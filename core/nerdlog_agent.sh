@@ -8,7 +8,7 @@
 # This script logic is really convoluted and hard to understand, and begs for a
 # major rewrite.
 
-trap 'echo "exit_code:$?"' EXIT
+trap 'exit_code=$?; stop_cancel_watcher; echo "exit_code:$exit_code"' EXIT
 
 # Arguments:
 #
@@ -113,6 +113,23 @@ function detect_timezone() { # {{{
   exit 1
 } # }}}
 
+function get_host_time() { # {{{
+  # Tests use the mocked time, so that the clock skew is deterministic.
+  if [[ "${NERDLOG_HOST_TIME_MOCK}" != "" ]]; then
+    echo "${NERDLOG_HOST_TIME_MOCK}"
+    return
+  fi
+
+  # EPOCHREALTIME is only available since bash 5, and depending on the
+  # locale, it might use a comma as the decimal separator.
+  if [[ "${EPOCHREALTIME}" != "" ]]; then
+    echo "${EPOCHREALTIME/,/.}"
+    return
+  fi
+
+  date +%s
+} # }}}
+
 # function concat_cmds_array() {{{
 #
 # Concatenates the global `cmds` array into a single bash command, using " && ".
@@ -295,6 +312,25 @@ while [[ $# -gt 0 ]]; do
       shift # past value
       ;;
 
+    # The two arguments below enable grouping of multi-line messages (like
+    # stack traces) into a single event, which is counted once in the stats and
+    # printed as a single "mm:" record, with newlines and backslashes escaped
+    # as "\n" and "\\". Only supported for log files, not journalctl.
+    #
+    # --multiline-no-timestamp: lines which don't start with a timestamp are
+    # continuations of the previous line;
+    # --multiline-regex: lines matching the given awk regex are continuations
+    # of the previous line.
+    --multiline-no-timestamp)
+      multiline_no_timestamp="1"
+      shift # past argument
+      ;;
+    --multiline-regex)
+      multiline_regex="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
     -*|--*)
       echo "Unknown option $1" 1>&2
       exit 1
@@ -334,6 +370,17 @@ if [[ "$CUR_MONTH" == "" ]]; then
   CUR_MONTH="$(date +'%m')"
 fi
 
+# Awk expression which is true if the current line is a continuation of the
+# previous one; empty if multi-line messages are not grouped. The regex is
+# passed via the environment, so that we don't have to escape it for awk.
+awk_is_continuation=""
+if [[ "$multiline_no_timestamp" != "" ]]; then
+  awk_is_continuation='!((('"$awktime_hhmm"') ~ /^[0-9][0-9]:[0-9][0-9]$/) && (('"$awktime_day"') ~ /^[0-9][0-9]$/))'
+elif [[ "$multiline_regex" != "" ]]; then
+  export NERDLOG_MULTILINE_REGEX="$multiline_regex"
+  awk_is_continuation='($0 ~ ENVIRON["NERDLOG_MULTILINE_REGEX"])'
+fi
+
 # TODO: instead of always detecting it, add support for the --awk-binary flag,
 # and only autodetect if it wasn't provided. Also, gotta always do this during
 # logstream_info command.
@@ -430,6 +477,10 @@ case "${command}" in
     ;;
 
   logstream_info)
+    # Print the host time first, so that the client can measure the clock skew
+    # as precisely as possible.
+    echo "host_time:$(get_host_time)"
+
     host_timezone="$(detect_timezone)"
     if [[ $? == 0 ]]; then
       echo "host_timezone:$host_timezone"
@@ -504,6 +555,74 @@ esac
 
 # What follows is the handler for the "query" command.
 
+# Support for query cancellation (e.g. when the user has already submitted
+# another query, so the results of this one are not needed anymore): the
+# client can't send us any signals, but our stdin is the same as the stdin of
+# the shell which has invoked us, so the client just writes the cancel line
+# there, and a background watcher started below reads it and kills the query.
+#
+# It relies on the fact that the client invokes the agent and echoes the
+# command_done markers in the same line, so there's nothing else in the stdin
+# for the watcher to consume. And if the query is already done by the time the
+# client writes the cancel line, the watcher is already killed too, and the
+# shell just executes the cancel line, which is a no-op (see
+# queryCancelLine in lstream_client.go).
+agent_pid=$$
+
+# indexing is set to 1 while the index is being updated, so that if the query
+# is cancelled at this time, we'll remove the (potentially incomplete) index.
+indexing=0
+
+function kill_descendants() { # {{{
+  local pid
+  # NOTE: not using pgrep or ps --ppid, since they aren't available everywhere
+  # (e.g. on minimal Linux images or on BSD), while this works with any ps.
+  for pid in $(ps -A -o pid= -o ppid= | awk -v ppid="$1" '$2 == ppid { print $1 }'); do
+    # Don't kill the watcher itself.
+    if [[ "$pid" == "$BASHPID" ]]; then
+      continue
+    fi
+
+    kill_descendants "$pid"
+    kill "$pid" 2>/dev/null
+  done
+} # }}}
+
+function on_cancel() { # {{{
+  echo "error:query cancelled" 1>&2
+
+  if [[ "$indexing" == 1 ]]; then
+    echo "debug:query cancelled while indexing, removing index file" 1>&2
+    rm -f $indexfile
+  fi
+
+  exit 1
+} # }}}
+
+function stop_cancel_watcher() { # {{{
+  if [[ "$cancel_watcher_pid" != "" ]]; then
+    kill "$cancel_watcher_pid" 2>/dev/null
+  fi
+} # }}}
+
+trap on_cancel USR1
+
+(
+  while IFS= read -r line; do
+    if [[ "$line" == *"nerdlog_cancel_query"* ]]; then
+      # First let the agent know that it's cancelled (it'll handle the signal
+      # once the currently running command exits), and then kill whatever
+      # it's running.
+      kill -USR1 $agent_pid
+      kill_descendants $agent_pid
+      exit 0
+    fi
+  done
+  # NOTE: the explicit stdin redirection is needed, because otherwise the
+  # background commands get their stdin from /dev/null.
+) <&0 &
+cancel_watcher_pid=$!
+
 # NOTE: we only show percentages with 5% increments, to save on traffic and
 # other overhead. With all 24 my-nodes, having percentage being printed with
 # 1% increments, it generates extra traffic of about 290KB per single query,
@@ -518,34 +637,60 @@ function printPercentage(numCur, numTotal) {
 }
 '
 
+# Escapes newlines and backslashes in a multi-line event as "\n" and "\\",
+# so that it can be printed as a single line. NOTE: it intentionally doesn't use
+# gsub, since backslashes in the replacement are treated differently by
+# different awk implementations.
+awk_func_escape_multiline='
+function escapeMultiline(s,    ret, nlIdx, bsIdx, idx) {
+  ret = "";
+  while (1) {
+    nlIdx = index(s, "\n");
+    bsIdx = index(s, "\\");
+    if (nlIdx == 0 && bsIdx == 0) {
+      break;
+    }
+
+    if (nlIdx == 0 || (bsIdx > 0 && bsIdx < nlIdx)) {
+      ret = ret substr(s, 1, bsIdx-1) "\\\\";
+      idx = bsIdx;
+    } else {
+      ret = ret substr(s, 1, nlIdx-1) "\\n";
+      idx = nlIdx;
+    }
+
+    s = substr(s, idx+1);
+  }
+
+  return ret s;
+}
+'
+
+# The monthByName map from a 3-char string like "Jan" to the corresponding
+# string like "01"; it has to be initialized in the BEGIN block of every
+# script which evaluates the --awktime-* expressions, since they might use it.
+awk_init_month_by_name='
+  monthByName["Jan"] = "01";
+  monthByName["Feb"] = "02";
+  monthByName["Mar"] = "03";
+  monthByName["Apr"] = "04";
+  monthByName["May"] = "05";
+  monthByName["Jun"] = "06";
+  monthByName["Jul"] = "07";
+  monthByName["Aug"] = "08";
+  monthByName["Sep"] = "09";
+  monthByName["Oct"] = "10";
+  monthByName["Nov"] = "11";
+  monthByName["Dec"] = "12";
+'
+
 function run_awk_script_logfiles {
   awk_pattern=''
   if [[ "$user_pattern" != "" ]]; then
     awk_pattern="!($user_pattern) {numFilteredOut++; next}"
   fi
 
-  # NOTE: this script MUST be executed with the "-b" awk key, which means that
-  # awk will work in terms of bytes, not characters. We use length($0) there and
-  # we rely on it being number of bytes.
-  #
-  # Also btw, percentage calculation slows the whole query by about 10%, which
-  # isn't ideal. TODO: maybe instead of doing the division on every line, we can
-  # only do the division when the percentage changes, so we calculate the next
-  # point when it'd change, and going forward we just compare it with a simple
-  # "<".
-  awk_script='
-  '$awk_func_print_percentage'
-
-  BEGIN {
-    bytenr=1; curline=0; maxlines='$max_num_lines'; lastPercent=0;
-    numFilteredOut=0;
-    prevMinKey="";
-  }
-  { bytenr += length($0)+1 }
-  NR % 100 == 0 {
-    printPercentage(bytenr, '$num_bytes_to_scan')
-  }
-  '$awk_pattern'
+  awk_main='
   {
     curMinKey = '"$awktime_minute_key"';
 
@@ -589,8 +734,100 @@ function run_awk_script_logfiles {
 
     next;
   }
+  '
+  awk_end_flush=''
+
+  # If multi-line messages are grouped, then instead of handling every line
+  # right away, we accumulate the lines of the current event in curEvent, and
+  # only handle the whole event (in the exact same way as a single line above)
+  # once the next event begins. The user pattern is then also matched
+  # against the whole event.
+  if [[ "$awk_is_continuation" != "" ]]; then
+    awk_event_pattern=''
+    if [[ "$user_pattern" != "" ]]; then
+      awk_event_pattern="if (!($user_pattern)) { numFilteredOut++; return; }"
+    fi
+
+    awk_event_lines_until_check=''
+    if [[ "$lines_until_nr" != "" ]]; then
+      awk_event_lines_until_check="if (curEventNR >= $lines_until_nr) { return; }"
+    fi
+
+    awk_pattern=''
+    awk_main='
+  function handleEvent() {
+    $0 = curEvent;
+    '$awk_event_pattern'
+
+    stats['"$awktime_minute_key"']++;
+
+    '$awk_event_lines_until_check'
+
+    lastlines[curline] = $0;
+    lastNRs[curline] = curEventNR;
+    curline++
+    if (curline >= maxlines) {
+      curline = 0;
+    }
+  }
+
+  ('"$awk_is_continuation"') {
+    # If there is no current event, it means the range starts in the middle
+    # of an event which began earlier, so just skip these lines.
+    if (curEventNR) {
+      curEvent = curEvent "\n" $0;
+    }
+    next;
+  }
+
+  {
+    # NOTE: handleEvent overwrites $0, so save the current line first.
+    line = $0;
+    if (curEventNR) {
+      handleEvent();
+    }
+
+    curEvent = line;
+    curEventNR = NR;
+    next;
+  }
+  '
+    awk_end_flush='
+    if (curEventNR) {
+      handleEvent();
+    }
+    '
+  fi
+
+  # NOTE: this script MUST be executed with the "-b" awk key, which means that
+  # awk will work in terms of bytes, not characters. We use length($0) there and
+  # we rely on it being number of bytes.
+  #
+  # Also btw, percentage calculation slows the whole query by about 10%, which
+  # isn't ideal. TODO: maybe instead of doing the division on every line, we can
+  # only do the division when the percentage changes, so we calculate the next
+  # point when it'd change, and going forward we just compare it with a simple
+  # "<".
+  awk_script='
+  '$awk_func_print_percentage'
+  '$awk_func_escape_multiline'
+
+  BEGIN {
+    '"$awk_init_month_by_name"'
+    bytenr=1; curline=0; maxlines='$max_num_lines'; lastPercent=0;
+    numFilteredOut=0;
+    prevMinKey="";
+  }
+  { bytenr += length($0)+1 }
+  NR % 100 == 0 {
+    printPercentage(bytenr, '$num_bytes_to_scan')
+  }
+  '$awk_pattern'
+  '$awk_main'
 
   END {
+    '$awk_end_flush'
+
     print "debug:Filtered out " numFilteredOut " from " NR " lines" > "/dev/stderr"
 
     print "logfile:'$logfile_prev':0";
@@ -612,7 +849,11 @@ function run_awk_script_logfiles {
 
       curNR = lastNRs[ln] + '$from_linenr_int' - 1;
 
-      print "m:" curNR ":" lastlines[ln];
+      if (index(lastlines[ln], "\n")) {
+        print "mm:" curNR ":" escapeMultiline(lastlines[ln]);
+      } else {
+        print "m:" curNR ":" lastlines[ln];
+      }
     }
   }
   '
@@ -688,6 +929,7 @@ function run_awk_script_journalctl {
   }
 
   BEGIN {
+    '"$awk_init_month_by_name"'
     curline=0;
     lastline="";
     maxlines='$max_num_lines';
@@ -916,23 +1158,14 @@ if [[ "$refresh_index" == "1" ]]; then
 fi
 
 function refresh_index { # {{{
+  indexing=1
+
   local last_linenr=0
   local last_bytenr=0
   local prevlog_bytes=$(get_prevlog_bytenr)
 
   awk_vars='
-    monthByName["Jan"] = "01";
-    monthByName["Feb"] = "02";
-    monthByName["Mar"] = "03";
-    monthByName["Apr"] = "04";
-    monthByName["May"] = "05";
-    monthByName["Jun"] = "06";
-    monthByName["Jul"] = "07";
-    monthByName["Aug"] = "08";
-    monthByName["Sep"] = "09";
-    monthByName["Oct"] = "10";
-    monthByName["Nov"] = "11";
-    monthByName["Dec"] = "12";
+    '"$awk_init_month_by_name"'
 
     curYear = '${CUR_YEAR}';
     curMonth = '${CUR_MONTH}';
@@ -1024,6 +1257,13 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
   curHHMM = '"$awktime_hhmm"';
 }'
 
+  # Continuation lines of multi-line messages don't have their own timestamps,
+  # so they must not get into the index.
+  if [[ "$awk_is_continuation" != "" ]]; then
+    script1="$script1"'
+  ('"$awk_is_continuation"') { next }'
+  fi
+
   if [ -s $indexfile ]
   then
     echo "p:stage:$STAGE_INDEX_APPEND:indexing up" 1>&2
@@ -1097,6 +1337,8 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
       exit 1
     fi
   fi
+
+  indexing=0
 } # }}}
 
 # Performs index lookup by a timestr like "2006-01-02-15:04" (typically given
@@ -1266,8 +1508,10 @@ if [[ "$from_linenr" == "" ]]; then
 fi
 
 lines_until_check=''
+lines_until_nr=''
 if [[ "$lines_until" != "" ]]; then
-  lines_until_check="if (NR >= $((lines_until-from_linenr_int+1))) { next; }"
+  lines_until_nr=$((lines_until-from_linenr_int+1))
+  lines_until_check="if (NR >= $lines_until_nr) { next; }"
 fi
 
 num_bytes_to_scan=0
@@ -1364,6 +1608,7 @@ eval $cmds_concatenated | \
   max_num_lines="$max_num_lines"                        \
   num_bytes_to_scan="$num_bytes_to_scan"                \
   lines_until_check="$lines_until_check"                \
+  lines_until_nr="$lines_until_nr"                      \
   prevlog_lines="$prevlog_lines"                        \
   from_linenr_int="$from_linenr_int"                    \
   run_awk_script_logfiles -
@@ -5,6 +5,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/juju/errors"
@@ -31,9 +32,21 @@ type TimeFormatDescr struct {
 	// (if we decided to not include the year).
 	MinuteKeyLayout string
 
+	// TimestampLocation is where the timestamp is in the log line; the zero
+	// value means that it's at the very beginning.
+	TimestampLocation TimestampLocation
+
 	// AWKExpr contains all the awk expressions which will be used by the
 	// nerdlog_agent.sh script to get the time components from logs.
 	AWKExpr TimeFormatAWKExpr
+
+	// UTC is true if the timestamps contain an explicit offset like "+02:00"
+	// or "Z", and the awk expressions use it to convert the time to UTC; then
+	// the agent needs to run with TZ=UTC, and the minute keys as well as the
+	// --from and --to arguments are in UTC too. This way, it doesn't matter
+	// which timezone the logs are in, and there are no ambiguities around the
+	// DST switches, when the local time repeats.
+	UTC bool `json:",omitempty"`
 }
 
 // TimeFormatAWKExpr contains all the awk expressions which will be used by
@@ -98,6 +111,284 @@ type TimeFormatAWKExpr struct {
 	MinuteKey string
 }
 
+const (
+	// TimeLayoutEpoch, TimeLayoutEpochMillis and TimeLayoutEpochMicros are the
+	// special values of TimeFormatDescr.TimestampLayout, for the unix epoch
+	// timestamps in seconds, milliseconds and microseconds, like
+	// "1718000000", "1718000000123" and "1718000000123456" respectively.
+	// They can also have a fractional part, like "1718000000.123".
+	TimeLayoutEpoch       = "epoch"
+	TimeLayoutEpochMillis = "epoch_ms"
+	TimeLayoutEpochMicros = "epoch_us"
+
+	// epochSecondsLen is the number of digits in the epoch seconds; it's 10
+	// for all dates from 2001 to 2286, and we rely on that being stable, so
+	// that the awk expressions can get the seconds as a fixed-width substring.
+	epochSecondsLen = 10
+
+	// epochMinuteKeyLayout is the MinuteKeyLayout for the epoch timestamps;
+	// the awk expression generates the minute key with strftime.
+	epochMinuteKeyLayout = "2006-01-02 15:04"
+)
+
+// epochTimestampRegex matches the epoch timestamp at the beginning of the
+// line, in seconds, milliseconds or microseconds, with an optional fractional
+// part.
+var epochTimestampRegex = regexp.MustCompile(`^([0-9]{10})([0-9]{6}|[0-9]{3})?(\.[0-9]+)?([^0-9.]|$)`)
+
+// isEpochLayout returns whether the layout is one of the epoch ones, like
+// TimeLayoutEpoch.
+func isEpochLayout(layout string) bool {
+	switch layout {
+	case TimeLayoutEpoch, TimeLayoutEpochMillis, TimeLayoutEpochMicros:
+		return true
+	}
+
+	return false
+}
+
+// detectEpochLayout returns the epoch layout (like TimeLayoutEpoch) if the
+// log line starts with an epoch timestamp, or an empty string otherwise.
+func detectEpochLayout(logLine string) string {
+	m := epochTimestampRegex.FindStringSubmatch(logLine)
+	if m == nil {
+		return ""
+	}
+
+	switch len(m[2]) {
+	case 3:
+		return TimeLayoutEpochMillis
+	case 6:
+		return TimeLayoutEpochMicros
+	default:
+		return TimeLayoutEpoch
+	}
+}
+
+// parseLayoutTimestamp parses the timestamp in the given Go-style layout at
+// the beginning of the log line, and returns the time and the length of the
+// timestamp.
+func parseLayoutTimestamp(
+	logLine, layout string, location *time.Location,
+) (time.Time, int, error) {
+	timestampLen := len(layout)
+
+	// If the layout ends with the offset like "Z07" or "Z07:00", but the
+	// actual timestamp string is in UTC and it ends with just "Z", we then
+	// need to remove that extra
+	zIdx := strings.Index(layout, "Z07")
+	if zIdx >= 0 && len(logLine) > zIdx && logLine[zIdx] == 'Z' {
+		// We have a Z in the timestamp, so there should be no offset after it.
+		timestampLen = zIdx + 1
+	}
+
+	if len(logLine) < timestampLen {
+		return time.Time{}, 0, errors.Errorf("line %q is too short to have a timestamp", logLine)
+	}
+
+	t, err := time.ParseInLocation(layout, logLine[:timestampLen], location)
+	if err != nil {
+		return time.Time{}, 0, errors.Trace(err)
+	}
+
+	return t, timestampLen, nil
+}
+
+// parseEpochTimestamp parses the epoch timestamp at the beginning of the log
+// line, and returns the time and the length of the timestamp.
+func parseEpochTimestamp(logLine, layout string) (time.Time, int, error) {
+	m := epochTimestampRegex.FindStringSubmatch(logLine)
+	if m == nil {
+		return time.Time{}, 0, errors.Errorf("no epoch timestamp in %q", logLine)
+	}
+
+	// Number of digits in the integer part, after the seconds.
+	wantSubsecDigits := 0
+	switch layout {
+	case TimeLayoutEpochMillis:
+		wantSubsecDigits = 3
+	case TimeLayoutEpochMicros:
+		wantSubsecDigits = 6
+	}
+
+	if len(m[2]) != wantSubsecDigits {
+		return time.Time{}, 0, errors.Errorf(
+			"epoch timestamp %q doesn't match the layout %s", m[1]+m[2]+m[3], layout,
+		)
+	}
+
+	secs, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, errors.Trace(err)
+	}
+
+	// Put together all the digits after the seconds, like "123" for
+	// "1718000000123" or "1718000000.123", and convert them to nanoseconds.
+	subsec := m[2] + strings.TrimPrefix(m[3], ".")
+	if len(subsec) > 9 {
+		subsec = subsec[:9]
+	}
+
+	var nsecs int64
+	if subsec != "" {
+		nsecs, err = strconv.ParseInt(subsec+strings.Repeat("0", 9-len(subsec)), 10, 64)
+		if err != nil {
+			return time.Time{}, 0, errors.Trace(err)
+		}
+	}
+
+	return time.Unix(secs, nsecs), len(m[1]) + len(m[2]) + len(m[3]), nil
+}
+
+// TimestampLocation describes where the timestamp is in the log line, if it's
+// not at the very beginning, like in the nginx access logs:
+//
+//	1.2.3.4 - - [10/Oct/2024:13:55:36 +0000] "GET / HTTP/1.1" 200 ...
+//
+// At most one of the fields can be set; if none is set, the timestamp is at
+// the beginning of the line.
+type TimestampLocation struct {
+	// Field, if not 0, is the 1-based index of the whitespace-separated field
+	// where the timestamp starts; an opening bracket at the beginning of the
+	// field, if any, is skipped. So for the nginx example above, it's 4.
+	Field int
+
+	// Regex, if not empty, is a regex matching the text preceding the
+	// timestamp; the timestamp starts right after the first match. Since it's
+	// used by both awk and Go, it must be a POSIX extended regex. So for the
+	// nginx example above, it could be `^[^[]*\[`.
+	Regex string
+}
+
+// IsLineStart returns whether the location means the beginning of the line.
+func (loc TimestampLocation) IsLineStart() bool {
+	return loc.Field == 0 && loc.Regex == ""
+}
+
+// Validate returns an error if the location is invalid.
+func (loc TimestampLocation) Validate() error {
+	if loc.Field != 0 && loc.Regex != "" {
+		return errors.Errorf("only one of field and regex can be set")
+	}
+
+	if loc.Field < 0 {
+		return errors.Errorf("field must be positive, got %d", loc.Field)
+	}
+
+	if loc.Regex != "" {
+		// The regex is used by awk, so make sure it's a valid POSIX one.
+		if _, err := regexp.CompilePOSIX(loc.Regex); err != nil {
+			return errors.Annotatef(err, "invalid regex")
+		}
+	}
+
+	return nil
+}
+
+// prefixRegex returns the regex matching the text preceding the timestamp,
+// or an empty string if the timestamp is at the beginning of the line.
+func (loc TimestampLocation) prefixRegex() string {
+	if loc.Regex != "" {
+		return loc.Regex
+	}
+
+	if loc.Field == 0 {
+		return ""
+	}
+
+	// NOTE: not using the interval expressions like {3}, since not every awk
+	// supports them.
+	return `^[ \t]*` + strings.Repeat(`[^ \t]+[ \t]+`, loc.Field-1) + `\[?`
+}
+
+// awkOffsetExpr returns the awk expression evaluating to the number of
+// characters preceding the timestamp. If the prefix regex doesn't match, the
+// offset is the length of the whole line, so that all the time components
+// are empty strings.
+func (loc TimestampLocation) awkOffsetExpr() string {
+	re := loc.prefixRegex()
+	if re == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(
+		"(match($0, /%s/) ? RSTART + RLENGTH - 1 : length($0))",
+		awkEscapeRegexSlashes(re),
+	)
+}
+
+// awkEscapeRegexSlashes escapes the unescaped slashes in the regex, so that
+// it can be used as an awk regex literal like /foo/.
+func awkEscapeRegexSlashes(re string) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(re); i++ {
+		switch re[i] {
+		case '\\':
+			sb.WriteByte(re[i])
+			if i+1 < len(re) {
+				i++
+				sb.WriteByte(re[i])
+			}
+		case '/':
+			sb.WriteString("\\/")
+		default:
+			sb.WriteByte(re[i])
+		}
+	}
+
+	return sb.String()
+}
+
+// timestampOffset returns the index in the line where the timestamp starts,
+// or an error if the prefix regex doesn't match.
+func (loc TimestampLocation) timestampOffset(line string) (int, error) {
+	re := loc.prefixRegex()
+	if re == "" {
+		return 0, nil
+	}
+
+	rgx, err := compileTimestampPrefixRegex(re)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	m := rgx.FindStringIndex(line)
+	if m == nil {
+		return 0, errors.Errorf("timestamp location regex %q doesn't match", re)
+	}
+
+	return m[1], nil
+}
+
+var (
+	timestampPrefixRegexesMtx sync.Mutex
+	timestampPrefixRegexes    = map[string]*regexp.Regexp{}
+)
+
+// compileTimestampPrefixRegex compiles the regex, caching the result, since
+// it's used for every log line.
+func compileTimestampPrefixRegex(re string) (*regexp.Regexp, error) {
+	timestampPrefixRegexesMtx.Lock()
+	defer timestampPrefixRegexesMtx.Unlock()
+
+	if rgx, ok := timestampPrefixRegexes[re]; ok {
+		return rgx, nil
+	}
+
+	rgx, err := regexp.CompilePOSIX(re)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	timestampPrefixRegexes[re] = rgx
+	return rgx, nil
+}
+
+// maxTimestampField is the max field index where DetectTimeLayoutAndLocation
+// looks for a timestamp.
+const maxTimestampField = 8
+
 func GetTimeFormatDescrFromLogLines(logLines []string) (*TimeFormatDescr, error) {
 	if len(logLines) == 0 {
 		return nil, errors.Errorf("no logs, can't detect time format")
@@ -106,12 +397,12 @@ func GetTimeFormatDescrFromLogLines(logLines []string) (*TimeFormatDescr, error)
 	descrs := make([]*TimeFormatDescr, 0, len(logLines))
 
 	for i, line := range logLines {
-		layout := DetectTimeLayout(line)
+		layout, loc := DetectTimeLayoutAndLocation(line)
 		if layout == "" {
 			return nil, errors.Errorf("unable to detect time format from %q", line)
 		}
 
-		timeDescr, err := GenerateTimeDescr(layout)
+		timeDescr, err := GenerateTimeDescrWithLocation(layout, loc)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -124,6 +415,14 @@ func GetTimeFormatDescrFromLogLines(logLines []string) (*TimeFormatDescr, error)
 					timeDescr.TimestampLayout,
 				)
 			}
+
+			if descrs[0].TimestampLocation != timeDescr.TimestampLocation {
+				return nil, errors.Errorf(
+					"log lines have timestamps in different places: %+v and %+v",
+					descrs[0].TimestampLocation,
+					timeDescr.TimestampLocation,
+				)
+			}
 		}
 
 		descrs = append(descrs, timeDescr)
@@ -156,20 +455,192 @@ func DetectTimeLayout(logLine string) string {
 	}
 
 	for _, layout := range knownFormats {
-		for curLen := 5; curLen <= len(layout) && curLen <= len(logLine); curLen++ {
-			sub := logLine[:curLen]
-			_, err := time.Parse(layout, sub)
-			if err == nil {
-				return layout
+		if hasTimestampWithLayout(logLine, layout) {
+			return layout
+		}
+	}
+
+	return detectEpochLayout(logLine)
+}
+
+// hasTimestampWithLayout returns whether the log line starts with a timestamp
+// in the given layout.
+func hasTimestampWithLayout(logLine, layout string) bool {
+	if isEpochLayout(layout) {
+		return detectEpochLayout(logLine) == layout
+	}
+
+	for curLen := 5; curLen <= len(layout) && curLen <= len(logLine); curLen++ {
+		sub := logLine[:curLen]
+		_, err := time.Parse(layout, sub)
+		if err == nil {
+			// time.Parse accepts fractional seconds even if the layout doesn't
+			// have them, so e.g. "2024-10-11T22:14:15.003Z" matches the layout
+			// "2006-01-02T15:04:05Z07:00"; but then the timestamp can't be cut
+			// from the line by the layout length, so make sure that it can.
+			_, _, err := parseLayoutTimestamp(logLine, layout, time.UTC)
+			return err == nil
+		}
+	}
+
+	return false
+}
+
+// strftimeToGoLayout maps strftime directives to the Go layout components.
+var strftimeToGoLayout = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'e': "_2",
+	'b': "Jan",
+	'h': "Jan",
+	'a': "Mon",
+	'H': "15",
+	'M': "04",
+	'S': "05",
+	'f': "000000",
+	'z': "-0700",
+	'Z': "MST",
+	'T': "15:04:05",
+	'F': "2006-01-02",
+	'%': "%",
+}
+
+// ParseTimeFormatSpec takes the time format given as the time_format
+// logstream option, and returns the Go-style time layout. The format is
+// either a Go layout like "2006-01-02 15:04:05", or a strftime one like
+// "%Y-%m-%d %H:%M:%S" (if it contains "%"). It also checks that the layout
+// has all the components necessary to build the TimeFormatDescr.
+func ParseTimeFormatSpec(spec string) (string, error) {
+	if spec == "" {
+		return "", errors.Errorf("time format is empty")
+	}
+
+	if isEpochLayout(spec) {
+		return spec, nil
+	}
+
+	layout := spec
+	if spec == "%s" {
+		layout = TimeLayoutEpoch
+	} else if strings.Contains(spec, "%") {
+		var sb strings.Builder
+
+		for i := 0; i < len(spec); i++ {
+			if spec[i] != '%' {
+				sb.WriteByte(spec[i])
+				continue
 			}
+
+			if i+1 >= len(spec) {
+				return "", errors.Errorf("trailing %%")
+			}
+
+			i++
+			v, ok := strftimeToGoLayout[spec[i]]
+			if !ok {
+				return "", errors.Errorf("unsupported strftime directive %%%c", spec[i])
+			}
+
+			sb.WriteString(v)
+		}
+
+		layout = sb.String()
+	}
+
+	if _, err := GenerateTimeDescr(layout); err != nil {
+		return "", errors.Annotatef(err, "layout %q", layout)
+	}
+
+	return layout, nil
+}
+
+// GetTimeFormatDescrFromSpec returns the TimeFormatDescr for the time format
+// given as the time_format logstream option (see ParseTimeFormatSpec). The
+// layout is not detected then, but the location of the timestamp still is:
+// it's either at the beginning of the log lines, or at the beginning of one
+// of the first few fields, see DetectTimeLayoutAndLocation. If there are no
+// log lines, the timestamp is assumed to be at the beginning.
+func GetTimeFormatDescrFromSpec(spec string, logLines []string) (*TimeFormatDescr, error) {
+	layout, err := ParseTimeFormatSpec(spec)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(logLines) == 0 {
+		return GenerateTimeDescr(layout)
+	}
+
+	line := logLines[0]
+	if hasTimestampWithLayout(line, layout) {
+		return GenerateTimeDescr(layout)
+	}
+
+	// NOTE: starting from the field 1, in case the timestamp is in brackets.
+	for field := 1; field <= maxTimestampField; field++ {
+		loc := TimestampLocation{Field: field}
+
+		offset, err := loc.timestampOffset(line)
+		if err != nil {
+			// No more fields
+			break
+		}
+
+		if hasTimestampWithLayout(line[offset:], layout) {
+			return GenerateTimeDescrWithLocation(layout, loc)
+		}
+	}
+
+	return nil, errors.Errorf("time format %q doesn't match the log line %q", layout, line)
+}
+
+// DetectTimeLayoutAndLocation is like DetectTimeLayout, but if there's no
+// timestamp at the beginning of the line, it also looks for it at the
+// beginning of the next few whitespace-separated fields, like in the nginx
+// access logs. If nothing is found, the returned layout is empty.
+func DetectTimeLayoutAndLocation(logLine string) (string, TimestampLocation) {
+	if layout := DetectTimeLayout(logLine); layout != "" {
+		return layout, TimestampLocation{}
+	}
+
+	for field := 2; field <= maxTimestampField; field++ {
+		loc := TimestampLocation{Field: field}
+
+		offset, err := loc.timestampOffset(logLine)
+		if err != nil {
+			// No more fields
+			break
+		}
+
+		if layout := DetectTimeLayout(logLine[offset:]); layout != "" {
+			return layout, loc
 		}
 	}
-	return ""
+
+	return "", TimestampLocation{}
 }
 
 // GenerateTimeDescr takes a Go-style time layout, and returns the full time
-// format descriptor to be used for parsing all logs.
+// format descriptor to be used for parsing all logs, assuming that the
+// timestamp is at the beginning of the line.
 func GenerateTimeDescr(layout string) (*TimeFormatDescr, error) {
+	return GenerateTimeDescrWithLocation(layout, TimestampLocation{})
+}
+
+// GenerateTimeDescrWithLocation is like GenerateTimeDescr, but the timestamp
+// can be located anywhere in the line, see TimestampLocation.
+func GenerateTimeDescrWithLocation(
+	layout string, loc TimestampLocation,
+) (*TimeFormatDescr, error) {
+	if err := loc.Validate(); err != nil {
+		return nil, errors.Annotatef(err, "timestamp location")
+	}
+
+	if isEpochLayout(layout) {
+		return generateEpochTimeDescr(layout, loc), nil
+	}
+
 	// Find index positions of time components
 	partInfo := map[string]*indexAndLength{
 		"year":   indexAndLengthOfTimeComponent(layout, "2006"),
@@ -184,8 +655,14 @@ func GenerateTimeDescr(layout string) (*TimeFormatDescr, error) {
 		return nil, errors.New("unsupported layout: required components not found")
 	}
 
-	// Helper to generate substr($0, x, y)
+	// Helper to generate substr($0, x, y); if the timestamp is not at the
+	// beginning of the line, the offset is added to x.
+	offsetExpr := loc.awkOffsetExpr()
 	substr := func(start, length int) string {
+		if offsetExpr != "" {
+			return "substr($0, " + offsetExpr + " + " + itoa(start+1) + ", " + itoa(length) + ")"
+		}
+
 		return "substr($0, " + itoa(start+1) + ", " + itoa(length) + ")"
 	}
 
@@ -237,16 +714,147 @@ func GenerateTimeDescr(layout string) (*TimeFormatDescr, error) {
 		awk.Month = fmt.Sprintf("monthByName[%s]", awk.Month)
 	}
 
+	// If the timestamp has an offset and a year, convert it to UTC; see
+	// TimeFormatDescr.UTC.
+	if tzOffset := indexOfTimezoneOffset(layout); tzOffset != nil && partInfo["year"] != nil {
+		return &TimeFormatDescr{
+			TimestampLayout:   layout,
+			MinuteKeyLayout:   utcMinuteKeyLayout,
+			TimestampLocation: loc,
+			AWKExpr:           utcAWKExpr(awk, partInfo["hhmm"].index, tzOffset, substr),
+			UTC:               true,
+		}, nil
+	}
+
 	// Build minute layout (truncated to minute precision)
 	minuteLayout := layout[minuteKeyStart:minuteKeyEnd]
 
 	return &TimeFormatDescr{
-		TimestampLayout: layout,
-		MinuteKeyLayout: minuteLayout,
-		AWKExpr:         awk,
+		TimestampLayout:   layout,
+		MinuteKeyLayout:   minuteLayout,
+		TimestampLocation: loc,
+		AWKExpr:           awk,
 	}, nil
 }
 
+// utcMinuteKeyLayout is the MinuteKeyLayout for the formats with
+// TimeFormatDescr.UTC.
+const utcMinuteKeyLayout = "2006-01-02 15:04"
+
+// timezoneOffset describes where the offset like "+02:00" is in the layout.
+type timezoneOffset struct {
+	// index is the index of the sign (or of the "Z", for UTC).
+	index int
+
+	// minutesIndex is the index of the minutes, relative to index: 4 for
+	// "-07:00", and 3 for "-0700".
+	minutesIndex int
+}
+
+// indexOfTimezoneOffset returns where the numeric offset is in the given
+// layout, or nil if there's no such offset.
+func indexOfTimezoneOffset(layout string) *timezoneOffset {
+	for _, v := range []struct {
+		comp         string
+		minutesIndex int
+	}{
+		{"Z07:00", 4},
+		{"-07:00", 4},
+		{"Z0700", 3},
+		{"-0700", 3},
+	} {
+		if idx := strings.Index(layout, v.comp); idx >= 0 {
+			return &timezoneOffset{index: idx, minutesIndex: v.minutesIndex}
+		}
+	}
+
+	return nil
+}
+
+// utcAWKExpr takes the awk expressions which return the time components as
+// they are in the log line, and returns the ones which convert them to UTC
+// using the offset in the timestamp. hhmmIndex is the index of "15:04" in the
+// layout, and substr is used to generate the expressions for parts of the
+// timestamp, see GenerateTimeDescrWithLocation.
+//
+// The resulting expressions rely on the agent running with TZ=UTC, so that
+// mktime and strftime don't apply any timezone by themselves. If the line
+// doesn't have a valid timestamp, mktime returns -1 and the expressions
+// return an empty string, so that it's not mistaken for a timestamp (which
+// matters e.g. for the multi-line messages).
+func utcAWKExpr(
+	awk TimeFormatAWKExpr,
+	hhmmIndex int,
+	tzOffset *timezoneOffset,
+	substr func(start, length int) string,
+) TimeFormatAWKExpr {
+	// The components might be ternary expressions, so wrap them in parens.
+	localSecs := fmt.Sprintf(
+		`mktime((%s) " " (%s) " " (%s) " " %s " " %s " 00")`,
+		awk.Year, awk.Month, awk.Day, substr(hhmmIndex, 2), substr(hhmmIndex+3, 2),
+	)
+
+	// The offset in seconds; "Z" means UTC.
+	sign := substr(tzOffset.index, 1)
+	offsetSecs := fmt.Sprintf(
+		`((%s == "Z") ? 0 : ((%s == "-") ? -1 : 1) * (%s * 3600 + %s * 60))`,
+		sign, sign,
+		substr(tzOffset.index+1, 2),
+		substr(tzOffset.index+tzOffset.minutesIndex, 2),
+	)
+
+	// The agent evaluates several of these expressions for every line, and
+	// computing the UTC time is relatively expensive (especially if the
+	// timestamp location involves a regex), so it's cached in the awk
+	// variables for the last line: nerdlogUTCKey is the line with the "k"
+	// prefix (so that it's never equal to the uninitialized variable), and
+	// nerdlogUTCSecs is the UTC time, or -1 if there's no valid timestamp.
+	utcSecs := fmt.Sprintf(
+		`(((nerdlogUTCKey == "k" $0) || ((nerdlogUTCKey = "k" $0) && ((nerdlogUTCSecs = ((%s >= 0) ? %s - %s : -1)) || 1))) ? nerdlogUTCSecs : -1)`,
+		localSecs, localSecs, offsetSecs,
+	)
+
+	strftime := func(format string) string {
+		return fmt.Sprintf(`((%s >= 0) ? strftime(%q, %s) : "")`, utcSecs, format, utcSecs)
+	}
+
+	return TimeFormatAWKExpr{
+		Month:     strftime("%m"),
+		Year:      strftime("%Y"),
+		Day:       strftime("%d"),
+		HHMM:      strftime("%H:%M"),
+		MinuteKey: strftime("%Y-%m-%d %H:%M"),
+	}
+}
+
+// generateEpochTimeDescr returns the TimeFormatDescr for the epoch layout
+// like TimeLayoutEpoch. The awk expressions use strftime to get the time
+// components from the seconds, so they're in the timezone of the host, just
+// like the calendar timestamps without the offset.
+func generateEpochTimeDescr(layout string, loc TimestampLocation) *TimeFormatDescr {
+	secs := fmt.Sprintf("substr($0, 1, %d)", epochSecondsLen)
+	if offsetExpr := loc.awkOffsetExpr(); offsetExpr != "" {
+		secs = fmt.Sprintf("substr($0, %s + 1, %d)", offsetExpr, epochSecondsLen)
+	}
+
+	strftime := func(format string) string {
+		return fmt.Sprintf("strftime(%q, %s + 0)", format, secs)
+	}
+
+	return &TimeFormatDescr{
+		TimestampLayout:   layout,
+		MinuteKeyLayout:   epochMinuteKeyLayout,
+		TimestampLocation: loc,
+		AWKExpr: TimeFormatAWKExpr{
+			Month:     strftime("%m"),
+			Year:      strftime("%Y"),
+			Day:       strftime("%d"),
+			HHMM:      strftime("%H:%M"),
+			MinuteKey: strftime("%Y-%m-%d %H:%M"),
+		},
+	}
+}
+
 // indexAndLengthOfTimeComponent takes one or more timestamp components, such as "2006",
 // "01", "_1", "1" etc, and returns the index of the given component in the
 // given string s, not preceded or followed by any number or "_".
@@ -1,7 +1,11 @@
 package core
 
 import (
+	"os"
+	"os/exec"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -44,6 +48,31 @@ func TestDetectTimeFormat(t *testing.T) {
 			logLine:    "2025-05-11T21:33:13.924352+0200 Starting server",
 			wantLayout: "2006-01-02T15:04:05.000000-0700",
 		},
+		{
+			name:       "epoch seconds",
+			logLine:    "1718000000 something happened",
+			wantLayout: "epoch",
+		},
+		{
+			name:       "epoch seconds with fraction",
+			logLine:    "1718000000.123 something happened",
+			wantLayout: "epoch",
+		},
+		{
+			name:       "epoch millis",
+			logLine:    "1718000000123 something happened",
+			wantLayout: "epoch_ms",
+		},
+		{
+			name:       "epoch micros",
+			logLine:    "1718000000123456\tsomething happened",
+			wantLayout: "epoch_us",
+		},
+		{
+			name:       "too many digits for epoch",
+			logLine:    "17180000001234 something happened",
+			wantLayout: "",
+		},
 		{
 			name:       "No timestamp in line",
 			logLine:    "This is a log line without a timestamp.",
@@ -66,6 +95,18 @@ type timeDescrTestCase struct {
 	expectErr string
 }
 
+// isoUTCExpr returns the awk expression which converts the timestamp like
+// "2024-10-11T22:14:15.000000+02:00" at the beginning of the line to UTC, and
+// formats it with the given strftime format.
+func isoUTCExpr(format string) string {
+	localSecs := `mktime((substr($0, 1, 4)) " " (substr($0, 6, 2)) " " (substr($0, 9, 2)) " " substr($0, 12, 2) " " substr($0, 15, 2) " 00")`
+	offsetSecs := `((substr($0, 27, 1) == "Z") ? 0 : ((substr($0, 27, 1) == "-") ? -1 : 1) * (substr($0, 28, 2) * 3600 + substr($0, 31, 2) * 60))`
+	utcSecs := `(((nerdlogUTCKey == "k" $0) || ((nerdlogUTCKey = "k" $0) && ((nerdlogUTCSecs = ((` +
+		localSecs + ` >= 0) ? ` + localSecs + ` - ` + offsetSecs + ` : -1)) || 1))) ? nerdlogUTCSecs : -1)`
+
+	return `((` + utcSecs + ` >= 0) ? strftime("` + format + `", ` + utcSecs + `) : "")`
+}
+
 func TestGenerateTimeDescr(t *testing.T) {
 	tests := []timeDescrTestCase{
 		{
@@ -88,14 +129,15 @@ func TestGenerateTimeDescr(t *testing.T) {
 			layout: "2006-01-02T15:04:05.000000Z07:00",
 			expected: &TimeFormatDescr{
 				TimestampLayout: "2006-01-02T15:04:05.000000Z07:00",
-				MinuteKeyLayout: "01-02T15:04",
+				MinuteKeyLayout: "2006-01-02 15:04",
 				AWKExpr: TimeFormatAWKExpr{
-					Month:     "substr($0, 6, 2)",
-					Year:      "substr($0, 1, 4)",
-					Day:       "substr($0, 9, 2)",
-					HHMM:      "substr($0, 12, 5)",
-					MinuteKey: "substr($0, 6, 11)",
+					Month:     isoUTCExpr("%m"),
+					Year:      isoUTCExpr("%Y"),
+					Day:       isoUTCExpr("%d"),
+					HHMM:      isoUTCExpr("%H:%M"),
+					MinuteKey: isoUTCExpr("%Y-%m-%d %H:%M"),
 				},
+				UTC: true,
 			},
 		},
 		{
@@ -128,6 +170,21 @@ func TestGenerateTimeDescr(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:   "Epoch millis",
+			layout: "epoch_ms",
+			expected: &TimeFormatDescr{
+				TimestampLayout: "epoch_ms",
+				MinuteKeyLayout: "2006-01-02 15:04",
+				AWKExpr: TimeFormatAWKExpr{
+					Month:     `strftime("%m", substr($0, 1, 10) + 0)`,
+					Year:      `strftime("%Y", substr($0, 1, 10) + 0)`,
+					Day:       `strftime("%d", substr($0, 1, 10) + 0)`,
+					HHMM:      `strftime("%H:%M", substr($0, 1, 10) + 0)`,
+					MinuteKey: `strftime("%Y-%m-%d %H:%M", substr($0, 1, 10) + 0)`,
+				},
+			},
+		},
 		{
 			name:      "Seconds are in between, unsupported",
 			layout:    "15:04:05 Jan _2 2006",
@@ -154,3 +211,385 @@ func TestGenerateTimeDescr(t *testing.T) {
 		})
 	}
 }
+
+func TestDetectTimeLayoutAndLocation(t *testing.T) {
+	type testCase struct {
+		name       string
+		logLine    string
+		wantLayout string
+		wantLoc    TimestampLocation
+	}
+
+	testCases := []testCase{
+		{
+			name:       "at the beginning",
+			logLine:    "Apr 18 01:02:03 somehost systemd[1]: Started something.",
+			wantLayout: "Jan _2 15:04:05",
+		},
+		{
+			name:       "nginx access log",
+			logLine:    `1.2.3.4 - - [10/Oct/2024:13:55:36 +0000] "GET / HTTP/1.1" 200 612`,
+			wantLayout: "02/Jan/2006:15:04:05 -0700",
+			wantLoc:    TimestampLocation{Field: 4},
+		},
+		{
+			name:       "in the second field, no brackets",
+			logLine:    "myhost 2024-04-19T14:23:45+02:00 Starting server",
+			wantLayout: "2006-01-02T15:04:05Z07:00",
+			wantLoc:    TimestampLocation{Field: 2},
+		},
+		{
+			name:       "RFC 5424",
+			logLine:    `<34>1 2024-10-11T22:14:15.003Z myhost su 1234 ID47 [sd@1 k="v"] 'su root' failed`,
+			wantLayout: "2006-01-02T15:04:05.000Z07:00",
+			wantLoc:    TimestampLocation{Field: 2},
+		},
+		{
+			name:       "no timestamp",
+			logLine:    "This is a log line without a timestamp.",
+			wantLayout: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			layout, loc := DetectTimeLayoutAndLocation(tc.logLine)
+			assert.Equal(t, tc.wantLayout, layout)
+			assert.Equal(t, tc.wantLoc, loc)
+		})
+	}
+}
+
+// TestUTCAWKExpr runs the awk expressions generated for the timestamps with
+// offsets, and checks that they're correctly converted to UTC, including
+// across the DST switches.
+func TestUTCAWKExpr(t *testing.T) {
+	gawkPath, err := exec.LookPath("gawk")
+	if err != nil {
+		t.Skip("gawk is not found")
+	}
+
+	type testCase struct {
+		name   string
+		layout string
+		loc    TimestampLocation
+		lines  []string
+
+		// wantMinuteKeys contains one item per line: minute key, day and hhmm,
+		// separated by "|".
+		wantMinuteKeys []string
+	}
+
+	testCases := []testCase{
+		{
+			name:   "DST ends in Europe/Berlin",
+			layout: "2006-01-02T15:04:05.000000Z07:00",
+			lines: []string{
+				"2024-10-27T02:30:00.000000+02:00 before the switch",
+				"2024-10-27T02:59:59.000000+02:00 right before the switch",
+				"2024-10-27T02:00:00.000000+01:00 right after the switch",
+				"2024-10-27T02:30:00.000000+01:00 after the switch",
+			},
+			wantMinuteKeys: []string{
+				"2024-10-27 00:30|27|00:30",
+				"2024-10-27 00:59|27|00:59",
+				"2024-10-27 01:00|27|01:00",
+				"2024-10-27 01:30|27|01:30",
+			},
+		},
+		{
+			name:   "DST starts in America/New_York",
+			layout: "2006-01-02T15:04:05-07:00",
+			lines: []string{
+				"2024-03-10T01:59:00-05:00 before the switch",
+				"2024-03-10T03:00:00-04:00 after the switch",
+			},
+			wantMinuteKeys: []string{
+				"2024-03-10 06:59|10|06:59",
+				"2024-03-10 07:00|10|07:00",
+			},
+		},
+		{
+			name:   "UTC and the year switch",
+			layout: "2006-01-02T15:04:05Z07:00",
+			lines: []string{
+				"2024-12-31T23:30:00Z foo",
+				"2024-12-31T23:30:00-01:00 bar",
+				"not a timestamp",
+			},
+			wantMinuteKeys: []string{
+				"2024-12-31 23:30|31|23:30",
+				"2025-01-01 00:30|01|00:30",
+				"||",
+			},
+		},
+		{
+			name:   "nginx access log",
+			layout: "02/Jan/2006:15:04:05 -0700",
+			loc:    TimestampLocation{Field: 4},
+			lines: []string{
+				`1.2.3.4 - - [10/Oct/2024:13:55:36 +0530] "GET / HTTP/1.1" 200 612`,
+			},
+			wantMinuteKeys: []string{
+				"2024-10-10 08:25|10|08:25",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			descr, err := GenerateTimeDescrWithLocation(tc.layout, tc.loc)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.True(t, descr.UTC)
+			assert.Equal(t, utcMinuteKeyLayout, descr.MinuteKeyLayout)
+
+			script := `BEGIN { monthByName["Oct"] = "10" } { print ` +
+				descr.AWKExpr.MinuteKey + ` "|" ` + descr.AWKExpr.Day + ` "|" ` + descr.AWKExpr.HHMM + ` }`
+
+			cmd := exec.Command(gawkPath, script)
+			cmd.Env = append(os.Environ(), "TZ=UTC")
+			cmd.Stdin = strings.NewReader(strings.Join(tc.lines, "\n") + "\n")
+
+			out, err := cmd.Output()
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.Equal(t, tc.wantMinuteKeys, strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"))
+		})
+	}
+}
+
+func TestGenerateTimeDescrWithLocation(t *testing.T) {
+	descr, err := GenerateTimeDescrWithLocation(
+		"02/Jan/2006:15:04:05", TimestampLocation{Field: 4},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	off := `(match($0, /^[ \t]*[^ \t]+[ \t]+[^ \t]+[ \t]+[^ \t]+[ \t]+\[?/) ? RSTART + RLENGTH - 1 : length($0))`
+	assert.Equal(t, &TimeFormatDescr{
+		TimestampLayout:   "02/Jan/2006:15:04:05",
+		MinuteKeyLayout:   "02/Jan/2006:15:04",
+		TimestampLocation: TimestampLocation{Field: 4},
+		AWKExpr: TimeFormatAWKExpr{
+			Month:     "monthByName[substr($0, " + off + " + 4, 3)]",
+			Year:      "substr($0, " + off + " + 8, 4)",
+			Day:       "substr($0, " + off + " + 1, 2)",
+			HHMM:      "substr($0, " + off + " + 13, 5)",
+			MinuteKey: "substr($0, " + off + " + 1, 17)",
+		},
+	}, descr)
+
+	// Slashes in the regex are escaped for awk.
+	descr, err = GenerateTimeDescrWithLocation(
+		"2006-01-02 15:04:05", TimestampLocation{Regex: `^[^/]*/ts=`},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t,
+		`substr($0, (match($0, /^[^\/]*\/ts=/) ? RSTART + RLENGTH - 1 : length($0)) + 12, 5)`,
+		descr.AWKExpr.HHMM,
+	)
+
+	_, err = GenerateTimeDescrWithLocation(
+		"2006-01-02 15:04:05", TimestampLocation{Field: 2, Regex: "^foo"},
+	)
+	assert.EqualError(t, err, "timestamp location: only one of field and regex can be set")
+
+	_, err = GenerateTimeDescrWithLocation(
+		"2006-01-02 15:04:05", TimestampLocation{Regex: "("},
+	)
+	assert.Error(t, err)
+}
+
+func TestCutTimestamp(t *testing.T) {
+	assert.Equal(t, "foo bar", cutTimestamp("", " foo bar"))
+	assert.Equal(t, `1.2.3.4 - - "GET /"`, cutTimestamp("1.2.3.4 - - [", `] "GET /"`))
+	assert.Equal(t, "myhost Starting", cutTimestamp("myhost ", " Starting"))
+	assert.Equal(t, "myhost", cutTimestamp("myhost ", ""))
+}
+
+func TestParseTimeFormatSpec(t *testing.T) {
+	type testCase struct {
+		spec       string
+		wantLayout string
+		wantErr    string
+	}
+
+	testCases := []testCase{
+		{spec: "2006-01-02 15:04:05", wantLayout: "2006-01-02 15:04:05"},
+		{spec: "%Y-%m-%d %H:%M:%S", wantLayout: "2006-01-02 15:04:05"},
+		{spec: "%F %T.%f", wantLayout: "2006-01-02 15:04:05.000000"},
+		{spec: "%d/%b/%Y:%H:%M:%S %z", wantLayout: "02/Jan/2006:15:04:05 -0700"},
+		{spec: "%b %e %H:%M:%S", wantLayout: "Jan _2 15:04:05"},
+		{spec: "epoch_us", wantLayout: "epoch_us"},
+		{spec: "%s", wantLayout: "epoch"},
+		{spec: "", wantErr: "time format is empty"},
+		{spec: "%Y-%m-%d %H:%M:%", wantErr: "trailing %"},
+		{spec: "%Y-%m-%d %I:%M", wantErr: "unsupported strftime directive %I"},
+		{spec: "%H:%M:%S", wantErr: `layout "15:04:05": unsupported layout: required components not found`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			layout, err := ParseTimeFormatSpec(tc.spec)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantLayout, layout)
+		})
+	}
+}
+
+func TestGetTimeFormatDescrFromSpec(t *testing.T) {
+	descr, err := GetTimeFormatDescrFromSpec("%Y-%m-%d %H:%M:%S", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2006-01-02 15:04:05", descr.TimestampLayout)
+		assert.Equal(t, TimestampLocation{}, descr.TimestampLocation)
+	}
+
+	descr, err = GetTimeFormatDescrFromSpec("%Y-%m-%d %H:%M:%S", []string{
+		"2025-03-10 10:00:01 foo",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, TimestampLocation{}, descr.TimestampLocation)
+	}
+
+	descr, err = GetTimeFormatDescrFromSpec("%d/%b/%Y:%H:%M:%S %z", []string{
+		`1.2.3.4 - - [10/Oct/2024:13:55:36 +0000] "GET / HTTP/1.1" 200 612`,
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, TimestampLocation{Field: 4}, descr.TimestampLocation)
+	}
+
+	descr, err = GetTimeFormatDescrFromSpec("%a %b %d %H:%M:%S %Y", []string{
+		"[Tue Jun 03 13:45:27 2025] [core:notice] foo",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, TimestampLocation{Field: 1}, descr.TimestampLocation)
+	}
+
+	_, err = GetTimeFormatDescrFromSpec("%Y-%m-%d %H:%M:%S", []string{
+		"Mar 10 10:00:01 myhost foo: bar",
+	})
+	assert.EqualError(t, err, `time format "2006-01-02 15:04:05" doesn't match the log line "Mar 10 10:00:01 myhost foo: bar"`)
+}
+
+func TestParseLayoutTimestampAcrossDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no tzdata: %s", err.Error())
+	}
+
+	layout := "2006-01-02T15:04:05.000000Z07:00"
+
+	type testCase struct {
+		logLine  string
+		wantTime time.Time
+	}
+
+	// On 2024-10-27, the local time in Berlin goes from 02:59:59 +02:00 back
+	// to 02:00:00 +01:00, so the local time alone is ambiguous, but the
+	// offset makes it clear.
+	testCases := []testCase{
+		{
+			logLine:  "2024-10-27T02:30:00.000000+02:00 first",
+			wantTime: time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC),
+		},
+		{
+			logLine:  "2024-10-27T02:30:00.000000+01:00 second",
+			wantTime: time.Date(2024, 10, 27, 1, 30, 0, 0, time.UTC),
+		},
+		{
+			// The offset doesn't match the location at all.
+			logLine:  "2024-10-27T02:30:00.000000-05:00 foo",
+			wantTime: time.Date(2024, 10, 27, 7, 30, 0, 0, time.UTC),
+		},
+		{
+			logLine:  "2024-10-27T02:30:00.000000Z foo",
+			wantTime: time.Date(2024, 10, 27, 2, 30, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.logLine, func(t *testing.T) {
+			tm, _, err := parseLayoutTimestamp(tc.logLine, layout, berlin)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.Equal(t, tc.wantTime, tm.UTC())
+		})
+	}
+}
+
+func TestParseEpochTimestamp(t *testing.T) {
+	type testCase struct {
+		logLine string
+		layout  string
+
+		wantTime time.Time
+		wantLen  int
+		wantErr  string
+	}
+
+	testCases := []testCase{
+		{
+			logLine:  "1718000000 foo",
+			layout:   TimeLayoutEpoch,
+			wantTime: time.Unix(1718000000, 0),
+			wantLen:  10,
+		},
+		{
+			logLine:  "1718000000.5 foo",
+			layout:   TimeLayoutEpoch,
+			wantTime: time.Unix(1718000000, 500000000),
+			wantLen:  12,
+		},
+		{
+			logLine:  "1718000000123 foo",
+			layout:   TimeLayoutEpochMillis,
+			wantTime: time.Unix(1718000000, 123000000),
+			wantLen:  13,
+		},
+		{
+			logLine:  "1718000000123456.789 foo",
+			layout:   TimeLayoutEpochMicros,
+			wantTime: time.Unix(1718000000, 123456789),
+			wantLen:  20,
+		},
+		{
+			logLine: "1718000000123 foo",
+			layout:  TimeLayoutEpoch,
+			wantErr: `epoch timestamp "1718000000123" doesn't match the layout epoch`,
+		},
+		{
+			logLine: "foo",
+			layout:  TimeLayoutEpoch,
+			wantErr: `no epoch timestamp in "foo"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.logLine, func(t *testing.T) {
+			gotTime, gotLen, err := parseEpochTimestamp(tc.logLine, tc.layout)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.True(t, tc.wantTime.Equal(gotTime), "want %s, got %s", tc.wantTime, gotTime)
+			assert.Equal(t, tc.wantLen, gotLen)
+		})
+	}
+}
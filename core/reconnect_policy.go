@@ -0,0 +1,191 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// ReconnectPolicy specifies how LStreamClient reconnects after failed
+// connection attempts.
+type ReconnectPolicy struct {
+	// InitialDelay is the delay before the first reconnection attempt.
+	InitialDelay time.Duration
+
+	// Multiplier is what the delay is multiplied by after every failed attempt
+	// (so 1 means no backoff, always use InitialDelay).
+	Multiplier float64
+
+	// MaxDelay is the max delay between the attempts, regardless of how many
+	// attempts there were. Zero means no limit.
+	MaxDelay time.Duration
+
+	// MaxAttempts is how many connection attempts in a row can fail before we
+	// give up and stop reconnecting (until the user asks to retry explicitly).
+	// Zero means no limit.
+	MaxAttempts int
+
+	// Jitter is a fraction (from 0 to 1) of the delay which is randomized, to
+	// avoid reconnecting to a bunch of hosts at exactly the same time. E.g.
+	// with the Jitter 0.2 and the delay 10s, the actual delay will be somewhere
+	// between 8s and 12s.
+	Jitter float64
+}
+
+// DefaultReconnectPolicy is used unless overridden by the user.
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialDelay: 2 * time.Second,
+	Multiplier:   2,
+	MaxDelay:     1 * time.Minute,
+	MaxAttempts:  0,
+	Jitter:       0.2,
+}
+
+const (
+	reconnectPolicyKeyInitial    = "initial"
+	reconnectPolicyKeyMultiplier = "multiplier"
+	reconnectPolicyKeyMax        = "max"
+	reconnectPolicyKeyAttempts   = "attempts"
+	reconnectPolicyKeyJitter     = "jitter"
+)
+
+// ParseReconnectPolicy parses a policy spec like
+// "initial=2s,multiplier=2,max=1m,attempts=10,jitter=0.2". All the keys are
+// optional: whatever is not specified in the spec, is taken from the base
+// policy.
+func ParseReconnectPolicy(base ReconnectPolicy, spec string) (*ReconnectPolicy, error) {
+	ret := base
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid reconnect policy part %q: expected key=value", part)
+		}
+
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		switch key {
+		case reconnectPolicyKeyInitial:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, errors.Annotatef(err, "parsing %s", key)
+			}
+			if d <= 0 {
+				return nil, errors.Errorf("%s must be positive", key)
+			}
+			ret.InitialDelay = d
+
+		case reconnectPolicyKeyMultiplier:
+			m, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, errors.Annotatef(err, "parsing %s", key)
+			}
+			if m < 1 {
+				return nil, errors.Errorf("%s must be at least 1", key)
+			}
+			ret.Multiplier = m
+
+		case reconnectPolicyKeyMax:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, errors.Annotatef(err, "parsing %s", key)
+			}
+			if d < 0 {
+				return nil, errors.Errorf("%s must not be negative", key)
+			}
+			ret.MaxDelay = d
+
+		case reconnectPolicyKeyAttempts:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, errors.Annotatef(err, "parsing %s", key)
+			}
+			if n < 0 {
+				return nil, errors.Errorf("%s must not be negative", key)
+			}
+			ret.MaxAttempts = n
+
+		case reconnectPolicyKeyJitter:
+			j, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, errors.Annotatef(err, "parsing %s", key)
+			}
+			if j < 0 || j > 1 {
+				return nil, errors.Errorf("%s must be from 0 to 1", key)
+			}
+			ret.Jitter = j
+
+		default:
+			return nil, errors.Errorf(
+				"invalid reconnect policy key %q; valid keys are: %s, %s, %s, %s, %s",
+				key,
+				reconnectPolicyKeyInitial,
+				reconnectPolicyKeyMultiplier,
+				reconnectPolicyKeyMax,
+				reconnectPolicyKeyAttempts,
+				reconnectPolicyKeyJitter,
+			)
+		}
+	}
+
+	return &ret, nil
+}
+
+// String returns the policy spec which can be parsed by ParseReconnectPolicy.
+func (p ReconnectPolicy) String() string {
+	return fmt.Sprintf(
+		"%s=%s,%s=%s,%s=%s,%s=%d,%s=%s",
+		reconnectPolicyKeyInitial, formatDuration(p.InitialDelay),
+		reconnectPolicyKeyMultiplier, strconv.FormatFloat(p.Multiplier, 'f', -1, 64),
+		reconnectPolicyKeyMax, formatDuration(p.MaxDelay),
+		reconnectPolicyKeyAttempts, p.MaxAttempts,
+		reconnectPolicyKeyJitter, strconv.FormatFloat(p.Jitter, 'f', -1, 64),
+	)
+}
+
+// Delay returns the delay before the next connection attempt, given the
+// number of connection attempts which have failed in a row so far (starting
+// from 1). The rnd should return a random number in [0, 1), it's only used if
+// Jitter is non-zero.
+func (p ReconnectPolicy) Delay(numFailedAttempts int, rnd func() float64) time.Duration {
+	delay := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(numFailedAttempts-1))
+
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*rnd()-1)
+	}
+
+	return time.Duration(delay)
+}
+
+// GivenUp returns whether we should stop reconnecting, given the number of
+// connection attempts which have failed in a row so far.
+func (p ReconnectPolicy) GivenUp(numFailedAttempts int) bool {
+	return p.MaxAttempts > 0 && numFailedAttempts >= p.MaxAttempts
+}
+
+// formatDuration is like time.Duration.String, but strips useless suffixes
+// like "0s" in "1m0s".
+func formatDuration(d time.Duration) string {
+	ret := d.String()
+
+	if strings.HasSuffix(ret, "h0m0s") {
+		return ret[:len(ret)-4]
+	} else if strings.HasSuffix(ret, "m0s") {
+		return ret[:len(ret)-2]
+	}
+
+	return ret
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type parseReconnectPolicyTestCase struct {
+	name      string
+	spec      string
+	expected  *ReconnectPolicy
+	expectErr string
+}
+
+func TestParseReconnectPolicy(t *testing.T) {
+	testCases := []parseReconnectPolicyTestCase{
+		{
+			name:     "empty spec",
+			spec:     "",
+			expected: &DefaultReconnectPolicy,
+		},
+		{
+			name: "all keys",
+			spec: "initial=1s, multiplier=1.5, max=30s, attempts=5, jitter=0",
+			expected: &ReconnectPolicy{
+				InitialDelay: 1 * time.Second,
+				Multiplier:   1.5,
+				MaxDelay:     30 * time.Second,
+				MaxAttempts:  5,
+				Jitter:       0,
+			},
+		},
+		{
+			name: "partial override",
+			spec: "attempts=10",
+			expected: &ReconnectPolicy{
+				InitialDelay: 2 * time.Second,
+				Multiplier:   2,
+				MaxDelay:     1 * time.Minute,
+				MaxAttempts:  10,
+				Jitter:       0.2,
+			},
+		},
+		{
+			name:      "unknown key",
+			spec:      "foo=1",
+			expectErr: `invalid reconnect policy key "foo"; valid keys are: initial, multiplier, max, attempts, jitter`,
+		},
+		{
+			name:      "no value",
+			spec:      "attempts",
+			expectErr: `invalid reconnect policy part "attempts": expected key=value`,
+		},
+		{
+			name:      "zero initial delay",
+			spec:      "initial=0s",
+			expectErr: "initial must be positive",
+		},
+		{
+			name:      "multiplier less than 1",
+			spec:      "multiplier=0.5",
+			expectErr: "multiplier must be at least 1",
+		},
+		{
+			name:      "jitter out of range",
+			spec:      "jitter=1.5",
+			expectErr: "jitter must be from 0 to 1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := ParseReconnectPolicy(DefaultReconnectPolicy, tc.spec)
+
+			if tc.expectErr != "" {
+				assert.EqualError(t, err, tc.expectErr)
+				assert.Nil(t, result)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestReconnectPolicyString(t *testing.T) {
+	assert.Equal(t, "initial=2s,multiplier=2,max=1m,attempts=0,jitter=0.2", DefaultReconnectPolicy.String())
+
+	// Make sure it can be parsed back.
+	policy := ReconnectPolicy{
+		InitialDelay: 1500 * time.Millisecond,
+		Multiplier:   1.5,
+		MaxDelay:     2 * time.Hour,
+		MaxAttempts:  3,
+		Jitter:       0.1,
+	}
+
+	parsed, err := ParseReconnectPolicy(DefaultReconnectPolicy, policy.String())
+	assert.NoError(t, err)
+	assert.Equal(t, &policy, parsed)
+}
+
+func TestReconnectPolicyDelay(t *testing.T) {
+	policy := ReconnectPolicy{
+		InitialDelay: 2 * time.Second,
+		Multiplier:   2,
+		MaxDelay:     10 * time.Second,
+	}
+
+	rnd := func() float64 { panic("should not be called without jitter") }
+
+	assert.Equal(t, 2*time.Second, policy.Delay(1, rnd))
+	assert.Equal(t, 4*time.Second, policy.Delay(2, rnd))
+	assert.Equal(t, 8*time.Second, policy.Delay(3, rnd))
+	assert.Equal(t, 10*time.Second, policy.Delay(4, rnd))
+	assert.Equal(t, 10*time.Second, policy.Delay(100, rnd))
+
+	policy.Jitter = 0.2
+
+	assert.Equal(t, 8*time.Second, policy.Delay(100, func() float64 { return 0 }))
+	assert.Equal(t, 10*time.Second, policy.Delay(100, func() float64 { return 0.5 }))
+	assert.Equal(t, 11*time.Second, policy.Delay(100, func() float64 { return 0.75 }))
+}
+
+func TestReconnectPolicyGivenUp(t *testing.T) {
+	policy := DefaultReconnectPolicy
+	assert.False(t, policy.GivenUp(1000))
+
+	policy.MaxAttempts = 3
+	assert.False(t, policy.GivenUp(2))
+	assert.True(t, policy.GivenUp(3))
+}
@@ -14,6 +14,7 @@ require (
 	github.com/rivo/uniseg v0.4.3
 	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.7.1
+	github.com/yuin/gopher-lua v1.1.1
 	golang.design/x/clipboard v0.7.0
 	golang.org/x/crypto v0.0.0-20220321153916-2c7772ba3064
 	gopkg.in/yaml.v2 v2.4.0